@@ -0,0 +1,261 @@
+package audit
+
+import "context"
+import "encoding/json"
+import "sync"
+import "time"
+
+import "github.com/gocql/gocql"
+import "github.com/logan/ibis"
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that identifies who makes a change. Commit or delete a row with
+// the returned context (see ibis.CF.CommitContext) to have the actor recorded with the change.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorOf returns the actor given to WithActor in making ctx, or an empty string.
+func ActorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// A Policy decides which column families are audited. Provide one to a schema to opt column
+// families in, then call Table.Attach.
+//
+//        schema.Provide(audit.Policy(audit.Audited{"users", "orders"}))
+//        model.History.Attach(schema)
+type Policy interface {
+	Audits(cf *ibis.CF) bool
+}
+
+// Audited is a Policy that audits the column families with the given names.
+type Audited []string
+
+func (a Audited) Audits(cf *ibis.CF) bool {
+	for _, name := range a {
+		if name == cf.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// A Change records one commit or delete of a row. Old and New hold JSON objects mapping the names
+// of the columns the change touched to their marshaled values; see Values.
+type Change struct {
+	Family  string        `ibis:"key"`
+	RowKey  string        `ibis:"key=partition"`
+	ID      ibis.TimeUUID `ibis:"key"`
+	Actor   string
+	At      time.Time
+	Deleted bool
+	Old     []byte // values before the change, or null where unknown
+	New     []byte // values after the change; empty for a delete
+}
+
+// Values returns the values before and after the change, as marshaled for the row's column family.
+// Columns whose previous value is unknown map to nil in the old values.
+func (c *Change) Values() (before, after ibis.MarshaledMap, err error) {
+	if before, err = decodeValues(c.Old); err != nil {
+		return
+	}
+	after, err = decodeValues(c.New)
+	return
+}
+
+// Table is the audit history column family. Include a field of type *Table in a schema struct
+// given to ibis.ReflectSchema. Column families are opted in with the "audit" tag on any of their
+// columns (e.g. `ibis.audit:"true"`), with a Policy (see Attach), or with Track. For the tag to be
+// seen, the Table's field must precede the column families using it.
+type Table struct {
+	*ibis.CF
+
+	mu      sync.Mutex
+	ids     ibis.TimeUUIDSequence
+	tracked map[*ibis.CF]bool
+}
+
+func (t *Table) NewCF() (*ibis.CF, error) {
+	var err error
+	t.CF, err = ibis.ReflectCF(Change{})
+	if t.CF != nil {
+		t.Provide(ibis.SchemaPlugin(t))
+	}
+	return t.CF, err
+}
+
+func (t *Table) RegisterColumnTags(tags *ibis.ColumnTags) {
+	tags.Register("audit", t)
+}
+
+func (t *Table) ApplyTag(value string, cf *ibis.CF, col ibis.Column) error {
+	t.Track(cf)
+	return nil
+}
+
+// Attach tracks each column family of the schema that the Policy provided to it audits.
+func (t *Table) Attach(schema *ibis.Schema) {
+	var policy Policy
+	if !schema.GetProvider(&policy) {
+		return
+	}
+	for _, cf := range schema.CFs {
+		if cf != t.CF && policy.Audits(cf) {
+			t.Track(cf)
+		}
+	}
+}
+
+// Track opts the given column families in to auditing. A change is appended to a row's history in
+// the same batch as each Commit, CommitCAS, or Delete of the row. Changes are only recorded for
+// commits made through these methods, and for CommitCAS, the change is written just after the
+// lightweight transaction, and only if it applied. Tracking a column family more than once has no
+// further effect.
+func (t *Table) Track(cfs ...*ibis.CF) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tracked == nil {
+		t.tracked = make(map[*ibis.CF]bool)
+	}
+	for _, cf := range cfs {
+		if !t.tracked[cf] {
+			t.tracked[cf] = true
+			cf.PrecommitContext(t.hook(cf, false))
+			cf.PredeleteContext(t.hook(cf, true))
+		}
+	}
+}
+
+func (t *Table) hook(cf *ibis.CF, deleted bool) ibis.PrecommitContextHook {
+	return func(ctx context.Context, row interface{}, mmap ibis.MarshaledMap) ([]ibis.CQL, error) {
+		before := make(map[string][]byte)
+		after := make(map[string][]byte)
+		for _, k := range mmap.DirtyKeys() {
+			v := mmap[k]
+			if deleted {
+				before[k] = v.Bytes
+			} else {
+				before[k] = v.OriginalBytes
+				after[k] = v.Bytes
+			}
+		}
+		if len(before) == 0 {
+			return nil, nil
+		}
+		rowKey, err := cf.EncodeKey(mmap)
+		if err != nil {
+			return nil, err
+		}
+		change := &Change{Family: cf.Name(), RowKey: rowKey, Actor: ActorOf(ctx),
+			Deleted: deleted}
+		change.ID, change.At = t.ids.Next(t.CF)
+		if change.Old, err = json.Marshal(before); err != nil {
+			return nil, err
+		}
+		if !deleted {
+			if change.New, err = json.Marshal(after); err != nil {
+				return nil, err
+			}
+		}
+		cql, err := t.MakeCommit(change)
+		if err != nil {
+			return nil, err
+		}
+		return []ibis.CQL{cql}, nil
+	}
+}
+
+func decodeValues(data []byte) (ibis.MarshaledMap, error) {
+	mmap := make(ibis.MarshaledMap)
+	if len(data) == 0 {
+		return mmap, nil
+	}
+	var values map[string][]byte
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for k, b := range values {
+		if b != nil {
+			mmap[k] = &ibis.MarshaledValue{Bytes: b}
+		} else {
+			mmap[k] = nil
+		}
+	}
+	return mmap, nil
+}
+
+// History returns the changes recorded for the row of the given column family with the given
+// primary key, oldest first.
+func (t *Table) History(cf *ibis.CF, key ...interface{}) ([]*Change, error) {
+	mkey, err := cf.MarshalKey(key...)
+	if err != nil {
+		return nil, err
+	}
+	rowKey, err := cf.EncodeKey(mkey)
+	if err != nil {
+		return nil, err
+	}
+	sel := ibis.Select().From(t.CF).
+		Where("Family = ?", cf.Name()).
+		Where("RowKey = ?", rowKey).
+		OrderBy("ID ASC")
+	q := t.Scanner(sel.Query())
+	changes := make([]*Change, 0)
+	for {
+		change := new(Change)
+		if !q.ScanRow(change) {
+			break
+		}
+		changes = append(changes, change)
+	}
+	if err := q.Close(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// StateAt reconstructs the row of the given column family with the given primary key as it was at
+// the given time, replaying its history into dest. If the row didn't exist at that time, as far as
+// its history shows, ibis.ErrNotFound is returned.
+func (t *Table) StateAt(cf *ibis.CF, dest interface{}, at time.Time, key ...interface{}) error {
+	changes, err := t.History(cf, key...)
+	if err != nil {
+		return err
+	}
+	state := make(ibis.MarshaledMap)
+	for _, change := range changes {
+		// the ID keeps the change's time at a finer resolution than At
+		if gocql.UUID(change.ID).Time().After(at) {
+			break
+		}
+		if change.Deleted {
+			state = make(ibis.MarshaledMap)
+			continue
+		}
+		_, after, err := change.Values()
+		if err != nil {
+			return err
+		}
+		for k, v := range after {
+			if v != nil {
+				state[k] = v
+			} else {
+				delete(state, k)
+			}
+		}
+	}
+	if len(state) == 0 {
+		return ibis.ErrNotFound.New()
+	}
+	mkey, err := cf.MarshalKey(key...)
+	if err != nil {
+		return err
+	}
+	for k, v := range mkey {
+		state[k] = v
+	}
+	return cf.Decode(dest, state)
+}
@@ -0,0 +1,128 @@
+package audit
+
+import "context"
+import "testing"
+import "time"
+
+import "github.com/logan/ibis"
+
+type user struct {
+	Name    string `ibis:"key" ibis.audit:"true"`
+	Email   string
+	Age     int64
+	Patcher *ibis.AutoPatcher
+}
+
+type account struct {
+	ID      string `ibis:"key"`
+	Balance int64
+}
+
+type testModel struct {
+	History  *Table
+	Users    *ibis.CF
+	Accounts *ibis.CF
+}
+
+func newTestModel(t *testing.T) (*testModel, *ibis.Schema) {
+	var err error
+	model := &testModel{}
+	if model.Users, err = ibis.ReflectCF(user{}); err != nil {
+		t.Fatal(err)
+	}
+	if model.Accounts, err = ibis.ReflectCF(account{}); err != nil {
+		t.Fatal(err)
+	}
+	return model, ibis.ReflectTestSchema(t, model)
+}
+
+func TestHistory(t *testing.T) {
+	model, schema := newTestModel(t)
+	defer schema.Cluster.Close()
+
+	ctx := context.Background()
+	u := &user{Name: "alice", Email: "alice@example.com", Age: 30}
+	if err := model.Users.CommitCASContext(WithActor(ctx, "signup"), u); err != nil {
+		t.Fatal(err)
+	}
+	// a CAS commit that doesn't apply records no change
+	err := model.Users.CommitCAS(&user{Name: "alice", Email: "mallory@example.com"})
+	if e, ok := err.(*ibis.Error); !ok || e.Key != ibis.ErrAlreadyExists {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	created := time.Now()
+	u.Email = "alice@example.org"
+	if err := model.Users.CommitContext(WithActor(ctx, "admin"), u); err != nil {
+		t.Fatal(err)
+	}
+	u.Age = 31
+	if err := model.Users.Commit(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Users.DeleteContext(WithActor(ctx, "cleanup"), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := model.History.History(model.Users, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("expected 4 changes, got %d", len(changes))
+	}
+	if changes[0].Actor != "signup" || changes[1].Actor != "admin" || changes[1].Deleted ||
+		changes[2].Actor != "" || changes[3].Actor != "cleanup" || !changes[3].Deleted {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+	before, after, err := changes[1].Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 1 || after["Email"] == nil || string(after["Email"].Bytes) != "alice@example.org" {
+		t.Errorf("expected only the new email, got %v", after)
+	}
+	if before["Email"] == nil || string(before["Email"].Bytes) != "alice@example.com" {
+		t.Errorf("expected the old email, got %v", before)
+	}
+
+	var state user
+	if err := model.History.StateAt(model.Users, &state, created, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if state.Name != "alice" || state.Email != "alice@example.com" || state.Age != 30 {
+		t.Errorf("unexpected state at creation: %+v", state)
+	}
+	err = model.History.StateAt(model.Users, &state, time.Now(), "alice")
+	if e, ok := err.(*ibis.Error); !ok || e.Key != ibis.ErrNotFound {
+		t.Errorf("expected ErrNotFound after deletion, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	model, schema := newTestModel(t)
+	defer schema.Cluster.Close()
+
+	if err := model.Accounts.Commit(&account{"a1", 100}); err != nil {
+		t.Fatal(err)
+	}
+	schema.Provide(Policy(Audited{"accounts"}))
+	model.History.Attach(schema)
+	if err := model.Accounts.Commit(&account{"a1", 150}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := model.History.History(model.Accounts, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Actor != "" {
+		t.Fatalf("expected one change without an actor, got %+v", changes)
+	}
+	var state account
+	if err := model.History.StateAt(model.Accounts, &state, time.Now(), "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if state.Balance != 150 {
+		t.Errorf("expected balance 150, got %d", state.Balance)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Package audit keeps an append-only history of the changes made to rows.
+
+History
+
+Each commit of a row in an audited column family appends a change to the row's history, recording
+who made it, when, the values of the columns it changed, and their values before the change (when
+known, as with an ibis.AutoPatcher). Deletes are recorded too. From the history, the state of a row
+at any earlier time can be reconstructed. Who made a change is taken from the context it was
+committed or deleted with (see WithActor), so it isn't carried over to later commits of the row.
+
+Example
+
+        type User struct {
+            Name    string `ibis:"key" ibis.audit:"true"`
+            Email   string
+            Patcher *ibis.AutoPatcher
+        }
+
+        type Model struct {
+            History *audit.Table
+            Users   *ibis.CF
+        }
+        ...
+        user.Email = "alice@example.org"
+        err := model.Users.CommitContext(audit.WithActor(ctx, "admin"), &user)
+        ...
+        changes, err := model.History.History(model.Users, "alice")
+        var before User
+        err = model.History.StateAt(model.Users, &before, yesterday, "alice")
+*/
+package audit
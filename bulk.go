@@ -0,0 +1,320 @@
+package ibis
+
+import "math"
+import "strconv"
+import "sync"
+import "time"
+
+// BulkOptions configures a BulkWriter. Zero values select the defaults.
+type BulkOptions struct {
+	// The maximum number of rows in a batch. Defaults to 50.
+	BatchSize int
+	// The maximum number of batches executing at once. Defaults to 4.
+	Concurrency int
+	// The maximum number of rows written per second, on average. If not positive, rows are written
+	// as fast as possible.
+	Rate float64
+	// The number of rows that may be written at once before the rate applies. Defaults to BatchSize.
+	Burst int
+	// The number of times a failed batch is retried. Defaults to 3; a negative value disables
+	// retries.
+	Retries int
+	// The delay before the first retry of a batch, doubled for each retry after. Defaults to 100ms.
+	Backoff time.Duration
+	// Reports whether an error is transient, so that the batch that failed with it may be retried. If
+	// nil, every error is taken to be transient.
+	Transient func(error) bool
+	// If not nil, called after each batch is written or fails for good.
+	OnProgress func(BulkProgress)
+	// If not nil, called for each row of a batch that failed for good, with the last error.
+	OnFailure func(row interface{}, err error)
+}
+
+// BulkProgress counts the rows given to a BulkWriter.
+type BulkProgress struct {
+	Written int64 // rows written
+	Failed  int64 // rows whose batch failed for good
+	Pending int64 // rows buffered or being written
+}
+
+// A BulkWriter writes large numbers of rows to a column family. Rows are grouped by partition
+// into unlogged batches, which are executed concurrently, at a limited rate, with retries.
+//
+//        w := model.Events.NewBulkWriter(ibis.BulkOptions{
+//            Rate:      5000,
+//            OnFailure: func(row interface{}, err error) { log.Println(row, err) },
+//        })
+//        for _, event := range events {
+//            if err := w.Add(event); err != nil {
+//                return err
+//            }
+//        }
+//        return w.Close()
+//
+// Only the rows themselves are written: precommit and postcommit hooks aren't invoked, and unique
+// values and lookup entries aren't maintained. Rows are marshaled (and validated) when they're
+// added, so they may be reused once Add returns. A BulkWriter is safe for concurrent use.
+type BulkWriter struct {
+	cf      *CF
+	options BulkOptions
+	bucket  *tokenBucket
+	sleep   func(time.Duration)
+
+	mu       sync.Mutex
+	buffered map[string][]bulkRow // rows not yet dispatched, by partition
+	count    int                  // the number of buffered rows
+	closed   bool
+
+	jobs     chan []bulkRow
+	inflight sync.WaitGroup // dispatched batches
+	workers  sync.WaitGroup
+
+	progressMu sync.Mutex
+	progress   BulkProgress
+	callbackMu sync.Mutex // held while calling OnProgress or OnFailure, but not progressMu
+}
+
+// bulkRow is a row added to a BulkWriter, with its commit statement.
+type bulkRow struct {
+	row  interface{}
+	mmap MarshaledMap
+	cql  CQL
+}
+
+// NewBulkWriter returns a BulkWriter for the column family. It must be closed when all rows have
+// been added.
+func (cf *CF) NewBulkWriter(options BulkOptions) *BulkWriter {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 50
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = 4
+	}
+	if options.Burst <= 0 {
+		options.Burst = options.BatchSize
+	}
+	if options.Retries == 0 {
+		options.Retries = 3
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = 100 * time.Millisecond
+	}
+	w := &BulkWriter{
+		cf:       cf,
+		options:  options,
+		sleep:    time.Sleep,
+		buffered: make(map[string][]bulkRow),
+		jobs:     make(chan []bulkRow, options.Concurrency),
+	}
+	if options.Rate > 0 {
+		w.bucket = newTokenBucket(options.Rate, options.Burst)
+	}
+	for i := 0; i < options.Concurrency; i++ {
+		w.workers.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+// Add marshals a row and buffers it to be written. A batch is dispatched when enough rows of the
+// same partition are buffered, or when enough rows are buffered in all; Add blocks while every
+// worker is busy. Errors marshaling the row are returned, while errors writing it are reported to
+// the OnFailure callback.
+func (w *BulkWriter) Add(row interface{}) error {
+	cf := w.cf
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if cf.IsCounterTable() {
+		return errCounterCommit(cf)
+	}
+	mmap, err := cf.marshal(row)
+	if err != nil {
+		return ChainError(err, "marshal failed")
+	}
+	cql, ok := cf.generateCommit(mmap, false)
+	if !ok {
+		return nil
+	}
+	cql.unlogged = true
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return NewError(ErrBulkWriteFailed, "writer is closed")
+	}
+	partition := cf.partitionGroup(mmap)
+	w.buffered[partition] = append(w.buffered[partition], bulkRow{row, mmap, cql})
+	w.count++
+	w.addProgress(BulkProgress{Pending: 1}, false)
+	if len(w.buffered[partition]) >= w.options.BatchSize {
+		w.dispatch(partition)
+	} else if w.count >= w.options.BatchSize*w.options.Concurrency {
+		w.dispatchAll()
+	}
+	return nil
+}
+
+// dispatch hands the buffered rows of a partition to the workers. The caller must hold w.mu.
+func (w *BulkWriter) dispatch(partition string) {
+	rows := w.buffered[partition]
+	delete(w.buffered, partition)
+	w.count -= len(rows)
+	w.inflight.Add(1)
+	w.jobs <- rows
+}
+
+// dispatchAll hands every buffered row to the workers. The caller must hold w.mu.
+func (w *BulkWriter) dispatchAll() {
+	for partition := range w.buffered {
+		w.dispatch(partition)
+	}
+}
+
+// Flush dispatches every buffered row and waits for them to be written. It returns an error with
+// the key ErrBulkWriteFailed if any row has failed to be written since the writer was created.
+func (w *BulkWriter) Flush() error {
+	w.mu.Lock()
+	w.dispatchAll()
+	w.mu.Unlock()
+	w.inflight.Wait()
+	return w.failure()
+}
+
+// Close flushes the writer (see Flush) and stops its workers. Rows may not be added once it's
+// closed; the writer is closed before the flush, so that a row is either refused or written.
+func (w *BulkWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		w.dispatchAll()
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+	w.inflight.Wait()
+	w.workers.Wait()
+	return w.failure()
+}
+
+// failure returns an error if any row has failed to be written.
+func (w *BulkWriter) failure() error {
+	if failed := w.Progress().Failed; failed > 0 {
+		return NewError(ErrBulkWriteFailed, strconv.FormatInt(failed, 10), "rows failed")
+	}
+	return nil
+}
+
+// Progress returns the current counts of the writer's rows.
+func (w *BulkWriter) Progress() BulkProgress {
+	w.progressMu.Lock()
+	defer w.progressMu.Unlock()
+	return w.progress
+}
+
+// addProgress updates the counts of the writer's rows, and reports them if asked to. Callbacks are
+// made one at a time, in the order of the updates they report, and may call Progress.
+func (w *BulkWriter) addProgress(delta BulkProgress, report bool) {
+	report = report && w.options.OnProgress != nil
+	if report {
+		w.callbackMu.Lock()
+		defer w.callbackMu.Unlock()
+	}
+	w.progressMu.Lock()
+	w.progress.Written += delta.Written
+	w.progress.Failed += delta.Failed
+	w.progress.Pending += delta.Pending
+	progress := w.progress
+	w.progressMu.Unlock()
+	if report {
+		w.options.OnProgress(progress)
+	}
+}
+
+func (w *BulkWriter) work() {
+	defer w.workers.Done()
+	for rows := range w.jobs {
+		w.write(rows)
+		w.inflight.Done()
+	}
+}
+
+// write executes a batch of rows, retrying it if it fails with a transient error.
+func (w *BulkWriter) write(rows []bulkRow) {
+	if w.bucket != nil {
+		w.sleep(w.bucket.take(len(rows)))
+	}
+	batch := make([]CQL, len(rows))
+	for i, r := range rows {
+		batch[i] = r.cql
+	}
+	var err error
+	backoff := w.options.Backoff
+	for attempt := 0; ; attempt++ {
+		if err = w.cf.schema.Cluster.Query(batch...).Exec(); err == nil {
+			break
+		}
+		if attempt >= w.options.Retries || (w.options.Transient != nil && !w.options.Transient(err)) {
+			break
+		}
+		w.sleep(backoff)
+		backoff *= 2
+	}
+	for _, r := range rows {
+		w.cf.invalidate(r.mmap)
+	}
+	n := int64(len(rows))
+	if err != nil {
+		err = ChainError(err, "bulk write failed")
+		if w.options.OnFailure != nil {
+			w.callbackMu.Lock()
+			for _, r := range rows {
+				w.options.OnFailure(r.row, err)
+			}
+			w.callbackMu.Unlock()
+		}
+		w.addProgress(BulkProgress{Failed: n, Pending: -n}, true)
+		return
+	}
+	w.addProgress(BulkProgress{Written: n, Pending: -n}, true)
+}
+
+// isUnloggedBatch returns true if every statement given may be batched without the batch log.
+func isUnloggedBatch(stmts []CQL) bool {
+	for _, stmt := range stmts {
+		if !stmt.unlogged {
+			return false
+		}
+	}
+	return len(stmts) > 0
+}
+
+// A tokenBucket limits a rate of events, allowing bursts up to its capacity.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// take removes n tokens from the bucket, and returns how long to wait until they would have been
+// available. Tokens taken in advance are owed by later callers.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,188 @@
+package ibis
+
+import "errors"
+import "sync"
+import "testing"
+import "time"
+
+import . "github.com/smartystreets/goconvey/convey"
+
+// flakyCluster fails the given number of queries made through it before passing them on, and
+// records the statements of each query passed on.
+type flakyCluster struct {
+	Cluster
+	sync.Mutex
+	failures int
+	batches  [][]CQL
+}
+
+func (c *flakyCluster) Query(stmts ...CQL) Query {
+	c.Lock()
+	defer c.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return &fakeQuery{err: errors.New("timed out")}
+	}
+	c.batches = append(c.batches, stmts)
+	return c.Cluster.Query(stmts...)
+}
+
+// gatedCluster holds each query made through it until its gate is closed.
+type gatedCluster struct {
+	Cluster
+	gate chan struct{}
+}
+
+func (c *gatedCluster) Query(stmts ...CQL) Query {
+	<-c.gate
+	return c.Cluster.Query(stmts...)
+}
+
+func TestBulkWriter(t *testing.T) {
+	var err error
+	type event struct {
+		Stream string `ibis:"key"`
+		Seq    int64  `ibis:"key"`
+		Body   string
+	}
+	model := &struct{ Events *CF }{}
+	model.Events, err = ReflectCF(event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	flaky := &flakyCluster{Cluster: schema.Cluster}
+	schema.Cluster = flaky
+	cf := model.Events
+	reset := func(failures int) {
+		flaky.failures = failures
+		flaky.batches = nil
+	}
+	noSleep := func(time.Duration) {}
+
+	Convey("Rows should be grouped into unlogged batches by partition", t, func() {
+		reset(0)
+		w := cf.NewBulkWriter(BulkOptions{BatchSize: 3, Concurrency: 2})
+		for seq := int64(0); seq < 4; seq++ {
+			So(w.Add(&event{Stream: "a", Seq: seq}), ShouldBeNil)
+			So(w.Add(&event{Stream: "b", Seq: seq}), ShouldBeNil)
+		}
+		So(w.Close(), ShouldBeNil)
+		So(w.Progress(), ShouldResemble, BulkProgress{Written: 8})
+		So(len(flaky.batches), ShouldEqual, 4)
+		for _, batch := range flaky.batches {
+			So(isUnloggedBatch(batch), ShouldBeTrue)
+			stream := batch[0].params[0]
+			for _, stmt := range batch {
+				So(stmt.params[0], ShouldResemble, stream)
+			}
+		}
+		var e event
+		So(cf.LoadByKey(&e, "b", 3), ShouldBeNil)
+		So(w.Add(&event{Stream: "c"}), shouldBeError, ErrBulkWriteFailed)
+	})
+
+	Convey("Transient failures should be retried", t, func() {
+		reset(2)
+		w := cf.NewBulkWriter(BulkOptions{Retries: 2})
+		var delays []time.Duration
+		w.sleep = func(d time.Duration) { delays = append(delays, d) }
+		So(w.Add(&event{Stream: "retried", Seq: 1}), ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		So(delays, ShouldResemble, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond})
+		var e event
+		So(cf.LoadByKey(&e, "retried", 1), ShouldBeNil)
+	})
+
+	Convey("Rows should be reported when their batch fails for good", t, func() {
+		reset(10)
+		var failed []interface{}
+		var progress []BulkProgress
+		w := cf.NewBulkWriter(BulkOptions{
+			BatchSize:  2,
+			Retries:    1,
+			OnFailure:  func(row interface{}, err error) { failed = append(failed, row) },
+			OnProgress: func(p BulkProgress) { progress = append(progress, p) },
+		})
+		w.sleep = noSleep
+		rows := []*event{{Stream: "lost", Seq: 1}, {Stream: "lost", Seq: 2}}
+		for _, row := range rows {
+			So(w.Add(row), ShouldBeNil)
+		}
+		So(w.Close(), shouldBeError, ErrBulkWriteFailed)
+		So(failed, ShouldResemble, []interface{}{rows[0], rows[1]})
+		So(progress, ShouldResemble, []BulkProgress{{Failed: 2}})
+		So(flaky.failures, ShouldEqual, 8)
+	})
+
+	Convey("Callbacks should be able to read the progress", t, func() {
+		reset(1)
+		var w *BulkWriter
+		var seen []BulkProgress
+		w = cf.NewBulkWriter(BulkOptions{
+			BatchSize:  1,
+			Transient:  func(error) bool { return false },
+			OnFailure:  func(row interface{}, err error) { seen = append(seen, w.Progress()) },
+			OnProgress: func(p BulkProgress) { seen = append(seen, w.Progress()) },
+		})
+		So(w.Add(&event{Stream: "observed", Seq: 1}), ShouldBeNil)
+		So(w.Flush(), shouldBeError, ErrBulkWriteFailed)
+		So(seen, ShouldResemble, []BulkProgress{{Pending: 1}, {Failed: 1}})
+		So(w.Close(), shouldBeError, ErrBulkWriteFailed)
+	})
+
+	Convey("Permanent failures shouldn't be retried", t, func() {
+		reset(1)
+		w := cf.NewBulkWriter(BulkOptions{Transient: func(error) bool { return false }})
+		w.sleep = noSleep
+		So(w.Add(&event{Stream: "permanent"}), ShouldBeNil)
+		So(w.Flush(), shouldBeError, ErrBulkWriteFailed)
+		So(w.Progress().Failed, ShouldEqual, 1)
+		So(flaky.failures, ShouldEqual, 0)
+		So(w.Close(), shouldBeError, ErrBulkWriteFailed)
+	})
+
+	Convey("Rows added while the writer closes should be refused or written", t, func() {
+		reset(0)
+		gated := &gatedCluster{Cluster: flaky, gate: make(chan struct{})}
+		schema.Cluster = gated
+		defer func() { schema.Cluster = flaky }()
+		w := cf.NewBulkWriter(BulkOptions{BatchSize: 100, Concurrency: 1})
+		So(w.Add(&event{Stream: "closing"}), ShouldBeNil)
+		closed := make(chan error)
+		go func() { closed <- w.Close() }()
+		accepted := int64(1)
+		for seq := int64(1); seq < 100; seq++ {
+			if w.Add(&event{Stream: "closing", Seq: seq}) != nil {
+				break
+			}
+			accepted++
+			time.Sleep(time.Millisecond)
+		}
+		close(gated.gate)
+		So(<-closed, ShouldBeNil)
+		So(w.Progress(), ShouldResemble, BulkProgress{Written: accepted})
+	})
+
+	Convey("Invalid rows should be rejected when added", t, func() {
+		w := cf.NewBulkWriter(BulkOptions{})
+		So(w.Add(&struct{ Name string }{}), ShouldNotBeNil)
+		So(w.Close(), ShouldBeNil)
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	Convey("Tokens should be replenished at the given rate up to the burst", t, func() {
+		now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+		b := newTokenBucket(100, 10)
+		b.now = func() time.Time { return now }
+		So(b.take(10), ShouldEqual, 0)
+		So(b.take(5), ShouldEqual, 50*time.Millisecond)
+		now = now.Add(50 * time.Millisecond)
+		So(b.take(5), ShouldEqual, 50*time.Millisecond)
+		now = now.Add(time.Hour)
+		So(b.take(10), ShouldEqual, 0)
+		So(b.take(1), ShouldEqual, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,244 @@
+package ibis
+
+import "container/list"
+import "encoding/hex"
+import "hash/fnv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// A Cache holds marshaled rows by key for a column family (see CF.SetCache). A nil row records that
+// no row exists under the key. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the row stored under the key, and whether one was found that hadn't expired by
+	// the given time.
+	Get(key string, now time.Time) (MarshaledMap, bool)
+	// Set stores a row under the key until the given expiry.
+	Set(key string, mmap MarshaledMap, expires time.Time)
+	// Delete removes the row stored under the key, if any.
+	Delete(key string)
+}
+
+// CacheStats counts the loads of a column family that were answered by its cache, and those that
+// weren't.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// cfCache is a cache attached to a column family. Copies of the column family (see IncludeDeleted)
+// share it.
+type cfCache struct {
+	Cache
+	ttl         time.Duration
+	notFoundTTL time.Duration
+	hits        int64
+	misses      int64
+
+	// Each invalidation advances the generation of the key's stripe. A row loaded on a miss is only
+	// stored if its stripe's generation hasn't advanced since the load began, so that a load racing
+	// a commit can't put back the row the commit invalidated.
+	mu          sync.Mutex
+	generations [64]uint64
+}
+
+// stripe returns the index of the generation counting invalidations of the key.
+func (c *cfCache) stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(c.generations)))
+}
+
+// generation returns the current generation of the key's stripe.
+func (c *cfCache) generation(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[c.stripe(key)]
+}
+
+// setIfCurrent stores a row under the key unless it has been invalidated since the given
+// generation.
+func (c *cfCache) setIfCurrent(key string, gen uint64, mmap MarshaledMap, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[c.stripe(key)] == gen {
+		c.Set(key, mmap, expires)
+	}
+}
+
+// invalidate removes the row stored under the key, and advances the generation of its stripe.
+func (c *cfCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[c.stripe(key)]++
+	c.Delete(key)
+}
+
+// SetCache attaches a cache to the column family. Rows loaded by key (as by LoadByKey, LoadByUnique,
+// and LoadBy) are looked up in the cache first, and rows loaded from Cassandra are kept in it for
+// the given TTL. If notFoundTTL is positive, keys with no row are also cached for that long, so
+// that repeated loads of a missing row return ErrNotFound without a query. A nil cache detaches the
+// cache.
+//
+//        model.Users.SetCache(ibis.NewLRUCache(10000), time.Minute, 10*time.Second)
+//
+// Commit, CommitCAS, Delete, Restore, Purge, and Increment invalidate the cached rows they change.
+// Changes made by other processes, or through statements such as those of MakeCommit, aren't seen
+// until the cached rows expire; nor are commits of a partition's static columns, which change every
+// row of the partition. A load that misses the cache while a commit or delete of the same row is
+// under way doesn't store what it read, so it can't put back a row the commit invalidated.
+//
+// SetCache returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) SetCache(cache Cache, ttl, notFoundTTL time.Duration) *CF {
+	if cache == nil {
+		cf.cache = nil
+	} else {
+		cf.cache = &cfCache{Cache: cache, ttl: ttl, notFoundTTL: notFoundTTL}
+	}
+	return cf
+}
+
+// CacheStats returns the number of cache hits and misses of the column family's loads.
+func (cf *CF) CacheStats() CacheStats {
+	if cf.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&cf.cache.hits),
+		Misses: atomic.LoadInt64(&cf.cache.misses),
+	}
+}
+
+// cacheKey returns the key a row is cached under, given its marshaled primary key.
+func (cf *CF) cacheKey(mmap MarshaledMap) string {
+	key := cf.name
+	for _, k := range cf.primaryKey {
+		key += ":"
+		if v := mmap[k]; v != nil {
+			key += hex.EncodeToString(v.Bytes)
+		}
+	}
+	return key
+}
+
+// fetchMarshaled loads the row with the given key through the cache, if the column family has one.
+func (cf *CF) fetchMarshaled(key ...interface{}) (MarshaledMap, error) {
+	if cf.cache == nil {
+		return cf.selectMarshaled(key...)
+	}
+	mkey, err := cf.MarshalKey(key...)
+	if err != nil {
+		return cf.selectMarshaled(key...)
+	}
+	ckey := cf.cacheKey(mkey)
+	now := cf.now()
+	if mmap, ok := cf.cache.Get(ckey, now); ok {
+		atomic.AddInt64(&cf.cache.hits, 1)
+		if mmap == nil {
+			return nil, ErrNotFound.New()
+		}
+		return mmap.clone(), nil
+	}
+	atomic.AddInt64(&cf.cache.misses, 1)
+	gen := cf.cache.generation(ckey)
+	mmap, err := cf.selectMarshaled(key...)
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Key == ErrNotFound && cf.cache.notFoundTTL > 0 {
+			cf.cache.setIfCurrent(ckey, gen, nil, now.Add(cf.cache.notFoundTTL))
+		}
+		return nil, err
+	}
+	cf.cache.setIfCurrent(ckey, gen, mmap.clone(), now.Add(cf.cache.ttl))
+	return mmap, nil
+}
+
+// invalidate removes the row with the given marshaled primary key from the cache.
+func (cf *CF) invalidate(mmap MarshaledMap) {
+	if cf.cache != nil {
+		cf.cache.invalidate(cf.cacheKey(mmap))
+	}
+}
+
+// invalidateKey removes the row with the given primary key from the cache.
+func (cf *CF) invalidateKey(key ...interface{}) {
+	if cf.cache != nil {
+		if mkey, err := cf.MarshalKey(key...); err == nil {
+			cf.invalidate(mkey)
+		}
+	}
+}
+
+// clone returns a copy of the map and its values.
+func (rv MarshaledMap) clone() MarshaledMap {
+	c := make(MarshaledMap, len(rv))
+	for k, v := range rv {
+		if v != nil {
+			copied := *v
+			v = &copied
+		}
+		c[k] = v
+	}
+	return c
+}
+
+type lruEntry struct {
+	key     string
+	mmap    MarshaledMap
+	expires time.Time
+}
+
+type lruCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+// NewLRUCache returns an in-process Cache holding up to the given number of rows. When it's full,
+// the least recently used row is evicted.
+func NewLRUCache(size int) Cache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) Get(key string, now time.Time) (MarshaledMap, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.mmap, true
+}
+
+func (c *lruCache) Set(key string, mmap MarshaledMap, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &lruEntry{key, mmap, expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, mmap, expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
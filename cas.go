@@ -0,0 +1,88 @@
+package ibis
+
+import "sort"
+import "strings"
+
+// A CASConflict carries the existing row that caused a lightweight transaction to fail, as sent back
+// by Cassandra. It is given as the cause of the ErrAlreadyExists error returned by CommitCAS.
+//
+//        if err := model.Users.CommitCAS(&user); err != nil {
+//            if conflict := ibis.CASConflictOf(err); conflict != nil {
+//                var existing User
+//                if err := conflict.Decode(&existing); err != nil {
+//                    ...
+//                }
+//            }
+//        }
+type CASConflict struct {
+	Existing MarshaledMap
+	cf       *CF
+}
+
+func (c *CASConflict) Error() string {
+	return "conflicting row in " + c.cf.name
+}
+
+// Decode unmarshals the existing row into dest, which may be any value CF.LoadByKey accepts.
+func (c *CASConflict) Decode(dest interface{}) error {
+	return c.cf.load(dest, c.Existing)
+}
+
+// CASConflictOf returns the CASConflict that caused the given error, or nil if there is none.
+func CASConflictOf(err error) *CASConflict {
+	for err != nil {
+		switch e := err.(type) {
+		case *CASConflict:
+			return e
+		case *Error:
+			err = e.Cause
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// CommitCASInto is like CommitCAS, except that if a row with the same key already exists, it is
+// decoded into existing before ErrAlreadyExists is returned. This allows a row to be created or
+// the existing one loaded in a single round trip. The existing argument may be the same as row.
+//
+//        if err := model.Users.CommitCASInto(&user, &user); err != nil {
+//            if e, ok := err.(*ibis.Error); !ok || e.Key != ibis.ErrAlreadyExists {
+//                ...
+//            }
+//            // user now holds the existing row
+//        }
+func (cf *CF) CommitCASInto(row, existing interface{}) error {
+	err := cf.CommitCAS(row)
+	if conflict := CASConflictOf(err); conflict != nil {
+		if decodeErr := conflict.Decode(existing); decodeErr != nil {
+			return ChainError(decodeErr, "decoding conflicting row failed")
+		}
+	}
+	return err
+}
+
+// casColumns returns the names of the columns in the order Cassandra reports them when a
+// lightweight transaction isn't applied: the primary key, then the other columns by name.
+func (cf *CF) casColumns() []string {
+	keys := make(map[string]bool)
+	for _, k := range cf.primaryKey {
+		keys[k] = true
+	}
+	others := make([]string, 0, len(cf.columns))
+	for _, col := range cf.columns {
+		if !keys[col.Name] {
+			others = append(others, col.Name)
+		}
+	}
+	sort.Sort(byLowerName(others))
+	return append(append([]string{}, cf.primaryKey...), others...)
+}
+
+// byLowerName sorts column names as Cassandra orders them, without regard to case.
+type byLowerName []string
+
+func (s byLowerName) Len() int           { return len(s) }
+func (s byLowerName) Less(i, j int) bool { return strings.ToLower(s[i]) < strings.ToLower(s[j]) }
+func (s byLowerName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
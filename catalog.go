@@ -0,0 +1,289 @@
+package ibis
+
+import "sort"
+import "strconv"
+import "strings"
+
+// Cassandra describes the schema of its keyspaces in tables of the system keyspace up to version
+// 2.2, and in the system_schema keyspace from version 3.0 on. A live schema is read entirely from
+// whichever of the two the cluster has, according to the release version it reports.
+
+// A releaseVersion is the version of Cassandra a cluster reports running.
+type releaseVersion struct {
+	major, minor int
+}
+
+// getReleaseVersion returns the release version reported by system.local.
+func getReleaseVersion(cluster Cluster) (releaseVersion, error) {
+	var b CQLBuilder
+	cql := b.Append("SELECT release_version FROM system.local").CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	var version string
+	qiter.Scan(&version)
+	if err := qiter.Close(); err != nil {
+		return releaseVersion{}, ChainError(err, "release version check failed")
+	}
+	return parseReleaseVersion(version), nil
+}
+
+// parseReleaseVersion parses the major and minor version from a version string such as "2.1.8".
+func parseReleaseVersion(version string) releaseVersion {
+	var v releaseVersion
+	parts := strings.SplitN(version, ".", 3)
+	v.major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		v.minor, _ = strconv.Atoi(parts[1])
+	}
+	return v
+}
+
+// systemSchema returns true if the schema is described in the system_schema keyspace.
+func (v releaseVersion) systemSchema() bool {
+	return v.major >= 3
+}
+
+// userTypes returns true if the cluster supports user-defined types.
+func (v releaseVersion) userTypes() bool {
+	return v.major > 2 || v.major == 2 && v.minor >= 1
+}
+
+// typeFromCQL translates a type as system_schema describes it into the name ibis gives it.
+func typeFromCQL(cqlType string) string {
+	if cqlType == "text" {
+		return "varchar"
+	}
+	if _, ok := typeInfoMap[cqlType]; ok || strings.HasPrefix(cqlType, "frozen<") {
+		return cqlType
+	}
+	return "blob"
+}
+
+// systemSchemaColumn is a row of system_schema.columns.
+type systemSchemaColumn struct {
+	table, name, kind, cqlType, order string
+	position                          int
+}
+
+// getSystemSchema builds the live schema of a keyspace from the system_schema keyspace.
+func getSystemSchema(c Cluster, keyspace string) (*Schema, error) {
+	types, err := getSystemSchemaTypes(c, keyspace)
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{CFs: make(Keyspace), Types: types, nextTypeID: 1}
+
+	sel := Select("table_name", "comment", "compaction", "compression", "caching",
+		"default_time_to_live", "gc_grace_seconds").
+		From(NewCF("system_schema.tables")).Where("keyspace_name = ?", keyspace)
+	cql := sel.CQL()
+	cql.Cluster(c)
+	qiter := cql.Query()
+	for {
+		var table_name, comment string
+		var compaction, compression, caching map[string]string
+		var default_ttl, gc_grace int
+		if !qiter.Scan(&table_name, &comment, &compaction, &compression, &caching, &default_ttl,
+			&gc_grace) {
+			break
+		}
+		t := &CF{name: table_name, columns: make([]Column, 0, 16)}
+		t.options = systemSchemaTableOptions(compaction, compression, caching, default_ttl, gc_grace)
+		t.typeID = typeIDFromComment(comment)
+		if t.typeID >= schema.nextTypeID {
+			schema.nextTypeID = t.typeID + 1
+		}
+		schema.CFs[strings.ToLower(table_name)] = t
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+
+	sel = Select("view_name", "base_table_name").
+		From(NewCF("system_schema.views")).Where("keyspace_name = ?", keyspace)
+	cql = sel.CQL()
+	cql.Cluster(c)
+	qiter = cql.Query()
+	bases := make(map[string]string)
+	for {
+		var view_name, base_name string
+		if !qiter.Scan(&view_name, &base_name) {
+			break
+		}
+		bases[view_name] = base_name
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+
+	sel = Select("table_name", "column_name", "kind", "position", `"type"`, "clustering_order").
+		From(NewCF("system_schema.columns")).Where("keyspace_name = ?", keyspace)
+	cql = sel.CQL()
+	cql.Cluster(c)
+	qiter = cql.Query()
+	columns := make(map[string][]systemSchemaColumn)
+	for {
+		var col systemSchemaColumn
+		if !qiter.Scan(&col.table, &col.name, &col.kind, &col.position, &col.cqlType, &col.order) {
+			break
+		}
+		columns[col.table] = append(columns[col.table], col)
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, t := range schema.CFs {
+		for _, col := range columns[t.name] {
+			t.columns = append(t.columns, Column{
+				Name:   col.name,
+				Type:   typeFromCQL(col.cqlType),
+				Static: col.kind == "static",
+			})
+			if strings.EqualFold(col.order, "desc") {
+				t.options.ClusteringOrder = setOption(t.options.ClusteringOrder, col.name, "DESC")
+			}
+		}
+		partition, clustering := systemSchemaKey(columns[t.name])
+		t.SetCompositeKey(partition, clustering...)
+	}
+	for view_name, base_name := range bases {
+		if t := schema.CFs[strings.ToLower(base_name)]; t != nil {
+			partition, clustering := systemSchemaKey(columns[view_name])
+			t.views = append(t.views, MaterializedView{
+				Name:         view_name,
+				PartitionKey: partition,
+				Clustering:   clustering,
+			})
+		}
+	}
+
+	sel = Select("table_name", "index_name", "options").
+		From(NewCF("system_schema.indexes")).Where("keyspace_name = ?", keyspace)
+	cql = sel.CQL()
+	cql.Cluster(c)
+	qiter = cql.Query()
+	for {
+		var table_name, index_name string
+		var options map[string]string
+		if !qiter.Scan(&table_name, &index_name, &options) {
+			break
+		}
+		if t := schema.CFs[strings.ToLower(table_name)]; t != nil {
+			t.indexes = append(t.indexes, Index{Name: index_name, Column: options["target"]})
+		}
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// systemSchemaKey returns the partition key and clustering columns among the given columns of a
+// table or view, in order.
+func systemSchemaKey(columns []systemSchemaColumn) ([]string, []string) {
+	var partition, clustering []systemSchemaColumn
+	for _, col := range columns {
+		switch col.kind {
+		case "partition_key":
+			partition = append(partition, col)
+		case "clustering":
+			clustering = append(clustering, col)
+		}
+	}
+	names := func(cols []systemSchemaColumn) []string {
+		sort.Sort(byPosition(cols))
+		result := make([]string, len(cols))
+		for i, col := range cols {
+			result[i] = col.name
+		}
+		return result
+	}
+	return names(partition), names(clustering)
+}
+
+type byPosition []systemSchemaColumn
+
+func (p byPosition) Len() int           { return len(p) }
+func (p byPosition) Less(i, j int) bool { return p[i].position < p[j].position }
+func (p byPosition) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// systemSchemaTableOptions decodes the options reported by system_schema.tables. The compressor is
+// reported under the key class, rather than sstable_compression as it's given.
+func systemSchemaTableOptions(compaction, compression, caching map[string]string,
+	defaultTTL, gcGrace int) TableOptions {
+	o := TableOptions{
+		Compaction:        compaction,
+		Compression:       compression,
+		Caching:           caching,
+		DefaultTimeToLive: &defaultTTL,
+		GCGraceSeconds:    &gcGrace,
+	}
+	if o.Compaction == nil {
+		o.Compaction = make(map[string]string)
+	}
+	if o.Compression == nil {
+		o.Compression = make(map[string]string)
+	}
+	if class, ok := o.Compression["class"]; ok {
+		delete(o.Compression, "class")
+		o.Compression["sstable_compression"] = class
+	}
+	return o
+}
+
+// getSystemSchemaTypes returns the user-defined types of the keyspace described by
+// system_schema.types.
+func getSystemSchemaTypes(cluster Cluster, keyspace string) (map[string]*UDT, error) {
+	sel := Select("type_name", "field_names", "field_types").
+		From(NewCF("system_schema.types")).Where("keyspace_name = ?", keyspace)
+	cql := sel.CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	types := make(map[string]*UDT)
+	for {
+		var type_name string
+		var field_names, field_types []string
+		if !qiter.Scan(&type_name, &field_names, &field_types) {
+			break
+		}
+		udt := newUDT(type_name)
+		for i, name := range field_names {
+			var cqlType string
+			if i < len(field_types) {
+				cqlType = field_types[i]
+			}
+			udt.Fields = append(udt.Fields, Column{Name: name, Type: typeFromCQL(cqlType)})
+		}
+		types[type_name] = udt
+	}
+	return types, qiter.Close()
+}
+
+// getSystemSchemaKeyspace describes the replication of the named keyspace from
+// system_schema.keyspaces.
+func getSystemSchemaKeyspace(cluster Cluster, name string) (*KeyspaceSpec, error) {
+	sel := Select("durable_writes", "replication").
+		From(NewCF("system_schema.keyspaces")).Where("keyspace_name = ?", name)
+	cql := sel.CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	var durable bool
+	var replication map[string]string
+	if !qiter.Scan(&durable, &replication) {
+		if err := qiter.Close(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound.New()
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+	options := make(map[string]string)
+	for k, v := range replication {
+		if k != "class" {
+			options[k] = v
+		}
+	}
+	return liveKeyspaceSpec(name, replication["class"], durable, options), nil
+}
@@ -1,5 +1,6 @@
 package ibis
 
+import "context"
 import "fmt"
 import "reflect"
 import "strings"
@@ -9,12 +10,21 @@ import "github.com/gocql/gocql"
 // A type of function that produces CQL statements to execute before committing data.
 type PrecommitHook func(interface{}, MarshaledMap) ([]CQL, error)
 
+// A PrecommitContextHook is a PrecommitHook that is also given the context of the commit or delete
+// (see CommitContext and DeleteContext).
+type PrecommitContextHook func(ctx context.Context, row interface{}, mmap MarshaledMap) ([]CQL, error)
+
 // A MarshalHook is invoked just after a row is marshalled, prior to commit.
 type MarshalHook func(MarshaledMap) error
 
 // An UnmarshalHook is invoked just before a row is unmarshalled, after a commit, load, or scan.
 type UnmarshalHook func(MarshaledMap) error
 
+// A PostHook is invoked after a row is committed, deleted, or loaded, with the row, its marshaled
+// values, and whether it was committed with CommitCAS. The write or load has already taken place, so
+// an error returned by the hook is surfaced to the caller, but nothing is rolled back.
+type PostHook func(row interface{}, mmap MarshaledMap, cas bool) error
+
 // CFProvider is an interface for producing and configuring a column family definition. Use
 // CFProvider when specifying a schema struct for ReflectSchema(). Exported fields that implement
 // this interface will be included in the resulting schema.
@@ -33,18 +43,37 @@ func CFProviderFunc(provider func() *CF) CFProvider { return cfProviderFunc(prov
 // live schema, then operations on a column family may be made through methods on this type.
 type CF struct {
 	// data definition
-	name       string
-	columns    []Column
-	primaryKey []string
+	name        string
+	columns     []Column
+	primaryKey  []string
+	options     TableOptions
+	indexes     []Index
+	views       []MaterializedView
+	types       []*UDT // user-defined types used by columns, in dependency order
+	uniques     []string
+	lookups     []Lookup
+	deletedAt   string // the soft delete column, if any
+	constraints []Constraint
+	autoColumns []autoColumn
+	references  []Reference
+
+	// the number of leading primaryKey columns making up the partition key; zero is taken as one
+	partitionKeySize int
 
 	// plumbing
 	schema *Schema
 	typeID int
 	*rowReflector
-	provisions     []reflect.Value
-	precommitHooks []PrecommitHook
-	marshalHooks   []MarshalHook
-	unmarshalHooks []UnmarshalHook
+	provisions      []reflect.Value
+	precommitHooks  []PrecommitContextHook
+	predeleteHooks  []PrecommitContextHook
+	marshalHooks    []MarshalHook
+	unmarshalHooks  []UnmarshalHook
+	postcommitHooks []PostHook
+	postdeleteHooks []PostHook
+	postloadHooks   []PostHook
+	includeDeleted  bool
+	cache           *cfCache
 }
 
 func NewCF(name string, columns ...Column) *CF {
@@ -84,7 +113,27 @@ func (cf *CF) Name() string {
 // SetPrimaryKey returns a pointer to the column family it was called on so it can be chained during
 // configuration.
 func (cf *CF) SetPrimaryKey(keys ...string) *CF {
+	return cf.setKey(keys, 1)
+}
+
+// SetCompositeKey configures a primary key with a composite partition key. The partition argument
+// names one or more columns that together make up the partition key. Zero or more additional
+// arguments specify the name of the clustering columns.
+//
+//        cf.SetCompositeKey([]string{"Stream", "Day"}, "ID")  // PRIMARY KEY ((Stream, Day), ID)
+//
+// SetCompositeKey returns a pointer to the column family it was called on so it can be chained
+// during configuration.
+func (cf *CF) SetCompositeKey(partition []string, clustering ...string) *CF {
+	keys := make([]string, 0, len(partition)+len(clustering))
+	keys = append(keys, partition...)
+	keys = append(keys, clustering...)
+	return cf.setKey(keys, len(partition))
+}
+
+func (cf *CF) setKey(keys []string, partitionKeySize int) *CF {
 	cf.primaryKey = keys
+	cf.partitionKeySize = partitionKeySize
 
 	// primary key columns must come first and in order
 	rearranged := make([]Column, len(cf.columns))
@@ -109,27 +158,97 @@ func (cf *CF) SetPrimaryKey(keys ...string) *CF {
 	return cf
 }
 
-// Precommit adds a hook to the column family's list of precommit hooks.
-func (cf *CF) Precommit(hook PrecommitHook) *CF {
-	if cf.precommitHooks == nil {
-		cf.precommitHooks = append(cf.precommitHooks, hook)
+// PrimaryKey returns the names of the columns making up the primary key, beginning with those of the
+// partition key. This is the order in which key values are given to methods like LoadByKey.
+func (cf *CF) PrimaryKey() []string {
+	return cf.primaryKey
+}
+
+// PartitionKey returns the names of the columns making up the partition key.
+func (cf *CF) PartitionKey() []string {
+	n := cf.partitionKeySize
+	if n == 0 {
+		n = 1
+	}
+	if n > len(cf.primaryKey) {
+		n = len(cf.primaryKey)
 	}
+	return cf.primaryKey[:n]
+}
+
+func (cf *CF) clusteringColumns() []string {
+	return cf.primaryKey[len(cf.PartitionKey()):]
+}
+
+// Precommit adds a hook to the column family's list of precommit hooks. The statements they return
+// are executed in the same batch as Commit writes a row with. For CommitCAS, they are executed after
+// the lightweight transaction, and only if it applied.
+func (cf *CF) Precommit(hook PrecommitHook) *CF {
+	return cf.PrecommitContext(hook.withContext())
+}
+
+// PrecommitContext adds a hook that is given the context of each commit to the column family's list
+// of precommit hooks.
+func (cf *CF) PrecommitContext(hook PrecommitContextHook) *CF {
+	cf.precommitHooks = append(cf.precommitHooks, hook)
+	return cf
+}
+
+// Predelete adds a hook to the column family's list of predelete hooks. The statements they return
+// are executed in the same batch that Delete removes a row with. They receive the row as it was
+// before deletion, as postdelete hooks do.
+func (cf *CF) Predelete(hook PrecommitHook) *CF {
+	return cf.PredeleteContext(hook.withContext())
+}
+
+// PredeleteContext adds a hook that is given the context of each delete to the column family's list
+// of predelete hooks.
+func (cf *CF) PredeleteContext(hook PrecommitContextHook) *CF {
+	cf.predeleteHooks = append(cf.predeleteHooks, hook)
 	return cf
 }
 
+func (hook PrecommitHook) withContext() PrecommitContextHook {
+	return func(ctx context.Context, row interface{}, mmap MarshaledMap) ([]CQL, error) {
+		return hook(row, mmap)
+	}
+}
+
 // OnMarshal adds a hook to the column family's list of marshal hooks.
 func (cf *CF) OnMarshal(hook MarshalHook) *CF {
-	if cf.marshalHooks == nil {
-		cf.marshalHooks = append(cf.marshalHooks, hook)
-	}
+	cf.marshalHooks = append(cf.marshalHooks, hook)
 	return cf
 }
 
 // OnUnmarshal adds a hook to the column family's list of unmarshal hooks.
 func (cf *CF) OnUnmarshal(hook UnmarshalHook) *CF {
-	if cf.unmarshalHooks == nil {
-		cf.unmarshalHooks = append(cf.unmarshalHooks, hook)
-	}
+	cf.unmarshalHooks = append(cf.unmarshalHooks, hook)
+	return cf
+}
+
+// Postcommit adds a hook to the column family's list of postcommit hooks, which are invoked after
+// Commit or CommitCAS writes a row, with the committed row.
+//
+//        model.Users.Postcommit(func(row interface{}, mmap ibis.MarshaledMap, cas bool) error {
+//            return cache.Invalidate(row.(*User).Name)
+//        })
+func (cf *CF) Postcommit(hook PostHook) *CF {
+	cf.postcommitHooks = append(cf.postcommitHooks, hook)
+	return cf
+}
+
+// Postdelete adds a hook to the column family's list of postdelete hooks, which are invoked after
+// Delete removes a row, with the row as it was before deletion. If the column family was generated
+// by reflection, the row is a pointer to a value of the reflected type; otherwise it is nil.
+func (cf *CF) Postdelete(hook PostHook) *CF {
+	cf.postdeleteHooks = append(cf.postdeleteHooks, hook)
+	return cf
+}
+
+// Postload adds a hook to the column family's list of postload hooks, which are invoked after a row
+// is loaded and unmarshalled, as by LoadByKey or ScanRow.
+func (cf *CF) Postload(hook PostHook) *CF {
+	cf.postloadHooks = append(cf.postloadHooks, hook)
 	return cf
 }
 
@@ -138,11 +257,21 @@ func (cf *CF) CreateStatement() CQL {
 	var b CQLBuilder
 	b.Append("CREATE TABLE " + cf.name + " (")
 	for _, col := range cf.columns {
-		b.Append(col.Name + " " + col.Type + ", ")
+		b.Append(col.definition() + ", ")
+	}
+	keys := cf.clusteringColumns()
+	if partition := cf.PartitionKey(); len(partition) > 1 {
+		keys = append([]string{"(" + strings.Join(partition, ", ") + ")"}, keys...)
+	} else {
+		keys = cf.primaryKey
 	}
-	b.Append("PRIMARY KEY (" + strings.Join(cf.primaryKey, ", ") + "))")
+	b.Append("PRIMARY KEY (" + strings.Join(keys, ", ") + "))")
+	options := cf.options.clauses(cf.clusteringColumns())
 	if cf.typeID != 0 {
-		b.Append(fmt.Sprintf(" WITH comment='%d'", cf.typeID))
+		options = append(options, fmt.Sprintf("comment='%d'", cf.typeID))
+	}
+	if len(options) > 0 {
+		b.Append(" WITH " + strings.Join(options, " AND "))
 	}
 	cql := b.CQL()
 	if cf.schema != nil {
@@ -156,8 +285,27 @@ func (cf *CF) CreateStatement() CQL {
 type Column struct {
 	Name     string
 	Type     string // The cassandra type of the column ("varchar", "bigint", etc.).
+	Static   bool   // True if the column is shared by all rows of a partition.
 	typeInfo *gocql.TypeInfo
 	tag      reflect.StructTag
+	udt      *UDT
+}
+
+// definition returns the column's name and type as given in CREATE TABLE or ALTER TABLE ADD.
+func (col Column) definition() string {
+	if col.Static {
+		return col.Name + " " + col.Type + " static"
+	}
+	return col.Name + " " + col.Type
+}
+
+func (cf *CF) column(name string) (Column, bool) {
+	for _, col := range cf.columns {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return Column{}, false
 }
 
 // Provide associates an interface with the column family for lookup with GetProvider.
@@ -209,11 +357,18 @@ func (cf *CF) IsBound() bool {
 
 // Exists returns true if a row can be found in the column family with the given primary key.
 // The values for the key must be given in order respective to the primary key definition for this
-// column family (see the Key function).
+// column family (see the PrimaryKey function).
 func (cf *CF) Exists(key ...interface{}) (bool, error) {
 	if !cf.IsBound() {
 		return false, ErrTableNotBound.New()
 	}
+	if cf.filtersDeleted() {
+		_, err := cf.loadMarshaled(key...)
+		if e, ok := err.(*Error); ok && e.Key == ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
 	sel := Select("COUNT(*)").From(cf)
 	for i, k := range cf.primaryKey {
 		sel.Where(k+" = ?", key[i])
@@ -232,8 +387,8 @@ func (cf *CF) Exists(key ...interface{}) (bool, error) {
 // was reflected.
 //
 // The values for the key must be given in order respective to the primary key definition for this
-// column family (see the Key function). If no row is found under the given key, ErrNotFound is
-// returned.
+// column family (see the PrimaryKey function). If no row is found under the given key, ErrNotFound
+// is returned.
 func (cf *CF) LoadByKey(dest interface{}, key ...interface{}) error {
 	if !cf.IsBound() {
 		return ErrTableNotBound.New()
@@ -241,7 +396,28 @@ func (cf *CF) LoadByKey(dest interface{}, key ...interface{}) error {
 	if len(key) != len(cf.primaryKey) {
 		return ErrInvalidKey.New()
 	}
+	mmap, err := cf.loadMarshaled(key...)
+	if err != nil {
+		return err
+	}
+	return cf.load(dest, mmap)
+}
+
+// loadMarshaled retrieves the marshaled values of the row with the given primary key, through the
+// cache if there is one. Soft-deleted rows aren't found unless they're included.
+func (cf *CF) loadMarshaled(key ...interface{}) (MarshaledMap, error) {
+	mmap, err := cf.fetchMarshaled(key...)
+	if err != nil {
+		return nil, err
+	}
+	if cf.filtersDeleted() && cf.isDeleted(mmap) {
+		return nil, ErrNotFound.New()
+	}
+	return mmap, nil
+}
 
+// selectMarshaled queries for the row with the given key.
+func (cf *CF) selectMarshaled(key ...interface{}) (MarshaledMap, error) {
 	colnames := make([]string, len(cf.columns))
 	for i, col := range cf.columns {
 		colnames[i] = col.Name
@@ -255,25 +431,31 @@ func (cf *CF) LoadByKey(dest interface{}, key ...interface{}) error {
 	mmap := make(MarshaledMap)
 	if !qiter.Scan(mmap.PointersTo(colnames...)...) {
 		if err := qiter.Close(); err != nil {
-			return ChainError(err, "scan failed")
+			return nil, ChainError(err, "scan failed")
 		}
-		return ErrNotFound.New()
+		return nil, ErrNotFound.New()
 	}
-	return cf.unmarshal(dest, mmap)
+	return mmap, nil
 }
 
 // CommitCAS writes a row to the column family if no row already exists under the same key. If a row
-// with the same key already exists, ErrAlreadyExists will be returned.
+// with the same key already exists, ErrAlreadyExists will be returned, caused by a CASConflict
+// holding the existing row (see CASConflictOf and CommitCASInto).
 //
 // The row argument should implement the Row interface. Alternatively, if this column family was
 // generated by reflection, then the row argument may be a pointer to a value of the same type that
 // was reflected.
 func (cf *CF) CommitCAS(row interface{}) error {
+	return cf.CommitCASContext(context.Background(), row)
+}
+
+// CommitCASContext is CommitCAS with a context, which is given to the precommit hooks.
+func (cf *CF) CommitCASContext(ctx context.Context, row interface{}) error {
 	if !cf.IsBound() {
 		return ErrTableNotBound.New()
 	}
 	// TODO: handle pk changes
-	return cf.commit(row, true)
+	return cf.commit(ctx, row, true)
 }
 
 // Commit writes a row to the column family. If a row already exists with the same key, it will be
@@ -283,16 +465,100 @@ func (cf *CF) CommitCAS(row interface{}) error {
 // generated by reflection, then the row argument may be a pointer to a value of the same type that
 // was reflected.
 func (cf *CF) Commit(row interface{}) error {
+	return cf.CommitContext(context.Background(), row)
+}
+
+// CommitContext is Commit with a context, which is given to the precommit hooks.
+//
+//        err := model.Users.CommitContext(audit.WithActor(ctx, "admin"), &user)
+func (cf *CF) CommitContext(ctx context.Context, row interface{}) error {
 	if !cf.IsBound() {
 		return ErrTableNotBound.New()
 	}
 	// TODO: handle pk changes
-	return cf.commit(row, false)
+	return cf.commit(ctx, row, false)
+}
+
+// Delete removes the row with the given primary key, along with its entries in lookup column
+// families and its claims on unique values. If there is no such row, ErrNotFound is returned. If the
+// column family has a soft delete column, the row is only marked deleted (see SetSoftDelete).
+//
+// The values for the key must be given in order respective to the primary key definition for this
+// column family (see the PrimaryKey function).
+func (cf *CF) Delete(key ...interface{}) error {
+	return cf.DeleteContext(context.Background(), key...)
+}
+
+// DeleteContext is Delete with a context, which is given to the predelete hooks.
+func (cf *CF) DeleteContext(ctx context.Context, key ...interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if len(key) != len(cf.primaryKey) {
+		return ErrInvalidKey.New()
+	}
+	mmap, err := cf.loadMarshaled(key...)
+	if err != nil {
+		return err
+	}
+	var row interface{}
+	if cf.rowReflector != nil {
+		row = reflect.New(cf.rowReflector.rowType.Elem()).Interface()
+		if err := cf.unmarshal(row, mmap); err != nil {
+			return err
+		}
+	}
+	cqls, err := applyPreHooks(ctx, "predelete", cf.predeleteHooks, row, mmap)
+	if err != nil {
+		return ChainError(err, "predelete setup failed")
+	}
+	if cf.deletedAt != "" {
+		err = cf.softDelete(cqls, key...)
+	} else {
+		err = cf.hardDelete(cqls, mmap)
+	}
+	if err != nil {
+		return err
+	}
+	return applyPostHooks("postdelete", cf.postdeleteHooks, row, mmap, false)
+}
+
+// hardDelete removes a row, its lookup entries, and its unique values in a batch with the given
+// statements.
+func (cf *CF) hardDelete(cqls []CQL, mmap MarshaledMap) error {
+	del := DeleteFrom(cf)
+	for _, k := range cf.primaryKey {
+		del.Where(k+" = ?", mmap[k])
+	}
+	cqls = append(cqls, del.CQL())
+	for _, l := range cf.lookups {
+		if lookup := cf.lookup(l.Column); lookup != nil && mmap[l.Column] != nil &&
+			len(mmap[l.Column].Bytes) > 0 {
+			cqls = append(cqls, cf.lookupDelete(lookup, l.Column, mmap[l.Column], mmap))
+		}
+	}
+	if err := cf.schema.Cluster.Query(cqls...).Exec(); err != nil {
+		return ChainError(err, "delete failed")
+	}
+	cf.invalidate(mmap)
+	// unique values are released after the batch, since a conditional delete can't share it
+	for _, column := range cf.uniques {
+		if lookup := cf.uniqueLookup(column); lookup != nil && mmap[column] != nil &&
+			len(mmap[column].Bytes) > 0 {
+			if err := (uniqueClaim{lookup, column, mmap[column], mmap}).release(); err != nil {
+				return ChainError(err, "release of unique", column, "failed")
+			}
+		}
+	}
+	return nil
 }
 
 // MakeCommit returns the CQL statement that would commit the given row. ErrNothingToCommit may be
 // returned.
 func (cf *CF) MakeCommit(row interface{}) (CQL, error) {
+	if cf.IsCounterTable() {
+		return CQL{}, errCounterCommit(cf)
+	}
 	mmap, err := cf.marshal(row)
 	if err != nil {
 		return CQL{}, err
@@ -306,6 +572,9 @@ func (cf *CF) MakeCommit(row interface{}) (CQL, error) {
 
 // MakeCommitCAS returns the CQL statement that would CAS-commit the given row.
 func (cf *CF) MakeCommitCAS(row interface{}) (CQL, error) {
+	if cf.IsCounterTable() {
+		return CQL{}, errCounterCommit(cf)
+	}
 	mmap, err := cf.marshal(row)
 	if err != nil {
 		return CQL{}, err
@@ -314,16 +583,22 @@ func (cf *CF) MakeCommitCAS(row interface{}) (CQL, error) {
 	return cql, nil
 }
 
-func (cf *CF) applyPrecommitHooks(row interface{}, mmap MarshaledMap) ([]CQL, error) {
+func (cf *CF) applyPrecommitHooks(ctx context.Context, row interface{}, mmap MarshaledMap) (
+	[]CQL, error) {
+	return applyPreHooks(ctx, "precommit", cf.precommitHooks, row, mmap)
+}
+
+// applyPreHooks invokes each of the given hooks, collecting the statements they return. The first
+// error stops the collection.
+func applyPreHooks(ctx context.Context, kind string, hooks []PrecommitContextHook, row interface{},
+	mmap MarshaledMap) ([]CQL, error) {
 	total := make([]CQL, 0)
-	if cf.precommitHooks != nil {
-		for i, hook := range cf.precommitHooks {
-			cqls, err := hook(row, mmap)
-			if err != nil {
-				return nil, ChainError(err, fmt.Sprintf("precommit hook #%d failed", i))
-			}
-			total = append(total, cqls...)
+	for i, hook := range hooks {
+		cqls, err := hook(ctx, row, mmap)
+		if err != nil {
+			return nil, ChainError(err, fmt.Sprintf("%s hook #%d failed", kind, i))
 		}
+		total = append(total, cqls...)
 	}
 	return total, nil
 }
@@ -341,6 +616,8 @@ func (cf *CF) generateCommit(mmap MarshaledMap, cas bool) (cql CQL, ok bool) {
 			IfNotExists()
 		cql = ins.CQL()
 		ok = true
+	} else if cf.isStaticCommit(mmap) {
+		cql, ok = cf.generateStaticCommit(mmap)
 	} else {
 		var allDirty bool
 		// If any primary keys are dirty, invalidate the entire object.
@@ -378,58 +655,107 @@ func (cf *CF) generateCommit(mmap MarshaledMap, cas bool) (cql CQL, ok bool) {
 	return
 }
 
-func (cf *CF) commit(row interface{}, cas bool) error {
+func errCounterCommit(cf *CF) error {
+	return NewError(ErrInvalidCounterTable, "can't commit rows to counter table",
+		cf.name+"; use Increment instead")
+}
+
+func (cf *CF) commit(ctx context.Context, row interface{}, cas bool) error {
+	if cf.IsCounterTable() {
+		return errCounterCommit(cf)
+	}
 	mmap, err := cf.marshal(row)
 	if err != nil {
 		return ChainError(err, "marshal failed")
 	}
 
-	// Generate CQL from precommit hooks and execute it in a batch.
-	// TODO: Include commit in the same batch.
-	cqls, err := cf.applyPrecommitHooks(row, mmap)
+	// Claim changed unique values before anything is written. The claims are released if the
+	// commit doesn't go through.
+	claims, err := cf.claimUniques(mmap)
 	if err != nil {
-		return ChainError(err, "precommit setup failed")
+		return err
 	}
-	if len(cqls) > 0 {
-		if err := cf.schema.Cluster.Query(cqls...).Exec(); err != nil {
-			return ChainError(err, "precommit failed")
+	written, err := cf.write(ctx, row, mmap, cas)
+	cf.invalidate(mmap)
+	if err != nil {
+		// a row written by CAS holds its claims even if the statements following it failed
+		if !written {
+			releaseUniques(claims)
 		}
+		return err
 	}
+	return cf.finishCommit(row, mmap, cas, written)
+}
 
-	// Generate CQL for commit.
-	cql, ok := cf.generateCommit(mmap, cas)
-	if !ok {
-		return nil
+// finishCommit releases the unique values a committed row replaced, makes the row unmarshal its
+// committed values, and applies the postcommit hooks if it was written.
+func (cf *CF) finishCommit(row interface{}, mmap MarshaledMap, cas, written bool) error {
+	if err := cf.releaseReplacedUniques(mmap); err != nil {
+		return err
 	}
 
-	// Apply the INSERT or UPDATE and check results.
-	qiter := cql.Query()
-	if cas {
-		// A CAS query uses ScanCAS for the lightweight transaction. This returns a boolean
-		// indicating success, and a row with the values that were committed. We don't need this
-		// response, but we need to supply MarshaledValue pointers for the returned columns anyway.
-		// Despite this, the values pointed to will not be filled in except in the case of error.
-		casmap := make(MarshaledMap)
-		selectedKeys := make([]string, len(cf.columns))
-		for i, col := range cf.columns {
-			selectedKeys[i] = col.Name
+	// Make the row unmarshal its given values, in case it is caching upon load.
+	if err := cf.unmarshal(row, mmap); err != nil {
+		return err
+	}
+	if written {
+		return applyPostHooks("postcommit", cf.postcommitHooks, row, mmap, cas)
+	}
+	return nil
+}
+
+// commitStatements generates the statements of the precommit hooks and lookups of a marshaled row,
+// and its commit statement. If there is nothing to commit, ok is false.
+func (cf *CF) commitStatements(ctx context.Context, row interface{}, mmap MarshaledMap, cas bool) (
+	cqls []CQL, cql CQL, ok bool, err error) {
+	if cqls, err = cf.applyPrecommitHooks(ctx, row, mmap); err != nil {
+		return nil, CQL{}, false, ChainError(err, "precommit setup failed")
+	}
+	cqls = append(cqls, cf.lookupStatements(mmap)...)
+	cql, ok = cf.generateCommit(mmap, cas)
+	return
+}
+
+// write applies the precommit hooks and commit statement of a marshaled row. It returns false if
+// there was nothing to commit, or if the commit failed before the row was written.
+func (cf *CF) write(ctx context.Context, row interface{}, mmap MarshaledMap, cas bool) (bool, error) {
+	cqls, cql, ok, err := cf.commitStatements(ctx, row, mmap, cas)
+	if err != nil {
+		return false, err
+	}
+
+	// A plain commit is executed in the same batch as the precommit statements.
+	if !cas {
+		if ok {
+			cqls = append(cqls, cql)
 		}
-		pointers := casmap.PointersTo(selectedKeys...)
-		if applied := qiter.ScanCAS(pointers...); !applied {
-			err := qiter.Close()
-			if err == nil {
-				return ErrAlreadyExists.New()
+		if len(cqls) > 0 {
+			if err := cf.schema.Cluster.Query(cqls...).Exec(); err != nil {
+				return false, ChainError(err, "commit failed")
 			}
-			return ChainError(err, "CAS commit failed")
-		}
-	} else {
-		if err := qiter.Exec(); err != nil {
-			return ChainError(err, "commit failed")
 		}
+		return ok, nil
 	}
 
-	// Make the row unmarshal its given values, in case it is caching upon load.
-	return cf.unmarshal(row, mmap)
+	// A lightweight transaction can't share a batch with statements on other partitions, so for CAS
+	// the precommit statements are executed only once it has applied. ScanCAS returns a boolean
+	// indicating success. If the row wasn't applied, the values of the existing row are filled in,
+	// and they are returned with the error so the caller may decode them.
+	qiter := cql.Query()
+	casmap := make(MarshaledMap)
+	if applied := qiter.ScanCAS(casmap.PointersTo(cf.casColumns()...)...); !applied {
+		err := qiter.Close()
+		if err == nil {
+			return false, &Error{Key: ErrAlreadyExists, Cause: &CASConflict{Existing: casmap, cf: cf}}
+		}
+		return false, ChainError(err, "CAS commit failed")
+	}
+	if len(cqls) > 0 {
+		if err := cf.schema.Cluster.Query(cqls...).Exec(); err != nil {
+			return true, ChainError(err, "precommit statements failed after CAS commit")
+		}
+	}
+	return true, nil
 }
 
 func (cf *CF) marshal(src interface{}) (MarshaledMap, error) {
@@ -455,9 +781,35 @@ func (cf *CF) marshal(src interface{}) (MarshaledMap, error) {
 			}
 		}
 	}
+	if err := cf.validate(src, mmap); err != nil {
+		return nil, err
+	}
+	if err := cf.checkStaticCommit(mmap); err != nil {
+		return nil, err
+	}
 	return mmap, nil
 }
 
+// load unmarshals a row that was loaded, then applies the postload hooks.
+func (cf *CF) load(dest interface{}, mmap MarshaledMap) error {
+	if err := cf.unmarshal(dest, mmap); err != nil {
+		return err
+	}
+	return applyPostHooks("postload", cf.postloadHooks, dest, mmap, false)
+}
+
+// applyPostHooks invokes each of the given hooks, even if an earlier one fails. The first error is
+// returned.
+func applyPostHooks(kind string, hooks []PostHook, row interface{}, mmap MarshaledMap, cas bool) error {
+	var first error
+	for i, hook := range hooks {
+		if err := hook(row, mmap, cas); err != nil && first == nil {
+			first = ChainError(err, fmt.Sprintf("%s hook #%d failed", kind, i))
+		}
+	}
+	return first
+}
+
 func (cf *CF) unmarshal(dest interface{}, mmap MarshaledMap) error {
 	row, ok := dest.(Row)
 	if !ok {
@@ -480,6 +832,42 @@ func (cf *CF) unmarshal(dest interface{}, mmap MarshaledMap) error {
 	return row.Unmarshal(mmap)
 }
 
+// Decode unmarshals a marshaled row into dest, which may be any value LoadByKey accepts. Values
+// given without type info are taken to be of their column's type. Unlike a load, postload hooks
+// aren't applied.
+func (cf *CF) Decode(dest interface{}, mmap MarshaledMap) error {
+	typed := make(MarshaledMap, len(mmap))
+	for k, v := range mmap {
+		if v != nil && v.TypeInfo == nil {
+			if col, ok := cf.column(k); ok {
+				v = &MarshaledValue{Bytes: v.Bytes, OriginalBytes: v.OriginalBytes, TypeInfo: col.typeInfo}
+			}
+		}
+		typed[k] = v
+	}
+	return cf.unmarshal(dest, typed)
+}
+
+// MarshalKey marshals the values of a primary key, given in the order of the PrimaryKey function.
+func (cf *CF) MarshalKey(key ...interface{}) (MarshaledMap, error) {
+	if len(key) != len(cf.primaryKey) {
+		return nil, ErrInvalidKey.New()
+	}
+	mmap := make(MarshaledMap, len(key))
+	for i, k := range cf.primaryKey {
+		col, ok := cf.column(k)
+		if !ok {
+			return nil, NewError(ErrInvalidKey, "no column for key", k)
+		}
+		b, err := gocql.Marshal(col.typeInfo, key[i])
+		if err != nil {
+			return nil, ChainError(err, "marshal of key", k, "failed")
+		}
+		mmap[k] = &MarshaledValue{Bytes: b, TypeInfo: col.typeInfo}
+	}
+	return mmap, nil
+}
+
 func (cf *CF) Scanner(query Query) CFQuery {
 	return CFQuery{cf, query, nil}
 }
@@ -496,11 +884,17 @@ func (q *CFQuery) ScanRow(dest interface{}) bool {
 		cols[i] = col.Name
 	}
 	mmap := make(MarshaledMap)
-	if ok := q.query.Scan(mmap.PointersTo(cols...)...); !ok {
-		q.err = q.query.Close()
-		return false
+	for {
+		if ok := q.query.Scan(mmap.PointersTo(cols...)...); !ok {
+			q.err = q.query.Close()
+			return false
+		}
+		if !q.cf.filtersDeleted() || !q.cf.isDeleted(mmap) {
+			break
+		}
+		mmap = make(MarshaledMap)
 	}
-	q.err = q.cf.unmarshal(dest, mmap)
+	q.err = q.cf.load(dest, mmap)
 	return q.err == nil
 }
 
@@ -522,11 +916,42 @@ func (q *CFQuery) Close() error {
 //  * float64    (marshals to double)
 //  * bool       (marshals to boolean)
 //  * time.Time  (marshals to timestamp)
+//  * ibis.Counter (marshals to counter; see Counter)
+//  * structs tagged `ibis:"udt"` (marshal to a frozen user-defined type; see UDT)
 //
-// You can designate the primary key (or other features) with struct field tags. For example, a
-// column field with the tag `ibis:"key"` will become part of the primary key. The order of key
-// fields in the struct definition matters. Other features that apply at reflection may be available
-// under ibis.* tag names.
+// Struct field tags designate the primary key and other features. A field tagged `ibis:"key"` is
+// part of the primary key, in the order the key fields are declared. The first key field is the
+// partition key, unless fields are tagged `ibis:"key=partition"` to form a composite partition key.
+// The remaining key fields, or those tagged `ibis:"key=cluster"`, are clustering columns.
+//
+// A clustering column tagged `ibis:"key,desc"` is sorted in descending order.
+//
+//        type Message struct {
+//            Thread string    `ibis:"key"`
+//            Posted time.Time `ibis:"key,desc"`
+//        }
+//
+// A column tagged `ibis:"index"` is given a secondary index (see AddIndex), and one tagged
+// `ibis:"static"` is shared by all rows of a partition (see StaticColumns).
+//
+// A column tagged `ibis:"unique"` may hold no value held by another row (see AddUnique), and one
+// tagged `ibis:"lookup=name"` is mapped back to the keys of the rows holding each of its values in
+// the named lookup column family (see AddLookup).
+//
+// Deletes of rows with a time.Time column tagged `ibis:"deleted_at"` only set that column (see
+// SetSoftDelete).
+//
+// Columns tagged `ibis:"required"`, `ibis:"min=n"`, or `ibis:"max=n"` are constrained (see
+// AddConstraint).
+//
+// Columns tagged `ibis:"created_at"` or `ibis:"updated_at"` are populated with the time of commit
+// (see AddDefault).
+//
+// A column tagged `ibis:"ref=name"` holds keys of rows in the named column family, which LoadRefs
+// loads into a field tagged `ibis:"attach=column"` (see AddReference).
+//
+// Table options may be declared by embedding Options. Other features that apply at reflection may
+// be available under ibis.* tag names.
 //
 // The returned CF will support row operations on pointers to values of the same type as
 // the given template, without requiring an implementation of the Row interface.
@@ -549,10 +974,26 @@ func (cf *CF) fillFromRowType(row_type reflect.Type) error {
 	pluginType := reflect.TypeOf((*MarshalPlugin)(nil)).Elem()
 	for i := 0; i < row_type.NumField(); i++ {
 		field := row_type.Field(i)
-		if col, ok := columnFromStructField(field); ok {
+		if field.Type == optionsType {
+			if err := cf.options.parseTag(field.Tag.Get("ibis")); err != nil {
+				return ChainError(err, "invalid options tag")
+			}
+		} else if hasDirective(field.Tag.Get("ibis"), "udt") {
+			udt, types, err := reflectUDT(field.Type, cf.types)
+			if err != nil {
+				return ChainError(err, "invalid udt field "+field.Name)
+			}
+			cf.types = types
+			cf.columns = append(cf.columns, udt.column(field.Name, field.Tag))
+		} else if col, ok := columnFromStructField(field); ok {
 			cf.columns = append(cf.columns, col)
 		} else if field.Type.Kind() == reflect.Struct {
 			cf.fillFromRowType(field.Type)
+		} else if column := attachDirective(field.Tag.Get("ibis")); column != "" {
+			if field.Type.Kind() != reflect.Ptr {
+				return NewError(ErrInvalidRowType, "attached field", field.Name, "must be a pointer")
+			}
+			cf.rowReflector.attach(column, field.Name)
 		} else if field.Type.ConvertibleTo(pluginType) {
 			cf.rowReflector.addMarshalPlugin(field)
 		}
@@ -563,7 +1004,7 @@ func (cf *CF) fillFromRowType(row_type reflect.Type) error {
 func columnFromStructField(field reflect.StructField) (Column, bool) {
 	ts, ok := goTypeToCassType(field.Type)
 	if ok {
-		return Column{field.Name, ts, typeInfoMap[ts], field.Tag}, true
+		return Column{Name: field.Name, Type: ts, typeInfo: typeInfoMap[ts], tag: field.Tag}, true
 	}
 	return Column{}, ok
 }
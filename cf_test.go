@@ -1,5 +1,7 @@
 package ibis
 
+import "context"
+import "errors"
 import "fmt"
 import "reflect"
 import "testing"
@@ -99,6 +101,30 @@ func TestCrud(t *testing.T) {
 		So(cf.CommitCAS(&crud), shouldBeError, ErrAlreadyExists)
 	})
 
+	Convey("A failed CommitCAS should carry the existing row", t, func() {
+		crud := crudRow{Partition: "P1", Cluster: 0, Value: "other"}
+		err := cf.CommitCAS(&crud)
+		So(err, shouldBeError, ErrAlreadyExists)
+		conflict := CASConflictOf(err)
+		So(conflict, ShouldNotBeNil)
+		var existing crudRow
+		So(conflict.Decode(&existing), ShouldBeNil)
+		So(existing, ShouldResemble, crudRow{Partition: "P1", Cluster: 0, Value: "P1-0"})
+		So(CASConflictOf(ErrNotFound.New()), ShouldBeNil)
+		So(CASConflictOf(nil), ShouldBeNil)
+	})
+
+	Convey("CommitCASInto should load the existing row on conflict", t, func() {
+		crud := crudRow{Partition: "P1", Cluster: 0, Value: "other"}
+		So(cf.CommitCASInto(&crud, &crud), shouldBeError, ErrAlreadyExists)
+		So(crud.Value, ShouldEqual, "P1-0")
+
+		fresh := crudRow{Partition: "P3", Cluster: 0, Value: "P3-0"}
+		var existing crudRow
+		So(cf.CommitCASInto(&fresh, &existing), ShouldBeNil)
+		So(existing, ShouldResemble, crudRow{})
+	})
+
 	Convey("LoadByKey should retrieve (\"P1\", 0)", t, func() {
 		var crud crudRow
 		So(cf.LoadByKey(&crud, "P1", 0), ShouldBeNil)
@@ -323,3 +349,1267 @@ func TestCFQuery(t *testing.T) {
 		So(cfq.Close(), ShouldBeNil)
 	})
 }
+
+func TestTableOptions(t *testing.T) {
+	type event struct {
+		Options `ibis:"compaction=TimeWindowCompactionStrategy,compaction.compaction_window_unit=DAYS,default_ttl=24h"`
+		Stream  string   `ibis:"key"`
+		ID      TimeUUID `ibis:"key,desc"`
+		Body    []byte
+	}
+
+	Convey("Options declared by tag should be rendered in create statement", t, func() {
+		cf, err := ReflectCF(event{})
+		So(err, ShouldBeNil)
+		cf.name = "events"
+		NewSchema().AddCF(cf)
+		So(cf.CreateStatement().String(), ShouldEqual,
+			"CREATE TABLE events (Stream varchar, ID timeuuid, Body blob, PRIMARY KEY (Stream, ID))"+
+				" WITH CLUSTERING ORDER BY (ID DESC)"+
+				" AND compaction = {'class': 'TimeWindowCompactionStrategy',"+
+				" 'compaction_window_unit': 'DAYS'}"+
+				" AND default_time_to_live = 86400 AND comment='1'")
+	})
+
+	Convey("Options set by method should be rendered in create statement", t, func() {
+		cf := NewCF("test",
+			Column{Name: "A", Type: "varchar"},
+			Column{Name: "B", Type: "bigint"},
+			Column{Name: "C", Type: "bigint"}).
+			SetPrimaryKey("A", "B", "C").
+			SetClusteringOrder("C desc").
+			SetCompression("LZ4Compressor", nil).
+			SetCaching("ALL", "NONE").
+			SetGCGrace(time.Hour)
+		So(cf.CreateStatement().String(), ShouldEqual,
+			"CREATE TABLE test (A varchar, B bigint, C bigint, PRIMARY KEY (A, B, C))"+
+				" WITH CLUSTERING ORDER BY (B ASC, C DESC)"+
+				" AND compression = {'sstable_compression': 'LZ4Compressor'}"+
+				" AND caching = {'keys': 'ALL', 'rows_per_partition': 'NONE'}"+
+				" AND gc_grace_seconds = 3600")
+	})
+
+	Convey("Invalid options tag should fail reflection", t, func() {
+		type bad struct {
+			Options `ibis:"compaction"`
+			ID      string `ibis:"key"`
+		}
+		_, err := ReflectCF(bad{})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCompositePartitionKey(t *testing.T) {
+	var err error
+	type message struct {
+		Stream string `ibis:"key=partition"`
+		Day    int64  `ibis:"key=partition"`
+		Seq    int64  `ibis:"key=cluster"`
+		Body   string
+	}
+	model := &struct{ Messages *CF }{}
+	model.Messages, err = ReflectCF(message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Messages
+
+	Convey("Composite partition key should be rendered in create statement", t, func() {
+		So(cf.PartitionKey(), ShouldResemble, []string{"Stream", "Day"})
+		So(cf.PrimaryKey(), ShouldResemble, []string{"Stream", "Day", "Seq"})
+		So(cf.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE messages (Stream varchar, Day bigint, Seq bigint, Body varchar,"+
+				" PRIMARY KEY ((Stream, Day), Seq))")
+
+		cf := NewCF("t",
+			Column{Name: "A", Type: "varchar"},
+			Column{Name: "B", Type: "varchar"},
+			Column{Name: "C", Type: "varchar"}).
+			SetCompositeKey([]string{"C", "A"})
+		So(cf.CreateStatement().String(), ShouldEqual,
+			"CREATE TABLE t (C varchar, A varchar, B varchar, PRIMARY KEY ((C, A)))")
+	})
+
+	Convey("Live schema should recognize composite partition key", t, func() {
+		live, err := GetLiveSchema(schema.Cluster)
+		So(err, ShouldBeNil)
+		So(live.CFs["messages"].PartitionKey(), ShouldResemble, []string{"stream", "day"})
+		So(live.CFs["messages"].clusteringColumns(), ShouldResemble, []string{"seq"})
+	})
+
+	Convey("LoadByKey should honor composite partition key", t, func() {
+		So(cf.Commit(&message{"s", 1, 1, "s-1-1"}), ShouldBeNil)
+		So(cf.Commit(&message{"s", 2, 1, "s-2-1"}), ShouldBeNil)
+		var m message
+		So(cf.LoadByKey(&m, "s", 2, 1), ShouldBeNil)
+		So(m.Body, ShouldEqual, "s-2-1")
+		So(cf.LoadByKey(&m, "s", 3, 1), shouldBeError, ErrNotFound)
+	})
+
+	Convey("Queries must restrict the entire partition key", t, func() {
+		q := Select().From(cf).Where("Stream = ?", "s").Query()
+		So(q.Scan(), ShouldBeFalse)
+		So(q.Close(), ShouldNotBeNil)
+	})
+}
+
+func TestIndexesAndViews(t *testing.T) {
+	var err error
+	type post struct {
+		ID     string `ibis:"key"`
+		Author string `ibis:"index"`
+		Topic  string
+		Body   string
+	}
+	model := &struct{ Posts *CF }{}
+	model.Posts, err = ReflectCF(post{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Posts.AddView("posts_by_topic", []string{"Topic"})
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Posts
+
+	Convey("Index tag and views should be declared", t, func() {
+		So(cf.Indexes(), ShouldResemble, []Index{Index{Name: "posts_author_idx", Column: "Author"}})
+		So(cf.Views(), ShouldResemble, []MaterializedView{
+			MaterializedView{
+				Name:         "posts_by_topic",
+				PartitionKey: []string{"Topic"},
+				Clustering:   []string{"ID"},
+			},
+		})
+		So(cf.View("nonexistent"), ShouldBeNil)
+	})
+
+	for _, p := range []post{{"1", "alice", "go", "one"}, {"2", "bob", "go", "two"},
+		{"3", "alice", "cql", "three"}} {
+		if err := cf.Commit(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Convey("Where on an indexed column should work", t, func() {
+		q := cf.Scanner(Select().From(cf).Where("Author = ?", "alice").Query())
+		bodies := make([]string, 0)
+		var p post
+		for q.ScanRow(&p) {
+			bodies = append(bodies, p.Body)
+		}
+		So(q.Close(), ShouldBeNil)
+		So(bodies, ShouldResemble, []string{"one", "three"})
+	})
+
+	Convey("Where on a non-indexed column should require filtering", t, func() {
+		q := Select().From(cf).Where("Body = ?", "two").Query()
+		So(q.Scan(), ShouldBeFalse)
+		So(q.Close(), ShouldNotBeNil)
+
+		var count int
+		q = Select("COUNT(*)").From(cf).Where("Body = ?", "two").AllowFiltering().Query()
+		So(q.Scan(&count), ShouldBeTrue)
+		So(q.Close(), ShouldBeNil)
+		So(count, ShouldEqual, 1)
+	})
+
+	Convey("Materialized views should be queryable", t, func() {
+		view := cf.View("posts_by_topic")
+		So(view.PrimaryKey(), ShouldResemble, []string{"Topic", "ID"})
+		q := view.Scanner(Select().From(view).Where("Topic = ?", "go").Query())
+		ids := make([]string, 0)
+		var p post
+		for q.ScanRow(&p) {
+			ids = append(ids, p.ID)
+		}
+		So(q.Close(), ShouldBeNil)
+		So(ids, ShouldResemble, []string{"1", "2"})
+
+		var p3 post
+		So(view.LoadByKey(&p3, "cql", "3"), ShouldBeNil)
+		So(p3.Body, ShouldEqual, "three")
+	})
+}
+
+func TestUDT(t *testing.T) {
+	var err error
+	type geo struct {
+		Lat, Lng float64
+	}
+	type address struct {
+		Street   string
+		City     string
+		Location geo `ibis:"udt"`
+	}
+	type user struct {
+		Name string  `ibis:"key"`
+		Home address `ibis:"udt"`
+		Work address `ibis:"udt"`
+	}
+	model := &struct{ Users *CF }{}
+	model.Users, err = ReflectCF(user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Users
+
+	Convey("UDT fields should be reflected into types and frozen columns", t, func() {
+		So(cf.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE users (Name varchar, Home frozen<address>, Work frozen<address>,")
+		So(len(schema.Types), ShouldEqual, 2)
+		So(schema.Types["geo"].CreateStatement().String(), ShouldEqual,
+			"CREATE TYPE geo (Lat double, Lng double)")
+		So(schema.Types["address"].CreateStatement().String(), ShouldEqual,
+			"CREATE TYPE address (Street varchar, City varchar, Location frozen<geo>)")
+		So(cf.UDTs(), ShouldResemble, []*UDT{schema.Types["geo"], schema.Types["address"]})
+	})
+
+	Convey("UDT values should round trip", t, func() {
+		u := user{
+			Name: "logan",
+			Home: address{"1 Main St", "Springfield", geo{1.5, -2.5}},
+		}
+		So(cf.Commit(&u), ShouldBeNil)
+		var loaded user
+		So(cf.LoadByKey(&loaded, "logan"), ShouldBeNil)
+		So(loaded, ShouldResemble, u)
+	})
+
+	Convey("Live schema should include types", t, func() {
+		live, err := GetLiveSchema(schema.Cluster)
+		So(err, ShouldBeNil)
+		So(live.CFs["users"].columns[1].Type, ShouldEqual, "frozen<address>")
+		So(live.Types["address"].Fields, ShouldResemble, []Column{
+			Column{Name: "street", Type: "varchar"},
+			Column{Name: "city", Type: "varchar"},
+			Column{Name: "location", Type: "frozen<geo>"},
+		})
+
+		diff, err := DiffLiveSchema(schema.Cluster, schema)
+		So(err, ShouldBeNil)
+		So(diff.Size(), ShouldEqual, 0)
+	})
+
+	Convey("Values written before fields were added should unmarshal", t, func() {
+		type oldAddress struct{ Street string }
+		udt, _, err := reflectUDT(reflect.TypeOf(oldAddress{}), nil)
+		So(err, ShouldBeNil)
+		marshaled, err := udt.marshal(reflect.ValueOf(oldAddress{"2 Elm St"}))
+		So(err, ShouldBeNil)
+		a := address{City: "stale"}
+		So(schema.Types["address"].unmarshal(marshaled, reflect.ValueOf(&a).Elem()), ShouldBeNil)
+		So(a, ShouldResemble, address{Street: "2 Elm St"})
+	})
+
+	Convey("Conflicting definitions of a type should be rejected", t, func() {
+		type address struct{ Zip string }
+		_, _, err := reflectUDT(reflect.TypeOf(address{}), cf.UDTs())
+		So(err, shouldBeError, ErrConflictingType)
+
+		type customer struct {
+			Name string  `ibis:"key"`
+			Home address `ibis:"udt"`
+		}
+		conflicting := &struct{ Users, Customers *CF }{}
+		conflicting.Users, err = ReflectCF(user{})
+		So(err, ShouldBeNil)
+		conflicting.Customers, err = ReflectCF(customer{})
+		So(err, ShouldBeNil)
+		_, err = ReflectSchema(conflicting)
+		So(err, shouldBeError, ErrConflictingType)
+	})
+}
+
+func TestCounters(t *testing.T) {
+	var err error
+	type pageViews struct {
+		Page  string `ibis:"key"`
+		Views Counter
+	}
+	model := &struct{ PageViews *CF }{}
+	model.PageViews, err = ReflectCF(pageViews{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.PageViews
+
+	Convey("Counter fields should be reflected as counter columns", t, func() {
+		So(cf.IsCounterTable(), ShouldBeTrue)
+		So(cf.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE pageviews (Page varchar, Views counter, PRIMARY KEY (Page))")
+	})
+
+	Convey("Increment should add to counters", t, func() {
+		So(cf.Increment(3, "/"), ShouldBeNil)
+		So(cf.Increment(-1, "/"), ShouldBeNil)
+		var pv pageViews
+		So(cf.LoadByKey(&pv, "/"), ShouldBeNil)
+		So(pv.Views, ShouldEqual, 2)
+		So(cf.Increment(1), shouldBeError, ErrInvalidKey)
+	})
+
+	Convey("Increments should be batched together", t, func() {
+		a, err := cf.MakeIncrement(5, "/a")
+		So(err, ShouldBeNil)
+		b, err := cf.MakeIncrement(7, "/b")
+		So(err, ShouldBeNil)
+		So(schema.Cluster.Query(a, b).Exec(), ShouldBeNil)
+		var pv pageViews
+		So(cf.LoadByKey(&pv, "/b"), ShouldBeNil)
+		So(pv.Views, ShouldEqual, 7)
+
+		c := Update(cf).Set("Page", "/c").Where("Page = ?", "/c").CQL()
+		So(schema.Cluster.Query(a, c).Exec(), ShouldNotBeNil)
+	})
+
+	Convey("Counter rows can't be committed or set", t, func() {
+		So(cf.Commit(&pageViews{"/", 1}), shouldBeError, ErrInvalidCounterTable)
+		So(cf.CommitCAS(&pageViews{"/", 1}), shouldBeError, ErrInvalidCounterTable)
+		So(Update(cf).Set("Views", Counter(1)).Where("Page = ?", "/").Query().Exec(),
+			ShouldNotBeNil)
+	})
+
+	Convey("Counter tables may only have counters outside the key", t, func() {
+		mixed := NewCF("mixed",
+			Column{Name: "K", Type: "varchar"},
+			Column{Name: "C", Type: "counter"},
+			Column{Name: "V", Type: "varchar"}).SetPrimaryKey("K")
+		So(mixed.validateCounters(), shouldBeError, ErrInvalidCounterTable)
+		keyed := NewCF("keyed", Column{Name: "C", Type: "counter"}).SetPrimaryKey("C")
+		So(keyed.validateCounters(), shouldBeError, ErrInvalidCounterTable)
+
+		var b CQLBuilder
+		cql := b.Append("CREATE TABLE mixed (k varchar, c counter, v varchar, PRIMARY KEY (k))").CQL()
+		cql.Cluster(schema.Cluster)
+		So(cql.Query().Exec(), ShouldNotBeNil)
+	})
+
+	Convey("Live schema should recognize counter columns", t, func() {
+		live, err := GetLiveSchema(schema.Cluster)
+		So(err, ShouldBeNil)
+		So(live.CFs["pageviews"].IsCounterTable(), ShouldBeTrue)
+	})
+}
+
+func TestStaticColumns(t *testing.T) {
+	var err error
+	type message struct {
+		Thread string   `ibis:"key"`
+		ID     TimeUUID `ibis:"key"`
+		Title  string   `ibis:"static"`
+		Body   string
+	}
+	model := &struct{ Messages *CF }{}
+	model.Messages, err = ReflectCF(message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Messages
+	now := time.Now()
+	scanThread := func(thread string) []message {
+		q := cf.Scanner(Select().From(cf).Where("Thread = ?", thread).Query())
+		rows := make([]message, 0)
+		var m message
+		for q.ScanRow(&m) {
+			rows = append(rows, m)
+		}
+		So(q.Close(), ShouldBeNil)
+		return rows
+	}
+
+	Convey("Static fields should be reflected as static columns", t, func() {
+		So(cf.StaticColumns(), ShouldResemble, []string{"Title"})
+		So(cf.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE messages (Thread varchar, ID timeuuid, Title varchar static, Body varchar,"+
+				" PRIMARY KEY (Thread, ID))")
+	})
+
+	Convey("Static values should be shared by a partition", t, func() {
+		first := message{Thread: "a", ID: UUIDFromTime(now), Title: "hello", Body: "first"}
+		So(cf.Commit(&first), ShouldBeNil)
+		second := message{Thread: "a", ID: UUIDFromTime(now.Add(time.Second)), Title: "goodbye", Body: "second"}
+		So(cf.Commit(&second), ShouldBeNil)
+		var m message
+		So(cf.LoadByKey(&m, "a", first.ID), ShouldBeNil)
+		So(m.Title, ShouldEqual, "goodbye")
+		So(m.Body, ShouldEqual, "first")
+	})
+
+	Convey("Commit with only a partition key should update only static columns", t, func() {
+		So(cf.Commit(&message{Thread: "a", Title: "renamed"}), ShouldBeNil)
+		rows := scanThread("a")
+		So(len(rows), ShouldEqual, 2)
+		for _, m := range rows {
+			So(m.Title, ShouldEqual, "renamed")
+			So(m.Body, ShouldNotEqual, "")
+		}
+
+		So(cf.Commit(&message{Thread: "b", Title: "empty"}), ShouldBeNil)
+		So(scanThread("b")[0].Title, ShouldEqual, "empty")
+		So(cf.Commit(&message{Thread: "b", ID: UUIDFromTime(now), Body: "only"}), ShouldBeNil)
+		rows = scanThread("b")
+		So(len(rows), ShouldEqual, 1)
+		So(rows[0].Title, ShouldEqual, "")
+		So(rows[0].Body, ShouldEqual, "only")
+	})
+
+	Convey("Rows with regular values should be given TimeUUID keys", t, func() {
+		m := &message{Thread: "c", Title: "new", Body: "first"}
+		So(cf.Commit(m), ShouldBeNil)
+		So(m.ID.IsSet(), ShouldBeTrue)
+		rows := scanThread("c")
+		So(len(rows), ShouldEqual, 1)
+		So(rows[0].ID, ShouldEqual, m.ID)
+		So(rows[0].Body, ShouldEqual, "first")
+
+		static := &message{Thread: "c", Title: "renamed"}
+		So(cf.Commit(static), ShouldBeNil)
+		So(static.ID.IsSet(), ShouldBeFalse)
+		So(len(scanThread("c")), ShouldEqual, 1)
+	})
+
+	Convey("Regular columns shouldn't be committed without clustering columns", t, func() {
+		mmap, err := cf.marshal(&message{Thread: "a", ID: UUIDFromTime(now)})
+		So(err, ShouldBeNil)
+		delete(mmap, "ID")
+		So(cf.checkStaticCommit(mmap), ShouldBeNil)
+		mmap["Body"].Bytes = []byte("lost")
+		So(cf.checkStaticCommit(mmap), shouldBeError, ErrInvalidKey)
+	})
+
+	Convey("Empty strings should be given clustering values", t, func() {
+		labeled := NewCF("labeled",
+			Column{Name: "K", Type: "varchar"},
+			Column{Name: "Label", Type: "varchar"},
+			Column{Name: "S", Type: "varchar", Static: true}).SetPrimaryKey("K", "Label")
+		mmap := MarshaledMap{
+			"K":     &MarshaledValue{Bytes: []byte("k"), TypeInfo: TIVarchar},
+			"Label": &MarshaledValue{Bytes: []byte{}, TypeInfo: TIVarchar},
+		}
+		So(labeled.isStaticCommit(mmap), ShouldBeFalse)
+		mmap["Label"].Bytes = nil
+		So(labeled.isStaticCommit(mmap), ShouldBeTrue)
+	})
+
+	Convey("Static columns must be outside the key of a clustered table", t, func() {
+		unclustered := NewCF("unclustered",
+			Column{Name: "K", Type: "varchar"},
+			Column{Name: "S", Type: "varchar", Static: true}).SetPrimaryKey("K")
+		So(unclustered.validateStatics(), shouldBeError, ErrInvalidStaticColumn)
+		keyed := NewCF("keyed",
+			Column{Name: "K", Type: "varchar"},
+			Column{Name: "C", Type: "varchar", Static: true}).SetPrimaryKey("K", "C")
+		So(keyed.validateStatics(), shouldBeError, ErrInvalidStaticColumn)
+
+		var b CQLBuilder
+		cql := b.Append("CREATE TABLE unclustered (k varchar, s varchar static, PRIMARY KEY (k))").CQL()
+		cql.Cluster(schema.Cluster)
+		So(cql.Query().Exec(), ShouldNotBeNil)
+	})
+
+	Convey("Live schema should recognize static columns", t, func() {
+		live, err := GetLiveSchema(schema.Cluster)
+		So(err, ShouldBeNil)
+		So(live.CFs["messages"].StaticColumns(), ShouldResemble, []string{"title"})
+		diff, err := DiffLiveSchema(schema.Cluster, schema)
+		So(err, ShouldBeNil)
+		So(diff.Size(), ShouldEqual, 0)
+	})
+}
+
+func TestUnique(t *testing.T) {
+	var err error
+	type user struct {
+		*AutoPatcher
+		Name  string `ibis:"key"`
+		Email string `ibis:"unique"`
+	}
+	model := &struct{ Users *CF }{}
+	model.Users, err = ReflectCF(user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Users
+
+	Convey("Unique columns should have lookup tables in the schema", t, func() {
+		So(cf.Uniques(), ShouldResemble, []string{"Email"})
+		lookup := schema.CFs["users_email_unique"]
+		So(lookup, ShouldNotBeNil)
+		So(lookup.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE users_email_unique (Email varchar, Name varchar, PRIMARY KEY (Email))")
+	})
+
+	Convey("Commit should claim unique values", t, func() {
+		So(cf.Commit(&user{Name: "alice", Email: "a@example.com"}), ShouldBeNil)
+		So(cf.Commit(&user{Name: "bob", Email: "a@example.com"}), shouldBeError, ErrNotUnique)
+		exists, err := cf.Exists("bob")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		So(cf.CommitCAS(&user{Name: "bob", Email: "a@example.com"}), shouldBeError, ErrNotUnique)
+
+		// recommitting the holder of a value is fine
+		So(cf.Commit(&user{Name: "alice", Email: "a@example.com"}), ShouldBeNil)
+		So(cf.Commit(&user{Name: "bob"}), ShouldBeNil)
+		So(cf.Commit(&user{Name: "carol"}), ShouldBeNil)
+	})
+
+	Convey("LoadByUnique should find the holder of a value", t, func() {
+		var u user
+		So(cf.LoadByUnique(&u, "Email", "a@example.com"), ShouldBeNil)
+		So(u.Name, ShouldEqual, "alice")
+		So(cf.LoadByUnique(&u, "Email", "b@example.com"), shouldBeError, ErrNotFound)
+		So(cf.LoadByUnique(&u, "Name", "alice"), shouldBeError, ErrInvalidKey)
+	})
+
+	Convey("Changing a unique value should release the old one", t, func() {
+		var u user
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		u.Email = "alice@example.com"
+		So(cf.Commit(&u), ShouldBeNil)
+		So(cf.LoadByUnique(&u, "Email", "a@example.com"), shouldBeError, ErrNotFound)
+		So(cf.LoadByUnique(&u, "Email", "alice@example.com"), ShouldBeNil)
+		So(cf.Commit(&user{Name: "bob", Email: "a@example.com"}), ShouldBeNil)
+	})
+
+	Convey("A failed commit should release its claims", t, func() {
+		So(cf.CommitCAS(&user{Name: "bob", Email: "b@example.com"}), shouldBeError,
+			ErrAlreadyExists)
+		So(cf.Commit(&user{Name: "carol", Email: "b@example.com"}), ShouldBeNil)
+	})
+
+	Convey("Rows shouldn't release values claimed by other rows", t, func() {
+		// dave and erin are written without claims, over values held by carol
+		for _, name := range []string{"dave", "erin"} {
+			cql, err := cf.MakeCommit(&user{Name: name, Email: "b@example.com"})
+			So(err, ShouldBeNil)
+			So(cql.Query().Exec(), ShouldBeNil)
+		}
+		So(cf.Delete("dave"), ShouldBeNil)
+		var u user
+		So(cf.LoadByKey(&u, "erin"), ShouldBeNil)
+		u.Email = "erin@example.com"
+		So(cf.Commit(&u), ShouldBeNil)
+		So(cf.LoadByUnique(&u, "Email", "b@example.com"), ShouldBeNil)
+		So(u.Name, ShouldEqual, "carol")
+		So(cf.Commit(&user{Name: "frank", Email: "b@example.com"}), shouldBeError, ErrNotUnique)
+	})
+}
+
+func TestLookups(t *testing.T) {
+	var err error
+	type post struct {
+		*AutoPatcher
+		ID     string `ibis:"key"`
+		Author string `ibis:"lookup=posts_by_author"`
+		Title  string
+	}
+	type comment struct {
+		Post   string `ibis:"key"`
+		Author string `ibis:"key,lookup=comments_by_author"`
+		Text   string
+	}
+	model := &struct{ Posts, Comments *CF }{}
+	model.Posts, err = ReflectCF(post{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Comments, err = ReflectCF(comment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Posts
+
+	titles := func(posts []*post) []string {
+		result := make([]string, len(posts))
+		for i, p := range posts {
+			result[i] = p.Title
+		}
+		return result
+	}
+
+	Convey("Lookup columns should have lookup tables in the schema", t, func() {
+		So(cf.Lookups(), ShouldResemble, []Lookup{{Name: "posts_by_author", Column: "Author"}})
+		lookup := schema.CFs["posts_by_author"]
+		So(lookup, ShouldNotBeNil)
+		So(lookup.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE posts_by_author (Author varchar, ID varchar, PRIMARY KEY (Author, ID))")
+	})
+
+	Convey("LoadBy should find rows through their lookup entries", t, func() {
+		So(cf.Commit(&post{ID: "1", Author: "alice", Title: "one"}), ShouldBeNil)
+		So(cf.Commit(&post{ID: "2", Author: "bob", Title: "two"}), ShouldBeNil)
+		So(cf.Commit(&post{ID: "3", Author: "alice", Title: "three"}), ShouldBeNil)
+		var posts []*post
+		So(cf.LoadBy(&posts, "Author", "alice"), ShouldBeNil)
+		So(titles(posts), ShouldResemble, []string{"one", "three"})
+
+		var values []post
+		So(cf.LoadBy(&values, "Author", "bob"), ShouldBeNil)
+		So(len(values), ShouldEqual, 1)
+		So(values[0].Title, ShouldEqual, "two")
+
+		So(cf.LoadBy(&posts, "Title", "one"), shouldBeError, ErrInvalidKey)
+		So(cf.LoadBy(posts, "Author", "alice"), shouldBeError, ErrInvalidRowType)
+	})
+
+	Convey("Changed values should move between lookup entries", t, func() {
+		var p post
+		So(cf.LoadByKey(&p, "3"), ShouldBeNil)
+		p.Author = "bob"
+		So(cf.Commit(&p), ShouldBeNil)
+		var posts []*post
+		So(cf.LoadBy(&posts, "Author", "alice"), ShouldBeNil)
+		So(titles(posts), ShouldResemble, []string{"one"})
+		posts = nil
+		So(cf.LoadBy(&posts, "Author", "bob"), ShouldBeNil)
+		So(titles(posts), ShouldResemble, []string{"two", "three"})
+	})
+
+	Convey("Delete should remove rows and their lookup entries", t, func() {
+		So(cf.Delete("2"), ShouldBeNil)
+		So(cf.Delete("2"), shouldBeError, ErrNotFound)
+		So(cf.Delete(), shouldBeError, ErrInvalidKey)
+		var p post
+		So(cf.LoadByKey(&p, "2"), shouldBeError, ErrNotFound)
+		var posts []*post
+		So(cf.LoadBy(&posts, "Author", "bob"), ShouldBeNil)
+		So(titles(posts), ShouldResemble, []string{"three"})
+	})
+
+	Convey("RebuildLookup should backfill and clean lookup entries", t, func() {
+		lookup := schema.CFs["posts_by_author"]
+		So(DeleteFrom(lookup).Where("Author = ?", "alice").Where("ID = ?", "1").Query().Exec(),
+			ShouldBeNil)
+		So(InsertInto(lookup).Keys("Author", "ID").Values("carol", "9").Query().Exec(), ShouldBeNil)
+		var posts []*post
+		So(cf.LoadBy(&posts, "Author", "alice"), ShouldBeNil)
+		So(len(posts), ShouldEqual, 0)
+
+		written, err := cf.RebuildLookup("Author")
+		So(err, ShouldBeNil)
+		So(written, ShouldEqual, 2)
+		So(cf.LoadBy(&posts, "Author", "alice"), ShouldBeNil)
+		So(titles(posts), ShouldResemble, []string{"one"})
+		var entries int
+		So(Select("count(*)").From(lookup).Where("Author = ?", "carol").Query().Scan(&entries),
+			ShouldBeTrue)
+		So(entries, ShouldEqual, 0)
+	})
+
+	Convey("Lookups of key columns should list each column once", t, func() {
+		lookup := schema.CFs["comments_by_author"]
+		So(lookup.CreateStatement().String(), ShouldStartWith,
+			"CREATE TABLE comments_by_author (Author varchar, Post varchar,"+
+				" PRIMARY KEY (Author, Post))")
+		comments := model.Comments
+		So(comments.Commit(&comment{Post: "1", Author: "alice", Text: "first"}), ShouldBeNil)
+		So(comments.Commit(&comment{Post: "2", Author: "alice", Text: "second"}), ShouldBeNil)
+		var loaded []comment
+		So(comments.LoadBy(&loaded, "Author", "alice"), ShouldBeNil)
+		So(len(loaded), ShouldEqual, 2)
+		So(comments.Delete("1", "alice"), ShouldBeNil)
+		written, err := comments.RebuildLookup("Author")
+		So(err, ShouldBeNil)
+		So(written, ShouldEqual, 1)
+		loaded = nil
+		So(comments.LoadBy(&loaded, "Author", "alice"), ShouldBeNil)
+		So(loaded, ShouldResemble, []comment{{Post: "2", Author: "alice", Text: "second"}})
+	})
+}
+
+func TestPostHooks(t *testing.T) {
+	var err error
+	type hookRow struct {
+		Name string `ibis:"key"`
+		Text string
+	}
+	model := &struct{ Rows *CF }{}
+	model.Rows, err = ReflectCF(hookRow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Rows
+
+	events := make([]string, 0)
+	record := func(kind string) PostHook {
+		return func(row interface{}, mmap MarshaledMap, cas bool) error {
+			events = append(events, fmt.Sprintf("%s %s %t", kind, row.(*hookRow).Text, cas))
+			return nil
+		}
+	}
+	failing := func(row interface{}, mmap MarshaledMap, cas bool) error {
+		return errors.New("hook failed")
+	}
+	cf.Postcommit(record("commit")).Postdelete(record("delete")).Postload(record("load"))
+
+	Convey("Every hook added should be kept", t, func() {
+		precommits := 0
+		precommit := func(row interface{}, mmap MarshaledMap) ([]CQL, error) {
+			precommits++
+			return nil, nil
+		}
+		other := NewCF("other").Precommit(precommit).Precommit(precommit)
+		_, err := other.applyPrecommitHooks(context.Background(), nil, nil)
+		So(err, ShouldBeNil)
+		So(precommits, ShouldEqual, 2)
+	})
+
+	Convey("Post hooks should see committed, deleted, and loaded rows", t, func() {
+		So(cf.Commit(&hookRow{"a", "one"}), ShouldBeNil)
+		So(cf.CommitCAS(&hookRow{"b", "two"}), ShouldBeNil)
+		So(cf.CommitCAS(&hookRow{"b", "three"}), shouldBeError, ErrAlreadyExists)
+		var row hookRow
+		So(cf.LoadByKey(&row, "a"), ShouldBeNil)
+		So(cf.Delete("b"), ShouldBeNil)
+		So(events, ShouldResemble, []string{
+			"commit one false", "commit two true", "load one false", "delete two false"})
+	})
+
+	Convey("Post hook errors should be surfaced without rolling back", t, func() {
+		events = events[:0]
+		cf.Postcommit(failing)
+		So(cf.Commit(&hookRow{"c", "four"}), ShouldNotBeNil)
+		So(events, ShouldResemble, []string{"commit four false"})
+		var row hookRow
+		So(cf.LoadByKey(&row, "c"), ShouldBeNil)
+		So(row.Text, ShouldEqual, "four")
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	var err error
+	type account struct {
+		ID        string    `ibis:"key"`
+		Owner     string    `ibis:"lookup=accounts_by_owner"`
+		Email     string    `ibis:"unique"`
+		DeletedAt time.Time `ibis:"deleted_at"`
+	}
+	model := &struct{ Accounts *CF }{}
+	model.Accounts, err = ReflectCF(account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Accounts
+
+	Convey("The soft delete column should be validated", t, func() {
+		So(cf.SoftDeleteColumn(), ShouldEqual, "DeletedAt")
+		keyed := NewCF("keyed", Column{Name: "K", Type: "timestamp"}).SetPrimaryKey("K").
+			SetSoftDelete("K")
+		So(keyed.validateSoftDelete(), shouldBeError, ErrInvalidSoftDelete)
+		untimed := NewCF("untimed", Column{Name: "K", Type: "varchar"},
+			Column{Name: "D", Type: "varchar"}).SetPrimaryKey("K").SetSoftDelete("D")
+		So(untimed.validateSoftDelete(), shouldBeError, ErrInvalidSoftDelete)
+	})
+
+	Convey("Soft-deleted rows should be hidden from loads and scans", t, func() {
+		So(cf.Commit(&account{ID: "a1", Owner: "alice", Email: "a1@example.com"}), ShouldBeNil)
+		So(cf.Commit(&account{ID: "a2", Owner: "alice", Email: "a2@example.com"}), ShouldBeNil)
+		So(cf.Delete("a1"), ShouldBeNil)
+		So(cf.Delete("a1"), shouldBeError, ErrNotFound)
+
+		var acct account
+		So(cf.LoadByKey(&acct, "a1"), shouldBeError, ErrNotFound)
+		exists, err := cf.Exists("a1")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		So(cf.LoadByUnique(&acct, "Email", "a1@example.com"), shouldBeError, ErrNotFound)
+		var accts []*account
+		So(cf.LoadBy(&accts, "Owner", "alice"), ShouldBeNil)
+		So(len(accts), ShouldEqual, 1)
+		So(accts[0].ID, ShouldEqual, "a2")
+
+		q := cf.Scanner(Select().From(cf).Query())
+		ids := make([]string, 0)
+		for q.ScanRow(&acct) {
+			ids = append(ids, acct.ID)
+		}
+		So(q.Close(), ShouldBeNil)
+		So(ids, ShouldResemble, []string{"a2"})
+
+		So(cf.IncludeDeleted().LoadByKey(&acct, "a1"), ShouldBeNil)
+		So(acct.DeletedAt.IsZero(), ShouldBeFalse)
+		exists, err = cf.IncludeDeleted().Exists("a1")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+
+	Convey("Restore should undelete a row", t, func() {
+		So(cf.Restore("a2"), shouldBeError, ErrNotFound)
+		So(cf.Restore("a1"), ShouldBeNil)
+		var acct account
+		So(cf.LoadByKey(&acct, "a1"), ShouldBeNil)
+		So(acct.DeletedAt.IsZero(), ShouldBeTrue)
+		So(cf.LoadByUnique(&acct, "Email", "a1@example.com"), ShouldBeNil)
+	})
+
+	Convey("Purge should remove rows deleted before the retention period", t, func() {
+		So(cf.Delete("a1"), ShouldBeNil)
+		n, err := cf.Purge(time.Hour)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		time.Sleep(2 * time.Millisecond)
+		n, err = cf.Purge(0)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		var acct account
+		So(cf.IncludeDeleted().LoadByKey(&acct, "a1"), shouldBeError, ErrNotFound)
+		So(cf.Commit(&account{ID: "a3", Email: "a1@example.com"}), ShouldBeNil)
+	})
+
+	Convey("Purge should remove expired rows a page at a time", t, func() {
+		defer func(n int) { purgePageSize = n }(purgePageSize)
+		purgePageSize = 2
+		for _, id := range []string{"b1", "b2", "b3", "b4", "b5"} {
+			So(cf.Commit(&account{ID: id}), ShouldBeNil)
+			So(cf.Delete(id), ShouldBeNil)
+		}
+		time.Sleep(2 * time.Millisecond)
+		n, err := cf.Purge(0)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 5)
+		exists, err := cf.IncludeDeleted().Exists("b5")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+
+	Convey("Restore and Purge should require a soft delete column", t, func() {
+		hard := NewCF("hard", Column{Name: "K", Type: "varchar"}).SetPrimaryKey("K")
+		other := NewSchema()
+		other.Cluster = schema.Cluster
+		other.AddCF(hard)
+		So(hard.Restore("k"), shouldBeError, ErrNoSoftDelete)
+		_, err := hard.Purge(0)
+		So(err, shouldBeError, ErrNoSoftDelete)
+	})
+}
+
+type validatedAccount struct {
+	ID        string `ibis:"key"`
+	Name      string `ibis:"required,max=8"`
+	Balance   int64  `ibis:"min=0"`
+	Overdraft bool
+}
+
+func (a *validatedAccount) Validate() error {
+	if a.Overdraft && a.Balance > 0 {
+		return Violations{{Field: "Overdraft", Message: "requires a negative balance"}}
+	}
+	return nil
+}
+
+func TestValidation(t *testing.T) {
+	var err error
+	model := &struct{ Accounts *CF }{}
+	model.Accounts, err = ReflectCF(validatedAccount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Accounts
+
+	Convey("Constraint tags should be reflected", t, func() {
+		So(cf.Constraints(), ShouldResemble, []Constraint{
+			{Column: "Name", Kind: "required"},
+			{Column: "Name", Kind: "max", Bound: 8},
+			{Column: "Balance", Kind: "min", Bound: 0},
+		})
+		var plugin defaultPlugin
+		So(plugin.ApplyTag("max=many", NewCF("bad"), Column{Name: "ID"}), ShouldNotBeNil)
+	})
+
+	Convey("Valid rows should be committed", t, func() {
+		So(cf.Commit(&validatedAccount{ID: "a1", Name: "alice", Balance: 10}), ShouldBeNil)
+	})
+
+	Convey("Violations should be reported per field before anything is written", t, func() {
+		err := cf.Commit(&validatedAccount{ID: "a2", Name: "bartholomew", Balance: -5})
+		So(err, shouldBeError, ErrValidationFailed)
+		So(ViolationsOf(err), ShouldResemble, Violations{
+			{Field: "Name", Message: "length must be at most 8"},
+			{Field: "Balance", Message: "value must be at least 0"},
+		})
+		exists, err := cf.Exists("a2")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		err = cf.CommitCAS(&validatedAccount{ID: "a3", Balance: 5, Overdraft: true})
+		So(err, shouldBeError, ErrValidationFailed)
+		So(ViolationsOf(err), ShouldResemble, Violations{
+			{Field: "Name", Message: "is required"},
+			{Field: "Overdraft", Message: "requires a negative balance"},
+		})
+		So(ViolationsOf(ErrNotFound.New()), ShouldBeNil)
+	})
+}
+
+func TestDefaults(t *testing.T) {
+	var err error
+	type event struct {
+		Stream    string   `ibis:"key"`
+		ID        TimeUUID `ibis:"key"`
+		Kind      string
+		CreatedAt time.Time `ibis:"created_at"`
+		UpdatedAt time.Time `ibis:"updated_at"`
+		DeletedAt time.Time `ibis:"deleted_at"`
+	}
+	model := &struct{ Events *CF }{}
+	model.Events, err = ReflectCF(event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	cf := model.Events
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := &FakeClock{Time: start}
+	schema.Provide(Clock(clock))
+	cf.AddDefault("Kind", func(now time.Time) (interface{}, error) {
+		return "created " + now.Format("2006-01-02"), nil
+	})
+
+	Convey("Empty fields should be populated from the clock", t, func() {
+		e := &event{Stream: "s"}
+		So(cf.Commit(e), ShouldBeNil)
+		So(gocql.UUID(e.ID).Time(), ShouldResemble, start)
+		So(e.Kind, ShouldEqual, "created 2015-06-01")
+		So(e.CreatedAt, ShouldResemble, start)
+		So(e.UpdatedAt, ShouldResemble, start)
+		So(e.DeletedAt.IsZero(), ShouldBeTrue)
+
+		var loaded event
+		So(cf.LoadByKey(&loaded, "s", e.ID), ShouldBeNil)
+		So(loaded.CreatedAt.Equal(start), ShouldBeTrue)
+	})
+
+	Convey("Later commits should only change updated_at", t, func() {
+		e := &event{Stream: "s"}
+		So(cf.Commit(e), ShouldBeNil)
+		clock.Advance(time.Hour)
+		e.Kind = "renamed"
+		So(cf.Commit(e), ShouldBeNil)
+		So(e.Kind, ShouldEqual, "renamed")
+		So(e.CreatedAt, ShouldResemble, start)
+		So(e.UpdatedAt, ShouldResemble, start.Add(time.Hour))
+	})
+
+	Convey("Soft deletes should use the clock", t, func() {
+		e := &event{Stream: "d"}
+		So(cf.Commit(e), ShouldBeNil)
+		So(cf.Delete("d", e.ID), ShouldBeNil)
+		var deleted event
+		So(cf.IncludeDeleted().LoadByKey(&deleted, "d", e.ID), ShouldBeNil)
+		So(deleted.DeletedAt.Equal(clock.Now()), ShouldBeTrue)
+		n, err := cf.Purge(time.Minute)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		clock.Advance(2 * time.Minute)
+		n, err = cf.Purge(time.Minute)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+	})
+}
+
+func TestCache(t *testing.T) {
+	var err error
+	type user struct {
+		Name  string `ibis:"key"`
+		Email string
+	}
+	model := &struct{ Users *CF }{}
+	model.Users, err = ReflectCF(user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	clock := &FakeClock{Time: time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)}
+	schema.Provide(Clock(clock))
+	cf := model.Users.SetCache(NewLRUCache(2), time.Minute, time.Second)
+
+	// write behind the cache's back
+	sneak := func(u *user) {
+		cql, err := cf.MakeCommit(u)
+		So(err, ShouldBeNil)
+		So(cql.Query().Exec(), ShouldBeNil)
+	}
+
+	Convey("Loads should be answered by the cache until it expires", t, func() {
+		So(cf.Commit(&user{"alice", "alice@example.com"}), ShouldBeNil)
+		var u user
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(cf.CacheStats(), ShouldResemble, CacheStats{Hits: 0, Misses: 1})
+		sneak(&user{"alice", "alice@example.org"})
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "alice@example.com")
+		So(cf.CacheStats(), ShouldResemble, CacheStats{Hits: 1, Misses: 1})
+		clock.Advance(time.Minute)
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "alice@example.org")
+		So(cf.CacheStats(), ShouldResemble, CacheStats{Hits: 1, Misses: 2})
+	})
+
+	Convey("Commits and deletes should invalidate cached rows", t, func() {
+		var u user
+		So(cf.Commit(&user{"alice", "alice@example.net"}), ShouldBeNil)
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "alice@example.net")
+		So(cf.Delete("alice"), ShouldBeNil)
+		So(cf.LoadByKey(&u, "alice"), shouldBeError, ErrNotFound)
+	})
+
+	Convey("Missing rows should be cached for the not-found TTL", t, func() {
+		var u user
+		So(cf.LoadByKey(&u, "bob"), shouldBeError, ErrNotFound)
+		sneak(&user{"bob", "bob@example.com"})
+		stats := cf.CacheStats()
+		So(cf.LoadByKey(&u, "bob"), shouldBeError, ErrNotFound)
+		So(cf.CacheStats().Hits, ShouldEqual, stats.Hits+1)
+		clock.Advance(time.Second)
+		So(cf.LoadByKey(&u, "bob"), ShouldBeNil)
+	})
+
+	Convey("A load racing a commit shouldn't store the row it read", t, func() {
+		mkey, err := cf.MarshalKey("carol")
+		So(err, ShouldBeNil)
+		ckey := cf.cacheKey(mkey)
+		gen := cf.cache.generation(ckey)
+		// the commit invalidates the row after the load has read it, but before it's stored
+		cf.invalidate(mkey)
+		cf.cache.setIfCurrent(ckey, gen, nil, clock.Now().Add(time.Minute))
+		_, ok := cf.cache.Get(ckey, clock.Now())
+		So(ok, ShouldBeFalse)
+
+		cf.cache.setIfCurrent(ckey, cf.cache.generation(ckey), nil, clock.Now().Add(time.Minute))
+		_, ok = cf.cache.Get(ckey, clock.Now())
+		So(ok, ShouldBeTrue)
+		cf.invalidate(mkey)
+	})
+
+	Convey("The LRU cache should evict the least recently used row", t, func() {
+		cache := NewLRUCache(2)
+		now := clock.Now()
+		cache.Set("a", MarshaledMap{}, now.Add(time.Minute))
+		cache.Set("b", MarshaledMap{}, now.Add(time.Minute))
+		_, ok := cache.Get("a", now)
+		So(ok, ShouldBeTrue)
+		cache.Set("c", MarshaledMap{}, now.Add(time.Minute))
+		_, ok = cache.Get("b", now)
+		So(ok, ShouldBeFalse)
+		_, ok = cache.Get("a", now)
+		So(ok, ShouldBeTrue)
+		cache.Delete("a")
+		_, ok = cache.Get("a", now)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+// countingCluster counts the queries made through it.
+type countingCluster struct {
+	Cluster
+	queries int
+}
+
+func (c *countingCluster) Query(stmts ...CQL) Query {
+	c.queries++
+	return c.Cluster.Query(stmts...)
+}
+
+func TestSession(t *testing.T) {
+	var err error
+	type user struct {
+		Name      string `ibis:"key"`
+		Email     string `ibis:"unique"`
+		Visits    int64
+		UpdatedAt time.Time `ibis:"updated_at"`
+	}
+	type pageViews struct {
+		Page  string `ibis:"key"`
+		Views Counter
+	}
+	model := &struct{ Users, Views *CF }{}
+	model.Users, err = ReflectCF(user{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Views, err = ReflectCF(pageViews{}); err != nil {
+		t.Fatal(err)
+	}
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	if err := model.Views.Increment(1, "/"); err != nil {
+		t.Fatal(err)
+	}
+	clock := &FakeClock{Time: time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)}
+	schema.Provide(Clock(clock))
+	cf := model.Users
+	if err := cf.Commit(&user{Name: "alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingCluster{Cluster: schema.Cluster}
+	schema.Cluster = counter
+
+	Convey("Loads should return the same row from the identity map", t, func() {
+		sess := schema.NewSession()
+		var a, b *user
+		So(sess.Load(cf, &a, "alice"), ShouldBeNil)
+		queries := counter.queries
+		So(sess.Load(cf, &b, "alice"), ShouldBeNil)
+		So(b, ShouldPointTo, a)
+		So(counter.queries, ShouldEqual, queries)
+		var u user
+		So(sess.Load(cf, &u, "alice"), shouldBeError, ErrInvalidRowType)
+		So(sess.Load(cf, &a, "nobody"), shouldBeError, ErrNotFound)
+	})
+
+	Convey("Flush should commit changed and added rows in one batch", t, func() {
+		sess := schema.NewSession()
+		var alice *user
+		So(sess.Load(cf, &alice, "alice"), ShouldBeNil)
+		alice.Visits++
+		sess.Add(cf, &user{Name: "bob", Email: "bob@example.com"})
+		clock.Advance(time.Minute)
+		queries := counter.queries
+		So(sess.Flush(), ShouldBeNil)
+		// one query for the batch, plus one for claiming bob's email
+		So(counter.queries, ShouldEqual, queries+2)
+
+		var u user
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Visits, ShouldEqual, 1)
+		So(u.UpdatedAt, ShouldHappenOnOrAfter, clock.Now())
+		So(cf.LoadByKey(&u, "bob"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "bob@example.com")
+
+		var bob *user
+		So(sess.Load(cf, &bob, "bob"), ShouldBeNil)
+		So(bob.Email, ShouldEqual, "bob@example.com")
+	})
+
+	Convey("Flush should skip rows that haven't changed", t, func() {
+		sess := schema.NewSession()
+		var alice *user
+		So(sess.Load(cf, &alice, "alice"), ShouldBeNil)
+		updated := alice.UpdatedAt
+		clock.Advance(time.Minute)
+		queries := counter.queries
+		So(sess.Flush(), ShouldBeNil)
+		So(counter.queries, ShouldEqual, queries)
+		So(alice.UpdatedAt, ShouldEqual, updated)
+	})
+
+	Convey("Flush should skip unchanged counter rows, and refuse changed ones", t, func() {
+		sess := schema.NewSession()
+		var views *pageViews
+		So(sess.Load(model.Views, &views, "/"), ShouldBeNil)
+		So(views.Views, ShouldEqual, 1)
+		So(sess.Flush(), ShouldBeNil)
+		views.Views++
+		So(sess.Flush(), shouldBeError, ErrInvalidCounterTable)
+	})
+
+	Convey("Flush should write nothing if a unique claim fails", t, func() {
+		sess := schema.NewSession()
+		var alice *user
+		So(sess.Load(cf, &alice, "alice"), ShouldBeNil)
+		alice.Visits = 10
+		sess.Add(cf, &user{Name: "carol", Email: "bob@example.com"})
+		So(sess.Flush(), shouldBeError, ErrNotUnique)
+		var u user
+		So(cf.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Visits, ShouldEqual, 1)
+		So(cf.LoadByKey(&u, "carol"), shouldBeError, ErrNotFound)
+	})
+}
+
+func TestReferences(t *testing.T) {
+	var err error
+	type user struct {
+		Name  string `ibis:"key"`
+		Email string
+	}
+	type post struct {
+		ID         TimeUUID `ibis:"key"`
+		AuthorName string   `ibis:"ref=users"`
+		Author     *user    `ibis:"attach=AuthorName"`
+	}
+	type draft struct {
+		ID     TimeUUID `ibis:"key"`
+		Editor *user    `ibis:"attach=EditorName"`
+	}
+	model := &struct {
+		Users  *CF
+		Posts  *CF
+		Drafts *CF
+	}{}
+	if model.Users, err = ReflectCF(user{}); err != nil {
+		t.Fatal(err)
+	}
+	if model.Posts, err = ReflectCF(post{}); err != nil {
+		t.Fatal(err)
+	}
+	if model.Drafts, err = ReflectCF(draft{}); err != nil {
+		t.Fatal(err)
+	}
+	// a reference to a column the row type has no field for
+	model.Drafts.AddReference("EditorName", "users")
+	schema := ReflectTestSchema(t, model)
+	defer schema.Cluster.Close()
+	for _, u := range []*user{{"alice", "alice@example.com"}, {"bob", "bob@example.com"}} {
+		if err := model.Users.Commit(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model.Users.SetCache(NewLRUCache(10), time.Minute, time.Minute)
+
+	Convey("References should be reflected", t, func() {
+		So(model.Posts.References(), ShouldResemble, []Reference{{Column: "AuthorName", CF: "users"}})
+	})
+
+	Convey("LoadRefs should load each referenced row once and attach it", t, func() {
+		posts := []*post{
+			{AuthorName: "alice"},
+			{AuthorName: "bob"},
+			{AuthorName: "alice"},
+			{AuthorName: "carol"},
+			{},
+		}
+		stats := model.Users.CacheStats()
+		So(model.Posts.LoadRefs(posts), ShouldBeNil)
+		So(model.Users.CacheStats().Misses, ShouldEqual, stats.Misses+3)
+		So(posts[0].Author, ShouldResemble, &user{"alice", "alice@example.com"})
+		So(posts[1].Author.Email, ShouldEqual, "bob@example.com")
+		So(posts[2].Author, ShouldPointTo, posts[0].Author)
+		So(posts[3].Author, ShouldBeNil)
+		So(posts[4].Author, ShouldBeNil)
+
+		values := []post{{AuthorName: "bob"}}
+		So(model.Posts.LoadRefs(values, "AuthorName"), ShouldBeNil)
+		So(values[0].Author.Name, ShouldEqual, "bob")
+	})
+
+	Convey("LoadRefs should reject columns that aren't references", t, func() {
+		So(model.Posts.LoadRefs([]*post{}, "ID"), shouldBeError, ErrInvalidReference)
+		So(model.Posts.LoadRefs([]*user{{}}), shouldBeError, ErrInvalidRowType)
+	})
+
+	Convey("LoadRefs should reject references to columns without a field", t, func() {
+		So(model.Drafts.LoadRefs([]*draft{{}}, "EditorName"), shouldBeError, ErrInvalidReference)
+	})
+}
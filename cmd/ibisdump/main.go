@@ -0,0 +1,220 @@
+// Command ibisdump exports a column family to JSON Lines or CSV, or imports one from such a file. It
+// also snapshots a whole keyspace into a directory, restores such a snapshot into an empty keyspace,
+// and rebuilds the lookup column family of a column (see ibis.CF.RebuildLookup).
+//
+//        ibisdump -cluster 10.0.0.1:9042 -keyspace app -cf users -ranges 16 export > users.jsonl
+//        ibisdump -cluster 10.0.0.1:9042 -keyspace app -cf users -rate 500 \
+//            -checkpoint users.pos import < users.jsonl
+//        ibisdump -cluster 10.0.0.1:9042 -keyspace app -dir snap snapshot
+//        ibisdump -cluster 10.0.0.1:9042 -keyspace staging -dir snap restore
+//        ibisdump -cluster 10.0.0.1:9042 -keyspace app -cf posts -column author \
+//            -lookup posts_by_author rebuild-lookup
+//
+// Column families are taken from the live schema of the keyspace. An interrupted import given a
+// checkpoint file resumes from the position recorded in it when run again.
+package main
+
+import "flag"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+
+import "github.com/logan/ibis"
+
+var (
+	flagCluster     = flag.String("cluster", "", "cassandra nodes given as comma-separated host:port pairs")
+	flagKeyspace    = flag.String("keyspace", "", "keyspace of the column family")
+	flagConsistency = flag.String("consistency", "quorum", "consistency level")
+	flagCF          = flag.String("cf", "", "name of the column family")
+	flagFormat      = flag.String("format", "jsonl", "format of the file: jsonl or csv")
+	flagFile        = flag.String("file", "", "file to export to or import from; stdout or stdin if empty")
+	flagRanges      = flag.Int("ranges", 1, "export: number of token ranges to scan concurrently")
+	flagBatch       = flag.Int("batch", 100, "import: number of rows written per batch")
+	flagRate        = flag.Float64("rate", 0, "import: maximum rows written per second; 0 is unlimited")
+	flagResume      = flag.Int("resume", 0, "import: number of leading records to skip")
+	flagCheckpoint  = flag.String("checkpoint", "", "import: file recording the position to resume from")
+	flagDir         = flag.String("dir", "", "snapshot, restore: directory of the snapshot")
+	flagColumn      = flag.String("column", "", "rebuild-lookup: column of the lookup")
+	flagLookup      = flag.String("lookup", "", "rebuild-lookup: name of the lookup column family")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] export|import|snapshot|restore|rebuild-lookup\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *flagCluster == "" || *flagKeyspace == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command := flag.Arg(0)
+	if ((command == "export" || command == "import") && *flagCF == "") ||
+		((command == "snapshot" || command == "restore") && *flagDir == "") ||
+		(command == "rebuild-lookup" && (*flagCF == "" || *flagColumn == "" || *flagLookup == "")) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch command {
+	case "export":
+		err = export()
+	case "import":
+		err = load()
+	case "snapshot":
+		err = snapshot()
+	case "restore":
+		err = restore()
+	case "rebuild-lookup":
+		err = rebuildLookup()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func dial() (ibis.Cluster, error) {
+	return ibis.DialCassandra(ibis.CassandraConfig{
+		Node:        strings.Split(*flagCluster, ","),
+		Keyspace:    *flagKeyspace,
+		Consistency: *flagConsistency,
+	})
+}
+
+// liveSchema connects to the cluster and returns the live schema of the keyspace, bound to it.
+func liveSchema() (*ibis.Schema, error) {
+	cluster, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	live, err := ibis.GetLiveSchema(cluster)
+	if err != nil {
+		return nil, err
+	}
+	schema := ibis.NewSchema()
+	schema.Cluster = cluster
+	for name, udt := range live.Types {
+		schema.Types[name] = udt
+	}
+	for _, cf := range live.CFs {
+		schema.AddCF(cf)
+	}
+	return schema, nil
+}
+
+// bind returns the live column family named on the command line.
+func bind() (*ibis.CF, error) {
+	schema, err := liveSchema()
+	if err != nil {
+		return nil, err
+	}
+	cf, ok := schema.CFs[strings.ToLower(*flagCF)]
+	if !ok {
+		return nil, fmt.Errorf("no column family %s in keyspace %s", *flagCF, *flagKeyspace)
+	}
+	return cf, nil
+}
+
+func export() error {
+	format, err := ibis.ParseFormat(*flagFormat)
+	if err != nil {
+		return err
+	}
+	cf, err := bind()
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *flagFile != "" {
+		f, err := os.Create(*flagFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := cf.Export(w, ibis.ExportOptions{Format: format, Ranges: *flagRanges})
+	fmt.Fprintf(os.Stderr, "exported %d rows\n", n)
+	return err
+}
+
+func load() error {
+	format, err := ibis.ParseFormat(*flagFormat)
+	if err != nil {
+		return err
+	}
+	options := ibis.ImportOptions{
+		Format:    format,
+		BatchSize: *flagBatch,
+		Rate:      *flagRate,
+		Resume:    *flagResume,
+	}
+	if *flagCheckpoint != "" {
+		if options.Resume == 0 {
+			if saved, err := ioutil.ReadFile(*flagCheckpoint); err == nil {
+				if options.Resume, err = strconv.Atoi(strings.TrimSpace(string(saved))); err != nil {
+					return fmt.Errorf("invalid checkpoint file %s: %v", *flagCheckpoint, err)
+				}
+			}
+		}
+		options.Checkpoint = func(position int) error {
+			return ioutil.WriteFile(*flagCheckpoint, []byte(strconv.Itoa(position)+"\n"), 0644)
+		}
+	}
+	cf, err := bind()
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *flagFile != "" {
+		f, err := os.Open(*flagFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	position, err := cf.Import(r, options)
+	fmt.Fprintf(os.Stderr, "imported through record %d\n", position)
+	return err
+}
+
+func snapshot() error {
+	schema, err := liveSchema()
+	if err != nil {
+		return err
+	}
+	return schema.Snapshot(*flagDir, ibis.SnapshotOptions{Ranges: *flagRanges})
+}
+
+func restore() error {
+	cluster, err := dial()
+	if err != nil {
+		return err
+	}
+	_, err = ibis.RestoreSnapshot(cluster, *flagDir,
+		ibis.RestoreOptions{BatchSize: *flagBatch, Rate: *flagRate})
+	return err
+}
+
+// rebuildLookup rebuilds the lookup column family named on the command line. The live schema
+// doesn't record lookups, so the lookup is declared on the live column family first. Names are
+// matched as the live schema reports them, in lower case.
+func rebuildLookup() error {
+	cf, err := bind()
+	if err != nil {
+		return err
+	}
+	column := strings.ToLower(*flagColumn)
+	cf.AddLookup(column, strings.ToLower(*flagLookup))
+	n, err := cf.RebuildLookup(column)
+	fmt.Fprintf(os.Stderr, "wrote %d lookup entries\n", n)
+	return err
+}
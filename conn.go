@@ -86,7 +86,13 @@ func (conn *cassandraConn) query(stmt CQL) Query {
 }
 
 func (conn *cassandraConn) queryBatch(stmts []CQL) Query {
-	batch := gocql.NewBatch(gocql.LoggedBatch)
+	batchType := gocql.LoggedBatch
+	if isCounterBatch(stmts) {
+		batchType = gocql.CounterBatch
+	} else if isUnloggedBatch(stmts) {
+		batchType = gocql.UnloggedBatch
+	}
+	batch := gocql.NewBatch(batchType)
 	for _, stmt := range stmts {
 		batch.Query(string(stmt.PreparedCQL), stmt.params...)
 	}
@@ -0,0 +1,147 @@
+package ibis
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+
+import "github.com/gocql/gocql"
+
+// Counter is the Go type of Cassandra counter columns. A column family with counter columns may
+// have no other columns besides those of its primary key, and its rows can't be committed; counters
+// are changed with CF.Increment or UpdateBuilder.Incr instead.
+//
+//        type PageViews struct {
+//            Page  string `ibis:"key"`
+//            Views ibis.Counter
+//        }
+//        ...
+//        err := model.PageViews.Increment(1, "/index.html")
+type Counter int64
+
+func (c Counter) MarshalCQL(info *gocql.TypeInfo) ([]byte, error) {
+	switch info.Type {
+	case gocql.TypeCounter, gocql.TypeBigInt:
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(c))
+		return data, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("ibis can't marshal %T into %s", c, info))
+	}
+}
+
+func (c *Counter) UnmarshalCQL(info *gocql.TypeInfo, data []byte) error {
+	switch info.Type {
+	case gocql.TypeCounter, gocql.TypeBigInt:
+		if len(data) == 0 {
+			*c = 0
+			return nil
+		}
+		if len(data) != 8 {
+			return errors.New(fmt.Sprintf("ibis can't unmarshal %d bytes into %T", len(data), *c))
+		}
+		*c = Counter(binary.BigEndian.Uint64(data))
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("ibis can't unmarshal %T from %s", *c, info))
+	}
+}
+
+// IsCounterTable returns true if the column family has counter columns.
+func (cf *CF) IsCounterTable() bool {
+	for _, col := range cf.columns {
+		if col.Type == "counter" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCounters checks that a counter table has only counter columns outside its primary key,
+// and none within it.
+func (cf *CF) validateCounters() error {
+	if !cf.IsCounterTable() {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, k := range cf.primaryKey {
+		keys[k] = true
+	}
+	for _, col := range cf.columns {
+		if keys[col.Name] && col.Type == "counter" {
+			return NewError(ErrInvalidCounterTable, "counter column", col.Name, "of", cf.name,
+				"is part of the primary key")
+		}
+		if !keys[col.Name] && col.Type != "counter" {
+			return NewError(ErrInvalidCounterTable, "column", col.Name, "of", cf.name,
+				"must be a counter, as only counters may be outside the primary key")
+		}
+	}
+	return nil
+}
+
+// counterColumn returns the name of the sole counter column of the column family.
+func (cf *CF) counterColumn() (string, error) {
+	var name string
+	for _, col := range cf.columns {
+		if col.Type == "counter" {
+			if name != "" {
+				return "", NewError(ErrInvalidCounterTable, cf.name,
+					"has more than one counter column; use UpdateBuilder.Incr")
+			}
+			name = col.Name
+		}
+	}
+	if name == "" {
+		return "", NewError(ErrInvalidCounterTable, cf.name, "has no counter column")
+	}
+	return name, nil
+}
+
+// MakeIncrement returns the CQL statement that would add delta to the counter column of the row
+// with the given primary key. Statements made by MakeIncrement may be given together to
+// Cluster.Query to be applied in a counter batch.
+func (cf *CF) MakeIncrement(delta int64, key ...interface{}) (CQL, error) {
+	if len(key) != len(cf.primaryKey) {
+		return CQL{}, ErrInvalidKey.New()
+	}
+	column, err := cf.counterColumn()
+	if err != nil {
+		return CQL{}, err
+	}
+	upd := Update(cf).Incr(column, delta)
+	for i, k := range cf.primaryKey {
+		upd.Where(k+" = ?", key[i])
+	}
+	return upd.CQL(), nil
+}
+
+// Increment adds delta, which may be negative, to the counter column of the row with the given
+// primary key. The column family must have exactly one counter column; for tables with several,
+// use UpdateBuilder.Incr.
+//
+// The values for the key must be given in order respective to the primary key definition for this
+// column family (see the PrimaryKey function).
+func (cf *CF) Increment(delta int64, key ...interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	cql, err := cf.MakeIncrement(delta, key...)
+	if err != nil {
+		return err
+	}
+	if err := cql.Query().Exec(); err != nil {
+		return ChainError(err, "increment failed")
+	}
+	cf.invalidateKey(key...)
+	return nil
+}
+
+// isCounterBatch returns true if every statement given updates counters.
+func isCounterBatch(stmts []CQL) bool {
+	for _, stmt := range stmts {
+		if !stmt.counter {
+			return false
+		}
+	}
+	return len(stmts) > 0
+}
@@ -30,8 +30,10 @@ func (pcql PreparedCQL) Bind(params ...interface{}) CQL {
 // after which it can be executed by calling the Query method.
 type CQL struct {
 	PreparedCQL
-	params  []interface{}
-	cluster Cluster
+	params   []interface{}
+	cluster  Cluster
+	counter  bool // true if the statement updates counters, so it may only be batched with others
+	unlogged bool // true if the statement may be batched without the batch log (see BulkWriter)
 }
 
 // String returns the prepared CQL string.
@@ -111,6 +113,7 @@ type SelectBuilder struct {
 	where   CQLBuilder
 	orderBy CQLBuilder
 	limit   int
+	filter  bool
 }
 
 // Select initializes and returns a SelectBuilder. If no arguments are given, it is initialized as
@@ -153,6 +156,13 @@ func (sel *SelectBuilder) Limit(limit int) *SelectBuilder {
 	return sel
 }
 
+// AllowFiltering permits the statement to restrict columns that are neither part of the primary key
+// nor indexed, at the cost of Cassandra scanning rows that don't match.
+func (sel *SelectBuilder) AllowFiltering() *SelectBuilder {
+	sel.filter = true
+	return sel
+}
+
 // CQL compiles the built select statement.
 func (sel *SelectBuilder) CQL() CQL {
 	var b CQLBuilder
@@ -175,6 +185,9 @@ func (sel *SelectBuilder) CQL() CQL {
 	if sel.limit != 0 {
 		b.Append(fmt.Sprintf(" LIMIT %d", sel.limit))
 	}
+	if sel.filter {
+		b.Append(" ALLOW FILTERING")
+	}
 	cql := b.CQL()
 	cql.Cluster(sel.cf.Cluster())
 	return cql
@@ -242,9 +255,10 @@ func (ins *InsertBuilder) Query() Query {
 
 // UpdateBuilder provides a declarative interface for building CQL UPDATE statements.
 type UpdateBuilder struct {
-	cf    *CF
-	set   CQLBuilder
-	where CQLBuilder
+	cf      *CF
+	set     CQLBuilder
+	where   CQLBuilder
+	counter bool
 }
 
 // Update initializes and returns an UpdateBuilder for declaring an update statement on the given
@@ -261,6 +275,16 @@ func (upd *UpdateBuilder) Set(key string, value interface{}) *UpdateBuilder {
 	return upd
 }
 
+// Incr adds delta, which may be negative, to a counter column. Call this method for each counter to
+// update.
+//
+//   Update(model.PageViews).Incr("Views", 1).Where("Page = ?", "/index.html")
+func (upd *UpdateBuilder) Incr(key string, delta int64) *UpdateBuilder {
+	upd.set.Append(key+" = "+key+" + ?", delta)
+	upd.counter = true
+	return upd
+}
+
 // Where specifies a term for the WHERE clause of the statement. If Where is called multiple times
 // on a builder, the given terms will be combined with the AND operator.
 func (upd *UpdateBuilder) Where(term string, params ...interface{}) *UpdateBuilder {
@@ -276,6 +300,7 @@ func (upd *UpdateBuilder) CQL() CQL {
 	b.AppendCQL(upd.where.join(" WHERE ", " AND "))
 	cql := b.CQL()
 	cql.Cluster(upd.cf.Cluster())
+	cql.counter = upd.counter
 	return cql
 }
 
@@ -287,6 +312,7 @@ func (upd *UpdateBuilder) Query() Query {
 type DeleteBuilder struct {
 	cf    *CF
 	where CQLBuilder
+	cond  CQLBuilder
 }
 
 // DeleteFrom initializes and returns a DeleteBuilder for declaring a delete statement on the given
@@ -294,7 +320,7 @@ type DeleteBuilder struct {
 //
 //   DeleteFrom(model.Users).Where("Name = ?", "logan")
 func DeleteFrom(cf *CF) *DeleteBuilder {
-	return &DeleteBuilder{cf: cf, where: make(CQLBuilder, 0)}
+	return &DeleteBuilder{cf: cf, where: make(CQLBuilder, 0), cond: make(CQLBuilder, 0)}
 }
 
 // Where specifies a term for the WHERE clause of the statement. If Where is called multiple times
@@ -304,9 +330,23 @@ func (del *DeleteBuilder) Where(term string, params ...interface{}) *DeleteBuild
 	return del
 }
 
+// If turns this into a CAS statement, deleting the row only if the given term holds. If If is called
+// multiple times on a builder, the given terms will be combined with the AND operator.
+//
+//   DeleteFrom(model.UserEmails).Where("Email = ?", email).If("Name = ?", "logan")
+func (del *DeleteBuilder) If(term string, params ...interface{}) *DeleteBuilder {
+	del.cond.Append(term, params...)
+	return del
+}
+
 // CQL compiles the built delete statement.
 func (del *DeleteBuilder) CQL() CQL {
-	cql := del.where.join("DELETE FROM "+del.cf.name+" WHERE ", " AND ")
+	var b CQLBuilder
+	b.AppendCQL(del.where.join("DELETE FROM "+del.cf.name+" WHERE ", " AND "))
+	if len(del.cond) > 0 {
+		b.AppendCQL(del.cond.join(" IF ", " AND "))
+	}
+	cql := b.CQL()
 	cql.Cluster(del.cf.Cluster())
 	return cql
 }
@@ -90,6 +90,11 @@ func TestSelectBuilder(t *testing.T) {
 			ShouldEqual, "SELECT X FROM test WHERE X = ? AND Y < ? ORDER BY X, Y LIMIT 1")
 		So(cql.params, ShouldResemble, []interface{}{1, 2})
 	})
+
+	Convey("SelectBuilder specifies filtering correctly", t, func() {
+		So(Select().From(cf).Where("Z = ?", 1).Limit(10).AllowFiltering().CQL().String(),
+			ShouldEqual, "SELECT X, Y, Z FROM test WHERE Z = ? LIMIT 10 ALLOW FILTERING")
+	})
 }
 
 func TestInsertBuilder(t *testing.T) {
@@ -121,6 +126,14 @@ func TestUpdateBuilder(t *testing.T) {
 		cql = Update(cf).Set("X", 1).Set("Y", 2).Where("X = ?", 3).Where("Y > 0").CQL()
 		So(cql.String(), ShouldEqual, "UPDATE test SET X = ?, Y = ? WHERE X = ? AND Y > 0")
 		So(cql.params, ShouldResemble, []interface{}{1, 2, 3})
+		So(cql.counter, ShouldBeFalse)
+	})
+
+	Convey("UpdateBuilder builds counter increments", t, func() {
+		cql := Update(cf).Incr("X", 1).Incr("Y", -2).Where("Z = ?", 3).CQL()
+		So(cql.String(), ShouldEqual, "UPDATE test SET X = X + ?, Y = Y + ? WHERE Z = ?")
+		So(cql.params, ShouldResemble, []interface{}{int64(1), int64(-2), 3})
+		So(cql.counter, ShouldBeTrue)
 	})
 }
 
@@ -135,5 +148,9 @@ func TestDeleteBuilder(t *testing.T) {
 		cql = DeleteFrom(cf).Where("X = ?", 1).Where("Y = 2").CQL()
 		So(cql.String(), ShouldEqual, "DELETE FROM test WHERE X = ? AND Y = 2")
 		So(cql.params, ShouldResemble, []interface{}{1})
+
+		cql = DeleteFrom(cf).Where("X = ?", 1).If("Y = ?", 2).If("Z = 3").CQL()
+		So(cql.String(), ShouldEqual, "DELETE FROM test WHERE X = ? IF Y = ? AND Z = 3")
+		So(cql.params, ShouldResemble, []interface{}{1, 2})
 	})
 }
@@ -0,0 +1,208 @@
+package ibis
+
+import "fmt"
+import "reflect"
+import "sync"
+import "time"
+
+// A Clock tells the time used for auto-populated columns and soft deletes. Provide one to a schema
+// (see Schema.Provide) to control the time, as in tests; otherwise the system clock is used.
+//
+//        schema.Provide(ibis.Clock(&ibis.FakeClock{Time: start}))
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Clock returns the clock provided to the column family's schema, or the system clock.
+func (cf *CF) Clock() Clock {
+	var clock Clock
+	if cf.schema != nil && cf.schema.GetProvider(&clock) {
+		return clock
+	}
+	return systemClock{}
+}
+
+// now returns the time of the column family's clock.
+func (cf *CF) now() time.Time {
+	return cf.Clock().Now()
+}
+
+// A TimeUUIDSequence issues TimeUUIDs from the clock of a column family's schema, with strictly
+// increasing times so that the TimeUUIDs it issues are unique and in order. The zero value is ready
+// to use, and is safe for concurrent use.
+type TimeUUIDSequence struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Next returns a new TimeUUID, and the time it was issued at.
+func (s *TimeUUIDSequence) Next(cf *CF) (TimeUUID, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := cf.now()
+	if !at.After(s.last) {
+		// timeuuids have a resolution of 100ns
+		at = s.last.Add(100 * time.Nanosecond)
+	}
+	s.last = at
+	return UUIDFromTime(at), at
+}
+
+// A DefaultProvider produces the value of a column for a row being committed without one. It's
+// given the time of the schema's clock (see Clock).
+type DefaultProvider func(now time.Time) (interface{}, error)
+
+// autoColumn describes a column that is populated when a reflected row is marshaled.
+type autoColumn struct {
+	column  string
+	always  bool // if false, only zero values are populated
+	provide DefaultProvider
+}
+
+func provideNow(now time.Time) (interface{}, error) { return now, nil }
+
+// AddDefault registers a provider of the default value of a column. When a reflected row is
+// marshaled with the zero value in the column's field, the field is set to the provided value.
+// Reflected time.Time columns tagged `ibis:"created_at"` are given the current time this way, and
+// those tagged `ibis:"updated_at"` are set to the current time whenever their row is marshaled.
+// Empty TimeUUID fields in the primary key are also given the current time, except for a row that
+// commits only the static columns of its partition (see StaticColumns): its empty clustering
+// columns and its regular columns are left as they are.
+//
+//        type User struct {
+//            Name    string    `ibis:"key"`
+//            Created time.Time `ibis:"created_at"`
+//            Updated time.Time `ibis:"updated_at"`
+//        }
+//        ...
+//        model.Users.AddDefault("Plan", func(now time.Time) (interface{}, error) {
+//            return "free", nil
+//        })
+//
+// AddDefault returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddDefault(column string, provider DefaultProvider) *CF {
+	cf.autoColumns = append(cf.autoColumns, autoColumn{column: column, provide: provider})
+	return cf
+}
+
+func (cf *CF) setCreatedAt(column string) {
+	cf.autoColumns = append(cf.autoColumns, autoColumn{column: column, provide: provideNow})
+}
+
+func (cf *CF) setUpdatedAt(column string) {
+	cf.autoColumns = append(cf.autoColumns,
+		autoColumn{column: column, always: true, provide: provideNow})
+}
+
+// isKey returns true if the named column is part of the primary key.
+func (cf *CF) isKey(name string) bool {
+	for _, k := range cf.primaryKey {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isClustering returns true if the named column is a clustering column.
+func (cf *CF) isClustering(name string) bool {
+	for _, k := range cf.clusteringColumns() {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// populate fills in the auto-populated fields of a reflected row: empty SeqIDs (from the schema's
+// SeqIDGenerator), empty TimeUUID keys, and columns with defaults.
+func (rr *reflectedRow) populate() error {
+	cf := rr.cf
+	staticsOnly := rr.staticsOnly()
+	var now time.Time
+	clockTime := func() time.Time {
+		if now.IsZero() {
+			now = cf.now()
+		}
+		return now
+	}
+	for _, col := range cf.columns {
+		fieldval := rr.value.FieldByName(col.Name)
+		if !fieldval.IsValid() || !fieldval.CanSet() {
+			continue
+		}
+		switch v := fieldval.Interface().(type) {
+		case SeqID:
+			var gen SeqIDGenerator
+			if v == "" && cf.Schema() != nil && cf.Schema().GetProvider(&gen) {
+				seqid, err := gen.NewSeqID()
+				if err != nil {
+					return err
+				}
+				fieldval.Set(reflect.ValueOf(seqid))
+			}
+		case TimeUUID:
+			// empty clustering columns mark a commit of the static columns
+			if !v.IsSet() && cf.isKey(col.Name) && !(staticsOnly && cf.isClustering(col.Name)) {
+				fieldval.Set(reflect.ValueOf(UUIDFromTime(clockTime())))
+			}
+		}
+	}
+	for _, auto := range cf.autoColumns {
+		fieldval := rr.value.FieldByName(auto.column)
+		if !fieldval.IsValid() || !fieldval.CanSet() || (!auto.always && !fieldval.IsZero()) {
+			continue
+		}
+		if staticsOnly && rr.isRegular(auto.column) {
+			continue
+		}
+		v, err := auto.provide(clockTime())
+		if err != nil {
+			return ChainError(err, "default for", auto.column, "failed")
+		}
+		value := reflect.ValueOf(v)
+		if !value.IsValid() || !value.Type().ConvertibleTo(fieldval.Type()) {
+			return NewError(ErrInvalidRowType, fmt.Sprintf("default for %s is a %T", auto.column, v))
+		}
+		fieldval.Set(value.Convert(fieldval.Type()))
+	}
+	return nil
+}
+
+// staticsOnly returns true if the reflected row commits only the static columns of its partition:
+// the column family has static columns, each of the row's clustering fields is an unset TimeUUID,
+// and each of its regular fields is zero.
+func (rr *reflectedRow) staticsOnly() bool {
+	cf := rr.cf
+	clustering := cf.clusteringColumns()
+	if len(clustering) == 0 || len(cf.StaticColumns()) == 0 {
+		return false
+	}
+	for _, k := range clustering {
+		fieldval := rr.value.FieldByName(k)
+		if !fieldval.IsValid() {
+			return false
+		}
+		if id, ok := fieldval.Interface().(TimeUUID); !ok || id.IsSet() {
+			return false
+		}
+	}
+	for _, col := range cf.columns {
+		if fieldval := rr.value.FieldByName(col.Name); rr.isRegular(col.Name) &&
+			fieldval.IsValid() && !fieldval.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// isRegular returns true if the named column is neither part of the primary key nor static.
+func (rr *reflectedRow) isRegular(name string) bool {
+	col, ok := rr.cf.column(name)
+	return ok && !col.Static && !rr.cf.isKey(name)
+}
@@ -0,0 +1,228 @@
+package ibis
+
+import "encoding/json"
+import "io/ioutil"
+import "sort"
+import "strings"
+
+// schemaDocument is the serialized form of a Schema. See Schema.Document.
+type schemaDocument struct {
+	Keyspace *keyspaceDocument `json:"keyspace,omitempty"`
+	Types    []typeDocument    `json:"types,omitempty"`
+	Tables   []tableDocument   `json:"tables"`
+}
+
+// The document types below mirror their exported counterparts, differing only in tags, so that
+// they may be converted directly.
+
+type keyspaceDocument struct {
+	Name              string         `json:"name,omitempty"`
+	Strategy          string         `json:"strategy"`
+	ReplicationFactor int            `json:"replication_factor,omitempty"`
+	DataCenters       map[string]int `json:"data_centers,omitempty"`
+	DurableWrites     *bool          `json:"durable_writes,omitempty"`
+}
+
+type typeDocument struct {
+	Name   string           `json:"name"`
+	Fields []columnDocument `json:"fields"`
+}
+
+type columnDocument struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Static bool   `json:"static,omitempty"`
+}
+
+type tableDocument struct {
+	Name         string                `json:"name"`
+	TypeID       int                   `json:"type_id,omitempty"`
+	Columns      []columnDocument      `json:"columns"`
+	PartitionKey []string              `json:"partition_key"`
+	Clustering   []string              `json:"clustering,omitempty"`
+	Options      *tableOptionsDocument `json:"options,omitempty"`
+	Indexes      []indexDocument       `json:"indexes,omitempty"`
+	Views        []viewDocument        `json:"views,omitempty"`
+}
+
+type tableOptionsDocument struct {
+	ClusteringOrder   map[string]string `json:"clustering_order,omitempty"`
+	Compaction        map[string]string `json:"compaction,omitempty"`
+	Compression       map[string]string `json:"compression,omitempty"`
+	Caching           map[string]string `json:"caching,omitempty"`
+	DefaultTimeToLive *int              `json:"default_time_to_live,omitempty"`
+	GCGraceSeconds    *int              `json:"gc_grace_seconds,omitempty"`
+}
+
+type indexDocument struct {
+	Name   string `json:"name,omitempty"`
+	Column string `json:"column"`
+}
+
+type viewDocument struct {
+	Name         string   `json:"name"`
+	PartitionKey []string `json:"partition_key"`
+	Clustering   []string `json:"clustering,omitempty"`
+}
+
+func columnDocuments(columns []Column) []columnDocument {
+	docs := make([]columnDocument, len(columns))
+	for i, col := range columns {
+		docs[i] = columnDocument{Name: col.Name, Type: col.Type, Static: col.Static}
+	}
+	return docs
+}
+
+func documentColumns(docs []columnDocument) []Column {
+	columns := make([]Column, len(docs))
+	for i, doc := range docs {
+		columns[i] = Column{Name: doc.Name, Type: doc.Type, Static: doc.Static}
+	}
+	return columns
+}
+
+// Document renders the schema's column families, user-defined types, and keyspace spec as a schema
+// document: a declarative description suitable for checking in and reviewing alongside code. It is
+// JSON, and hence also valid YAML. Tables and types are listed in order of name, and map keys are
+// sorted, so that the same schema always yields the same document. The cluster binding and any
+// hooks or plugins are not included.
+//
+//        {
+//          "tables": [
+//            {
+//              "name": "users",
+//              "type_id": 1,
+//              "columns": [
+//                {"name": "Name", "type": "varchar"},
+//                {"name": "Password", "type": "varchar"}
+//              ],
+//              "partition_key": ["Name"]
+//            }
+//          ]
+//        }
+func (s *Schema) Document() ([]byte, error) {
+	var doc schemaDocument
+	if s.KeyspaceSpec != nil {
+		ks := keyspaceDocument(*s.KeyspaceSpec)
+		doc.Keyspace = &ks
+	}
+	types := make([]*UDT, 0, len(s.Types))
+	for _, udt := range s.Types {
+		types = append(types, udt)
+	}
+	for _, udt := range sortTypes(types) {
+		doc.Types = append(doc.Types, typeDocument{Name: udt.Name, Fields: columnDocuments(udt.Fields)})
+	}
+	names := make([]string, 0, len(s.CFs))
+	for name := range s.CFs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	doc.Tables = make([]tableDocument, len(names))
+	for i, name := range names {
+		cf := s.CFs[name]
+		table := tableDocument{
+			Name:         cf.name,
+			TypeID:       cf.typeID,
+			Columns:      columnDocuments(cf.columns),
+			PartitionKey: cf.PartitionKey(),
+			Clustering:   cf.clusteringColumns(),
+		}
+		if !cf.options.empty() || len(cf.options.ClusteringOrder) > 0 {
+			options := tableOptionsDocument(cf.options)
+			table.Options = &options
+		}
+		for _, idx := range cf.indexes {
+			table.Indexes = append(table.Indexes, indexDocument(idx))
+		}
+		for _, v := range cf.Views() {
+			table.Views = append(table.Views, viewDocument(v))
+		}
+		doc.Tables[i] = table
+	}
+	encoded, err := json.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, '\n'), nil
+}
+
+// WriteDocument writes the schema document of this schema to the named file.
+func (s *Schema) WriteDocument(filename string) error {
+	doc, err := s.Document()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, doc, 0644)
+}
+
+// LoadSchemaDocument builds an unbound schema from a schema document, as produced by
+// Schema.Document.
+func LoadSchemaDocument(data []byte) (*Schema, error) {
+	var doc schemaDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, NewError(ErrInvalidSchemaDocument, err.Error())
+	}
+	schema := NewSchema()
+	if doc.Keyspace != nil {
+		spec := KeyspaceSpec(*doc.Keyspace)
+		schema.KeyspaceSpec = &spec
+	}
+	for _, t := range doc.Types {
+		schema.Types[strings.ToLower(t.Name)] = newUDT(t.Name, documentColumns(t.Fields)...)
+	}
+	for _, t := range doc.Tables {
+		if t.TypeID >= schema.nextTypeID {
+			schema.nextTypeID = t.TypeID + 1
+		}
+	}
+	for _, t := range doc.Tables {
+		if t.Name == "" || len(t.PartitionKey) == 0 {
+			return nil, NewError(ErrInvalidSchemaDocument, "table", t.Name,
+				"requires a name and partition key")
+		}
+		cf := NewCF(t.Name, documentColumns(t.Columns)...).
+			SetCompositeKey(t.PartitionKey, t.Clustering...)
+		if t.Options != nil {
+			cf.options = TableOptions(*t.Options)
+		}
+		for _, idx := range t.Indexes {
+			cf.indexes = append(cf.indexes, Index(idx))
+		}
+		for _, v := range t.Views {
+			cf.views = append(cf.views, MaterializedView(v))
+		}
+		cf.typeID = t.TypeID
+		schema.AddCF(cf)
+	}
+	return schema, nil
+}
+
+// ReadSchemaDocument loads a schema from the named schema document file.
+func ReadSchemaDocument(filename string) (*Schema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSchemaDocument(data)
+}
+
+// DiffSchemaDocuments compares two schema documents offline, returning the changes necessary to
+// transform the schema described by from into that described by to.
+//
+//        diff, err := ibis.DiffSchemaDocuments(base, head)
+//        if err != nil {
+//            ...
+//        }
+//        fmt.Println(diff)  // e.g. "ALTER TABLE users ADD Email varchar"
+func DiffSchemaDocuments(from, to []byte) (*SchemaDiff, error) {
+	from_schema, err := LoadSchemaDocument(from)
+	if err != nil {
+		return nil, err
+	}
+	to_schema, err := LoadSchemaDocument(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSchemas(from_schema, to_schema), nil
+}
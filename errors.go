@@ -6,13 +6,29 @@ import "strings"
 type ErrorKey string
 
 const (
-	ErrNotFound          = ErrorKey("not found")
-	ErrAlreadyExists     = ErrorKey("already exists")
-	ErrTableNotBound     = ErrorKey("table not connected to a cluster")
-	ErrNothingToCommit   = ErrorKey("nothing to commit")
-	ErrInvalidKey        = ErrorKey("invalid key")
-	ErrInvalidRowType    = ErrorKey("row doesn't match schema")
-	ErrInvalidSchemaType = ErrorKey("schema must be reflected from a pointer to a struct")
+	ErrNotFound              = ErrorKey("not found")
+	ErrAlreadyExists         = ErrorKey("already exists")
+	ErrTableNotBound         = ErrorKey("table not connected to a cluster")
+	ErrNothingToCommit       = ErrorKey("nothing to commit")
+	ErrInvalidKey            = ErrorKey("invalid key")
+	ErrInvalidRowType        = ErrorKey("row doesn't match schema")
+	ErrInvalidSchemaType     = ErrorKey("schema must be reflected from a pointer to a struct")
+	ErrSchemaDisagreement    = ErrorKey("nodes disagree on schema version")
+	ErrInvalidSchemaDocument = ErrorKey("invalid schema document")
+	ErrSchemaChanged         = ErrorKey("live schema has changed since the diff was computed")
+	ErrInvalidCounterTable   = ErrorKey("invalid counter table")
+	ErrInvalidStaticColumn   = ErrorKey("invalid static column")
+	ErrNotUnique             = ErrorKey("unique value already held by another row")
+	ErrValidationFailed      = ErrorKey("row failed validation")
+	ErrInvalidSoftDelete     = ErrorKey("invalid soft delete column")
+	ErrNoSoftDelete          = ErrorKey("column family has no soft delete column")
+	ErrInvalidReference      = ErrorKey("invalid reference to another column family")
+	ErrInvalidRecord         = ErrorKey("imported record doesn't match the column family")
+	ErrInvalidSnapshot       = ErrorKey("invalid snapshot")
+	ErrKeyspaceNotEmpty      = ErrorKey("keyspace isn't empty")
+	ErrBulkWriteFailed       = ErrorKey("bulk write failed")
+	ErrUnsupportedChange     = ErrorKey("unsupported schema change")
+	ErrConflictingType       = ErrorKey("conflicting definitions of user-defined type")
 )
 
 // New returns a new ibis error with this key.
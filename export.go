@@ -0,0 +1,641 @@
+package ibis
+
+import "bufio"
+import "encoding/base64"
+import "encoding/csv"
+import "encoding/json"
+import "fmt"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/gocql/gocql"
+
+// A Format is an encoding of rows for export and import.
+type Format int
+
+const (
+	// JSONLines encodes each row as a JSON object on its own line. Numbers and booleans are encoded
+	// as JSON values, except that NaN and the infinities are encoded as the strings "NaN", "+Inf",
+	// and "-Inf". Timestamps are encoded as RFC 3339 strings, UUIDs in their canonical form, and
+	// blobs (and values of any other type) in base64. Null values are omitted.
+	JSONLines Format = iota
+	// CSV encodes each row as a record of comma-separated values, following a header record of
+	// column names. Values are encoded as for JSONLines, with null values left empty.
+	CSV
+)
+
+// ParseFormat returns the format with the given name: "jsonl" (or "json") or "csv".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "json":
+		return JSONLines, nil
+	case "csv":
+		return CSV, nil
+	}
+	return 0, fmt.Errorf("unknown format: %s", name)
+}
+
+func (f Format) String() string {
+	if f == CSV {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	Format Format
+	// The number of token ranges to split the column family into, each scanned concurrently. The
+	// order of exported rows is unspecified when this is greater than one.
+	Ranges int
+	// If not nil, applied to each row before it's written, as to sanitize it. Rows it returns nil
+	// for are skipped.
+	Transform func(MarshaledMap) (MarshaledMap, error)
+}
+
+// Export writes every row of the column family to w, and returns the number of rows written. Rows
+// are exported as they are stored; soft-deleted rows are included.
+//
+//        f, err := os.Create("users.jsonl")
+//        ...
+//        n, err := model.Users.Export(f, ibis.ExportOptions{Format: ibis.JSONLines, Ranges: 8})
+func (cf *CF) Export(w io.Writer, options ExportOptions) (int, error) {
+	if !cf.IsBound() {
+		return 0, ErrTableNotBound.New()
+	}
+	buf := bufio.NewWriter(w)
+	rw, err := cf.newRowWriter(buf, options.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	ranges := tokenRanges(options.Ranges)
+	rows := make(chan MarshaledMap, 64)
+	errs := make(chan error, len(ranges))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(r tokenRange) {
+			defer wg.Done()
+			errs <- cf.scanRange(r, rows, done)
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(rows)
+		close(errs)
+	}()
+
+	count := 0
+	var werr error
+	for mmap := range rows {
+		if werr != nil {
+			continue
+		}
+		if options.Transform != nil {
+			if mmap, werr = options.Transform(mmap); werr != nil {
+				close(done)
+				continue
+			} else if mmap == nil {
+				continue
+			}
+		}
+		if werr = rw.Write(mmap); werr != nil {
+			close(done)
+		} else {
+			count++
+		}
+	}
+	for err := range errs {
+		if err != nil {
+			return count, ChainError(err, "export scan failed")
+		}
+	}
+	if werr != nil {
+		return count, ChainError(werr, "export write failed")
+	}
+	if err := rw.Flush(); err != nil {
+		return count, ChainError(err, "export write failed")
+	}
+	return count, buf.Flush()
+}
+
+// A tokenRange is an inclusive range of partition key tokens. The zero range scans everything.
+type tokenRange struct {
+	lo, hi int64
+	all    bool
+}
+
+// tokenRanges splits the token ring into n ranges of equal size.
+func tokenRanges(n int) []tokenRange {
+	if n <= 1 {
+		return []tokenRange{{all: true}}
+	}
+	ranges := make([]tokenRange, n)
+	width := math.MaxUint64 / uint64(n)
+	lo := int64(math.MinInt64)
+	for i := range ranges {
+		hi := int64(uint64(lo) + width)
+		if i == n-1 {
+			hi = math.MaxInt64
+		}
+		ranges[i] = tokenRange{lo: lo, hi: hi}
+		lo = hi + 1
+	}
+	return ranges
+}
+
+// scanRange sends the rows in a token range to the given channel, until done is closed.
+func (cf *CF) scanRange(r tokenRange, rows chan<- MarshaledMap, done <-chan struct{}) error {
+	colnames := make([]string, len(cf.columns))
+	for i, col := range cf.columns {
+		colnames[i] = col.Name
+	}
+	sel := Select(colnames...).From(cf)
+	if !r.all {
+		token := "token(" + strings.Join(cf.PartitionKey(), ", ") + ")"
+		sel.Where(token+" >= ?", r.lo).Where(token+" <= ?", r.hi)
+	}
+	qiter := sel.CQL().Query()
+	for {
+		mmap := make(MarshaledMap)
+		if !qiter.Scan(mmap.PointersTo(colnames...)...) {
+			break
+		}
+		select {
+		case rows <- mmap:
+		case <-done:
+			return qiter.Close()
+		}
+	}
+	return qiter.Close()
+}
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Format Format
+	// The number of records read before their rows are written, in an unlogged batch for each
+	// partition they touch. If not positive, 100 is used.
+	BatchSize int
+	// The maximum number of rows to write per second. If not positive, rows are written as fast as
+	// possible.
+	Rate float64
+	// The number of leading records to skip, as when resuming an interrupted import.
+	Resume int
+	// If not nil, called after each batch is written with the position to resume from.
+	Checkpoint func(position int) error
+}
+
+// Import reads rows written by Export from r, and writes them to the column family in batches. It
+// returns the position to resume from: the number of records read and written, including those
+// skipped by options.Resume. If the import fails, it may be resumed from the returned position.
+//
+// Rows are written as they are, with an INSERT of the columns they hold; hooks aren't invoked,
+// lookups and unique values aren't maintained, and no validation is done. Import each column family
+// of a schema to restore it as a whole (see Schema.Snapshot). The counters of a counter table are
+// added to any existing values, so they should be imported into an empty table; for the same
+// reason, resuming a counter table's import after a failed batch may count some rows twice, as a
+// batch's partitions are written one at a time.
+func (cf *CF) Import(r io.Reader, options ImportOptions) (int, error) {
+	if !cf.IsBound() {
+		return 0, ErrTableNotBound.New()
+	}
+	rr, err := cf.newRowReader(r, options.Format)
+	if err != nil {
+		return 0, err
+	}
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	position := 0
+	for ; position < options.Resume; position++ {
+		if _, err := rr.Read(); err != nil {
+			if err == io.EOF {
+				return position, nil
+			}
+			return position, ChainError(err, "import failed at record", strconv.Itoa(position+1))
+		}
+	}
+
+	start := time.Now()
+	written := 0
+	batch := make([]CQL, 0, batchSize)
+	mmaps := make([]MarshaledMap, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// as with a BulkWriter, rows are written in an unlogged batch per partition
+		partitions := make([]string, 0)
+		groups := make(map[string][]CQL)
+		for i, cql := range batch {
+			p := cf.partitionGroup(mmaps[i])
+			if _, ok := groups[p]; !ok {
+				partitions = append(partitions, p)
+			}
+			groups[p] = append(groups[p], cql)
+		}
+		var err error
+		for _, p := range partitions {
+			if err = cf.schema.Cluster.Query(groups[p]...).Exec(); err != nil {
+				break
+			}
+		}
+		for _, mmap := range mmaps {
+			cf.invalidate(mmap)
+		}
+		if err != nil {
+			return ChainError(err, "import failed at record", strconv.Itoa(position-len(batch)+1))
+		}
+		written += len(batch)
+		batch, mmaps = batch[:0], mmaps[:0]
+		if options.Checkpoint != nil {
+			if err := options.Checkpoint(position); err != nil {
+				return err
+			}
+		}
+		if options.Rate > 0 {
+			due := start.Add(time.Duration(float64(written) / options.Rate * float64(time.Second)))
+			if d := due.Sub(time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		return nil
+	}
+	for {
+		mmap, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return position - len(batch), ChainError(err, "import failed at record",
+				strconv.Itoa(position+1))
+		}
+		cql, err := cf.importStatement(mmap)
+		if err != nil {
+			return position - len(batch), ChainError(err, "import failed at record",
+				strconv.Itoa(position+1))
+		}
+		cql.unlogged = true
+		batch = append(batch, cql)
+		mmaps = append(mmaps, mmap)
+		position++
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return position - len(batch), err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return position - len(batch), err
+	}
+	return position, nil
+}
+
+// importStatement generates the statement that writes an imported row.
+func (cf *CF) importStatement(mmap MarshaledMap) (CQL, error) {
+	for _, k := range cf.primaryKey {
+		if mmap[k] == nil {
+			return CQL{}, NewError(ErrInvalidRecord, "no value for key column", k)
+		}
+	}
+	if cf.IsCounterTable() {
+		upd := Update(cf)
+		for _, col := range cf.columns {
+			if mv := mmap[col.Name]; mv != nil && col.Type == "counter" {
+				var delta int64
+				if err := gocql.Unmarshal(TIBigInt, mv.Bytes, &delta); err != nil {
+					return CQL{}, err
+				}
+				upd.Incr(col.Name, delta)
+			}
+		}
+		for _, k := range cf.primaryKey {
+			upd.Where(k+" = ?", mmap[k])
+		}
+		return upd.CQL(), nil
+	}
+	keys := make([]string, 0, len(mmap))
+	for _, col := range cf.columns {
+		if _, ok := mmap[col.Name]; ok {
+			keys = append(keys, col.Name)
+		}
+	}
+	return InsertInto(cf).Keys(keys...).Values(mmap.InterfacesFor(keys...)...).CQL(), nil
+}
+
+type rowWriter interface {
+	Write(MarshaledMap) error
+	Flush() error
+}
+
+type rowReader interface {
+	// Read returns the next row, or io.EOF if there are no more.
+	Read() (MarshaledMap, error)
+}
+
+func (cf *CF) newRowWriter(w io.Writer, format Format) (rowWriter, error) {
+	switch format {
+	case JSONLines:
+		return &jsonRowWriter{cf: cf, enc: json.NewEncoder(w)}, nil
+	case CSV:
+		return &csvRowWriter{cf: cf, w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %d", format)
+}
+
+func (cf *CF) newRowReader(r io.Reader, format Format) (rowReader, error) {
+	switch format {
+	case JSONLines:
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		return &jsonRowReader{cf: cf, dec: dec}, nil
+	case CSV:
+		return &csvRowReader{cf: cf, r: csv.NewReader(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %d", format)
+}
+
+type jsonRowWriter struct {
+	cf  *CF
+	enc *json.Encoder
+}
+
+func (w *jsonRowWriter) Write(mmap MarshaledMap) error {
+	obj := make(map[string]interface{}, len(mmap))
+	for _, col := range w.cf.columns {
+		mv := mmap[col.Name]
+		if isNull(col, mv) {
+			continue
+		}
+		s, err := formatValue(col, mv)
+		if err != nil {
+			return ChainError(err, "can't encode", col.Name)
+		}
+		switch col.Type {
+		case "bigint", "counter":
+			obj[col.Name] = json.Number(s)
+		case "double":
+			// JSON has no numbers for NaN and the infinities, so those are written as strings
+			if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				obj[col.Name] = json.Number(s)
+			} else {
+				obj[col.Name] = s
+			}
+		case "boolean":
+			obj[col.Name] = s == "true"
+		default:
+			obj[col.Name] = s
+		}
+	}
+	return w.enc.Encode(obj)
+}
+
+func (w *jsonRowWriter) Flush() error { return nil }
+
+type jsonRowReader struct {
+	cf  *CF
+	dec *json.Decoder
+}
+
+func (r *jsonRowReader) Read() (MarshaledMap, error) {
+	var obj map[string]interface{}
+	if err := r.dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	mmap := make(MarshaledMap, len(obj))
+	for name, v := range obj {
+		col, ok := r.cf.columnFold(name)
+		if !ok {
+			return nil, NewError(ErrInvalidRecord, "unknown column", name)
+		}
+		var s string
+		switch x := v.(type) {
+		case nil:
+			continue
+		case string:
+			s = x
+		case json.Number:
+			s = x.String()
+		case bool:
+			s = strconv.FormatBool(x)
+		default:
+			return nil, NewError(ErrInvalidRecord, "invalid value for column", name)
+		}
+		mv, err := parseValue(col, s)
+		if err != nil {
+			return nil, ChainError(err, "invalid value for column", name)
+		}
+		if mv != nil {
+			mmap[col.Name] = mv
+		}
+	}
+	return mmap, nil
+}
+
+// columnFold finds a column by name, ignoring case if there's no exact match, since the live schema
+// of a column family (as used by ibisdump) has lowercased column names.
+func (cf *CF) columnFold(name string) (Column, bool) {
+	if col, ok := cf.column(name); ok {
+		return col, true
+	}
+	for _, col := range cf.columns {
+		if strings.EqualFold(col.Name, name) {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+type csvRowWriter struct {
+	cf     *CF
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvRowWriter) writeHeader() error {
+	names := make([]string, len(w.cf.columns))
+	for i, col := range w.cf.columns {
+		names[i] = col.Name
+	}
+	w.header = true
+	return w.w.Write(names)
+}
+
+func (w *csvRowWriter) Write(mmap MarshaledMap) error {
+	if !w.header {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	record := make([]string, len(w.cf.columns))
+	for i, col := range w.cf.columns {
+		mv := mmap[col.Name]
+		if isNull(col, mv) {
+			continue
+		}
+		s, err := formatValue(col, mv)
+		if err != nil {
+			return ChainError(err, "can't encode", col.Name)
+		}
+		record[i] = s
+	}
+	return w.w.Write(record)
+}
+
+func (w *csvRowWriter) Flush() error {
+	if !w.header {
+		// an empty export still names its columns
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvRowReader struct {
+	cf      *CF
+	r       *csv.Reader
+	columns []Column
+}
+
+func (r *csvRowReader) Read() (MarshaledMap, error) {
+	if r.columns == nil {
+		names, err := r.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		r.columns = make([]Column, len(names))
+		for i, name := range names {
+			col, ok := r.cf.columnFold(name)
+			if !ok {
+				return nil, NewError(ErrInvalidRecord, "unknown column", name)
+			}
+			r.columns[i] = col
+		}
+	}
+	record, err := r.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	mmap := make(MarshaledMap, len(record))
+	for i, s := range record {
+		col := r.columns[i]
+		mv, err := parseValue(col, s)
+		if err != nil {
+			return nil, ChainError(err, "invalid value for column", col.Name)
+		}
+		if mv != nil {
+			mmap[col.Name] = mv
+		}
+	}
+	return mmap, nil
+}
+
+// isNull returns true if a marshaled value holds no value of its column. Empty strings and blobs
+// are values.
+func isNull(col Column, mv *MarshaledValue) bool {
+	if mv == nil {
+		return true
+	}
+	return len(mv.Bytes) == 0 && !isTextual(col)
+}
+
+func isTextual(col Column) bool {
+	switch col.Type {
+	case "varchar", "text", "ascii", "blob":
+		return true
+	}
+	return false
+}
+
+// formatValue encodes a marshaled value of a column as text.
+func formatValue(col Column, mv *MarshaledValue) (string, error) {
+	switch col.Type {
+	case "varchar", "text", "ascii":
+		return string(mv.Bytes), nil
+	case "bigint", "counter":
+		var n int64
+		err := gocql.Unmarshal(TIBigInt, mv.Bytes, &n)
+		return strconv.FormatInt(n, 10), err
+	case "double":
+		var f float64
+		err := gocql.Unmarshal(TIDouble, mv.Bytes, &f)
+		return strconv.FormatFloat(f, 'g', -1, 64), err
+	case "boolean":
+		var b bool
+		err := gocql.Unmarshal(TIBoolean, mv.Bytes, &b)
+		return strconv.FormatBool(b), err
+	case "timestamp":
+		// decoded from milliseconds, so that times outside the range of time.Time survive
+		var ms int64
+		if err := gocql.Unmarshal(TIBigInt, mv.Bytes, &ms); err != nil {
+			return "", err
+		}
+		t := time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+		return t.Format(time.RFC3339Nano), nil
+	case "timeuuid", "uuid":
+		u, err := gocql.UUIDFromBytes(mv.Bytes)
+		return u.String(), err
+	}
+	return base64.StdEncoding.EncodeToString(mv.Bytes), nil
+}
+
+// parseValue decodes the text encoding of a value of a column. It returns nil for an empty null
+// value.
+func parseValue(col Column, s string) (*MarshaledValue, error) {
+	ti := col.typeInfo
+	if ti == nil {
+		ti = typeInfoMap[col.Type]
+	}
+	if s == "" && !isTextual(col) {
+		return nil, nil
+	}
+	var b []byte
+	var err error
+	switch col.Type {
+	case "varchar", "text", "ascii":
+		b = []byte(s)
+	case "bigint", "counter":
+		var n int64
+		if n, err = strconv.ParseInt(s, 10, 64); err == nil {
+			b, err = gocql.Marshal(TIBigInt, n)
+		}
+	case "double":
+		// ParseFloat also accepts NaN, +Inf, and -Inf, as formatValue writes non-finite doubles
+		var f float64
+		if f, err = strconv.ParseFloat(s, 64); err == nil {
+			b, err = gocql.Marshal(TIDouble, f)
+		}
+	case "boolean":
+		var v bool
+		if v, err = strconv.ParseBool(s); err == nil {
+			b, err = gocql.Marshal(TIBoolean, v)
+		}
+	case "timestamp":
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, s); err == nil {
+			ms := t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+			b, err = gocql.Marshal(TIBigInt, ms)
+		}
+	case "timeuuid", "uuid":
+		var u gocql.UUID
+		if u, err = gocql.ParseUUID(s); err == nil {
+			b = u.Bytes()
+		}
+	default:
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MarshaledValue{Bytes: b, TypeInfo: ti}, nil
+}
@@ -0,0 +1,257 @@
+package ibis
+
+import "bytes"
+import "io/ioutil"
+import "math"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/gocql/gocql"
+
+import . "github.com/smartystreets/goconvey/convey"
+
+func TestExportImport(t *testing.T) {
+	type record struct {
+		Name    string `ibis:"key"`
+		Total   int64
+		Score   float64
+		Active  bool
+		Seen    time.Time
+		ID      TimeUUID
+		Data    []byte
+		Comment string
+	}
+	newModel := func() (*struct{ Records *CF }, *Schema) {
+		model := &struct{ Records *CF }{}
+		var err error
+		if model.Records, err = ReflectCF(record{}); err != nil {
+			t.Fatal(err)
+		}
+		return model, ReflectTestSchema(t, model)
+	}
+	seen := time.Date(2015, 6, 1, 12, 30, 15, 250000000, time.UTC)
+	records := []*record{
+		{"alpha", 1, 0.5, true, seen, TimeUUID(gocql.UUIDFromTime(seen)), []byte{0, 1, 255}, "a,\"b\"\n"},
+		{"beta", -2, 1e100, false, time.Time{}, TimeUUID{}, nil, ""},
+		{"gamma", 3, 0, false, seen.Add(time.Hour), TimeUUID{}, []byte("x"), "third"},
+	}
+	src, srcSchema := newModel()
+	defer srcSchema.Cluster.Close()
+	for _, r := range records {
+		if err := src.Records.Commit(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range []Format{JSONLines, CSV} {
+		Convey("Rows should survive an export and import as "+format.String(), t, func() {
+			var buf bytes.Buffer
+			n, err := src.Records.Export(&buf, ExportOptions{Format: format, Ranges: 4})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(records))
+
+			dest, destSchema := newModel()
+			defer destSchema.Cluster.Close()
+			checkpoints := make([]int, 0)
+			position, err := dest.Records.Import(&buf, ImportOptions{
+				Format:     format,
+				BatchSize:  2,
+				Checkpoint: func(p int) error { checkpoints = append(checkpoints, p); return nil },
+			})
+			So(err, ShouldBeNil)
+			So(position, ShouldEqual, len(records))
+			So(checkpoints, ShouldResemble, []int{2, 3})
+			for _, r := range records {
+				var loaded record
+				So(dest.Records.LoadByKey(&loaded, r.Name), ShouldBeNil)
+				So(loaded.Total, ShouldEqual, r.Total)
+				So(loaded.Score, ShouldEqual, r.Score)
+				So(loaded.Active, ShouldEqual, r.Active)
+				So(loaded.Seen.Equal(r.Seen), ShouldBeTrue)
+				So(loaded.ID, ShouldResemble, r.ID)
+				So(string(loaded.Data), ShouldEqual, string(r.Data))
+				So(loaded.Comment, ShouldEqual, r.Comment)
+			}
+		})
+	}
+
+	Convey("Non-finite doubles should survive an export and import", t, func() {
+		odd, oddSchema := newModel()
+		defer oddSchema.Cluster.Close()
+		scores := map[string]float64{"nan": math.NaN(), "inf": math.Inf(1), "-inf": math.Inf(-1)}
+		for name, score := range scores {
+			So(odd.Records.Commit(&record{Name: name, Score: score}), ShouldBeNil)
+		}
+		for _, format := range []Format{JSONLines, CSV} {
+			var buf bytes.Buffer
+			n, err := odd.Records.Export(&buf, ExportOptions{Format: format})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(scores))
+			dest, destSchema := newModel()
+			defer destSchema.Cluster.Close()
+			_, err = dest.Records.Import(&buf, ImportOptions{Format: format})
+			So(err, ShouldBeNil)
+			for name, score := range scores {
+				var loaded record
+				So(dest.Records.LoadByKey(&loaded, name), ShouldBeNil)
+				if math.IsNaN(score) {
+					So(math.IsNaN(loaded.Score), ShouldBeTrue)
+				} else {
+					So(loaded.Score, ShouldEqual, score)
+				}
+			}
+		}
+	})
+
+	Convey("Imports should write an unlogged batch per partition", t, func() {
+		var buf bytes.Buffer
+		_, err := src.Records.Export(&buf, ExportOptions{Format: JSONLines})
+		So(err, ShouldBeNil)
+		dest, destSchema := newModel()
+		defer destSchema.Cluster.Close()
+		recorder := &flakyCluster{Cluster: destSchema.Cluster}
+		destSchema.Cluster = recorder
+		position, err := dest.Records.Import(&buf, ImportOptions{Format: JSONLines})
+		So(err, ShouldBeNil)
+		So(position, ShouldEqual, len(records))
+		So(len(recorder.batches), ShouldEqual, len(records))
+		for _, batch := range recorder.batches {
+			So(len(batch), ShouldEqual, 1)
+			So(isUnloggedBatch(batch), ShouldBeTrue)
+		}
+	})
+
+	Convey("A single-range export should include every row", t, func() {
+		var buf bytes.Buffer
+		n, err := src.Records.Export(&buf, ExportOptions{Format: JSONLines})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, len(records))
+		So(strings.Count(buf.String(), "\n"), ShouldEqual, len(records))
+	})
+
+	Convey("Imports should resume from a position", t, func() {
+		var buf bytes.Buffer
+		_, err := src.Records.Export(&buf, ExportOptions{Format: CSV})
+		So(err, ShouldBeNil)
+		dest, destSchema := newModel()
+		defer destSchema.Cluster.Close()
+		position, err := dest.Records.Import(&buf, ImportOptions{Format: CSV, Resume: 2})
+		So(err, ShouldBeNil)
+		So(position, ShouldEqual, 3)
+		n, err := dest.Records.Export(&bytes.Buffer{}, ExportOptions{})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+	})
+
+	Convey("Invalid records should stop an import at their position", t, func() {
+		dest, destSchema := newModel()
+		defer destSchema.Cluster.Close()
+		input := `{"name": "a", "Total": 1}` + "\n" + `{"Total": 2}` + "\n"
+		position, err := dest.Records.Import(strings.NewReader(input), ImportOptions{BatchSize: 1})
+		So(err, shouldBeError, ErrInvalidRecord)
+		So(position, ShouldEqual, 1)
+		position, err = dest.Records.Import(strings.NewReader(`{"Bogus": 1}`), ImportOptions{})
+		So(err, shouldBeError, ErrInvalidRecord)
+		So(position, ShouldEqual, 0)
+	})
+
+	Convey("Token ranges should cover the ring", t, func() {
+		ranges := tokenRanges(3)
+		So(len(ranges), ShouldEqual, 3)
+		So(ranges[0].lo, ShouldEqual, int64(-1<<63))
+		So(ranges[1].lo, ShouldEqual, ranges[0].hi+1)
+		So(ranges[2].lo, ShouldEqual, ranges[1].hi+1)
+		So(ranges[2].hi, ShouldEqual, int64(1<<63-1))
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	type user struct {
+		Name  string `ibis:"key"`
+		Email string `ibis:"unique"`
+	}
+	type visits struct {
+		Page  string `ibis:"key"`
+		Views Counter
+	}
+	type testModel struct {
+		Users  *CF
+		Visits *CF
+	}
+	newModel := func() *testModel {
+		model := &testModel{}
+		var err error
+		if model.Users, err = ReflectCF(user{}); err != nil {
+			t.Fatal(err)
+		}
+		if model.Visits, err = ReflectCF(visits{}); err != nil {
+			t.Fatal(err)
+		}
+		return model
+	}
+	src := newModel()
+	schema := ReflectTestSchema(t, src)
+	defer schema.Cluster.Close()
+	for _, u := range []*user{{"alice", "alice@example.com"}, {"bob", "bob@example.com"}} {
+		if err := src.Users.Commit(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Visits.Increment(5, "/home"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "ibis-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("A snapshot should be restored into another keyspace", t, func() {
+		sanitize := func(cf *CF, row MarshaledMap) (MarshaledMap, error) {
+			if cf == src.Users && string(row["Email"].Bytes) == "bob@example.com" {
+				row["Email"].Bytes = []byte("bob@example.invalid")
+			}
+			return row, nil
+		}
+		So(schema.Snapshot(dir, SnapshotOptions{Ranges: 2, Transform: sanitize}), ShouldBeNil)
+		_, err := os.Stat(filepath.Join(dir, "schema.json"))
+		So(err, ShouldBeNil)
+
+		cluster := FakeCassandra("restored")
+		restored, err := RestoreSnapshot(cluster, dir, RestoreOptions{BatchSize: 1})
+		So(err, ShouldBeNil)
+		So(restored.CFs["users"], ShouldNotBeNil)
+
+		dest := newModel()
+		destSchema, err := ReflectSchema(dest)
+		So(err, ShouldBeNil)
+		destSchema.Cluster = cluster
+		var u user
+		So(dest.Users.LoadByKey(&u, "alice"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "alice@example.com")
+		So(dest.Users.LoadByUnique(&u, "Email", "alice@example.com"), ShouldBeNil)
+		So(u.Name, ShouldEqual, "alice")
+		So(dest.Users.LoadByKey(&u, "bob"), ShouldBeNil)
+		So(u.Email, ShouldEqual, "bob@example.invalid")
+		var v visits
+		So(dest.Visits.LoadByKey(&v, "/home"), ShouldBeNil)
+		So(v.Views, ShouldEqual, 5)
+
+		// restoring again would add to the counters and alter what's there
+		_, err = RestoreSnapshot(cluster, dir, RestoreOptions{})
+		So(err, shouldBeError, ErrKeyspaceNotEmpty)
+		So(dest.Visits.LoadByKey(&v, "/home"), ShouldBeNil)
+		So(v.Views, ShouldEqual, 5)
+	})
+
+	Convey("Incomplete snapshots should be refused", t, func() {
+		empty, err := ioutil.TempDir("", "ibis-snapshot")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(empty)
+		_, err = RestoreSnapshot(FakeCassandra("restored"), empty, RestoreOptions{})
+		So(err, shouldBeError, ErrInvalidSnapshot)
+	})
+}
@@ -1,10 +1,14 @@
 package ibis
 
+import "encoding/hex"
+import "encoding/json"
 import "errors"
 import "fmt"
+import "hash/fnv"
 import "reflect"
 import "sort"
 import "strings"
+import "sync"
 import "time"
 
 import "github.com/gocql/gocql"
@@ -12,6 +16,8 @@ import "github.com/gocql/gocql"
 type fakeKeyspace struct {
 	Cluster *fakeCluster
 	CFs     map[string]*fakeTable
+	Views   map[string]*fakeView
+	Types   map[string]*fakeType
 	Options optionMap
 }
 
@@ -19,12 +25,55 @@ func (ks *fakeKeyspace) GetCF(name string) (*fakeTable, error) {
 	if ks.CFs == nil {
 		ks.CFs = make(map[string]*fakeTable)
 	}
+	version := parseReleaseVersion(ks.Cluster.ReleaseVersion)
+	if version.systemSchema() {
+		if strings.HasPrefix(name, "system.schema_") {
+			return nil, errors.New("unconfigured table " + name[len("system."):])
+		}
+	} else if strings.HasPrefix(name, "system_schema.") {
+		return nil, errors.New("keyspace system_schema does not exist")
+	} else if name == "system.schema_usertypes" && !version.userTypes() {
+		return nil, errors.New("unconfigured columnfamily schema_usertypes")
+	}
 	if name == "system.schema_columnfamilies" {
 		return ks.Cluster.schemaColumnFamilies(), nil
 	}
+	if name == "system.schema_keyspaces" {
+		return ks.Cluster.schemaKeyspaces(), nil
+	}
 	if name == "system.schema_columns" {
 		return ks.Cluster.schemaColumns(), nil
 	}
+	if name == "system.local" {
+		return ks.Cluster.systemLocal(), nil
+	}
+	if name == "system.peers" {
+		return ks.Cluster.systemPeers(), nil
+	}
+	if name == "system.schema_usertypes" {
+		return ks.Cluster.schemaUserTypes(), nil
+	}
+	if name == "system_schema.keyspaces" {
+		return ks.Cluster.systemSchemaKeyspaces(), nil
+	}
+	if name == "system_schema.tables" {
+		return ks.Cluster.systemSchemaTables(), nil
+	}
+	if name == "system_schema.columns" {
+		return ks.Cluster.systemSchemaColumns(), nil
+	}
+	if name == "system_schema.indexes" {
+		return ks.Cluster.systemSchemaIndexes(), nil
+	}
+	if name == "system_schema.types" {
+		return ks.Cluster.systemSchemaTypes(), nil
+	}
+	if name == "system_schema.views" {
+		return ks.Cluster.schemaViews(), nil
+	}
+	if view, ok := ks.Views[name]; ok {
+		return view.table(ks.CFs[view.Base]), nil
+	}
 	cf, ok := ks.CFs[name]
 	if !ok {
 		return nil, errors.New("column family doesn't exist: " + name)
@@ -39,16 +88,121 @@ func (ks *fakeKeyspace) AddCF(name string, table *fakeTable) {
 	ks.CFs[name] = table
 }
 
+func (ks *fakeKeyspace) AddView(name string, view *fakeView) {
+	if ks.Views == nil {
+		ks.Views = make(map[string]*fakeView)
+	}
+	ks.Views[name] = view
+}
+
+func (ks *fakeKeyspace) AddType(name string, udt *fakeType) {
+	if ks.Types == nil {
+		ks.Types = make(map[string]*fakeType)
+	}
+	ks.Types[name] = udt
+}
+
+// checkTypes returns an error if any of the given types is a user-defined type that doesn't exist.
+func (ks *fakeKeyspace) checkTypes(types []*gocql.TypeInfo) error {
+	for _, ti := range types {
+		if ti != nil && ti.Type == gocql.TypeCustom {
+			if _, ok := ks.Types[ti.Custom]; !ok {
+				return errors.New("type doesn't exist: " + ti.Custom)
+			}
+		}
+	}
+	return nil
+}
+
+// A fakeType imitates a user-defined type. Values of the type are stored as they are given.
+type fakeType struct {
+	Fields     []string
+	FieldTypes []*gocql.TypeInfo
+}
+
+// findIndex returns the table and column of the secondary index with the given name.
+func (ks *fakeKeyspace) findIndex(name string) (*fakeTable, string, bool) {
+	for _, t := range ks.CFs {
+		for col, idx := range t.Indexes {
+			if idx == name {
+				return t, col, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// A fakeView imitates a materialized view. Its rows are derived from those of its base table
+// whenever it is queried.
+type fakeView struct {
+	Base             string
+	Columns          []string // if nil, all columns of the base table are selected
+	Key              []string
+	PartitionKeySize int
+}
+
+func (v *fakeView) table(base *fakeTable) *fakeTable {
+	table := &fakeTable{
+		Columns:          v.Columns,
+		Key:              v.Key,
+		PartitionKeySize: v.PartitionKeySize,
+		Rows:             make([]MarshaledMap, 0),
+	}
+	if base == nil {
+		return table
+	}
+	if table.Columns == nil {
+		table.Columns = base.Columns
+	}
+	for _, row := range base.Rows {
+		// rows with null key columns are left out of the view
+		complete := true
+		for _, k := range v.Key {
+			if row[k] == nil {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			table.Rows = append(table.Rows, row)
+		}
+	}
+	return table
+}
+
 type fakeCluster struct {
 	Keyspaces       map[string]*fakeKeyspace
 	CurrentKeyspace string
+	SchemaVersion   gocql.UUID
+	Peers           map[string]*fakePeer
+
+	// The version of Cassandra imitated, which determines whether the schema is described in the
+	// system keyspace (before 3.0) or the system_schema keyspace.
+	ReleaseVersion string
+
+	sync.Mutex // held by queries, which may be made concurrently
+}
+
+// A fakePeer imitates another node in the cluster, for the purpose of schema agreement. After each
+// schema change, the peer continues to report its former schema version until it has been polled
+// Lag times.
+type fakePeer struct {
+	SchemaVersion gocql.UUID
+	Lag           int
+	Joining       bool // if set, the peer reports a null schema version
+	pending       int
 }
 
 // FakeCassandra returns a Cluster interface to an in-memory imitation of Cassandra. This is great
 // for unit testing, but beware that the fake implementation is quite rudimentary, incomplete, and
 // probably inaccurate.
 func FakeCassandra(keyspace string) Cluster {
-	c := &fakeCluster{Keyspaces: make(map[string]*fakeKeyspace)}
+	c := &fakeCluster{
+		Keyspaces:      make(map[string]*fakeKeyspace),
+		SchemaVersion:  gocql.TimeUUID(),
+		Peers:          make(map[string]*fakePeer),
+		ReleaseVersion: "3.0.0",
+	}
 	c.AddKeyspace("system")
 	c.AddKeyspace(keyspace)
 	c.CurrentKeyspace = keyspace
@@ -61,6 +215,20 @@ func (c *fakeCluster) GetKeyspace() string {
 	return c.CurrentKeyspace
 }
 
+// AddPeer simulates another node in the cluster that lags behind schema changes. After each
+// change, the peer will report a stale schema version the next lag times that system.peers is
+// queried.
+func (c *fakeCluster) AddPeer(addr string, lag int) {
+	c.Peers[addr] = &fakePeer{SchemaVersion: c.SchemaVersion, Lag: lag}
+}
+
+func (c *fakeCluster) schemaChanged() {
+	c.SchemaVersion = gocql.TimeUUID()
+	for _, peer := range c.Peers {
+		peer.pending = peer.Lag
+	}
+}
+
 func (c *fakeCluster) AddKeyspace(name string) *fakeKeyspace {
 	ks := &fakeKeyspace{Cluster: c}
 	c.Keyspaces[name] = ks
@@ -68,7 +236,17 @@ func (c *fakeCluster) AddKeyspace(name string) *fakeKeyspace {
 }
 
 func (c *fakeCluster) Query(stmts ...CQL) Query {
+	c.Lock()
+	defer c.Unlock()
 	var results resultSet
+	if len(stmts) > 1 && !isCounterBatch(stmts) {
+		for _, stmt := range stmts {
+			if stmt.counter {
+				return &fakeQuery{err: errors.New(
+					"counter and non-counter mutations cannot exist in the same batch")}
+			}
+		}
+	}
 	for _, stmt := range stmts {
 		parser := newStatement(string(stmt.PreparedCQL))
 		if err := parser.Compile(); err != nil {
@@ -90,7 +268,8 @@ func (c *fakeCluster) Query(stmts ...CQL) Query {
 func (c *fakeCluster) schemaColumnFamilies() *fakeTable {
 	table := &fakeTable{
 		Columns: []string{"keyspace_name", "columnfamily_name", "key_aliases", "column_aliases",
-			"comment"},
+			"comment", "compaction_strategy_class", "compaction_strategy_options",
+			"compression_parameters", "caching", "default_time_to_live", "gc_grace_seconds"},
 		Key:  []string{"keyspace_name", "columnfamily_name"},
 		Rows: make([]MarshaledMap, 0),
 	}
@@ -108,14 +287,27 @@ func (c *fakeCluster) schemaColumnFamilies() *fakeTable {
 			mmap := make(MarshaledMap)
 			mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
 			mmap["columnfamily_name"] = (*MarshaledValue)(LiteralValue(tname))
-			mmap["key_aliases"] = stringList(t.Key[:1])
-			mmap["column_aliases"] = stringList(t.Key[1:])
-			mmap["comment"] = (*MarshaledValue)(LiteralValue(""))
-			if t.Options != nil {
-				if c, ok := t.Options["comment"]; ok {
-					mmap["comment"] = (*MarshaledValue)(LiteralValue(c))
-				}
+			partition := t.PartitionKey()
+			mmap["key_aliases"] = stringList(partition)
+			mmap["column_aliases"] = stringList(t.Key[len(partition):])
+			mmap["comment"] = t.Options.value("comment", LiteralValue(""))
+			compaction := t.Options.optionMap("compaction")
+			class, ok := compaction["class"]
+			if !ok {
+				class = "SizeTieredCompactionStrategy"
+			}
+			if !strings.Contains(class, ".") {
+				class = "org.apache.cassandra.db.compaction." + class
 			}
+			delete(compaction, "class")
+			mmap["compaction_strategy_class"] = LiteralValue(class)
+			mmap["compaction_strategy_options"] = LiteralValue(encodeOptionMap(compaction))
+			mmap["compression_parameters"] = t.Options.value("compression",
+				LiteralValue(`{"sstable_compression":"org.apache.cassandra.io.compress.LZ4Compressor"}`))
+			mmap["caching"] = t.Options.value("caching",
+				LiteralValue(`{"keys":"ALL","rows_per_partition":"NONE"}`))
+			mmap["default_time_to_live"] = t.Options.value("default_time_to_live", LiteralValue(0))
+			mmap["gc_grace_seconds"] = t.Options.value("gc_grace_seconds", LiteralValue(864000))
 			table.Rows = append(table.Rows, mmap)
 		}
 	}
@@ -124,30 +316,273 @@ func (c *fakeCluster) schemaColumnFamilies() *fakeTable {
 
 func (c *fakeCluster) schemaColumns() *fakeTable {
 	table := &fakeTable{
-		Columns: []string{"keyspace_name", "columnfamily_name", "column_name", "validator"},
-		Key:     []string{"keyspace_name", "columnfamily_name"},
+		Columns: []string{"keyspace_name", "columnfamily_name", "column_name", "validator",
+			"index_name", "type"},
+		Key:  []string{"keyspace_name", "columnfamily_name"},
+		Rows: make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		validator := func(coltype *gocql.TypeInfo) string { return fakeValidator(ksname, coltype) }
+		for tname, t := range ks.CFs {
+			order := t.Options.optionMap("clustering order")
+			for i, colname := range t.Columns {
+				v := validator(t.ColumnTypes[i])
+				if order[colname] == "DESC" {
+					v = reversedType + v + ")"
+				}
+				mmap := make(MarshaledMap)
+				mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
+				mmap["columnfamily_name"] = (*MarshaledValue)(LiteralValue(strings.ToLower(tname)))
+				mmap["column_name"] = (*MarshaledValue)(LiteralValue(colname))
+				mmap["validator"] = (*MarshaledValue)(LiteralValue(v))
+				if idx, ok := t.Indexes[colname]; ok {
+					mmap["index_name"] = (*MarshaledValue)(LiteralValue(idx))
+				}
+				mmap["type"] = (*MarshaledValue)(LiteralValue(t.columnKind(colname)))
+				table.Rows = append(table.Rows, mmap)
+			}
+		}
+	}
+	return table
+}
+
+// fakeValidator returns the validator class Cassandra would report for a column of the given type.
+func fakeValidator(ksname string, coltype *gocql.TypeInfo) string {
+	if coltype.Type == gocql.TypeCustom {
+		return fmt.Sprintf("org.apache.cassandra.db.marshal.FrozenType("+
+			"org.apache.cassandra.db.marshal.UserType(%s,%s))",
+			ksname, hex.EncodeToString([]byte(coltype.Custom)))
+	}
+	for n, ti := range typeInfoMap {
+		if ti == coltype {
+			for v, t := range column_validators {
+				if t == n {
+					return v
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (c *fakeCluster) schemaKeyspaces() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "durable_writes", "strategy_class", "strategy_options"},
+		Key:     []string{"keyspace_name"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		replication := ks.Options.optionMap("replication")
+		class := replication["class"]
+		if class == "" {
+			class = "SimpleStrategy"
+		}
+		if !strings.Contains(class, ".") {
+			class = "org.apache.cassandra.locator." + class
+		}
+		delete(replication, "class")
+		mmap := make(MarshaledMap)
+		mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
+		mmap["durable_writes"] = ks.Options.value("durable_writes", LiteralValue(true))
+		mmap["strategy_class"] = (*MarshaledValue)(LiteralValue(class))
+		mmap["strategy_options"] = (*MarshaledValue)(LiteralValue(encodeOptionMap(replication)))
+		table.Rows = append(table.Rows, mmap)
+	}
+	return table
+}
+
+func (c *fakeCluster) schemaUserTypes() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "type_name", "field_names", "field_types"},
+		Key:     []string{"keyspace_name", "type_name"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		for tname, udt := range ks.Types {
+			validators := make([]string, len(udt.FieldTypes))
+			for i, ti := range udt.FieldTypes {
+				validators[i] = fakeValidator(ksname, ti)
+			}
+			mmap := make(MarshaledMap)
+			mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
+			mmap["type_name"] = (*MarshaledValue)(LiteralValue(tname))
+			mmap["field_names"] = (*MarshaledValue)(LiteralValue(udt.Fields))
+			mmap["field_types"] = (*MarshaledValue)(LiteralValue(validators))
+			table.Rows = append(table.Rows, mmap)
+		}
+	}
+	return table
+}
+
+func (c *fakeCluster) schemaViews() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "view_name", "base_table_name"},
+		Key:     []string{"keyspace_name", "view_name"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		for vname, v := range ks.Views {
+			mmap := make(MarshaledMap)
+			mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
+			mmap["view_name"] = (*MarshaledValue)(LiteralValue(vname))
+			mmap["base_table_name"] = (*MarshaledValue)(LiteralValue(v.Base))
+			table.Rows = append(table.Rows, mmap)
+		}
+	}
+	return table
+}
+
+// systemSchemaKeyspaces imitates system_schema.keyspaces.
+func (c *fakeCluster) systemSchemaKeyspaces() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "durable_writes", "replication"},
+		Key:     []string{"keyspace_name"},
 		Rows:    make([]MarshaledMap, 0),
 	}
-	validator := func(coltype *gocql.TypeInfo) string {
-		for n, ti := range typeInfoMap {
-			if ti == coltype {
-				for v, t := range column_validators {
-					if t == n {
-						return v
+	for ksname, ks := range c.Keyspaces {
+		replication := ks.Options.optionMap("replication")
+		if replication["class"] == "" {
+			replication["class"] = "SimpleStrategy"
+		}
+		if !strings.Contains(replication["class"], ".") {
+			replication["class"] = "org.apache.cassandra.locator." + replication["class"]
+		}
+		mmap := make(MarshaledMap)
+		mmap["keyspace_name"] = LiteralValue(ksname)
+		mmap["durable_writes"] = ks.Options.value("durable_writes", LiteralValue(true))
+		mmap["replication"] = LiteralValue(replication)
+		table.Rows = append(table.Rows, mmap)
+	}
+	return table
+}
+
+// systemSchemaTables imitates system_schema.tables.
+func (c *fakeCluster) systemSchemaTables() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "table_name", "comment", "compaction", "compression",
+			"caching", "default_time_to_live", "gc_grace_seconds"},
+		Key:  []string{"keyspace_name", "table_name"},
+		Rows: make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		for tname, t := range ks.CFs {
+			compaction := t.Options.optionMap("compaction")
+			if compaction["class"] == "" {
+				compaction["class"] = "SizeTieredCompactionStrategy"
+			}
+			if !strings.Contains(compaction["class"], ".") {
+				compaction["class"] = "org.apache.cassandra.db.compaction." + compaction["class"]
+			}
+			compression := t.Options.optionMap("compression")
+			if class, ok := compression["sstable_compression"]; ok {
+				delete(compression, "sstable_compression")
+				compression["class"] = class
+			} else if len(compression) == 0 {
+				compression["class"] = "org.apache.cassandra.io.compress.LZ4Compressor"
+			}
+			caching := t.Options.optionMap("caching")
+			if len(caching) == 0 {
+				caching = map[string]string{"keys": "ALL", "rows_per_partition": "NONE"}
+			}
+			mmap := make(MarshaledMap)
+			mmap["keyspace_name"] = LiteralValue(ksname)
+			mmap["table_name"] = LiteralValue(tname)
+			mmap["comment"] = t.Options.value("comment", LiteralValue(""))
+			mmap["compaction"] = LiteralValue(compaction)
+			mmap["compression"] = LiteralValue(compression)
+			mmap["caching"] = LiteralValue(caching)
+			mmap["default_time_to_live"] = t.Options.value("default_time_to_live", LiteralValue(0))
+			mmap["gc_grace_seconds"] = t.Options.value("gc_grace_seconds", LiteralValue(864000))
+			table.Rows = append(table.Rows, mmap)
+		}
+	}
+	return table
+}
+
+// systemSchemaColumns imitates system_schema.columns, which describes the columns of both tables
+// and materialized views.
+func (c *fakeCluster) systemSchemaColumns() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "table_name", "column_name", "kind", "position", "type",
+			"clustering_order"},
+		Key:  []string{"keyspace_name", "table_name", "column_name"},
+		Rows: make([]MarshaledMap, 0),
+	}
+	addColumns := func(ksname, tname string, t, base *fakeTable) {
+		order := t.Options.optionMap("clustering order")
+		partition := t.PartitionKey()
+		for _, colname := range t.Columns {
+			kind, position, clustering := t.columnKind(colname), -1, "none"
+			for i, k := range t.Key {
+				if k == colname {
+					if i < len(partition) {
+						position = i
+					} else {
+						kind, position, clustering = "clustering", i-len(partition), "asc"
+						if order[colname] == "DESC" {
+							clustering = "desc"
+						}
 					}
 				}
 			}
+			mmap := make(MarshaledMap)
+			mmap["keyspace_name"] = LiteralValue(ksname)
+			mmap["table_name"] = LiteralValue(tname)
+			mmap["column_name"] = LiteralValue(colname)
+			mmap["kind"] = LiteralValue(kind)
+			mmap["position"] = LiteralValue(position)
+			mmap["type"] = LiteralValue(fakeCQLType(base.columnType(colname)))
+			mmap["clustering_order"] = LiteralValue(clustering)
+			table.Rows = append(table.Rows, mmap)
+		}
+	}
+	for ksname, ks := range c.Keyspaces {
+		for tname, t := range ks.CFs {
+			addColumns(ksname, strings.ToLower(tname), t, t)
 		}
+		for vname, v := range ks.Views {
+			base := ks.CFs[v.Base]
+			addColumns(ksname, vname, v.table(base), base)
+		}
+	}
+	return table
+}
+
+// fakeCQLType returns the type system_schema would report for a column of the given type.
+func fakeCQLType(coltype *gocql.TypeInfo) string {
+	if coltype == nil {
 		return ""
 	}
+	if coltype.Type == gocql.TypeCustom {
+		return "frozen<" + coltype.Custom + ">"
+	}
+	for n, ti := range typeInfoMap {
+		if ti == coltype {
+			if n == "varchar" {
+				return "text"
+			}
+			return n
+		}
+	}
+	return ""
+}
+
+// systemSchemaIndexes imitates system_schema.indexes.
+func (c *fakeCluster) systemSchemaIndexes() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "table_name", "index_name", "kind", "options"},
+		Key:     []string{"keyspace_name", "table_name", "index_name"},
+		Rows:    make([]MarshaledMap, 0),
+	}
 	for ksname, ks := range c.Keyspaces {
 		for tname, t := range ks.CFs {
-			for i, colname := range t.Columns {
+			for colname, idx := range t.Indexes {
 				mmap := make(MarshaledMap)
-				mmap["keyspace_name"] = (*MarshaledValue)(LiteralValue(ksname))
-				mmap["columnfamily_name"] = (*MarshaledValue)(LiteralValue(strings.ToLower(tname)))
-				mmap["column_name"] = (*MarshaledValue)(LiteralValue(colname))
-				mmap["validator"] = (*MarshaledValue)(LiteralValue(validator(t.ColumnTypes[i])))
+				mmap["keyspace_name"] = LiteralValue(ksname)
+				mmap["table_name"] = LiteralValue(strings.ToLower(tname))
+				mmap["index_name"] = LiteralValue(idx)
+				mmap["kind"] = LiteralValue("COMPOSITES")
+				mmap["options"] = LiteralValue(map[string]string{"target": colname})
 				table.Rows = append(table.Rows, mmap)
 			}
 		}
@@ -155,6 +590,67 @@ func (c *fakeCluster) schemaColumns() *fakeTable {
 	return table
 }
 
+// systemSchemaTypes imitates system_schema.types.
+func (c *fakeCluster) systemSchemaTypes() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"keyspace_name", "type_name", "field_names", "field_types"},
+		Key:     []string{"keyspace_name", "type_name"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	for ksname, ks := range c.Keyspaces {
+		for tname, udt := range ks.Types {
+			types := make([]string, len(udt.FieldTypes))
+			for i, ti := range udt.FieldTypes {
+				types[i] = fakeCQLType(ti)
+			}
+			mmap := make(MarshaledMap)
+			mmap["keyspace_name"] = LiteralValue(ksname)
+			mmap["type_name"] = LiteralValue(tname)
+			mmap["field_names"] = LiteralValue(udt.Fields)
+			mmap["field_types"] = LiteralValue(types)
+			table.Rows = append(table.Rows, mmap)
+		}
+	}
+	return table
+}
+
+func (c *fakeCluster) systemLocal() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"key", "release_version", "schema_version"},
+		Key:     []string{"key"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	mmap := make(MarshaledMap)
+	mmap["key"] = (*MarshaledValue)(LiteralValue("local"))
+	mmap["release_version"] = LiteralValue(c.ReleaseVersion)
+	mmap["schema_version"] = (*MarshaledValue)(LiteralValue(c.SchemaVersion))
+	table.Rows = append(table.Rows, mmap)
+	return table
+}
+
+func (c *fakeCluster) systemPeers() *fakeTable {
+	table := &fakeTable{
+		Columns: []string{"peer", "schema_version"},
+		Key:     []string{"peer"},
+		Rows:    make([]MarshaledMap, 0),
+	}
+	for addr, peer := range c.Peers {
+		if peer.pending > 0 {
+			peer.pending--
+		} else {
+			peer.SchemaVersion = c.SchemaVersion
+		}
+		mmap := make(MarshaledMap)
+		mmap["peer"] = (*MarshaledValue)(LiteralValue(addr))
+		mmap["schema_version"] = (*MarshaledValue)(LiteralValue(peer.SchemaVersion))
+		if peer.Joining {
+			mmap["schema_version"].Bytes = nil
+		}
+		table.Rows = append(table.Rows, mmap)
+	}
+	return table
+}
+
 type fakeQuery struct {
 	results resultSet
 	err     error
@@ -215,12 +711,159 @@ func (q *fakeQuery) scan(dests []interface{}, cas bool) bool {
 
 type optionMap map[string]pval
 
+// value returns the literal value of the given option, or def if the option is not set.
+func (m optionMap) value(key string, def *MarshaledValue) *MarshaledValue {
+	if v, ok := m[key]; ok && v.Value != nil {
+		return v.Value
+	}
+	return def
+}
+
+// optionMap decodes a map-valued option.
+func (m optionMap) optionMap(key string) map[string]string {
+	result := make(map[string]string)
+	if v := m.value(key, nil); v != nil {
+		var encoded string
+		if err := gocql.Unmarshal(v.TypeInfo, v.Bytes, &encoded); err == nil {
+			json.Unmarshal([]byte(encoded), &result)
+		}
+	}
+	return result
+}
+
 type fakeTable struct {
-	Columns     []string
-	ColumnTypes []*gocql.TypeInfo
-	Key         []string
-	Rows        []MarshaledMap
-	Options     optionMap
+	Columns          []string
+	ColumnTypes      []*gocql.TypeInfo
+	Key              []string
+	PartitionKeySize int
+	Rows             []MarshaledMap
+	Options          optionMap
+	Indexes          map[string]string // index names by column
+	Statics          map[string]bool   // static columns
+}
+
+// PartitionKey returns the leading columns of Key that make up the partition key.
+func (t *fakeTable) PartitionKey() []string {
+	n := t.PartitionKeySize
+	if n == 0 {
+		n = 1
+	}
+	if n > len(t.Key) {
+		n = len(t.Key)
+	}
+	return t.Key[:n]
+}
+
+// columnKind describes the named column as system.schema_columns does: as "partition_key",
+// "clustering_key", "static", or "regular".
+func (t *fakeTable) columnKind(col string) string {
+	for i, k := range t.Key {
+		if k == col {
+			if i < len(t.PartitionKey()) {
+				return "partition_key"
+			}
+			return "clustering_key"
+		}
+	}
+	if t.Statics[col] {
+		return "static"
+	}
+	return "regular"
+}
+
+// casColumns returns the columns in the order Cassandra reports them for a lightweight transaction
+// that isn't applied: the primary key, then the other columns by name.
+func (t *fakeTable) casColumns() []string {
+	keys := make(map[string]bool)
+	for _, k := range t.Key {
+		keys[k] = true
+	}
+	others := make([]string, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		if !keys[col] {
+			others = append(others, col)
+		}
+	}
+	sort.Strings(others)
+	return append(append([]string{}, t.Key...), others...)
+}
+
+// columnType returns the type of the named column, or nil if there's no such column.
+func (t *fakeTable) columnType(col string) *gocql.TypeInfo {
+	for i, name := range t.Columns {
+		if name == col && i < len(t.ColumnTypes) {
+			return t.ColumnTypes[i]
+		}
+	}
+	return nil
+}
+
+// isCounter returns true if the named column is a counter.
+func (t *fakeTable) isCounter(col string) bool {
+	for i, name := range t.Columns {
+		if name == col && i < len(t.ColumnTypes) {
+			return t.ColumnTypes[i].Type == gocql.TypeCounter
+		}
+	}
+	return false
+}
+
+func (t *fakeTable) isCounterTable() bool {
+	for _, ti := range t.ColumnTypes {
+		if ti.Type == gocql.TypeCounter {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPartitionRestriction imitates Cassandra's requirement that a query restricting any part of a
+// composite partition key must restrict all of it.
+func (t *fakeTable) checkPartitionRestriction(where []comparison) error {
+	restricted := make(map[string]bool)
+	partition := t.PartitionKey()
+	for _, cmp := range where {
+		if cols := cmp.tokenColumns(); cols != nil {
+			if strings.Join(cols, ",") != strings.Join(partition, ",") {
+				return errors.New("token() must be given the partition key: " +
+					strings.Join(partition, ", "))
+			}
+		} else if cmp.op == "=" {
+			restricted[cmp.col] = true
+		}
+	}
+	missing := make([]string, 0)
+	for _, k := range partition {
+		if !restricted[k] {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 && len(missing) < len(partition) {
+		return errors.New("partition key parts must be restricted: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkIndexedRestriction imitates Cassandra's refusal to restrict columns that are neither part of
+// the primary key nor indexed, unless ALLOW FILTERING is given.
+func (t *fakeTable) checkIndexedRestriction(where []comparison) error {
+	for _, cmp := range where {
+		if _, ok := t.Indexes[cmp.col]; ok || cmp.tokenColumns() != nil {
+			continue
+		}
+		found := false
+		for _, k := range t.Key {
+			if k == cmp.col {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("cannot restrict column " + cmp.col +
+				" without a secondary index or ALLOW FILTERING")
+		}
+	}
+	return nil
 }
 
 func (t *fakeTable) Get(keyvals []*MarshaledValue) MarshaledMap {
@@ -234,8 +877,12 @@ func (t *fakeTable) Get(keyvals []*MarshaledValue) MarshaledMap {
 
 func (t *fakeTable) Set(mmap MarshaledMap, cas bool) (MarshaledMap, bool, error) {
 	values := mmap.ValuesOf(t.Key...)
+	partition := values[:len(t.PartitionKey())]
 	for i, v := range values {
 		if v == nil {
+			if i >= len(partition) && t.onlyStatics(mmap) {
+				return t.setStatics(partition, mmap, cas)
+			}
 			return nil, false, errors.New("key value for " + t.Key[i] + " not given")
 		}
 	}
@@ -246,22 +893,142 @@ func (t *fakeTable) Set(mmap MarshaledMap, cas bool) (MarshaledMap, bool, error)
 		}
 	} else {
 		row = make(MarshaledMap)
+		// a new row shares the static values of its partition, and replaces any row that held
+		// only those values
+		for _, prow := range t.partitionRows(partition) {
+			for col := range t.Statics {
+				if v, ok := prow[col]; ok {
+					row[col] = v
+				}
+			}
+		}
+		t.removeStaticRows(partition)
 		t.Rows = append(t.Rows, row)
 	}
 	for k, v := range mmap {
 		row[k] = v
 	}
+	for _, prow := range t.partitionRows(partition) {
+		for k, v := range mmap {
+			if t.Statics[k] {
+				prow[k] = v
+			}
+		}
+	}
 	return row, true, nil
 }
 
+// onlyStatics returns true if the columns given outside the primary key are all static.
+func (t *fakeTable) onlyStatics(mmap MarshaledMap) bool {
+	if len(t.Statics) == 0 {
+		return false
+	}
+	clustering := make(map[string]bool)
+	for _, k := range t.Key[len(t.PartitionKey()):] {
+		clustering[k] = true
+	}
+	for k, v := range mmap {
+		if clustering[k] {
+			if v != nil {
+				return false
+			}
+		} else if !t.Statics[k] && !t.inPartitionKey(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *fakeTable) inPartitionKey(col string) bool {
+	for _, k := range t.PartitionKey() {
+		if k == col {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionRows returns the rows of the partition with the given key.
+func (t *fakeTable) partitionRows(partition []*MarshaledValue) []MarshaledMap {
+	rows := make([]MarshaledMap, 0)
+	for _, row := range t.Rows {
+		if row.Match(t.PartitionKey(), partition) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// removeStaticRows removes the row holding only the static values of a partition that has no other
+// rows.
+func (t *fakeTable) removeStaticRows(partition []*MarshaledValue) {
+	rows := make([]MarshaledMap, 0, len(t.Rows))
+	clustering := t.Key[len(partition):]
+	for _, row := range t.Rows {
+		if row.Match(t.PartitionKey(), partition) && row[clustering[0]] == nil {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	t.Rows = rows
+}
+
+// setStatics writes static columns given only the partition key. If the partition has no rows, a
+// row is created with null clustering columns to hold the static values, as Cassandra reports them.
+func (t *fakeTable) setStatics(partition []*MarshaledValue, mmap MarshaledMap, cas bool) (
+	MarshaledMap, bool, error) {
+	rows := t.partitionRows(partition)
+	if len(rows) > 0 && cas {
+		return rows[0], false, nil
+	}
+	if len(rows) == 0 {
+		row := make(MarshaledMap)
+		for i, k := range t.PartitionKey() {
+			row[k] = partition[i]
+		}
+		t.Rows = append(t.Rows, row)
+		rows = append(rows, row)
+	}
+	for _, row := range rows {
+		for k, v := range mmap {
+			if t.Statics[k] {
+				row[k] = v
+			}
+		}
+	}
+	return rows[0], true, nil
+}
+
 type comparison struct {
-	col string
+	col string // may be a token of columns, as in "token(a,b)"
 	op  string
 	val pval
 }
 
+// tokenColumns returns the columns of a comparison of a token, or nil if it isn't one.
+func (cmp *comparison) tokenColumns() []string {
+	if !strings.HasPrefix(cmp.col, "token(") || !strings.HasSuffix(cmp.col, ")") {
+		return nil
+	}
+	return strings.Split(cmp.col[len("token("):len(cmp.col)-1], ",")
+}
+
+// fakeToken imitates a partitioner, hashing the values of the given columns to a bigint.
+func fakeToken(row MarshaledMap, cols []string) *MarshaledValue {
+	h := fnv.New64a()
+	for _, col := range cols {
+		if v := row[col]; v != nil {
+			h.Write(v.Bytes)
+		}
+	}
+	return LiteralValue(int64(h.Sum64()))
+}
+
 func (cmp *comparison) match(row MarshaledMap, binds valueList) (bool, error) {
 	left, ok := row[cmp.col]
+	if cols := cmp.tokenColumns(); cols != nil {
+		left, ok = fakeToken(row, cols), true
+	}
 	if !ok || left == nil {
 		return false, nil
 	}
@@ -494,6 +1261,10 @@ func LiteralValue(val interface{}) *MarshaledValue {
 		ti = TIBigInt
 	case string, SeqID:
 		ti = TIVarchar
+	case []string:
+		ti = tiVarcharList
+	case map[string]string:
+		ti = tiVarcharMap
 	case time.Time:
 		ti = TITimestamp
 	case TimeUUID, gocql.UUID:
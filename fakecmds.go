@@ -31,34 +31,250 @@ func (cmd *createKeyspaceCommand) Execute(ks *fakeKeyspace, vals valueList) (res
 		if cmd.strict {
 			return nil, errors.New("keyspace already exists: " + cmd.identifier)
 		}
+		return resultSet{}, nil
 	}
 	ks = ks.Cluster.AddKeyspace(cmd.identifier)
 	ks.Cluster.CurrentKeyspace = cmd.identifier
 	ks.Options = cmd.options
+	ks.Cluster.schemaChanged()
 	return resultSet{}, nil
 }
 
-type createTableCommand struct {
-	strict     bool
+type alterKeyspaceCommand struct {
 	identifier string
-	colnames   []string
-	coltypes   []*gocql.TypeInfo
-	key        []string
 	options    optionMap
 }
 
+func (cmd *alterKeyspaceCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
+	target, ok := ks.Cluster.Keyspaces[cmd.identifier]
+	if !ok {
+		return nil, errors.New("keyspace doesn't exist: " + cmd.identifier)
+	}
+	if target.Options == nil {
+		target.Options = make(optionMap)
+	}
+	for k, v := range cmd.options {
+		target.Options[k] = v
+	}
+	ks.Cluster.schemaChanged()
+	return resultSet{}, nil
+}
+
+type createTableCommand struct {
+	strict           bool
+	identifier       string
+	colnames         []string
+	coltypes         []*gocql.TypeInfo
+	key              []string
+	partitionKeySize int
+	statics          []string
+	options          optionMap
+}
+
 func (cmd *createTableCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
 	if _, ok := ks.CFs[cmd.identifier]; ok && cmd.strict {
 		return nil, errors.New("table " + cmd.identifier + " already exists")
 	}
+	if err := ks.checkTypes(cmd.coltypes); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, k := range cmd.key {
+		keys[k] = true
+	}
+	var counters, others int
+	for i, col := range cmd.colnames {
+		if cmd.coltypes[i].Type == gocql.TypeCounter {
+			if keys[col] {
+				return nil, errors.New("counter type is not supported for PRIMARY KEY part " + col)
+			}
+			counters++
+		} else if !keys[col] {
+			others++
+		}
+	}
+	if counters > 0 && others > 0 {
+		return nil, errors.New("cannot mix counter and non counter columns in the same table")
+	}
+	var statics map[string]bool
+	for _, col := range cmd.statics {
+		if keys[col] {
+			return nil, errors.New("static column " + col + " cannot be part of the PRIMARY KEY")
+		}
+		if len(cmd.key) <= cmd.partitionKeySize {
+			return nil, errors.New("static columns are only useful (and thus allowed) if the " +
+				"table has at least one clustering column")
+		}
+		if statics == nil {
+			statics = make(map[string]bool)
+		}
+		statics[col] = true
+	}
 	table := &fakeTable{
-		Columns:     cmd.colnames,
-		ColumnTypes: cmd.coltypes,
-		Key:         cmd.key,
-		Options:     cmd.options,
-		Rows:        make([]MarshaledMap, 0),
+		Columns:          cmd.colnames,
+		ColumnTypes:      cmd.coltypes,
+		Key:              cmd.key,
+		PartitionKeySize: cmd.partitionKeySize,
+		Options:          cmd.options,
+		Statics:          statics,
+		Rows:             make([]MarshaledMap, 0),
 	}
 	ks.AddCF(cmd.identifier, table)
+	ks.Cluster.schemaChanged()
+	return resultSet{}, nil
+}
+
+type createTypeCommand struct {
+	strict     bool
+	identifier string
+	fieldnames []string
+	fieldtypes []*gocql.TypeInfo
+}
+
+func (cmd *createTypeCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
+	if _, ok := ks.Types[cmd.identifier]; ok {
+		if cmd.strict {
+			return nil, errors.New("type " + cmd.identifier + " already exists")
+		}
+		return resultSet{}, nil
+	}
+	if err := ks.checkTypes(cmd.fieldtypes); err != nil {
+		return nil, err
+	}
+	ks.AddType(cmd.identifier, &fakeType{Fields: cmd.fieldnames, FieldTypes: cmd.fieldtypes})
+	ks.Cluster.schemaChanged()
+	return resultSet{}, nil
+}
+
+type alterTypeCommand struct {
+	identifier string
+	add        string
+	alter      string
+	fieldtype  *gocql.TypeInfo
+}
+
+func (cmd *alterTypeCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
+	udt, ok := ks.Types[cmd.identifier]
+	if !ok {
+		return nil, errors.New("type doesn't exist: " + cmd.identifier)
+	}
+	if err := ks.checkTypes([]*gocql.TypeInfo{cmd.fieldtype}); err != nil {
+		return nil, err
+	}
+	for i, f := range udt.Fields {
+		if cmd.add == f {
+			return nil, errors.New("field " + f + " already exists")
+		}
+		if cmd.alter == f {
+			udt.FieldTypes[i] = cmd.fieldtype
+			ks.Cluster.schemaChanged()
+			return resultSet{}, nil
+		}
+	}
+	if cmd.add == "" {
+		return nil, errors.New("no such field: " + cmd.alter)
+	}
+	udt.Fields = append(udt.Fields, cmd.add)
+	udt.FieldTypes = append(udt.FieldTypes, cmd.fieldtype)
+	ks.Cluster.schemaChanged()
+	return resultSet{}, nil
+}
+
+type createIndexCommand struct {
+	strict     bool
+	identifier string
+	table      string
+	column     string
+}
+
+func (cmd *createIndexCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
+	cf, ok := ks.CFs[cmd.table]
+	if !ok {
+		return nil, errors.New("column family doesn't exist: " + cmd.table)
+	}
+	found := false
+	for _, col := range cf.Columns {
+		if col == cmd.column {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("no such column: " + cmd.column)
+	}
+	name := cmd.identifier
+	if name == "" {
+		name = cmd.table + "_" + cmd.column + "_idx"
+	}
+	if _, _, ok := ks.findIndex(name); ok || cf.Indexes[cmd.column] != "" {
+		if cmd.strict {
+			return nil, errors.New("index already exists: " + name)
+		}
+		return resultSet{}, nil
+	}
+	if cf.Indexes == nil {
+		cf.Indexes = make(map[string]string)
+	}
+	cf.Indexes[cmd.column] = name
+	ks.Cluster.schemaChanged()
+	return resultSet{}, nil
+}
+
+type createViewCommand struct {
+	strict           bool
+	identifier       string
+	base             string
+	cols             []string
+	key              []string
+	partitionKeySize int
+}
+
+func (cmd *createViewCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
+	if _, ok := ks.Views[cmd.identifier]; ok {
+		if cmd.strict {
+			return nil, errors.New("materialized view already exists: " + cmd.identifier)
+		}
+		return resultSet{}, nil
+	}
+	base, ok := ks.CFs[cmd.base]
+	if !ok {
+		return nil, errors.New("column family doesn't exist: " + cmd.base)
+	}
+	view := &fakeView{
+		Base:             cmd.base,
+		Key:              cmd.key,
+		PartitionKeySize: cmd.partitionKeySize,
+	}
+	if len(cmd.cols) != 1 || cmd.cols[0] != "*" {
+		view.Columns = cmd.cols
+	}
+	columns := view.table(base).Columns
+	for _, k := range append(append([]string{}, base.Key...), cmd.key...) {
+		found := false
+		for _, col := range columns {
+			if col == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("primary key column must be selected: " + k)
+		}
+	}
+	for _, k := range base.Key {
+		found := false
+		for _, vk := range cmd.key {
+			if vk == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("view primary key must include base primary key column " + k)
+		}
+	}
+	ks.AddView(cmd.identifier, view)
+	ks.Cluster.schemaChanged()
 	return resultSet{}, nil
 }
 
@@ -84,6 +300,28 @@ func (cmd *dropCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, er
 			}
 		} else {
 			delete(c.Keyspaces, cmd.identifier)
+			c.schemaChanged()
+		}
+		return resultSet{}, nil
+	case "index":
+		cf, col, ok := ks.findIndex(cmd.identifier)
+		if !ok {
+			if cmd.strict {
+				return nil, errors.New("index doesn't exist: " + cmd.identifier)
+			}
+		} else {
+			delete(cf.Indexes, col)
+			ks.Cluster.schemaChanged()
+		}
+		return resultSet{}, nil
+	case "materialized view":
+		if _, ok := ks.Views[cmd.identifier]; !ok {
+			if cmd.strict {
+				return nil, errors.New("materialized view doesn't exist: " + cmd.identifier)
+			}
+		} else {
+			delete(ks.Views, cmd.identifier)
+			ks.Cluster.schemaChanged()
 		}
 		return resultSet{}, nil
 	default:
@@ -106,6 +344,9 @@ func (cmd *insertCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 	if len(cmd.keys) != len(cmd.values) {
 		return nil, errors.New("number of keys and number of values do not match")
 	}
+	if cf.isCounterTable() {
+		return nil, errors.New("INSERT statements are not allowed on counter tables, use UPDATE instead")
+	}
 	mmap := make(MarshaledMap)
 	for i, k := range cmd.keys {
 		mmap[k] = (*MarshaledValue)(cmd.values[i].Get(vals))
@@ -115,19 +356,23 @@ func (cmd *insertCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 		return nil, err
 	}
 	srow := row.Select(cmd.keys)
+	if cmd.cas && !applied {
+		// the existing row is reported in its entirety
+		srow = row.Select(cf.casColumns())
+	}
 	if cmd.cas {
-		srow.Columns = append([]string{"*applied"}, srow.Columns...)
-		srow.Row["*applied"] = (*MarshaledValue)(LiteralValue(applied))
+		srow = casResult(srow, applied)
 	}
 	return resultSet{srow}, nil
 }
 
 type selectCommand struct {
-	table string
-	cols  []string
-	where []comparison
-	order []order
-	limit int
+	table          string
+	cols           []string
+	where          []comparison
+	order          []order
+	limit          int
+	allowFiltering bool
 }
 
 func (cmd *selectCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
@@ -135,6 +380,14 @@ func (cmd *selectCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 	if err != nil {
 		return nil, err
 	}
+	if err := cf.checkPartitionRestriction(cmd.where); err != nil {
+		return nil, err
+	}
+	if !cmd.allowFiltering {
+		if err := cf.checkIndexedRestriction(cmd.where); err != nil {
+			return nil, err
+		}
+	}
 	rows, err := cf.Query(cmd.cols, cmd.where, vals)
 	if err != nil {
 		return nil, err
@@ -149,9 +402,16 @@ func (cmd *selectCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 type updateCommand struct {
 	table string
 	set   map[string]pval
+	incr  map[string]counterDelta
 	key   map[string]pval
 }
 
+// A counterDelta is an assignment of the form c = c + delta or c = c - delta.
+type counterDelta struct {
+	sign  int64
+	delta pval
+}
+
 func (cmd *updateCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
 	cf, err := ks.GetCF(cmd.table)
 	if err != nil {
@@ -159,11 +419,39 @@ func (cmd *updateCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 	}
 	mmap := make(MarshaledMap)
 	for k, v := range cmd.set {
+		if cf.isCounter(k) {
+			return nil, errors.New("cannot set the value of counter column " + k +
+				" (counters can only be incremented/decremented, not set)")
+		}
 		mmap[k] = (*MarshaledValue)(v.Get(vals))
 	}
 	for k, v := range cmd.key {
 		mmap[k] = (*MarshaledValue)(v.Get(vals))
 	}
+	if len(cmd.incr) > 0 {
+		row := cf.Get(mmap.ValuesOf(cf.Key...))
+		for k, d := range cmd.incr {
+			if !cf.isCounter(k) {
+				return nil, errors.New("invalid operation for non counter column " + k)
+			}
+			var current, delta int64
+			if row != nil && row[k] != nil {
+				if err := gocql.Unmarshal(TICounter, row[k].Bytes, &current); err != nil {
+					return nil, err
+				}
+			}
+			if v := d.delta.Get(vals); v != nil {
+				if err := gocql.Unmarshal(TIBigInt, v.Bytes, &delta); err != nil {
+					return nil, err
+				}
+			}
+			marshaled, err := gocql.Marshal(TICounter, current+d.sign*delta)
+			if err != nil {
+				return nil, err
+			}
+			mmap[k] = &MarshaledValue{Bytes: marshaled, TypeInfo: TICounter}
+		}
+	}
 	if _, _, err := cf.Set(mmap, false); err != nil {
 		return nil, err
 	}
@@ -176,6 +464,7 @@ type alterCommand struct {
 	alter   string
 	drop    string
 	coltype *gocql.TypeInfo
+	static  bool
 	options optionMap
 }
 
@@ -184,8 +473,17 @@ func (cmd *alterCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, e
 	if err != nil {
 		return nil, err
 	}
+	if err := ks.checkTypes([]*gocql.TypeInfo{cmd.coltype}); err != nil {
+		return nil, err
+	}
 	if cmd.options != nil {
-		cf.Options = cmd.options
+		if cf.Options == nil {
+			cf.Options = make(optionMap)
+		}
+		for k, v := range cmd.options {
+			cf.Options[k] = v
+		}
+		ks.Cluster.schemaChanged()
 		return resultSet{}, nil
 	}
 	found := -1
@@ -202,23 +500,37 @@ func (cmd *alterCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, e
 		}
 	}
 	if cmd.add != "" {
+		if cmd.static {
+			if len(cf.Key) <= len(cf.PartitionKey()) {
+				return nil, errors.New("static columns are only useful (and thus allowed) if the " +
+					"table has at least one clustering column")
+			}
+			if cf.Statics == nil {
+				cf.Statics = make(map[string]bool)
+			}
+			cf.Statics[cmd.add] = true
+		}
 		cf.Columns = append(cf.Columns, cmd.add)
 		cf.ColumnTypes = append(cf.ColumnTypes, cmd.coltype)
+		ks.Cluster.schemaChanged()
 		return resultSet{}, nil
 	}
 	if found == -1 {
 		return nil, errors.New("no such cmdumn: " + cmd.alter + cmd.drop)
 	}
 	if cmd.drop != "" {
+		delete(cf.Statics, cmd.drop)
 		cf.Columns = append(cf.Columns[:found], cf.Columns[found+1:]...)
 		cf.ColumnTypes = append(cf.ColumnTypes[:found], cf.ColumnTypes[found+1:]...)
 	}
+	ks.Cluster.schemaChanged()
 	return resultSet{}, nil
 }
 
 type deleteCommand struct {
 	table string
 	key   map[string]pval
+	cond  map[string]pval
 }
 
 func (cmd *deleteCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet, error) {
@@ -226,7 +538,7 @@ func (cmd *deleteCommand) Execute(ks *fakeKeyspace, vals valueList) (resultSet,
 	if err != nil {
 		return nil, err
 	}
-	cmps := make([]comparison, len(cmd.key))
+	cmps := make([]comparison, 0, len(cmd.key))
 	for k, v := range cmd.key {
 		cmps = append(cmps, comparison{k, "=", v})
 	}
@@ -238,6 +550,9 @@ loop:
 			}
 		}
 		// found match
+		if cmd.cond != nil {
+			return cmd.deleteIf(cf, i, vals)
+		}
 		cf.Rows = append(cf.Rows[:i], cf.Rows[i+1:]...)
 		result := selectedRow{row, make([]string, 0)}
 		for k, _ := range row {
@@ -245,5 +560,36 @@ loop:
 		}
 		return resultSet{result}, nil
 	}
+	if cmd.cond != nil {
+		return resultSet{casResult(selectedRow{MarshaledMap{}, []string{}}, false)}, nil
+	}
 	return resultSet{}, nil
 }
+
+// deleteIf deletes the i'th row of cf if it meets the command's conditions. The existing values of
+// the conditioned columns are reported if it doesn't.
+func (cmd *deleteCommand) deleteIf(cf *fakeTable, i int, vals valueList) (resultSet, error) {
+	row := cf.Rows[i]
+	cols := make([]string, 0, len(cmd.cond))
+	applied := true
+	for k, v := range cmd.cond {
+		cols = append(cols, k)
+		b, err := (&comparison{k, "=", v}).match(row, vals)
+		if err != nil {
+			return nil, err
+		}
+		applied = applied && b
+	}
+	if !applied {
+		return resultSet{casResult(row.Select(cols), false)}, nil
+	}
+	cf.Rows = append(cf.Rows[:i], cf.Rows[i+1:]...)
+	return resultSet{casResult(selectedRow{MarshaledMap{}, []string{}}, true)}, nil
+}
+
+// casResult prepends the [applied] column of a lightweight transaction to a selected row.
+func casResult(srow selectedRow, applied bool) selectedRow {
+	srow.Columns = append([]string{"*applied"}, srow.Columns...)
+	srow.Row["*applied"] = (*MarshaledValue)(LiteralValue(applied))
+	return srow
+}
@@ -1,5 +1,6 @@
 package ibis
 
+import "encoding/json"
 import "errors"
 import "fmt"
 import "strconv"
@@ -187,9 +188,50 @@ func pCreate(t pToken) pToken {
 		return pCreateKeyspace(u)
 	case "table", "columnfamily":
 		return pCreateTable(u)
-	default:
-		return t.fail("expected KEYSPACE or TABLE")
+	case "type":
+		return pCreateType(u)
+	}
+	switch u.ctx {
+	case termId("index"):
+		return pCreateIndex(u)
+	case termId("materialized"):
+		if u = gRequire(pTerm, termId("view"))(u); u.err != nil {
+			return u
+		}
+		return pCreateView(u)
 	}
+	return t.fail("expected KEYSPACE, TABLE, TYPE, INDEX, or MATERIALIZED VIEW")
+}
+
+func pCreateType(t pToken) pToken {
+	var cmd createTypeCommand
+	if u := pIfNotExists(t); u.err == nil {
+		t = u
+	} else {
+		cmd.strict = true
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.identifier = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termSymbol("("))(t); t.err != nil {
+		return t
+	}
+	if t = gList(pColumnDef, pTermComma)(t); t.err != nil {
+		return t
+	}
+	for _, ctx := range t.ctx.([]interface{}) {
+		cdef := ctx.(*ctxColumnDef)
+		if cdef.keys != nil {
+			return t.fail("types can't have a primary key")
+		}
+		cmd.fieldnames = append(cmd.fieldnames, cdef.colName)
+		cmd.fieldtypes = append(cmd.fieldtypes, cdef.colType)
+	}
+	if t = gRequire(pTerm, termSymbol(")"))(t); t.err != nil {
+		return t
+	}
+	return t.with(&cmd)
 }
 
 func pCreateKeyspace(t pToken) pToken {
@@ -237,10 +279,14 @@ func pCreateTable(t pToken) pToken {
 				return t.fail("multiple primary key definitions")
 			}
 			cmd.key = cdef.keys
+			cmd.partitionKeySize = cdef.partitionKeySize
 		}
 		if cdef.colName != "" {
 			cmd.colnames = append(cmd.colnames, cdef.colName)
 			cmd.coltypes = append(cmd.coltypes, cdef.colType)
+			if cdef.static {
+				cmd.statics = append(cmd.statics, cdef.colName)
+			}
 		}
 	}
 	if t = gRequire(pTerm, termSymbol(")"))(t); t.err != nil {
@@ -255,10 +301,115 @@ func pCreateTable(t pToken) pToken {
 	return t.with(&cmd)
 }
 
+func pCreateIndex(t pToken) pToken {
+	var cmd createIndexCommand
+	if u := pIfNotExists(t); u.err == nil {
+		t = u
+	} else {
+		cmd.strict = true
+	}
+	// The index name is optional, so ON may be the next identifier.
+	if u := gRequire(pTerm, termId("on"))(t); u.err != nil {
+		if t = pTermId(t); t.err != nil {
+			return t
+		}
+		cmd.identifier = string(t.ctx.(termId))
+	}
+	if t = gRequire(pTerm, termId("on"))(t); t.err != nil {
+		return t
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.table = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termSymbol("("))(t); t.err != nil {
+		return t
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.column = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termSymbol(")"))(t); t.err != nil {
+		return t
+	}
+	return t.with(&cmd)
+}
+
+func pCreateView(t pToken) pToken {
+	var cmd createViewCommand
+	if u := pIfNotExists(t); u.err == nil {
+		t = u
+	} else {
+		cmd.strict = true
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.identifier = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termId("as"))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termKeyword("select"))(t); t.err != nil {
+		return t
+	}
+	if t = pSelectList(t); t.err != nil {
+		return t
+	}
+	cmd.cols = t.ctx.([]string)
+	if t = gRequire(pTerm, termKeyword("from"))(t); t.err != nil {
+		return t
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.base = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termKeyword("where"))(t); t.err != nil {
+		return t
+	}
+	if t = gList(pIsNotNull, pTermAnd)(t); t.err != nil {
+		return t
+	}
+	if t = pColumnDef(t); t.err != nil {
+		return t
+	}
+	cdef := t.ctx.(*ctxColumnDef)
+	if cdef.keys == nil {
+		return t.fail("expected PRIMARY KEY")
+	}
+	cmd.key = cdef.keys
+	cmd.partitionKeySize = cdef.partitionKeySize
+	// options are accepted but ignored
+	return pWithOptions(t).with(&cmd)
+}
+
+func pIsNotNull(t pToken) pToken {
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	col := t.ctx.(termId)
+	if t = gRequire(pTerm, termId("is"))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termKeyword("not"))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termId("null"))(t); t.err != nil {
+		return t
+	}
+	return t.with(col)
+}
+
+func encodeOptionMap(m map[string]string) string {
+	encoded, _ := json.Marshal(m)
+	return string(encoded)
+}
+
 type ctxColumnDef struct {
-	colName string
-	colType *gocql.TypeInfo
-	keys    []string
+	colName          string
+	colType          *gocql.TypeInfo
+	keys             []string
+	partitionKeySize int
+	static           bool
 }
 
 func pColumnDef(t pToken) pToken {
@@ -270,13 +421,18 @@ func pColumnDef(t pToken) pToken {
 		if u = gRequire(pTerm, termSymbol("("))(u); u.err != nil {
 			return u
 		}
-		if u = pTermIdList(u); u.err != nil {
+		if u = pPartitionKey(u); u.err != nil {
 			return u
 		}
-		ctxs := u.ctx.([]interface{})
-		cdef.keys = make([]string, len(ctxs))
-		for i, ctx := range ctxs {
-			cdef.keys[i] = string(ctx.(termId))
+		cdef.keys = u.ctx.([]string)
+		cdef.partitionKeySize = len(cdef.keys)
+		if v := pTermComma(u); v.err == nil {
+			if u = pTermIdList(v); u.err != nil {
+				return u
+			}
+			for _, ctx := range u.ctx.([]interface{}) {
+				cdef.keys = append(cdef.keys, string(ctx.(termId)))
+			}
 		}
 		if u = gRequire(pTerm, termSymbol(")"))(u); u.err != nil {
 			return u
@@ -291,16 +447,43 @@ func pColumnDef(t pToken) pToken {
 		return t
 	}
 	cdef.colType = t.ctx.(*gocql.TypeInfo)
+	if u := gRequire(pTerm, termId("static"))(t); u.err == nil {
+		cdef.static = true
+		t = u
+	}
 	if u := gRequire(pTerm, termKeyword("primary"))(t); u.err == nil {
 		if u = gRequire(pTerm, termKeyword("key"))(u); u.err != nil {
 			return u
 		}
 		cdef.keys = []string{cdef.colName}
+		cdef.partitionKeySize = 1
 		t = u
 	}
 	return t.with(cdef)
 }
 
+// pPartitionKey parses either a single column name or a parenthesized list of them.
+func pPartitionKey(t pToken) pToken {
+	if u := gRequire(pTerm, termSymbol("("))(t); u.err == nil {
+		if u = pTermIdList(u); u.err != nil {
+			return u
+		}
+		ctxs := u.ctx.([]interface{})
+		keys := make([]string, len(ctxs))
+		for i, ctx := range ctxs {
+			keys[i] = string(ctx.(termId))
+		}
+		if u = gRequire(pTerm, termSymbol(")"))(u); u.err != nil {
+			return u
+		}
+		return u.with(keys)
+	}
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	return t.with([]string{string(t.ctx.(termId))})
+}
+
 func pWithOptions(t pToken) pToken {
 	u := gRequire(pTerm, termKeyword("with"))(t)
 	if u.err != nil {
@@ -329,23 +512,110 @@ func pOption(t pToken) pToken {
 		return t
 	}
 	key := string(t.ctx.(termId))
+	if key == "clustering" {
+		return pClusteringOrder(t)
+	}
 	if t = gRequire(pTerm, termSymbol("="))(t); t.err != nil {
 		return t
 	}
+	if u := gRequire(pTerm, termSymbol("{"))(t); u.err == nil {
+		// Map-valued options are kept as JSON-encoded strings, so that they can be reported
+		// through the fake system tables.
+		if u = pOptionMap(u); u.err != nil {
+			return u
+		}
+		m := u.ctx.(map[string]string)
+		if u = gRequire(pTerm, termSymbol("}"))(u); u.err != nil {
+			return u
+		}
+		return u.with(&ctxOption{key, pval{Value: LiteralValue(encodeOptionMap(m))}})
+	}
 	if t = pValue(t); t.err != nil {
 		return t
 	}
 	return t.with(&ctxOption{key, t.ctx.(pval)})
 }
 
+func pClusteringOrder(t pToken) pToken {
+	if t = gRequire(pTerm, termKeyword("order"))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termKeyword("by"))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termSymbol("("))(t); t.err != nil {
+		return t
+	}
+	if t = gList(pOrderSpec, pTermComma)(t); t.err != nil {
+		return t
+	}
+	m := make(map[string]string)
+	for _, ctx := range t.ctx.([]interface{}) {
+		ord := ctx.(order)
+		if ord.dir == desc {
+			m[ord.col] = "DESC"
+		} else {
+			m[ord.col] = "ASC"
+		}
+	}
+	if t = gRequire(pTerm, termSymbol(")"))(t); t.err != nil {
+		return t
+	}
+	return t.with(&ctxOption{"clustering order", pval{Value: LiteralValue(encodeOptionMap(m))}})
+}
+
+func pOptionMap(t pToken) pToken {
+	if t = gList(pOptionMapEntry, pTermComma)(t); t.err != nil {
+		return t
+	}
+	m := make(map[string]string)
+	for _, ctx := range t.ctx.([]interface{}) {
+		kv := ctx.([2]string)
+		m[kv[0]] = kv[1]
+	}
+	return t.with(m)
+}
+
+func pOptionMapEntry(t pToken) pToken {
+	var kv [2]string
+	for i := range kv {
+		if i == 1 {
+			if t = gRequire(pTerm, termSymbol(":"))(t); t.err != nil {
+				return t
+			}
+		}
+		u := pTerm(t)
+		switch v := u.ctx.(type) {
+		case termString:
+			kv[i] = string(v)
+		case termNumber:
+			kv[i] = strconv.Itoa(int(v))
+		case termId:
+			kv[i] = string(v)
+		default:
+			return t.fail("expected string or number")
+		}
+		t = u
+	}
+	return t.with(kv)
+}
+
 func pDrop(t pToken) pToken {
 	var cmd dropCommand
 	u := pTerm(t)
-	kw, _ := u.ctx.(termKeyword)
-	if kw != "keyspace" && kw != "table" {
-		return t.fail("expected KEYSPACE or TABLE")
+	switch u.ctx {
+	case termKeyword("keyspace"), termKeyword("table"):
+		cmd.dropType = string(u.ctx.(termKeyword))
+	case termId("index"):
+		cmd.dropType = "index"
+	case termId("materialized"):
+		if u = gRequire(pTerm, termId("view"))(u); u.err != nil {
+			return u
+		}
+		cmd.dropType = "materialized view"
+	default:
+		return t.fail("expected KEYSPACE, TABLE, INDEX, or MATERIALIZED VIEW")
 	}
-	cmd.dropType = string(kw)
 	t = u
 	if u = pIfExists(t); u.err == nil {
 		t = u
@@ -361,7 +631,12 @@ func pDrop(t pToken) pToken {
 
 func pAlter(t pToken) pToken {
 	var cmd alterCommand
-	// TODO: support ALTER KEYSPACE
+	if u := gRequire(pTerm, termKeyword("keyspace"))(t); u.err == nil {
+		return pAlterKeyspace(u)
+	}
+	if u := gRequire(pTerm, termKeyword("type"))(t); u.err == nil {
+		return pAlterType(u)
+	}
 	if t = gRequire(pTerm, termKeyword("table"))(t); t.err != nil {
 		return t
 	}
@@ -393,6 +668,10 @@ func pAlter(t pToken) pToken {
 			return t
 		}
 		cmd.coltype = t.ctx.(*gocql.TypeInfo)
+		if u := gRequire(pTerm, termId("static"))(t); u.err == nil && kw == "add" {
+			cmd.static = true
+			t = u
+		}
 	case "drop":
 		if t = pTermId(u); t.err != nil {
 			return t
@@ -404,6 +683,51 @@ func pAlter(t pToken) pToken {
 	return t.with(&cmd)
 }
 
+func pAlterKeyspace(t pToken) pToken {
+	var cmd alterKeyspaceCommand
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.identifier = string(t.ctx.(termId))
+	if t = pWithOptions(t); t.err != nil {
+		return t
+	}
+	if t.ctx == nil {
+		return t.fail("expected WITH")
+	}
+	cmd.options = t.ctx.(optionMap)
+	return t.with(&cmd)
+}
+
+func pAlterType(t pToken) pToken {
+	var cmd alterTypeCommand
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	cmd.identifier = string(t.ctx.(termId))
+	u := pTerm(t)
+	kw, _ := u.ctx.(termKeyword)
+	if kw != "add" && kw != "alter" {
+		return t.fail("expected ADD or ALTER")
+	}
+	if t = pTermId(u); t.err != nil {
+		return t
+	}
+	if kw == "add" {
+		cmd.add = string(t.ctx.(termId))
+	} else {
+		cmd.alter = string(t.ctx.(termId))
+		if t = gRequire(pTerm, termKeyword("type"))(t); t.err != nil {
+			return t
+		}
+	}
+	if t = pDataType(t); t.err != nil {
+		return t
+	}
+	cmd.fieldtype = t.ctx.(*gocql.TypeInfo)
+	return t.with(&cmd)
+}
+
 func pInsert(t pToken) pToken {
 	if t = gRequire(pTerm, termKeyword("into"))(t); t.err != nil {
 		return t
@@ -479,13 +803,18 @@ func pUpdate(t pToken) pToken {
 	if t = gRequire(pTerm, termKeyword("set"))(t); t.err != nil {
 		return t
 	}
-	if t = gList(pAssignOrEquals, pTermComma)(t); t.err != nil {
+	if t = gList(pAssignment, pTermComma)(t); t.err != nil {
 		return t
 	}
 	cmd.set = make(map[string]pval)
+	cmd.incr = make(map[string]counterDelta)
 	for _, ctx := range t.ctx.([]interface{}) {
-		a := ctx.(*ctxKeyValue)
-		cmd.set[a.id] = a.val
+		switch a := ctx.(type) {
+		case *ctxKeyValue:
+			cmd.set[a.id] = a.val
+		case *ctxCounterDelta:
+			cmd.incr[a.id] = a.counterDelta
+		}
 	}
 	if t = gRequire(pTerm, termKeyword("where"))(t); t.err != nil {
 		return t
@@ -521,6 +850,17 @@ func pDelete(t pToken) pToken {
 		w := ctx.(*ctxKeyValue)
 		cmd.key[w.id] = w.val
 	}
+	if u := gRequire(pTerm, termKeyword("if"))(t); u.err == nil {
+		t = u
+		if t = gList(pAssignOrEquals, pTermAnd)(t); t.err != nil {
+			return t
+		}
+		cmd.cond = make(map[string]pval)
+		for _, ctx := range t.ctx.([]interface{}) {
+			w := ctx.(*ctxKeyValue)
+			cmd.cond[w.id] = w.val
+		}
+	}
 	return t.with(&cmd)
 }
 
@@ -576,6 +916,13 @@ func pSelect(t pToken) pToken {
 		t = u
 		cmd.limit = int(limit)
 	}
+
+	if u := gRequire(pTerm, termId("allow"))(t); u.err == nil {
+		if t = gRequire(pTerm, termId("filtering"))(u); t.err != nil {
+			return t
+		}
+		cmd.allowFiltering = true
+	}
 	return t.with(&cmd)
 }
 
@@ -644,13 +991,67 @@ func pAssignOrEquals(t pToken) pToken {
 	return t.with(&ctx)
 }
 
+type ctxCounterDelta struct {
+	id string
+	counterDelta
+}
+
+// pAssignment parses an assignment in the SET clause of an UPDATE, which may either assign a value
+// or add to or subtract from a counter.
+func pAssignment(t pToken) pToken {
+	u := pAssignOrEquals(t)
+	if u.err == nil {
+		return u
+	}
+	var ctx ctxCounterDelta
+	if t = pTermId(t); t.err != nil {
+		return t
+	}
+	ctx.id = string(t.ctx.(termId))
+	if t = gRequire(pTerm, termSymbol("="))(t); t.err != nil {
+		return t
+	}
+	if t = gRequire(pTerm, termId(ctx.id))(t); t.err != nil {
+		return u
+	}
+	v := pTerm(t)
+	switch v.ctx {
+	case termSymbol("+"):
+		ctx.sign = 1
+	case termSymbol("-"):
+		ctx.sign = -1
+	default:
+		return t.fail("expected + or -")
+	}
+	if t = pValue(v); t.err != nil {
+		return t
+	}
+	ctx.delta = t.ctx.(pval)
+	return t.with(&ctx)
+}
+
 func pComparison(t pToken) pToken {
-	// TODO: IN, TOKEN
+	// TODO: IN
 	var cmp comparison
 	if t = pTermId(t); t.err != nil {
 		return t
 	}
 	cmp.col = string(t.ctx.(termId))
+	if cmp.col == "token" {
+		if u := gRequire(pTerm, termSymbol("("))(t); u.err == nil {
+			if t = pTermIdList(u); t.err != nil {
+				return t
+			}
+			cols := make([]string, 0)
+			for _, ctx := range t.ctx.([]interface{}) {
+				cols = append(cols, string(ctx.(termId)))
+			}
+			if t = gRequire(pTerm, termSymbol(")"))(t); t.err != nil {
+				return t
+			}
+			cmp.col = "token(" + strings.Join(cols, ",") + ")"
+		}
+	}
 	u := pTerm(t)
 	sym, ok := u.ctx.(termSymbol)
 	if !ok {
@@ -692,6 +1093,21 @@ func pOrderSpec(t pToken) pToken {
 
 func pDataType(t pToken) pToken {
 	u := pTerm(t)
+	if u.ctx == termId("frozen") {
+		// User-defined types are given as custom types named after the UDT. Whether the type
+		// exists is checked on execution.
+		if u = gRequire(pTerm, termSymbol("<"))(u); u.err != nil {
+			return u
+		}
+		if u = pTermId(u); u.err != nil {
+			return u
+		}
+		name := string(u.ctx.(termId))
+		if u = gRequire(pTerm, termSymbol(">"))(u); u.err != nil {
+			return u
+		}
+		return u.with(&gocql.TypeInfo{Type: gocql.TypeCustom, Custom: name})
+	}
 	kw, ok := u.ctx.(termKeyword)
 	if !ok {
 		return t.fail("expected column type")
@@ -759,6 +1175,13 @@ func pValue(t pToken) pToken {
 			return u.with(pval{Value: LiteralValue(string(v))})
 		case termNumber:
 			return u.with(pval{Value: LiteralValue(int(v))})
+		case termId:
+			switch v {
+			case "true":
+				return u.with(pval{Value: LiteralValue(true)})
+			case "false":
+				return u.with(pval{Value: LiteralValue(false)})
+			}
 		case termSymbol:
 			// TODO: add collection values to context
 			switch v {
@@ -830,6 +1253,8 @@ func pTerm(t pToken) pToken {
 		return pSkipSpace(t.advance(1)).with(v)
 	} else if first == '\'' {
 		return pSkipSpace(pStringLiteral(t))
+	} else if first == '"' {
+		return pSkipSpace(pQuotedIdentifier(t))
 	} else if unicode.IsDigit(first) {
 		return pSkipSpace(pNumberLiteral(t))
 	} else if first == '_' || unicode.IsLetter(first) {
@@ -869,6 +1294,16 @@ func pStringLiteral(t pToken) pToken {
 	return t.advance(i + 1).with(termString(strings.Join(parts, "")))
 }
 
+// pQuotedIdentifier parses a double-quoted identifier, which may be a keyword and keeps its case.
+func pQuotedIdentifier(t pToken) pToken {
+	for i := 1; i < len(t.runes); i++ {
+		if t.runes[i] == '"' {
+			return t.advance(i + 1).with(termId(string(t.runes[1:i])))
+		}
+	}
+	return t.fail("unterminated quoted identifier")
+}
+
 func pNumberLiteral(t pToken) pToken {
 	var i int
 	for i = 0; i < len(t.runes) && unicode.IsDigit(t.runes[i]); i++ {
@@ -984,6 +1419,8 @@ func isKeyword(id string) bool {
 		return true
 	case "timeuuid":
 		return true
+	case "counter":
+		return true
 	default:
 		return false
 	}
@@ -996,7 +1433,7 @@ func pSymbol(t pToken) pToken {
 			return t.advance(2).with(termSymbol(string(t.runes[:2])))
 		}
 		return t.advance(1).with(termSymbol(string(t.runes[:1])))
-	case '=', '{', '}', '[', ']', '(', ')', ':', ',', '*', '\'', '"':
+	case '=', '{', '}', '[', ']', '(', ')', ':', ',', '*', '\'', '"', '+', '-':
 		return t.advance(1).with(termSymbol(string(t.runes[:1])))
 	default:
 		return t.failf("don't know how to handle character '%c' (%#v)", t.runes[0], t.runes[0])
@@ -124,6 +124,12 @@ func TestParseValue(t *testing.T) {
 		So(parse(`INSERT INTO t (x) VALUES ('abc\')`), shouldFailNear, `'abc\'`)
 	})
 
+	Convey("Boolean literals", t, func() {
+		So(parse("INSERT INTO t (x, y) VALUES (true, FALSE)"), shouldParse)
+		expected := []pval{pval{Value: LiteralValue(true)}, pval{Value: LiteralValue(false)}}
+		So(cmd.values, ShouldResemble, expected)
+	})
+
 	Convey("Map and set literals", t, func() {
 		So(parse("INSERT INTO t (x) VALUES ({?, ?, ?})"), shouldParse)
 		expected := []pval{pval{Value: LiteralValue("")}}
@@ -243,6 +249,23 @@ func TestParseCreateTable(t *testing.T) {
 
 		So(parse("CREATE TABLE t (x blob, PRIMARY KEY (x, y), y blob)"), shouldParse)
 		So(cmd.key, ShouldResemble, []string{"x", "y"})
+		So(cmd.partitionKeySize, ShouldEqual, 1)
+
+		So(parse("CREATE TABLE t (x blob, y blob, z blob, PRIMARY KEY ((x, y), z))"), shouldParse)
+		So(cmd.key, ShouldResemble, []string{"x", "y", "z"})
+		So(cmd.partitionKeySize, ShouldEqual, 2)
+
+		So(parse("CREATE TABLE t (x blob, primary key ((x), )"), shouldFailNear, ")")
+		So(parse("CREATE TABLE t (x blob, primary key ((x, y)"), shouldFailNear, "")
+	})
+
+	Convey("Static columns", t, func() {
+		So(parse("CREATE TABLE t (x blob, y blob, z varchar static, PRIMARY KEY (x, y))"),
+			shouldParse)
+		So(cmd.colnames, ShouldResemble, []string{"x", "y", "z"})
+		So(cmd.statics, ShouldResemble, []string{"z"})
+
+		So(parse("CREATE TABLE t (x blob, z varchar static static)"), shouldFailNear, "static)")
 	})
 
 	Convey("Multiple primary key definitions should be caught", t, func() {
@@ -267,6 +290,20 @@ func TestParseCreateTable(t *testing.T) {
 		expected["y"] = pval{Value: LiteralValue("str")}
 		So(cmd.options, ShouldResemble, expected)
 	})
+
+	Convey("Map options and clustering order should parse correctly", t, func() {
+		So(parse("CREATE TABLE test (x varchar, y bigint, PRIMARY KEY (x, y))"+
+			" WITH CLUSTERING ORDER BY (y DESC) AND compaction = {'class': 'X', 'n': 4}"),
+			shouldParse)
+		expected := optionMap{
+			"clustering order": pval{Value: LiteralValue(`{"y":"DESC"}`)},
+			"compaction":       pval{Value: LiteralValue(`{"class":"X","n":"4"}`)},
+		}
+		So(cmd.options, ShouldResemble, expected)
+
+		So(parse("CREATE TABLE test (x varchar) WITH CLUSTERING BY (x)"), shouldFailNear, "BY")
+		So(parse("CREATE TABLE test (x varchar) WITH x = {'a': }"), shouldFailNear, "}")
+	})
 }
 
 func TestParseDrop(t *testing.T) {
@@ -308,6 +345,127 @@ func TestParseDrop(t *testing.T) {
 		So(cmd.identifier, ShouldEqual, "x")
 		So(cmd.strict, ShouldBeFalse)
 	})
+
+	Convey("Indexes and views", t, func() {
+		So(parse("DROP INDEX x_y_idx"), shouldParse)
+		So(cmd.dropType, ShouldEqual, "index")
+		So(cmd.identifier, ShouldEqual, "x_y_idx")
+		So(cmd.strict, ShouldBeTrue)
+
+		So(parse("DROP MATERIALIZED VIEW IF EXISTS v"), shouldParse)
+		So(cmd.dropType, ShouldEqual, "materialized view")
+		So(cmd.identifier, ShouldEqual, "v")
+		So(cmd.strict, ShouldBeFalse)
+
+		So(parse("DROP MATERIALIZED v"), shouldFailNear, "v")
+	})
+}
+
+func TestParseCreateType(t *testing.T) {
+	var cmd createTypeCommand
+	parse := func(s string) pToken { return parseInto(s, &cmd) }
+
+	Convey("Basic CREATE TYPE", t, func() {
+		So(parse("CREATE TYPE point (x double, y double)"), shouldParse)
+		So(cmd, ShouldResemble, createTypeCommand{
+			strict:     true,
+			identifier: "point",
+			fieldnames: []string{"x", "y"},
+			fieldtypes: []*gocql.TypeInfo{TIDouble, TIDouble},
+		})
+
+		So(parse("CREATE TYPE IF NOT EXISTS shape (origin frozen<point>)"), shouldParse)
+		So(cmd, ShouldResemble, createTypeCommand{
+			identifier: "shape",
+			fieldnames: []string{"origin"},
+			fieldtypes: []*gocql.TypeInfo{
+				&gocql.TypeInfo{Type: gocql.TypeCustom, Custom: "point"},
+			},
+		})
+	})
+
+	Convey("Parse errors should be caught", t, func() {
+		So(parse("CREATE TYPE point"), shouldFailNear, "")
+		So(parse("CREATE TYPE point (x double, PRIMARY KEY (x))"), shouldFailNear, ")")
+		So(parse("CREATE TYPE shape (origin frozen point)"), shouldFailNear, "point")
+		So(parse("CREATE TYPE shape (origin frozen<point)"), shouldFailNear, ")")
+	})
+}
+
+func TestParseAlterType(t *testing.T) {
+	var cmd alterTypeCommand
+	parse := func(s string) pToken { return parseInto(s, &cmd) }
+
+	Convey("ALTER TYPE", t, func() {
+		So(parse("ALTER TYPE point ADD z double"), shouldParse)
+		So(cmd, ShouldResemble, alterTypeCommand{identifier: "point", add: "z", fieldtype: TIDouble})
+
+		So(parse("ALTER TYPE point ALTER z TYPE blob"), shouldParse)
+		So(cmd, ShouldResemble, alterTypeCommand{identifier: "point", alter: "z", fieldtype: TIBlob})
+
+		So(parse("ALTER TYPE point DROP z"), shouldFailNear, "DROP")
+	})
+}
+
+func TestParseCreateIndex(t *testing.T) {
+	var cmd createIndexCommand
+	parse := func(s string) pToken { return parseInto(s, &cmd) }
+
+	Convey("Basic CREATE INDEX", t, func() {
+		So(parse("CREATE INDEX ON t (x)"), shouldParse)
+		So(cmd, ShouldResemble, createIndexCommand{strict: true, table: "t", column: "x"})
+
+		So(parse("CREATE INDEX IF NOT EXISTS t_x ON t (x)"), shouldParse)
+		So(cmd, ShouldResemble, createIndexCommand{identifier: "t_x", table: "t", column: "x"})
+	})
+
+	Convey("Parse errors should be caught", t, func() {
+		So(parse("CREATE INDEX"), shouldFailNear, "")
+		So(parse("CREATE INDEX t_x t (x)"), shouldFailNear, "t (x)")
+		So(parse("CREATE INDEX ON t x"), shouldFailNear, "x")
+		So(parse("CREATE INDEX ON t (x, y)"), shouldFailNear, ", y)")
+	})
+}
+
+func TestParseCreateView(t *testing.T) {
+	var cmd createViewCommand
+	parse := func(s string) pToken { return parseInto(s, &cmd) }
+
+	Convey("Basic CREATE MATERIALIZED VIEW", t, func() {
+		So(parse("CREATE MATERIALIZED VIEW v AS SELECT * FROM t"+
+			" WHERE y IS NOT NULL AND x IS NOT NULL PRIMARY KEY (y, x)"), shouldParse)
+		So(cmd, ShouldResemble, createViewCommand{
+			strict:           true,
+			identifier:       "v",
+			base:             "t",
+			cols:             []string{"*"},
+			key:              []string{"y", "x"},
+			partitionKeySize: 1,
+		})
+
+		So(parse("CREATE MATERIALIZED VIEW IF NOT EXISTS v AS SELECT x, y, z FROM t"+
+			" WHERE y IS NOT NULL AND z IS NOT NULL AND x IS NOT NULL PRIMARY KEY ((y, z), x)"+
+			" WITH comment = 'v'"), shouldParse)
+		So(cmd, ShouldResemble, createViewCommand{
+			identifier:       "v",
+			base:             "t",
+			cols:             []string{"x", "y", "z"},
+			key:              []string{"y", "z", "x"},
+			partitionKeySize: 2,
+		})
+	})
+
+	Convey("Parse errors should be caught", t, func() {
+		So(parse("CREATE MATERIALIZED VIEW v SELECT"), shouldFailNear, "SELECT")
+		So(parse("CREATE MATERIALIZED VIEW v AS SELECT * FROM t PRIMARY KEY (x)"),
+			shouldFailNear, "PRIMARY")
+		So(parse("CREATE MATERIALIZED VIEW v AS SELECT * FROM t WHERE x IS NULL"),
+			shouldFailNear, "NULL")
+		So(parse("CREATE MATERIALIZED VIEW v AS SELECT * FROM t WHERE x IS NOT NULL"),
+			shouldFailNear, "")
+		So(parse("CREATE MATERIALIZED VIEW v AS SELECT * FROM t WHERE x IS NOT NULL x blob"),
+			shouldFailNear, "")
+	})
 }
 
 func TestParseAlter(t *testing.T) {
@@ -332,6 +490,12 @@ func TestParseAlter(t *testing.T) {
 		So(cmd.options, ShouldBeNil)
 	})
 
+	Convey("Add static column", t, func() {
+		So(parse("ALTER TABLE test ADD x varchar static"), shouldParse)
+		So(cmd.add, ShouldEqual, "x")
+		So(cmd.static, ShouldBeTrue)
+	})
+
 	Convey("Drop column", t, func() {
 		So(parse("ALTER TABLE test DROP x"), shouldParse)
 		So(cmd.table, ShouldEqual, "test")
@@ -372,6 +536,27 @@ func TestParseAlter(t *testing.T) {
 	})
 }
 
+func TestParseAlterKeyspace(t *testing.T) {
+	var cmd alterKeyspaceCommand
+	parse := func(s string) pToken { return parseInto(s, &cmd) }
+
+	Convey("Replication and durable_writes", t, func() {
+		So(parse("ALTER KEYSPACE test WITH replication = {'class': 'SimpleStrategy', "+
+			"'replication_factor': 3} AND durable_writes = false"), shouldParse)
+		So(cmd.identifier, ShouldEqual, "test")
+		So(cmd.options.optionMap("replication"), ShouldResemble,
+			map[string]string{"class": "SimpleStrategy", "replication_factor": "3"})
+		So(cmd.options["durable_writes"], ShouldResemble, pval{Value: LiteralValue(false)})
+	})
+
+	Convey("Parse errors should be caught", t, func() {
+		So(parse("ALTER KEYSPACE"), shouldFailNear, "")
+		So(parse("ALTER KEYSPACE test"), shouldFailNear, "")
+		So(parse("ALTER KEYSPACE test WITH"), shouldFailNear, "")
+		So(parse("ALTER KEYSPACE test ADD x"), shouldFailNear, "ADD x")
+	})
+}
+
 func TestParseInsert(t *testing.T) {
 	var cmd insertCommand
 	parse := func(s string) pToken { return parseInto(s, &cmd) }
@@ -432,6 +617,17 @@ func TestParseUpdate(t *testing.T) {
 	var cmd updateCommand
 	parse := func(s string) pToken { return parseInto(s, &cmd) }
 
+	Convey("Updating counters", t, func() {
+		So(parse("UPDATE t SET x = x + ?, y = y - 1, z = 2 WHERE w = ?"), shouldParse)
+		So(cmd.set, ShouldResemble, map[string]pval{"z": pval{Value: LiteralValue(2)}})
+		So(cmd.incr, ShouldResemble, map[string]counterDelta{
+			"x": counterDelta{1, pval{VarIndex: 0}},
+			"y": counterDelta{-1, pval{Value: LiteralValue(1)}},
+		})
+		So(parse("UPDATE t SET x = y + 1 WHERE w = ?"), shouldFailNear, "y + 1 WHERE w = ?")
+		So(parse("UPDATE t SET x = x * 1 WHERE w = ?"), shouldFailNear, "* 1 WHERE w = ?")
+	})
+
 	Convey("Updating a single column", t, func() {
 		So(parse("UPDATE t SET x = 1 WHERE y = 2"), shouldParse)
 		So(cmd.table, ShouldEqual, "t")
@@ -532,6 +728,10 @@ func TestParseSelect(t *testing.T) {
 		So(parse("SELECT * FROM t"), shouldParse)
 		So(cmd.cols, ShouldResemble, []string{"*"})
 
+		So(parse(`SELECT x, "type" FROM t`), shouldParse)
+		So(cmd.cols, ShouldResemble, []string{"x", "type"})
+		So(parse(`SELECT "type FROM t`), shouldFailNear, `"type FROM t`)
+
 		So(parse("SELECT COUNT(*) FROM t"), shouldParse)
 		So(cmd.cols, ShouldResemble, []string{"count(*)"})
 
@@ -550,6 +750,9 @@ func TestParseSelect(t *testing.T) {
 			comparison{"y", "=", pval{Value: LiteralValue(1)}},
 			comparison{"z", "<", pval{VarIndex: 1}})
 		So(cmd.where, ShouldResemble, expected)
+
+		So(parse("SELECT * FROM t WHERE token(a, b) > ?"), shouldParse)
+		So(cmd.where, ShouldResemble, []comparison{{"token(a,b)", ">", pval{VarIndex: 0}}})
 	})
 
 	Convey("Orderings", t, func() {
@@ -583,6 +786,9 @@ func TestParseSelect(t *testing.T) {
 		So(cmd.where, ShouldResemble, []comparison{comparison{"x", "=", pval{VarIndex: 0}}})
 		So(cmd.order, ShouldResemble, []order{order{"x", desc}})
 		So(cmd.limit, ShouldEqual, 8421)
+
+		So(parse("SELECT * FROM t WHERE y = 1 ALLOW FILTERING"), shouldParse)
+		So(cmd.allowFiltering, ShouldBeTrue)
 	})
 
 	Convey("Parse errors should be caught", t, func() {
@@ -621,5 +827,6 @@ func TestParseSelect(t *testing.T) {
 		So(parse("SELECT * FROM t ORDER BY x garbage"), shouldFailNear, "garbage")
 		So(parse("SELECT * FROM t ORDER BY x DESC garbage"), shouldFailNear, "garbage")
 		So(parse("SELECT * FROM t WHERE x = ? LIMIT garbage"), shouldFailNear, "garbage")
+		So(parse("SELECT * FROM t ALLOW"), shouldFailNear, "")
 	})
 }
@@ -0,0 +1,169 @@
+package ibis
+
+import "strings"
+
+// An Index declares a secondary index on a column of a column family.
+type Index struct {
+	Name   string // if empty, the index is named <table>_<column>_idx
+	Column string
+}
+
+// A MaterializedView declares a view that Cassandra maintains from the rows of a column family,
+// keyed differently. All columns of the base column family are included in the view.
+type MaterializedView struct {
+	Name         string
+	PartitionKey []string
+	Clustering   []string
+}
+
+// AddIndex declares a secondary index on the given column. An optional name may be given; otherwise
+// Cassandra's default of <table>_<column>_idx is used.
+//
+//        cf.AddIndex("AuthorName")
+//
+// AddIndex returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddIndex(column string, name ...string) *CF {
+	idx := Index{Column: column}
+	if len(name) > 0 {
+		idx.Name = name[0]
+	}
+	cf.indexes = append(cf.indexes, idx)
+	return cf
+}
+
+// Indexes returns the secondary indexes declared on this column family, with names filled in.
+func (cf *CF) Indexes() []Index {
+	indexes := make([]Index, len(cf.indexes))
+	for i, idx := range cf.indexes {
+		if idx.Name == "" {
+			idx.Name = strings.ToLower(cf.name + "_" + idx.Column + "_idx")
+		}
+		indexes[i] = idx
+	}
+	return indexes
+}
+
+// AddView declares a materialized view of this column family under the given name, with a primary
+// key made of the given partition key and clustering columns. Any columns of this column family's
+// primary key that are missing from the view's are appended as clustering columns, since Cassandra
+// requires them.
+//
+//        cf.AddView("posts_by_author", []string{"AuthorName"}, "PublishedAt")
+//
+// AddView returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddView(name string, partition []string, clustering ...string) *CF {
+	cf.views = append(cf.views, MaterializedView{
+		Name:         name,
+		PartitionKey: partition,
+		Clustering:   clustering,
+	})
+	return cf
+}
+
+// Views returns the materialized views declared on this column family, with their primary keys
+// completed.
+func (cf *CF) Views() []MaterializedView {
+	views := make([]MaterializedView, len(cf.views))
+	for i, v := range cf.views {
+		views[i] = cf.completeView(v)
+	}
+	return views
+}
+
+func (cf *CF) completeView(v MaterializedView) MaterializedView {
+	present := make(map[string]bool)
+	for _, k := range v.PrimaryKey() {
+		present[strings.ToLower(k)] = true
+	}
+	clustering := append([]string{}, v.Clustering...)
+	for _, k := range cf.primaryKey {
+		if !present[strings.ToLower(k)] {
+			clustering = append(clustering, k)
+		}
+	}
+	v.Clustering = clustering
+	return v
+}
+
+// PrimaryKey returns the names of the columns making up the view's primary key.
+func (v MaterializedView) PrimaryKey() []string {
+	keys := make([]string, 0, len(v.PartitionKey)+len(v.Clustering))
+	keys = append(keys, v.PartitionKey...)
+	return append(keys, v.Clustering...)
+}
+
+// View returns a column family for querying the materialized view of the given name. The returned
+// CF shares the row type of this one, so ScanRow may be used on its results. It is not part of the
+// schema and must not be committed to. If no such view is declared, nil is returned.
+func (cf *CF) View(name string) *CF {
+	for _, v := range cf.Views() {
+		if v.Name == name {
+			view := &CF{
+				name:           v.Name,
+				columns:        append([]Column{}, cf.columns...),
+				schema:         cf.schema,
+				typeID:         cf.typeID,
+				rowReflector:   cf.rowReflector,
+				unmarshalHooks: cf.unmarshalHooks,
+				postloadHooks:  cf.postloadHooks,
+			}
+			return view.SetCompositeKey(v.PartitionKey, v.Clustering...)
+		}
+	}
+	return nil
+}
+
+// CreateStatement returns the CQL statement that would create this index on the given table.
+func (idx Index) CreateStatement(table string) CQL {
+	var b CQLBuilder
+	b.Append("CREATE INDEX " + idx.Name + " ON " + table + " (" + idx.Column + ")")
+	return b.CQL()
+}
+
+// CreateStatement returns the CQL statement that would create this view of the given table.
+func (v MaterializedView) CreateStatement(table string) CQL {
+	keys := v.PrimaryKey()
+	restrictions := make([]string, len(keys))
+	for i, k := range keys {
+		restrictions[i] = k + " IS NOT NULL"
+	}
+	pk := v.Clustering
+	if len(v.PartitionKey) > 1 {
+		pk = append([]string{"(" + strings.Join(v.PartitionKey, ", ") + ")"}, pk...)
+	} else {
+		pk = keys
+	}
+	var b CQLBuilder
+	b.Append("CREATE MATERIALIZED VIEW " + v.Name + " AS SELECT * FROM " + table +
+		" WHERE " + strings.Join(restrictions, " AND ") +
+		" PRIMARY KEY (" + strings.Join(pk, ", ") + ")")
+	return b.CQL()
+}
+
+// sameKey returns true if the two views have the same primary key, ignoring case.
+func (v MaterializedView) sameKey(w MaterializedView) bool {
+	return len(v.PartitionKey) == len(w.PartitionKey) &&
+		strings.EqualFold(strings.Join(v.PrimaryKey(), ","), strings.Join(w.PrimaryKey(), ","))
+}
+
+// getLiveIndexes returns the secondary indexes of each table in the keyspace, keyed by table name.
+func getLiveIndexes(cluster Cluster, keyspace string) (map[string][]Index, error) {
+	sel := Select("columnfamily_name", "column_name", "index_name").
+		From(NewCF("system.schema_columns")).Where("keyspace_name = ?", keyspace)
+	cql := sel.CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	indexes := make(map[string][]Index)
+	for {
+		var cf_name, col_name, index_name string
+		if !qiter.Scan(&cf_name, &col_name, &index_name) {
+			break
+		}
+		if index_name != "" {
+			indexes[cf_name] = append(indexes[cf_name], Index{Name: index_name, Column: col_name})
+		}
+	}
+	return indexes, qiter.Close()
+}
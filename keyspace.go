@@ -0,0 +1,218 @@
+package ibis
+
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+
+// KeyspaceSpec describes how a keyspace is replicated. Use SimpleStrategy or
+// NetworkTopologyStrategy to construct one.
+//
+//        schema.KeyspaceSpec = ibis.NetworkTopologyStrategy(map[string]int{"us-east": 3, "eu-west": 2})
+//        if err := schema.EnsureKeyspace(); err != nil {
+//            ...
+//        }
+type KeyspaceSpec struct {
+	Name              string         // if empty, the keyspace of the cluster connection is used
+	Strategy          string         // "SimpleStrategy" or "NetworkTopologyStrategy"
+	ReplicationFactor int            // for SimpleStrategy
+	DataCenters       map[string]int // replication factors by data center, for NetworkTopologyStrategy
+	DurableWrites     *bool          // if nil, left unmanaged (Cassandra defaults to true)
+}
+
+// SimpleStrategy returns a KeyspaceSpec placing the given number of replicas without regard to data
+// center.
+func SimpleStrategy(replicationFactor int) *KeyspaceSpec {
+	return &KeyspaceSpec{Strategy: "SimpleStrategy", ReplicationFactor: replicationFactor}
+}
+
+// NetworkTopologyStrategy returns a KeyspaceSpec placing the given number of replicas in each data
+// center.
+func NetworkTopologyStrategy(dataCenters map[string]int) *KeyspaceSpec {
+	return &KeyspaceSpec{Strategy: "NetworkTopologyStrategy", DataCenters: dataCenters}
+}
+
+// SetDurableWrites configures whether writes to the keyspace go through the commit log.
+//
+// SetDurableWrites returns a pointer to the spec it was called on so it can be chained during
+// configuration.
+func (k *KeyspaceSpec) SetDurableWrites(durable bool) *KeyspaceSpec {
+	k.DurableWrites = &durable
+	return k
+}
+
+func (k *KeyspaceSpec) replication() map[string]string {
+	r := map[string]string{"class": k.Strategy}
+	if shortClassName(k.Strategy) == "SimpleStrategy" {
+		r["replication_factor"] = strconv.Itoa(k.ReplicationFactor)
+	} else {
+		for dc, n := range k.DataCenters {
+			r[dc] = strconv.Itoa(n)
+		}
+	}
+	return r
+}
+
+func (k *KeyspaceSpec) clauses() string {
+	clauses := "replication = " + optionMapLiteral(k.replication())
+	if k.DurableWrites != nil {
+		clauses += fmt.Sprintf(" AND durable_writes = %t", *k.DurableWrites)
+	}
+	return clauses
+}
+
+// CreateStatement returns the CQL statement that would create the keyspace if it doesn't exist.
+func (k *KeyspaceSpec) CreateStatement() CQL {
+	var b CQLBuilder
+	b.Append("CREATE KEYSPACE IF NOT EXISTS " + k.Name + " WITH " + k.clauses())
+	return b.CQL()
+}
+
+// AlterStatement returns the CQL statement that would change an existing keyspace to match this
+// spec.
+func (k *KeyspaceSpec) AlterStatement() CQL {
+	var b CQLBuilder
+	b.Append("ALTER KEYSPACE " + k.Name + " WITH " + k.clauses())
+	return b.CQL()
+}
+
+// matches returns true if the live keyspace is replicated as this spec requires.
+func (k *KeyspaceSpec) matches(live *KeyspaceSpec) bool {
+	if shortClassName(k.Strategy) != shortClassName(live.Strategy) {
+		return false
+	}
+	want, have := k.replication(), live.replication()
+	delete(want, "class")
+	delete(have, "class")
+	if len(want) != len(have) {
+		return false
+	}
+	for key, v := range want {
+		if have[key] != v {
+			return false
+		}
+	}
+	return k.DurableWrites == nil || live.DurableWrites == nil ||
+		*k.DurableWrites == *live.DurableWrites
+}
+
+func (k *KeyspaceSpec) String() string {
+	var desc string
+	if shortClassName(k.Strategy) == "SimpleStrategy" {
+		desc = fmt.Sprintf("SimpleStrategy(%d)", k.ReplicationFactor)
+	} else {
+		dcs := make([]string, 0, len(k.DataCenters))
+		for dc, n := range k.DataCenters {
+			dcs = append(dcs, fmt.Sprintf("%s:%d", dc, n))
+		}
+		sort.Strings(dcs)
+		desc = fmt.Sprintf("%s(%s)", shortClassName(k.Strategy), strings.Join(dcs, ", "))
+	}
+	return k.Name + " " + desc
+}
+
+// withName returns a copy of the spec, naming the given keyspace if the spec doesn't name one.
+func (k *KeyspaceSpec) withName(name string) *KeyspaceSpec {
+	spec := *k
+	if spec.Name == "" {
+		spec.Name = name
+	}
+	return &spec
+}
+
+// GetLiveKeyspace describes the replication of the named keyspace. If no such keyspace exists,
+// ErrNotFound is returned.
+func GetLiveKeyspace(cluster Cluster, name string) (*KeyspaceSpec, error) {
+	version, err := getReleaseVersion(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if version.systemSchema() {
+		return getSystemSchemaKeyspace(cluster, name)
+	}
+	sel := Select("durable_writes", "strategy_class", "strategy_options").
+		From(NewCF("system.schema_keyspaces")).Where("keyspace_name = ?", name)
+	cql := sel.CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	var durable bool
+	var class, options string
+	if !qiter.Scan(&durable, &class, &options) {
+		if err := qiter.Close(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound.New()
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+	return liveKeyspaceSpec(name, class, durable, parseOptionMap(options)), nil
+}
+
+// liveKeyspaceSpec builds a spec from the replication options Cassandra reports for a keyspace.
+func liveKeyspaceSpec(name, class string, durable bool, options map[string]string) *KeyspaceSpec {
+	spec := &KeyspaceSpec{Name: name, Strategy: shortClassName(class), DurableWrites: &durable}
+	for key, v := range options {
+		n, _ := strconv.Atoi(v)
+		if key == "replication_factor" {
+			spec.ReplicationFactor = n
+		} else {
+			if spec.DataCenters == nil {
+				spec.DataCenters = make(map[string]int)
+			}
+			spec.DataCenters[key] = n
+		}
+	}
+	return spec
+}
+
+// A keyspaceChange creates or alters a keyspace to match a spec.
+type keyspaceChange struct {
+	Spec   *KeyspaceSpec
+	Create bool
+}
+
+func (c keyspaceChange) Statement() CQL {
+	if c.Create {
+		return c.Spec.CreateStatement()
+	}
+	return c.Spec.AlterStatement()
+}
+
+// diffKeyspace returns the change needed to make the live keyspace match the spec, if any.
+func diffKeyspace(cluster Cluster, spec *KeyspaceSpec) (*keyspaceChange, error) {
+	live, err := GetLiveKeyspace(cluster, spec.Name)
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Key == ErrNotFound {
+			return &keyspaceChange{Spec: spec, Create: true}, nil
+		}
+		return nil, ChainError(err, "inspection of live keyspace failed")
+	}
+	if spec.matches(live) {
+		return nil, nil
+	}
+	return &keyspaceChange{Spec: spec}, nil
+}
+
+// EnsureKeyspace creates the keyspace described by the schema's KeyspaceSpec if it doesn't exist,
+// or alters its replication if it differs. The schema must be bound to a cluster, though not
+// necessarily one using the keyspace in question. If the spec doesn't name a keyspace, that of the
+// cluster connection is used.
+func (s *Schema) EnsureKeyspace() error {
+	if !s.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if s.KeyspaceSpec == nil {
+		return nil
+	}
+	change, err := diffKeyspace(s.Cluster, s.KeyspaceSpec.withName(s.Cluster.GetKeyspace()))
+	if err != nil || change == nil {
+		return err
+	}
+	cql := change.Statement()
+	cql.Cluster(s.Cluster)
+	if err := cql.Query().Exec(); err != nil {
+		return ChainError(err, "keyspace update failed")
+	}
+	return WaitForSchemaAgreement(s.Cluster, SchemaAgreementTimeout)
+}
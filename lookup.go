@@ -0,0 +1,241 @@
+package ibis
+
+import "bytes"
+import "reflect"
+import "strings"
+
+// A Lookup declares a reverse-lookup column family maintained from the rows of another: for each row,
+// it records the row's primary key under its value of the given column. Lookups serve as manual
+// secondary indexes, and unlike unique columns (see AddUnique), any number of rows may share a value.
+type Lookup struct {
+	Name   string
+	Column string
+}
+
+// AddLookup declares a lookup column family under the given name, mapping values of the given column
+// to the primary keys of the rows holding them. Reflected columns tagged `ibis:"lookup=name"` are
+// declared this way. The lookup column family is added to the schema along with this one. Its
+// partition key is the column, and its clustering columns are this column family's primary key.
+//
+//        type Post struct {
+//            ID     string `ibis:"key"`
+//            Author string `ibis:"lookup=posts_by_author"`
+//        }
+//        ...
+//        var posts []*Post
+//        err := model.Posts.LoadBy(&posts, "Author", "alice")
+//
+// Lookup entries are written along with the precommit statements of Commit and CommitCAS, and
+// removed by Delete. When a row's value changes, its entry for the previous value is removed if the
+// previous value is known, as with an AutoPatcher; otherwise the stale entry remains until the lookup
+// is rebuilt (see RebuildLookup). LoadBy skips stale entries. Statements built with MakeCommit or
+// MakeCommitCAS don't maintain lookups.
+//
+// AddLookup returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddLookup(column, name string) *CF {
+	cf.lookups = append(cf.lookups, Lookup{Name: name, Column: column})
+	return cf
+}
+
+// Lookups returns the lookup column families declared on this column family.
+func (cf *CF) Lookups() []Lookup {
+	return cf.lookups
+}
+
+// newLookup returns the definition of a lookup column family.
+func (cf *CF) newLookup(l Lookup) *CF {
+	keys := cf.lookupKey(l.Column)
+	columns := make([]Column, 0, len(keys))
+	for _, name := range keys {
+		if col, ok := cf.column(name); ok {
+			columns = append(columns, Column{Name: col.Name, Type: col.Type, typeInfo: col.typeInfo})
+		}
+	}
+	return NewCF(l.Name, columns...).SetPrimaryKey(keys...)
+}
+
+// lookupKey returns the primary key of the lookup column family of the given column: the column,
+// followed by the rest of this column family's primary key.
+func (cf *CF) lookupKey(column string) []string {
+	keys := []string{column}
+	for _, k := range cf.primaryKey {
+		if k != column {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// lookup returns the lookup column family of the given column, or nil if it has none.
+func (cf *CF) lookup(column string) *CF {
+	for _, l := range cf.lookups {
+		if l.Column == column && cf.schema != nil {
+			return cf.schema.CFs[strings.ToLower(l.Name)]
+		}
+	}
+	return nil
+}
+
+// lookupStatements returns the statements that update the lookup entries of a row being committed.
+func (cf *CF) lookupStatements(mmap MarshaledMap) []CQL {
+	cqls := make([]CQL, 0)
+	for _, l := range cf.lookups {
+		v := mmap[l.Column]
+		lookup := cf.lookup(l.Column)
+		if v == nil || !v.Dirty() || lookup == nil {
+			continue
+		}
+		// a changed key makes another row, so the previous value's entry still holds
+		if len(v.OriginalBytes) > 0 && !cf.isKey(l.Column) {
+			old := &MarshaledValue{Bytes: v.OriginalBytes, TypeInfo: v.TypeInfo}
+			cqls = append(cqls, cf.lookupDelete(lookup, l.Column, old, mmap))
+		}
+		if len(v.Bytes) > 0 {
+			keys := cf.lookupKey(l.Column)
+			ins := InsertInto(lookup).Keys(keys...).Values(mmap.InterfacesFor(keys...)...)
+			cqls = append(cqls, ins.CQL())
+		}
+	}
+	return cqls
+}
+
+// lookupDelete returns the statement that removes the lookup entry of the given value for a row.
+func (cf *CF) lookupDelete(lookup *CF, column string, value *MarshaledValue, mmap MarshaledMap) CQL {
+	del := DeleteFrom(lookup).Where(column+" = ?", value)
+	for _, k := range cf.lookupKey(column)[1:] {
+		del.Where(k+" = ?", mmap[k])
+	}
+	return del.CQL()
+}
+
+// scanLookup returns the entries of a lookup column family, restricted to the given value unless it
+// is nil.
+func (cf *CF) scanLookup(lookup *CF, column string, value interface{}) ([]MarshaledMap, error) {
+	keys := cf.lookupKey(column)
+	sel := Select(keys...).From(lookup)
+	if value != nil {
+		sel.Where(column+" = ?", value)
+	}
+	qiter := sel.Query()
+	entries := make([]MarshaledMap, 0)
+	for {
+		entry := make(MarshaledMap)
+		if !qiter.Scan(entry.PointersTo(keys...)...) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, ChainError(err, "scan of lookup", lookup.name, "failed")
+	}
+	return entries, nil
+}
+
+// loadLookupEntry loads the row a lookup entry refers to. If the row no longer exists or no longer
+// holds the entry's value, nil is returned.
+func (cf *CF) loadLookupEntry(column string, entry MarshaledMap) (MarshaledMap, error) {
+	mmap, err := cf.loadMarshaled(entry.InterfacesFor(cf.primaryKey...)...)
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Key == ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if mmap[column] == nil || !bytes.Equal(mmap[column].Bytes, entry[column].Bytes) {
+		return nil, nil
+	}
+	return mmap, nil
+}
+
+// LoadBy loads the rows holding the given value of a column with a lookup column family (see
+// AddLookup). The dest argument must be a pointer to a slice of rows, or of pointers to rows; the
+// rows are appended to it in the order of their primary keys.
+func (cf *CF) LoadBy(dest interface{}, column string, value interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrInvalidRowType.New()
+	}
+	slice = slice.Elem()
+	rowType := slice.Type().Elem()
+	byPointer := rowType.Kind() == reflect.Ptr
+	if byPointer {
+		rowType = rowType.Elem()
+	}
+	lookup := cf.lookup(column)
+	if lookup == nil {
+		return NewError(ErrInvalidKey, column, "has no lookup in", cf.name)
+	}
+	entries, err := cf.scanLookup(lookup, column, value)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		mmap, err := cf.loadLookupEntry(column, entry)
+		if err != nil {
+			return err
+		}
+		if mmap == nil {
+			continue
+		}
+		row := reflect.New(rowType)
+		if err := cf.load(row.Interface(), mmap); err != nil {
+			return err
+		}
+		if byPointer {
+			slice.Set(reflect.Append(slice, row))
+		} else {
+			slice.Set(reflect.Append(slice, row.Elem()))
+		}
+	}
+	return nil
+}
+
+// RebuildLookup brings the lookup column family of the given column up to date with the rows of this
+// one, as for a backfill after a lookup is added to a column family that already has rows. Stale
+// entries are removed, and an entry is written for every row holding a value. The number of entries
+// written is returned. The ibisdump command runs this as its rebuild-lookup subcommand.
+func (cf *CF) RebuildLookup(column string) (int, error) {
+	if !cf.IsBound() {
+		return 0, ErrTableNotBound.New()
+	}
+	lookup := cf.lookup(column)
+	if lookup == nil {
+		return 0, NewError(ErrInvalidKey, column, "has no lookup in", cf.name)
+	}
+	entries, err := cf.scanLookup(lookup, column, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		mmap, err := cf.loadLookupEntry(column, entry)
+		if err != nil {
+			return 0, err
+		}
+		if mmap == nil {
+			if err := cf.lookupDelete(lookup, column, entry[column], entry).Query().Exec(); err != nil {
+				return 0, ChainError(err, "removal of stale lookup entry failed")
+			}
+		}
+	}
+	rows, err := cf.scanLookup(cf, column, nil)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	keys := cf.lookupKey(column)
+	for _, row := range rows {
+		if row[column] == nil || len(row[column].Bytes) == 0 {
+			continue
+		}
+		ins := InsertInto(lookup).Keys(keys...).Values(row.InterfacesFor(keys...)...)
+		if err := ins.Query().Exec(); err != nil {
+			return written, ChainError(err, "lookup entry write failed")
+		}
+		written++
+	}
+	return written, nil
+}
@@ -0,0 +1,343 @@
+package ibis
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "reflect"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// TableOptions describes the properties of a column family that are given in the WITH clause of
+// its CREATE TABLE statement. A nil field is left unmanaged: it is omitted from DDL and ignored when
+// comparing against the live schema.
+type TableOptions struct {
+	// ClusteringOrder maps clustering column names to "ASC" or "DESC". Clustering columns not
+	// present are ascending. This can only be given at table creation.
+	ClusteringOrder map[string]string
+
+	Compaction        map[string]string // e.g. {"class": "TimeWindowCompactionStrategy"}
+	Compression       map[string]string // e.g. {"sstable_compression": "LZ4Compressor"}
+	Caching           map[string]string // e.g. {"keys": "ALL", "rows_per_partition": "NONE"}
+	DefaultTimeToLive *int              // in seconds
+	GCGraceSeconds    *int
+}
+
+// Options may be embedded in a reflected row struct to declare table options through its ibis
+// tag. The tag is a comma-separated list of key=value pairs. Durations may be given in seconds or
+// in the format accepted by time.ParseDuration.
+//
+//        type Event struct {
+//            ibis.Options `ibis:"compaction=TimeWindowCompactionStrategy,compaction.compaction_window_unit=DAYS,default_ttl=720h"`
+//            ...
+//        }
+//
+// Recognized keys are compaction, compression, default_ttl and gc_grace. Options of compaction,
+// compression, and caching may be given as compaction.<name>, compression.<name>, and
+// caching.<name>.
+type Options struct{}
+
+var optionsType = reflect.TypeOf(Options{})
+
+// SetClusteringOrder configures the clustering order of this column family. Each argument is the
+// name of a clustering column, optionally followed by ASC or DESC.
+//
+//        cf.SetClusteringOrder("PublishedAt DESC")
+//
+// SetClusteringOrder returns a pointer to the column family it was called on so it can be chained
+// during configuration.
+func (cf *CF) SetClusteringOrder(orders ...string) *CF {
+	if cf.options.ClusteringOrder == nil {
+		cf.options.ClusteringOrder = make(map[string]string)
+	}
+	for _, o := range orders {
+		parts := strings.Fields(o)
+		if len(parts) == 0 {
+			continue
+		}
+		dir := "ASC"
+		if len(parts) > 1 && strings.ToUpper(parts[1]) == "DESC" {
+			dir = "DESC"
+		}
+		cf.options.ClusteringOrder[parts[0]] = dir
+	}
+	return cf
+}
+
+// SetCompaction configures the compaction strategy of this column family, with optional
+// strategy-specific options.
+//
+//        cf.SetCompaction("TimeWindowCompactionStrategy", map[string]string{
+//            "compaction_window_unit": "DAYS",
+//            "compaction_window_size": "1",
+//        })
+func (cf *CF) SetCompaction(class string, options map[string]string) *CF {
+	cf.options.Compaction = map[string]string{"class": class}
+	for k, v := range options {
+		cf.options.Compaction[k] = v
+	}
+	return cf
+}
+
+// SetCompression configures the sstable compressor of this column family, with optional
+// compressor-specific options.
+func (cf *CF) SetCompression(class string, options map[string]string) *CF {
+	cf.options.Compression = map[string]string{"sstable_compression": class}
+	for k, v := range options {
+		cf.options.Compression[k] = v
+	}
+	return cf
+}
+
+// SetCaching configures which keys and how many rows per partition are cached.
+//
+//        cf.SetCaching("ALL", "NONE")
+func (cf *CF) SetCaching(keys, rowsPerPartition string) *CF {
+	cf.options.Caching = map[string]string{"keys": keys, "rows_per_partition": rowsPerPartition}
+	return cf
+}
+
+// SetDefaultTTL configures the time to live applied to rows written without an explicit TTL.
+func (cf *CF) SetDefaultTTL(ttl time.Duration) *CF {
+	seconds := int(ttl / time.Second)
+	cf.options.DefaultTimeToLive = &seconds
+	return cf
+}
+
+// SetGCGrace configures how long tombstones are kept before they may be garbage collected.
+func (cf *CF) SetGCGrace(grace time.Duration) *CF {
+	seconds := int(grace / time.Second)
+	cf.options.GCGraceSeconds = &seconds
+	return cf
+}
+
+// Options returns the table options configured for this column family.
+func (cf *CF) Options() TableOptions {
+	return cf.options
+}
+
+// clauses renders the options as CQL property assignments suitable for joining with AND in a
+// WITH clause. Clustering order is only included if clusteringColumns is non-nil.
+func (o TableOptions) clauses(clusteringColumns []string) []string {
+	clauses := make([]string, 0, 6)
+	if len(o.ClusteringOrder) > 0 && len(clusteringColumns) > 0 {
+		orders := make([]string, len(clusteringColumns))
+		for i, col := range clusteringColumns {
+			dir, ok := o.ClusteringOrder[col]
+			if !ok {
+				dir = "ASC"
+			}
+			orders[i] = col + " " + dir
+		}
+		clauses = append(clauses, "CLUSTERING ORDER BY ("+strings.Join(orders, ", ")+")")
+	}
+	if o.Compaction != nil {
+		clauses = append(clauses, "compaction = "+optionMapLiteral(o.Compaction))
+	}
+	if o.Compression != nil {
+		clauses = append(clauses, "compression = "+optionMapLiteral(o.Compression))
+	}
+	if o.Caching != nil {
+		clauses = append(clauses, "caching = "+optionMapLiteral(o.Caching))
+	}
+	if o.DefaultTimeToLive != nil {
+		clauses = append(clauses, fmt.Sprintf("default_time_to_live = %d", *o.DefaultTimeToLive))
+	}
+	if o.GCGraceSeconds != nil {
+		clauses = append(clauses, fmt.Sprintf("gc_grace_seconds = %d", *o.GCGraceSeconds))
+	}
+	return clauses
+}
+
+func (o TableOptions) empty() bool {
+	return len(o.clauses(nil)) == 0
+}
+
+// drift returns the options of o that differ from those of live. Options unset in o are ignored, as
+// are entries of live option maps that o doesn't mention. Caching is also ignored if the live value
+// couldn't be decoded. Clustering order is included if it differs, though it can't be altered.
+func (o TableOptions) drift(live TableOptions) TableOptions {
+	var d TableOptions
+	if o.ClusteringOrder != nil && !sameClusteringOrder(o.ClusteringOrder, live.ClusteringOrder) {
+		d.ClusteringOrder = o.ClusteringOrder
+	}
+	if o.Compaction != nil && !optionMapSubset(o.Compaction, live.Compaction) {
+		d.Compaction = o.Compaction
+	}
+	if o.Compression != nil && !optionMapSubset(o.Compression, live.Compression) {
+		d.Compression = o.Compression
+	}
+	if o.Caching != nil && live.Caching != nil && !optionMapSubset(o.Caching, live.Caching) {
+		d.Caching = o.Caching
+	}
+	if o.DefaultTimeToLive != nil &&
+		(live.DefaultTimeToLive == nil || *o.DefaultTimeToLive != *live.DefaultTimeToLive) {
+		d.DefaultTimeToLive = o.DefaultTimeToLive
+	}
+	if o.GCGraceSeconds != nil &&
+		(live.GCGraceSeconds == nil || *o.GCGraceSeconds != *live.GCGraceSeconds) {
+		d.GCGraceSeconds = o.GCGraceSeconds
+	}
+	return d
+}
+
+// sameClusteringOrder returns true if two clustering orders agree on the direction of every
+// column, ignoring case. Columns not present are ascending.
+func sameClusteringOrder(a, b map[string]string) bool {
+	descending := func(m map[string]string) map[string]bool {
+		cols := make(map[string]bool)
+		for col, dir := range m {
+			if strings.EqualFold(dir, "DESC") {
+				cols[strings.ToLower(col)] = true
+			}
+		}
+		return cols
+	}
+	return reflect.DeepEqual(descending(a), descending(b))
+}
+
+func optionMapSubset(model, live map[string]string) bool {
+	for k, v := range model {
+		if !strings.EqualFold(shortClassName(v), shortClassName(live[k])) {
+			return false
+		}
+	}
+	return true
+}
+
+// shortClassName strips the package from a fully qualified Java class name, since Cassandra
+// reports compaction strategies and compressors by their full names.
+func shortClassName(name string) string {
+	if strings.HasPrefix(name, "org.apache.cassandra.") {
+		return name[strings.LastIndex(name, ".")+1:]
+	}
+	return name
+}
+
+func optionMapLiteral(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]string, len(keys))
+	for i, k := range keys {
+		entries[i] = quoteString(k) + ": " + quoteString(m[k])
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// parseTag applies the value of the ibis tag on an Options field.
+func (o *TableOptions) parseTag(tag string) error {
+	for _, item := range strings.Split(tag, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("invalid table option: " + item)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch {
+		case key == "compaction":
+			o.Compaction = setOption(o.Compaction, "class", value)
+		case strings.HasPrefix(key, "compaction."):
+			o.Compaction = setOption(o.Compaction, key[len("compaction."):], value)
+		case key == "compression":
+			o.Compression = setOption(o.Compression, "sstable_compression", value)
+		case strings.HasPrefix(key, "compression."):
+			o.Compression = setOption(o.Compression, key[len("compression."):], value)
+		case strings.HasPrefix(key, "caching."):
+			o.Caching = setOption(o.Caching, key[len("caching."):], value)
+		case key == "default_ttl":
+			seconds, err := parseSeconds(value)
+			if err != nil {
+				return err
+			}
+			o.DefaultTimeToLive = &seconds
+		case key == "gc_grace":
+			seconds, err := parseSeconds(value)
+			if err != nil {
+				return err
+			}
+			o.GCGraceSeconds = &seconds
+		default:
+			return errors.New("invalid table option: " + item)
+		}
+	}
+	return nil
+}
+
+func setOption(m map[string]string, key, value string) map[string]string {
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return m
+}
+
+func parseSeconds(value string) (int, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return seconds, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return int(d / time.Second), nil
+}
+
+// liveTableOptions decodes the options reported by system.schema_columnfamilies.
+func liveTableOptions(compactionClass, compactionOptions, compression, caching string,
+	defaultTTL, gcGrace int) TableOptions {
+	o := TableOptions{
+		Compaction:        parseOptionMap(compactionOptions),
+		Compression:       parseOptionMap(compression),
+		DefaultTimeToLive: &defaultTTL,
+		GCGraceSeconds:    &gcGrace,
+	}
+	o.Compaction["class"] = compactionClass
+	if strings.HasPrefix(caching, "{") {
+		o.Caching = parseOptionMap(caching)
+	} else if keys, ok := legacyCaching[strings.ToUpper(caching)]; ok {
+		o.Caching = map[string]string{"keys": keys[0], "rows_per_partition": keys[1]}
+	}
+	return o
+}
+
+// legacyCaching translates the caching keywords of Cassandra 2.0 into the keys and
+// rows_per_partition options that replaced them.
+var legacyCaching = map[string][2]string{
+	"ALL":       {"ALL", "ALL"},
+	"KEYS_ONLY": {"ALL", "NONE"},
+	"ROWS_ONLY": {"NONE", "ALL"},
+	"NONE":      {"NONE", "NONE"},
+}
+
+// reversedType is the validator Cassandra wraps around the type of a descending clustering column.
+const reversedType = "org.apache.cassandra.db.marshal.ReversedType("
+
+// unreverseValidator strips the ReversedType wrapper from a validator, returning true if it was
+// present.
+func unreverseValidator(validator string) (string, bool) {
+	if strings.HasPrefix(validator, reversedType) && strings.HasSuffix(validator, ")") {
+		return validator[len(reversedType) : len(validator)-1], true
+	}
+	return validator, false
+}
+
+func parseOptionMap(encoded string) map[string]string {
+	result := make(map[string]string)
+	var raw map[string]interface{}
+	json.Unmarshal([]byte(encoded), &raw)
+	for k, v := range raw {
+		result[k] = fmt.Sprint(v)
+	}
+	return result
+}
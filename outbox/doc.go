@@ -0,0 +1,30 @@
+/*
+Package outbox records change events for rows in the same batch that writes them.
+
+Outbox
+
+Publishing an event after a commit loses the event if the process dies in between. With an outbox,
+the event is instead written to an outbox column family along with the change it describes, and a
+relay tails the outbox to publish events in the order they were written. Each event is deleted
+once its sink accepts it, so an event is published at least once. Events are partitioned by the hour
+they're written in, and expire if they aren't delivered within the outbox's default TTL.
+
+Example
+
+        type Model struct {
+            Users  *ibis.CF
+            Outbox *outbox.Table
+        }
+        ...
+        model.Outbox.Track(model.Users)
+        err := model.Users.Commit(&user) // also writes an event
+
+        relay := model.Outbox.Relay(publisher)
+        for {
+            if _, err := relay.Poll(); err != nil {
+                log.Print(err)
+            }
+            time.Sleep(time.Second)
+        }
+*/
+package outbox
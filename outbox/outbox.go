@@ -0,0 +1,240 @@
+package outbox
+
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/logan/ibis"
+
+// Events are partitioned by the hour they're written in, so that no partition grows without bound.
+const BucketWidth = time.Hour
+
+// DefaultRetention is the default time to live of the outbox's events. An event that hasn't been
+// delivered within its time to live expires.
+const DefaultRetention = 7 * 24 * time.Hour
+
+// DefaultLag is the default Lag of a Relay.
+const DefaultLag = time.Minute
+
+// An Event records a commit or delete of a row in a tracked column family.
+type Event struct {
+	Bucket  time.Time     `ibis:"key"` // the start of the hour the event was written in
+	ID      ibis.TimeUUID `ibis:"key"`
+	Family  string        // name of the column family the row belongs to
+	RowKey  string        // JSON array of the row's primary key values
+	Columns string        // comma-separated names of the columns the commit changed
+	Deleted bool
+	At      time.Time
+}
+
+// ChangedColumns returns the names of the columns the commit changed, in sorted order. It is empty
+// for a delete.
+func (e *Event) ChangedColumns() []string {
+	if e.Columns == "" {
+		return []string{}
+	}
+	return strings.Split(e.Columns, ",")
+}
+
+// DecodeKey unmarshals the row's primary key values into dest, one pointer per key column. Values
+// of timeuuid columns must be decoded into a gocql.UUID. See ibis.DecodeKey.
+//
+//        var name string
+//        if err := event.DecodeKey(&name); err != nil {
+//            ...
+//        }
+func (e *Event) DecodeKey(dest ...interface{}) error {
+	return ibis.DecodeKey(e.RowKey, dest...)
+}
+
+// Table is the outbox column family. Include a field of type *Table in a schema struct given to
+// ibis.ReflectSchema, then call Track with each column family whose changes should be recorded.
+// Events are timestamped by the clock provided to the schema (see ibis.Clock), and expire after the
+// table's default TTL, DefaultRetention unless configured otherwise.
+type Table struct {
+	*ibis.CF
+
+	ids ibis.TimeUUIDSequence
+}
+
+func (t *Table) NewCF() (*ibis.CF, error) {
+	var err error
+	t.CF, err = ibis.ReflectCF(Event{})
+	if t.CF != nil {
+		t.SetDefaultTTL(DefaultRetention)
+	}
+	return t.CF, err
+}
+
+// retention returns the time to live of the outbox's events.
+func (t *Table) retention() time.Duration {
+	if ttl := t.Options().DefaultTimeToLive; ttl != nil && *ttl > 0 {
+		return time.Duration(*ttl) * time.Second
+	}
+	return DefaultRetention
+}
+
+// bucketOf returns the partition of events written at the given time.
+func bucketOf(at time.Time) time.Time {
+	return at.UTC().Truncate(BucketWidth)
+}
+
+// Track opts the given column families in to the outbox. Each Commit or CommitCAS that changes a row
+// writes an event listing the changed columns, and each Delete writes an event marked deleted. The
+// event is written in the same batch as the commit or delete, except that for CommitCAS it is
+// written just after the lightweight transaction, and only if it applied.
+func (t *Table) Track(cfs ...*ibis.CF) {
+	for _, cf := range cfs {
+		cf.Precommit(t.hook(cf, false))
+		cf.Predelete(t.hook(cf, true))
+	}
+}
+
+func (t *Table) hook(cf *ibis.CF, deleted bool) ibis.PrecommitHook {
+	return func(row interface{}, mmap ibis.MarshaledMap) ([]ibis.CQL, error) {
+		var columns []string
+		if !deleted {
+			columns = mmap.DirtyKeys()
+			if len(columns) == 0 {
+				return nil, nil
+			}
+			sort.Strings(columns)
+		}
+		key, err := cf.EncodeKey(mmap)
+		if err != nil {
+			return nil, err
+		}
+		id, at := t.ids.Next(t.CF)
+		event := &Event{
+			Bucket:  bucketOf(at),
+			ID:      id,
+			Family:  cf.Name(),
+			RowKey:  key,
+			Columns: strings.Join(columns, ","),
+			Deleted: deleted,
+			At:      at,
+		}
+		cql, err := t.MakeCommit(event)
+		if err != nil {
+			return nil, err
+		}
+		return []ibis.CQL{cql}, nil
+	}
+}
+
+// A Sink publishes events delivered by a Relay. If Deliver returns an error, the event is delivered
+// again by the next poll.
+type Sink interface {
+	Deliver(*Event) error
+}
+
+// MemorySink is a Sink that keeps delivered events in memory, for tests.
+type MemorySink struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (s *MemorySink) Deliver(event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the events delivered so far, in order.
+func (s *MemorySink) Events() []*Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Event{}, s.events...)
+}
+
+// A Relay tails the outbox, delivering events to a sink in the order of their IDs. Each event is
+// deleted once the sink accepts it.
+//
+// An event's ID is taken from the clock of the process writing it before its batch is executed, so
+// an event may be committed after others with later IDs. The relay keeps a low-water mark trailing
+// its clock by Lag, and every poll scans all events after the mark, so an event committed late is
+// still delivered so long as it's committed within Lag of its ID's time.
+type Relay struct {
+	// How long after its ID's time an event may be committed. Defaults to DefaultLag.
+	Lag time.Duration
+	// The number of events read from the outbox at a time. Defaults to 100.
+	PageSize int
+
+	table *Table
+	sink  Sink
+	mark  time.Time // every event before this time has been delivered
+}
+
+// Relay returns a relay that delivers the outbox's events to the given sink. It starts from the
+// oldest event that hasn't expired.
+func (t *Table) Relay(sink Sink) *Relay {
+	return &Relay{Lag: DefaultLag, PageSize: 100, table: t, sink: sink}
+}
+
+// Poll delivers the events after the low-water mark, deleting each as the sink accepts it. If the
+// sink fails, polling stops so that the event is retried before any that follow it; otherwise the
+// mark advances to Lag before the present. The number of events delivered is returned.
+func (r *Relay) Poll() (int, error) {
+	now := r.table.Clock().Now()
+	if r.mark.IsZero() {
+		r.mark = now.Add(-r.table.retention())
+	}
+	delivered := 0
+	for bucket := bucketOf(r.mark); !bucket.After(now); bucket = bucket.Add(BucketWidth) {
+		n, err := r.pollBucket(bucket)
+		delivered += n
+		if err != nil {
+			return delivered, err
+		}
+	}
+	if horizon := now.Add(-r.Lag); horizon.After(r.mark) {
+		r.mark = horizon
+	}
+	return delivered, nil
+}
+
+// pollBucket delivers the events of a bucket after the low-water mark, a page at a time.
+func (r *Relay) pollBucket(bucket time.Time) (int, error) {
+	after := ibis.UUIDFromTime(r.mark)
+	pageSize := r.PageSize
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	delivered := 0
+	for {
+		sel := ibis.Select().From(r.table.CF).
+			Where("Bucket = ?", bucket).
+			Where("ID > ?", after).
+			Limit(pageSize)
+		q := r.table.Scanner(sel.Query())
+		events := make([]*Event, 0, pageSize)
+		for {
+			event := new(Event)
+			if !q.ScanRow(event) {
+				break
+			}
+			events = append(events, event)
+		}
+		if err := q.Close(); err != nil {
+			return delivered, err
+		}
+		for _, event := range events {
+			if err := r.sink.Deliver(event); err != nil {
+				return delivered, err
+			}
+			del := ibis.DeleteFrom(r.table.CF).
+				Where("Bucket = ?", event.Bucket).
+				Where("ID = ?", event.ID)
+			if err := del.Query().Exec(); err != nil {
+				return delivered, err
+			}
+			delivered++
+			after = event.ID
+		}
+		if len(events) < pageSize {
+			return delivered, nil
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package outbox
+
+import "errors"
+import "testing"
+import "time"
+
+import "github.com/logan/ibis"
+
+type user struct {
+	Name  string `ibis:"key"`
+	Email string
+	Age   int64
+}
+
+type testModel struct {
+	cluster ibis.Cluster
+	clock   *ibis.FakeClock
+	Users   *ibis.CF
+	Outbox  *Table
+}
+
+func (m *testModel) Close() {
+	m.cluster.Close()
+}
+
+func newTestModel(t *testing.T) *testModel {
+	var err error
+	model := &testModel{
+		cluster: ibis.NewTestConn(t),
+		clock:   &ibis.FakeClock{Time: time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)},
+	}
+	if model.Users, err = ibis.ReflectCF(user{}); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := ibis.ReflectSchema(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema.Cluster = model.cluster
+	schema.Provide(ibis.Clock(model.clock))
+	if schema.SchemaUpdates, err = ibis.DiffLiveSchema(model.cluster, schema); err != nil {
+		t.Fatal(err)
+	}
+	if err = schema.ApplySchemaUpdates(); err != nil {
+		t.Fatal(err)
+	}
+	model.Outbox.Track(model.Users)
+	return model
+}
+
+type failingSink struct {
+	failures int
+}
+
+func (s *failingSink) Deliver(event *Event) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	model := newTestModel(t)
+	defer model.Close()
+
+	if err := model.Users.Commit(&user{Name: "alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Users.Commit(&user{Name: "bob", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// a CAS commit that doesn't apply writes no event
+	err := model.Users.CommitCAS(&user{Name: "bob", Age: 31})
+	if e, ok := err.(*ibis.Error); !ok || e.Key != ibis.ErrAlreadyExists {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	if err := model.Users.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := new(MemorySink)
+	relay := model.Outbox.Relay(sink)
+	n, err := relay.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 events delivered, got %d", n)
+	}
+	events := sink.Events()
+	expected := []struct {
+		name    string
+		columns string
+		deleted bool
+	}{
+		{"alice", "Age,Email,Name", false},
+		{"bob", "Age,Name", false},
+		{"alice", "", true},
+	}
+	for i, e := range expected {
+		var name string
+		if err := events[i].DecodeKey(&name); err != nil {
+			t.Fatal(err)
+		}
+		if events[i].Family != "users" || name != e.name || events[i].Columns != e.columns ||
+			events[i].Deleted != e.deleted {
+			t.Errorf("event %d: expected %+v, got %+v", i, e, events[i])
+		}
+	}
+
+	// delivered events aren't delivered again, even by a new relay
+	if n, err = model.Outbox.Relay(sink).Poll(); err != nil || n != 0 {
+		t.Errorf("expected nothing to redeliver, got %d, %v", n, err)
+	}
+
+	// a failed delivery is retried by the next poll
+	if err := model.Users.Commit(&user{Name: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingSink{failures: 1}
+	relay = model.Outbox.Relay(failing)
+	if n, err = relay.Poll(); err == nil || n != 0 {
+		t.Errorf("expected the sink's failure, got %d, %v", n, err)
+	}
+	if n, err = relay.Poll(); err != nil || n != 1 {
+		t.Errorf("expected a retried delivery, got %d, %v", n, err)
+	}
+}
+
+// pending returns the number of events in the outbox.
+func (m *testModel) pending(t *testing.T) int {
+	var n int
+	q := ibis.Select("count(*)").From(m.Outbox.CF).Query()
+	q.Scan(&n)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRelay(t *testing.T) {
+	model := newTestModel(t)
+	defer model.Close()
+	commit := func(name string) {
+		if err := model.Users.Commit(&user{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink := new(MemorySink)
+	relay := model.Outbox.Relay(sink)
+	relay.PageSize = 2
+	poll := func(expected int) {
+		if n, err := relay.Poll(); err != nil || n != expected {
+			t.Fatalf("expected %d events delivered, got %d, %v", expected, n, err)
+		}
+	}
+
+	// events are timestamped by the schema's clock, and deleted once delivered
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		commit(name)
+	}
+	poll(5)
+	if at := sink.Events()[0].At; !at.Equal(model.clock.Time) {
+		t.Errorf("expected the event at %s, got %s", model.clock.Time, at)
+	}
+	if n := model.pending(t); n != 0 {
+		t.Errorf("expected delivered events to be deleted, %d remain", n)
+	}
+
+	// an event committed late, with an earlier ID than one already delivered, is still delivered
+	model.clock.Advance(10 * time.Second)
+	commit("f")
+	poll(1)
+	// as by another process, whose batch was slow
+	at := model.clock.Add(-5 * time.Second)
+	late := &Event{Bucket: bucketOf(at), ID: ibis.UUIDFromTime(at), Family: "users",
+		RowKey: `["late"]`, At: at}
+	if err := model.Outbox.Commit(late); err != nil {
+		t.Fatal(err)
+	}
+	poll(1)
+	events := sink.Events()
+	var name string
+	if err := events[len(events)-1].DecodeKey(&name); err != nil || name != "late" {
+		t.Errorf("expected the late event, got %s, %v", name, err)
+	}
+
+	// events are partitioned by hour, and a relay reads each partition after its mark
+	model.clock.Advance(2 * time.Hour)
+	commit("g")
+	poll(1)
+	if bucket := sink.Events()[len(sink.Events())-1].Bucket; !bucket.Equal(bucketOf(model.clock.Time)) {
+		t.Errorf("expected the event in bucket %s, got %s", bucketOf(model.clock.Time), bucket)
+	}
+	if !relay.mark.Equal(model.clock.Add(-relay.Lag)) {
+		t.Errorf("expected the mark to trail the clock by %s, got %s", relay.Lag, relay.mark)
+	}
+}
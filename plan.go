@@ -0,0 +1,324 @@
+package ibis
+
+import "bufio"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "sort"
+import "strings"
+
+// A ChangeKind classifies a SchemaChange.
+type ChangeKind string
+
+const (
+	CreateKeyspace = ChangeKind("create keyspace")
+	AlterKeyspace  = ChangeKind("alter keyspace")
+	CreateType     = ChangeKind("create type")
+	AlterType      = ChangeKind("alter type")
+	CreateTable    = ChangeKind("create table")
+	AlterTable     = ChangeKind("alter table")
+	DropView       = ChangeKind("drop materialized view")
+	DropIndex      = ChangeKind("drop index")
+	CreateIndex    = ChangeKind("create index")
+	CreateView     = ChangeKind("create materialized view")
+)
+
+func (k ChangeKind) failure() string {
+	switch k {
+	case CreateKeyspace, AlterKeyspace:
+		return "keyspace update failed"
+	case CreateType:
+		return "type creation failed"
+	case AlterType:
+		return "type alteration failed"
+	case CreateTable:
+		return "column family creation failed"
+	case AlterTable:
+		return "column alteration failed"
+	}
+	return "index or view update failed"
+}
+
+// A SchemaChange describes one step of a SchemaDiff: the creation or alteration of a single
+// keyspace, type, table, index, or view.
+type SchemaChange struct {
+	Kind           ChangeKind
+	Name           string       // the keyspace, type, table, index, or view being changed
+	Table          string       // the table being changed, or that an index or view belongs to
+	NewColumns     []Column     // columns or fields added
+	AlteredColumns []Column     // columns or fields whose type is changed
+	Options        TableOptions // table options set
+	Statements     []CQL        // the CQL that makes the change
+	Unsupported    string       // if not empty, describes a part of the change no CQL can make
+}
+
+// Changes returns the steps of the SchemaDiff in the order they must be applied.
+func (d *SchemaDiff) Changes() []SchemaChange {
+	changes := make([]SchemaChange, 0, d.Size())
+	if d.keyspace != nil {
+		kind := AlterKeyspace
+		if d.keyspace.Create {
+			kind = CreateKeyspace
+		}
+		changes = append(changes, SchemaChange{
+			Kind:       kind,
+			Name:       d.keyspace.Spec.Name,
+			Statements: []CQL{d.keyspace.Statement()},
+		})
+	}
+	for _, t := range d.newTypes {
+		changes = append(changes, SchemaChange{
+			Kind:       CreateType,
+			Name:       t.Name,
+			NewColumns: t.Fields,
+			Statements: []CQL{t.CreateStatement()},
+		})
+	}
+	for _, a := range d.typeChanges {
+		changes = append(changes, SchemaChange{
+			Kind:           AlterType,
+			Name:           a.TypeName,
+			NewColumns:     a.NewFields,
+			AlteredColumns: a.AlteredFields,
+			Statements:     a.AlterStatements(),
+		})
+	}
+	for _, t := range d.creations {
+		changes = append(changes, SchemaChange{
+			Kind:       CreateTable,
+			Name:       t.name,
+			Table:      t.name,
+			NewColumns: t.columns,
+			Options:    t.options,
+			Statements: []CQL{t.CreateStatement()},
+		})
+	}
+	for _, a := range d.alterations {
+		changes = append(changes, SchemaChange{
+			Kind:           AlterTable,
+			Name:           a.TableName,
+			Table:          a.TableName,
+			NewColumns:     a.NewColumns,
+			AlteredColumns: a.AlteredColumns,
+			Options:        a.AlteredOptions,
+			Statements:     a.AlterStatements(),
+			Unsupported:    a.unsupported(),
+		})
+	}
+	// views are dropped before the indexes, and created after them
+	for _, c := range d.viewDrops {
+		var b CQLBuilder
+		changes = append(changes, SchemaChange{
+			Kind:       DropView,
+			Name:       c.View.Name,
+			Table:      c.Table,
+			Statements: []CQL{b.Append("DROP MATERIALIZED VIEW " + c.View.Name).CQL()},
+		})
+	}
+	for _, c := range d.indexDrops {
+		var b CQLBuilder
+		changes = append(changes, SchemaChange{
+			Kind:       DropIndex,
+			Name:       c.Index.Name,
+			Table:      c.Table,
+			Statements: []CQL{b.Append("DROP INDEX " + c.Index.Name).CQL()},
+		})
+	}
+	for _, c := range d.newIndexes {
+		changes = append(changes, SchemaChange{
+			Kind:       CreateIndex,
+			Name:       c.Index.Name,
+			Table:      c.Table,
+			Statements: []CQL{c.Index.CreateStatement(c.Table)},
+		})
+	}
+	for _, c := range d.newViews {
+		changes = append(changes, SchemaChange{
+			Kind:       CreateView,
+			Name:       c.View.Name,
+			Table:      c.Table,
+			Statements: []CQL{c.View.CreateStatement(c.Table)},
+		})
+	}
+	return changes
+}
+
+// Fingerprint identifies the live schema this SchemaDiff was computed against, or is empty if it
+// was computed offline. See SchemaFingerprint.
+func (d *SchemaDiff) Fingerprint() string {
+	return d.fingerprint
+}
+
+// Script renders the SchemaDiff as a CQL migration script for review. A header records the
+// fingerprint of the schema the diff was computed against, and each change is preceded by a
+// comment describing it. Creations and drops are guarded with IF NOT EXISTS and IF EXISTS, so that
+// a partially applied script may be run again. Each statement occupies a single line.
+//
+//        -- ibis schema migration: 2 changes
+//        -- fingerprint: 3f1c0a9e5b7d2c48
+//
+//        -- create table users
+//        CREATE TABLE IF NOT EXISTS users (...);
+//
+//        -- create index users_email_idx on users
+//        CREATE INDEX IF NOT EXISTS users_email_idx ON users (Email);
+//
+// The script may be applied with ApplyScript. Changes that no CQL can make, such as a change to the
+// clustering order of a table, are described in an "-- unsupported:" comment, and a script with
+// such a comment is refused by ApplyScript.
+func (d *SchemaDiff) Script() string {
+	lines := []string{fmt.Sprintf("-- ibis schema migration: %d changes", d.Size())}
+	if d.fingerprint != "" {
+		lines = append(lines, "-- fingerprint: "+d.fingerprint)
+	}
+	for _, c := range d.Changes() {
+		desc := "-- " + string(c.Kind) + " " + c.Name
+		if c.Table != "" && c.Table != c.Name {
+			desc += " on " + c.Table
+		}
+		lines = append(lines, "", desc)
+		if c.Unsupported != "" {
+			lines = append(lines, "-- unsupported: "+c.Unsupported)
+		}
+		for _, cql := range c.Statements {
+			lines = append(lines, guardStatement(cql.String())+";")
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+var statementGuards = [][2]string{
+	{"CREATE TABLE ", "IF NOT EXISTS "},
+	{"CREATE TYPE ", "IF NOT EXISTS "},
+	{"CREATE INDEX ", "IF NOT EXISTS "},
+	{"CREATE MATERIALIZED VIEW ", "IF NOT EXISTS "},
+	{"DROP INDEX ", "IF EXISTS "},
+	{"DROP MATERIALIZED VIEW ", "IF EXISTS "},
+}
+
+// guardStatement inserts IF NOT EXISTS or IF EXISTS into a CREATE or DROP statement.
+func guardStatement(stmt string) string {
+	for _, g := range statementGuards {
+		if strings.HasPrefix(stmt, g[0]) && !strings.HasPrefix(stmt[len(g[0]):], "IF ") {
+			return g[0] + g[1] + stmt[len(g[0]):]
+		}
+	}
+	return stmt
+}
+
+// SchemaFingerprint returns a short digest of the tables, columns, options, indexes, views, and
+// user-defined types of the schema. Names are compared without regard to case, and the order of
+// non-key columns is ignored.
+//
+// A fingerprint of a live schema is only comparable to another live fingerprint, since Cassandra
+// reports options a model may leave unmanaged.
+func SchemaFingerprint(s *Schema) string {
+	lines := make([]string, 0, len(s.CFs)+len(s.Types))
+	for _, udt := range s.Types {
+		fields := make([]string, len(udt.Fields))
+		for i, f := range udt.Fields {
+			fields[i] = f.Name + " " + f.Type
+		}
+		lines = append(lines, "type "+udt.Name+" ("+strings.Join(fields, ", ")+")")
+	}
+	for _, cf := range s.CFs {
+		keys := make(map[string]bool)
+		for _, k := range cf.primaryKey {
+			keys[k] = true
+		}
+		columns := make([]string, 0, len(cf.columns))
+		for _, col := range cf.columns {
+			if !keys[col.Name] {
+				columns = append(columns, col.definition())
+			}
+		}
+		sort.Strings(columns)
+		line := fmt.Sprintf("table %s %d (%s) (%s) (%s) (%s)", cf.name, cf.typeID,
+			strings.Join(cf.PartitionKey(), ", "), strings.Join(cf.clusteringColumns(), ", "),
+			strings.Join(columns, ", "), strings.Join(cf.options.clauses(cf.clusteringColumns()), " AND "))
+		lines = append(lines, line)
+		for _, idx := range cf.Indexes() {
+			lines = append(lines, "index "+idx.Name+" "+cf.name+" "+idx.Column)
+		}
+		for _, v := range cf.Views() {
+			lines = append(lines, fmt.Sprintf("view %s %s (%s) (%s)", v.Name, cf.name,
+				strings.Join(v.PartitionKey, ", "), strings.Join(v.Clustering, ", ")))
+		}
+	}
+	sort.Strings(lines)
+	digest := sha256.Sum256([]byte(strings.ToLower(strings.Join(lines, "\n"))))
+	return hex.EncodeToString(digest[:8])
+}
+
+// LiveSchemaFingerprint returns the SchemaFingerprint of the current keyspace of the cluster.
+func LiveSchemaFingerprint(cluster Cluster) (string, error) {
+	live, err := GetLiveSchema(cluster)
+	if err != nil {
+		return "", ChainError(err, "inspection of live schema failed")
+	}
+	return SchemaFingerprint(live), nil
+}
+
+// checkFingerprint returns ErrSchemaChanged if the live schema doesn't have the given fingerprint.
+func checkFingerprint(cluster Cluster, fingerprint string) error {
+	current, err := LiveSchemaFingerprint(cluster)
+	if err != nil {
+		return err
+	}
+	if current != fingerprint {
+		return NewError(ErrSchemaChanged, "expected fingerprint", fingerprint, "but found", current)
+	}
+	return nil
+}
+
+// ApplyIfUnchanged applies the SchemaDiff only if the live schema still matches the one it was
+// computed against. Otherwise ErrSchemaChanged is returned and nothing is applied. A diff without a
+// fingerprint, as computed offline by DiffSchemas, is applied unchecked.
+func (d *SchemaDiff) ApplyIfUnchanged(cluster Cluster) error {
+	if d.fingerprint != "" {
+		if err := checkFingerprint(cluster, d.fingerprint); err != nil {
+			return err
+		}
+	}
+	return d.Apply(cluster)
+}
+
+// ApplyScript executes a migration script as rendered by SchemaDiff.Script. If the script records
+// a fingerprint and the live schema no longer matches it, ErrSchemaChanged is returned and nothing
+// is applied. If any statements are issued, ApplyScript then waits for schema agreement. A script
+// describing an unsupported change is refused with ErrUnsupportedChange.
+func ApplyScript(cluster Cluster, script string) error {
+	var fingerprint string
+	stmts := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "-- fingerprint: ") {
+			fingerprint = strings.TrimPrefix(line, "-- fingerprint: ")
+		} else if strings.HasPrefix(line, "-- unsupported: ") {
+			return NewError(ErrUnsupportedChange, strings.TrimPrefix(line, "-- unsupported: "))
+		} else if line != "" && !strings.HasPrefix(line, "--") {
+			stmts = append(stmts, strings.TrimSuffix(line, ";"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if fingerprint != "" {
+		if err := checkFingerprint(cluster, fingerprint); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range stmts {
+		var b CQLBuilder
+		cql := b.Append(stmt).CQL()
+		cql.Cluster(cluster)
+		if err := cql.Query().Exec(); err != nil {
+			return ChainError(err, "migration failed at:", stmt)
+		}
+	}
+	if len(stmts) > 0 {
+		return WaitForSchemaAgreement(cluster, SchemaAgreementTimeout)
+	}
+	return nil
+}
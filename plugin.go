@@ -2,6 +2,8 @@ package ibis
 
 import "errors"
 import "reflect"
+import "strconv"
+import "strings"
 
 type ColumnTagApplier interface {
 	ApplyTag(tagValue string, cf *CF, col Column) error
@@ -46,16 +48,67 @@ func (plugin defaultPlugin) RegisterColumnTags(tags *ColumnTags) {
 	tags.Register("", plugin)
 }
 
+// ApplyTag handles a comma-separated list of directives given in the ibis tag of a column.
 func (plugin defaultPlugin) ApplyTag(value string, cf *CF, col Column) error {
-	switch {
-	case value == "key":
-		if cf.primaryKey == nil {
-			cf.primaryKey = []string{col.Name}
-		} else {
+	for _, directive := range strings.Split(value, ",") {
+		d := strings.TrimSpace(directive)
+		switch d {
+		case "key":
+			if cf.primaryKey == nil {
+				cf.primaryKey = []string{col.Name}
+				cf.partitionKeySize = 1
+			} else {
+				cf.primaryKey = append(cf.primaryKey, col.Name)
+			}
+		case "key=partition":
+			n := cf.partitionKeySize
+			keys := make([]string, 0, len(cf.primaryKey)+1)
+			keys = append(keys, cf.primaryKey[:n]...)
+			keys = append(keys, col.Name)
+			cf.primaryKey = append(keys, cf.primaryKey[n:]...)
+			cf.partitionKeySize++
+		case "key=cluster":
+			if cf.partitionKeySize == 0 {
+				return errors.New("clustering column " + col.Name + " precedes partition key")
+			}
 			cf.primaryKey = append(cf.primaryKey, col.Name)
+		case "desc":
+			cf.SetClusteringOrder(col.Name + " DESC")
+		case "index":
+			cf.AddIndex(col.Name)
+		case "static":
+			cf.setStatic(col.Name)
+		case "unique":
+			cf.AddUnique(col.Name)
+		case "deleted_at":
+			cf.SetSoftDelete(col.Name)
+		case "created_at":
+			cf.setCreatedAt(col.Name)
+		case "updated_at":
+			cf.setUpdatedAt(col.Name)
+		case "required":
+			cf.AddConstraint(Constraint{Column: col.Name, Kind: "required"})
+		case "udt":
+			// handled at reflection
+		default:
+			if name := strings.TrimPrefix(d, "lookup="); name != d && name != "" {
+				cf.AddLookup(col.Name, name)
+				continue
+			}
+			if name := strings.TrimPrefix(d, "ref="); name != d && name != "" {
+				cf.AddReference(col.Name, name)
+				continue
+			}
+			if kv := strings.SplitN(d, "=", 2); len(kv) == 2 && (kv[0] == "min" || kv[0] == "max") {
+				n, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					return errors.New("invalid bound in tag: " + value)
+				}
+				cf.AddConstraint(Constraint{Column: col.Name, Kind: kv[0], Bound: n})
+				continue
+			}
+			return errors.New("invalid tag: " + value)
 		}
-	default:
-		return errors.New("invalid tag: " + value)
 	}
 	return nil
 }
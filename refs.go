@@ -0,0 +1,199 @@
+package ibis
+
+import "reflect"
+import "strings"
+import "sync"
+
+// refLoadConcurrency limits the number of referenced rows LoadRefs loads at once.
+const refLoadConcurrency = 16
+
+// A Reference declares that the values of a column are keys of rows in another column family.
+type Reference struct {
+	Column string // the referencing column
+	CF     string // the name of the referenced column family, which must have a single-column key
+}
+
+// AddReference declares that the values of a column are keys of rows in the named column family.
+// Reflected columns tagged `ibis:"ref=name"` are declared this way. A reflected row may designate a
+// pointer field to hold the referenced row by tagging it `ibis:"attach=column"`; see LoadRefs.
+//
+//        type Post struct {
+//            ID         ibis.TimeUUID `ibis:"key"`
+//            AuthorName string        `ibis:"ref=users"`
+//            Author     *User         `ibis:"attach=AuthorName"`
+//        }
+//
+// AddReference returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddReference(column, target string) *CF {
+	cf.references = append(cf.references, Reference{Column: column, CF: target})
+	return cf
+}
+
+// References returns the references declared by the column family's columns.
+func (cf *CF) References() []Reference {
+	return cf.references
+}
+
+// attachDirective returns the column named by an attach directive in an ibis tag, if there is one.
+func attachDirective(tag string) string {
+	for _, directive := range strings.Split(tag, ",") {
+		d := strings.TrimSpace(directive)
+		if column := strings.TrimPrefix(d, "attach="); column != d {
+			return column
+		}
+	}
+	return ""
+}
+
+// LoadRefs eagerly loads the rows referenced by a slice of rows loaded from the column family, and
+// sets their attached fields (see AddReference). The rows argument may be a slice of reflected rows
+// or of pointers to them. Only the references of the given columns are loaded, or of every column
+// with an attached field if none are given.
+//
+//        var posts []*Post
+//        ... // load the posts
+//        err := model.Posts.LoadRefs(posts, "AuthorName")
+//
+// Each distinct key is loaded once, and up to 16 rows are loaded concurrently; rows holding the same
+// reference are given the same pointer. The attached field of a row is set to nil if its reference
+// is empty or no row exists under it.
+func (cf *CF) LoadRefs(rows interface{}, columns ...string) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if cf.rowReflector == nil {
+		return ErrInvalidRowType.New()
+	}
+	slice := reflect.ValueOf(rows)
+	if slice.Kind() != reflect.Slice {
+		return NewError(ErrInvalidRowType, "references must be loaded for a slice of rows")
+	}
+	elems := make([]reflect.Value, 0, slice.Len())
+	for i := 0; i < slice.Len(); i++ {
+		elem := slice.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				continue
+			}
+			elem = elem.Elem()
+		}
+		if elem.Type() != cf.rowType.Elem() || !elem.CanSet() {
+			return NewError(ErrInvalidRowType, "can't load references into", elem.Type().String())
+		}
+		elems = append(elems, elem)
+	}
+
+	refs := make([]Reference, 0, len(cf.references))
+	if len(columns) == 0 {
+		for _, ref := range cf.references {
+			if _, ok := cf.attachments[ref.Column]; ok {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	for _, column := range columns {
+		ref, ok := cf.reference(column)
+		if !ok {
+			return NewError(ErrInvalidReference, "column", column, "of", cf.name, "isn't a reference")
+		}
+		if _, ok := cf.attachments[column]; !ok {
+			return NewError(ErrInvalidReference, "no field is attached to", column, "of", cf.name)
+		}
+		refs = append(refs, ref)
+	}
+	for _, ref := range refs {
+		if err := cf.loadRef(ref, elems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf *CF) reference(column string) (Reference, bool) {
+	for _, ref := range cf.references {
+		if ref.Column == column {
+			return ref, true
+		}
+	}
+	return Reference{}, false
+}
+
+// refTarget is a distinct row referenced by the rows given to LoadRefs.
+type refTarget struct {
+	key interface{}
+	row reflect.Value // invalid if no row was found
+	err error
+}
+
+// loadRef loads the rows referenced through one column, and attaches them.
+func (cf *CF) loadRef(ref Reference, elems []reflect.Value) error {
+	target, ok := cf.schema.CFs[strings.ToLower(ref.CF)]
+	if !ok {
+		return NewError(ErrInvalidReference, "column family", ref.CF, "referenced by", cf.name,
+			"doesn't exist")
+	}
+	if len(target.primaryKey) != 1 {
+		return NewError(ErrInvalidReference, "column family", ref.CF, "referenced by", cf.name,
+			"has a compound key")
+	}
+	field := cf.attachments[ref.Column]
+	fieldType, _ := cf.rowType.Elem().FieldByName(field)
+
+	// Find the distinct keys referenced.
+	targets := make(map[string]*refTarget)
+	keys := make([]string, len(elems))
+	for i, elem := range elems {
+		v := elem.FieldByName(ref.Column)
+		if !v.IsValid() {
+			return NewError(ErrInvalidReference, "column", ref.Column, "of", cf.name,
+				"has no field in", elem.Type().String())
+		}
+		if v.IsZero() {
+			continue
+		}
+		mkey, err := target.MarshalKey(v.Interface())
+		if err != nil {
+			return ChainError(err, "invalid reference in", ref.Column)
+		}
+		keys[i] = target.cacheKey(mkey)
+		if _, ok := targets[keys[i]]; !ok {
+			targets[keys[i]] = &refTarget{key: v.Interface()}
+		}
+	}
+
+	// Load them concurrently.
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, refLoadConcurrency)
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *refTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			row := reflect.New(fieldType.Type.Elem())
+			if err := target.LoadByKey(row.Interface(), t.key); err != nil {
+				if e, ok := err.(*Error); !ok || e.Key != ErrNotFound {
+					t.err = err
+				}
+				return
+			}
+			t.row = row
+		}(t)
+	}
+	wg.Wait()
+	for _, t := range targets {
+		if t.err != nil {
+			return ChainError(t.err, "loading reference", ref.Column, "of", cf.name, "failed")
+		}
+	}
+
+	for i, elem := range elems {
+		dest := elem.FieldByName(field)
+		dest.Set(reflect.Zero(dest.Type()))
+		if t, ok := targets[keys[i]]; ok && t.row.IsValid() {
+			dest.Set(t.row)
+		}
+	}
+	return nil
+}
@@ -61,6 +61,7 @@ func (id *TimeUUID) UnmarshalCQL(info *gocql.TypeInfo, data []byte) error {
 var columnTypeMap = map[string]string{
 	"[]byte":                         "blob",
 	"bool":                           "boolean",
+	"github.com/logan/ibis.Counter":  "counter",
 	"float64":                        "double",
 	"github.com/logan/ibis.SeqID":    "varchar",
 	"github.com/logan/ibis.TimeUUID": "timeuuid",
@@ -79,6 +80,13 @@ var (
 	TIVarchar   = &gocql.TypeInfo{Type: gocql.TypeVarchar}
 	TITimestamp = &gocql.TypeInfo{Type: gocql.TypeTimestamp}
 	TIUUID      = &gocql.TypeInfo{Type: gocql.TypeTimeUUID}
+	TICounter   = &gocql.TypeInfo{Type: gocql.TypeCounter}
+)
+
+// The types of list<varchar> and map<varchar, varchar> columns in system tables.
+var (
+	tiVarcharList = &gocql.TypeInfo{Type: gocql.TypeList, Elem: TIVarchar}
+	tiVarcharMap  = &gocql.TypeInfo{Type: gocql.TypeMap, Key: TIVarchar, Elem: TIVarchar}
 )
 
 var typeInfoMap = map[string]*gocql.TypeInfo{
@@ -89,6 +97,7 @@ var typeInfoMap = map[string]*gocql.TypeInfo{
 	"varchar":   TIVarchar,
 	"timestamp": TITimestamp,
 	"timeuuid":  TIUUID,
+	"counter":   TICounter,
 }
 
 var column_validators = map[string]string{
@@ -99,6 +108,7 @@ var column_validators = map[string]string{
 	"org.apache.cassandra.db.marshal.TimestampType": "timestamp",
 	"org.apache.cassandra.db.marshal.UTF8Type":      "varchar",
 	"org.apache.cassandra.db.marshal.TimeUUIDType":  "timeuuid",
+	"org.apache.cassandra.db.marshal.CounterColumnType": "counter",
 }
 
 // MarshaledValue contains the bytes and type info for a value that has already been marshaled for
@@ -305,6 +315,7 @@ type rowReflector struct {
 	cf             *CF
 	rowType        reflect.Type
 	marshalPlugins []reflect.StructField
+	attachments    map[string]string // names of the fields referenced rows attach to, by column
 }
 
 func newRowReflector(cf *CF, template interface{}) *rowReflector {
@@ -319,6 +330,13 @@ func (s *rowReflector) addMarshalPlugin(field reflect.StructField) {
 	s.marshalPlugins = append(s.marshalPlugins, field)
 }
 
+func (s *rowReflector) attach(column, field string) {
+	if s.attachments == nil {
+		s.attachments = make(map[string]string)
+	}
+	s.attachments[column] = field
+}
+
 func (s *rowReflector) reflectedRow(x interface{}) (Row, error) {
 	xType := reflect.TypeOf(x)
 	if xType == nil {
@@ -361,26 +379,13 @@ func (rr *reflectedRow) Marshal(mmap MarshaledMap) error {
 		marshaled []byte
 		err       error
 	)
+	if err = rr.populate(); err != nil {
+		return err
+	}
 	for _, col := range rr.cf.columns {
 		fieldval := rr.value.FieldByName(col.Name)
 		if fieldval.IsValid() {
-			if seqid, ok := fieldval.Interface().(SeqID); ok && seqid == "" {
-				var gen SeqIDGenerator
-				if rr.cf.Schema() != nil && rr.cf.Schema().GetProvider(&gen) {
-					if seqid, err = gen.NewSeqID(); err != nil {
-						return err
-					}
-					fieldval.Set(reflect.ValueOf(seqid))
-				}
-			}
-			if t, ok := fieldval.Interface().(time.Time); ok && t.IsZero() {
-				// zero time values aren't marshaled correctly by gocql; they go into cassandra
-				// as 1754-08-30 22:43:41.129 +0000 UTC.
-				marshaled, err = gocql.Marshal(col.typeInfo, int64(0))
-			} else {
-				marshaled, err = gocql.Marshal(col.typeInfo, fieldval.Interface())
-			}
-			if err != nil {
+			if marshaled, err = marshalField(col, fieldval); err != nil {
 				return err
 			}
 			mmap[col.Name] = &MarshaledValue{
@@ -404,19 +409,12 @@ func (rr *reflectedRow) Unmarshal(mmap MarshaledMap) error {
 			if !target.IsValid() {
 				return ErrInvalidRowType.New()
 			}
-			if err := gocql.Unmarshal(v.TypeInfo, v.Bytes, target.Addr().Interface()); err != nil {
-				return err
+			col := Column{Name: k, typeInfo: v.TypeInfo}
+			if c, ok := rr.cf.column(k); ok {
+				col.udt = c.udt
 			}
-			// zero time values aren't unmarshaled correctly by gocql; when cassandra returns a
-			// time at 0 relative to its own epoch, we should zero it relative to time.Time's epoch
-			if t, ok := target.Addr().Interface().(*time.Time); ok {
-				var x int64
-				if err := gocql.Unmarshal(TIBigInt, v.Bytes, &x); err != nil {
-					return err
-				}
-				if x == 0 {
-					*t = time.Time{}
-				}
+			if err := unmarshalField(col, v.Bytes, target); err != nil {
+				return err
 			}
 		}
 	}
@@ -427,3 +425,38 @@ func (rr *reflectedRow) Unmarshal(mmap MarshaledMap) error {
 	}
 	return nil
 }
+
+// marshalField marshals the value of a struct field for storage in the given column.
+func marshalField(col Column, fieldval reflect.Value) ([]byte, error) {
+	if col.udt != nil {
+		return gocql.Marshal(col.typeInfo, udtValue{col.udt, fieldval})
+	}
+	if t, ok := fieldval.Interface().(time.Time); ok && t.IsZero() {
+		// zero time values aren't marshaled correctly by gocql; they go into cassandra
+		// as 1754-08-30 22:43:41.129 +0000 UTC.
+		return gocql.Marshal(col.typeInfo, int64(0))
+	}
+	return gocql.Marshal(col.typeInfo, fieldval.Interface())
+}
+
+// unmarshalField unmarshals the value of the given column into a struct field.
+func unmarshalField(col Column, data []byte, target reflect.Value) error {
+	if col.udt != nil {
+		return gocql.Unmarshal(col.typeInfo, data, udtValue{col.udt, target})
+	}
+	if err := gocql.Unmarshal(col.typeInfo, data, target.Addr().Interface()); err != nil {
+		return err
+	}
+	// zero time values aren't unmarshaled correctly by gocql; when cassandra returns a
+	// time at 0 relative to its own epoch, we should zero it relative to time.Time's epoch
+	if t, ok := target.Addr().Interface().(*time.Time); ok {
+		var x int64
+		if err := gocql.Unmarshal(TIBigInt, data, &x); err != nil {
+			return err
+		}
+		if x == 0 {
+			*t = time.Time{}
+		}
+	}
+	return nil
+}
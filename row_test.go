@@ -420,3 +420,50 @@ func TestTimeUUID(t *testing.T) {
 		So(t.String(), ShouldEqual, "00000000-0000-0000-0000-000000000000")
 	})
 }
+
+func TestEncodeKey(t *testing.T) {
+	type event struct {
+		Stream string   `ibis:"key"`
+		Seq    int64    `ibis:"key"`
+		ID     TimeUUID `ibis:"key"`
+	}
+	var err error
+	model := &struct{ Events *CF }{}
+	if model.Events, err = ReflectCF(event{}); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := ReflectSchema(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &FakeClock{Time: time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)}
+	schema.Provide(Clock(clock))
+	cf := model.Events
+
+	Convey("Keys should round trip through EncodeKey and DecodeKey", t, func() {
+		id := UUIDFromTime(time.Now())
+		mkey, err := cf.MarshalKey("a", int64(3), id)
+		So(err, ShouldBeNil)
+		key, err := cf.EncodeKey(mkey)
+		So(err, ShouldBeNil)
+		So(key, ShouldStartWith, `["a",3,"`)
+
+		var stream string
+		var seq int64
+		var uuid gocql.UUID
+		So(DecodeKey(key, &stream, &seq, &uuid), ShouldBeNil)
+		So(stream, ShouldEqual, "a")
+		So(seq, ShouldEqual, 3)
+		So(TimeUUID(uuid), ShouldEqual, id)
+		So(DecodeKey(key, &stream), shouldBeError, ErrInvalidKey)
+	})
+
+	Convey("A TimeUUIDSequence should issue increasing IDs from the schema's clock", t, func() {
+		var seq TimeUUIDSequence
+		first, at := seq.Next(cf)
+		So(at, ShouldResemble, clock.Time)
+		second, at := seq.Next(cf)
+		So(at, ShouldResemble, clock.Add(100*time.Nanosecond))
+		So(gocql.UUID(second).Time().After(gocql.UUID(first).Time()), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,77 @@
+package ibis
+
+import "encoding/json"
+import "fmt"
+import "time"
+
+import "github.com/gocql/gocql"
+
+// EncodeKey encodes the primary key of a marshaled row as a JSON array of its values, such as
+// ["alice",3]. It identifies the row in records kept about it elsewhere, as by the audit and outbox
+// packages, and its values may be recovered with DecodeKey.
+func (cf *CF) EncodeKey(mmap MarshaledMap) (string, error) {
+	values := make([]interface{}, 0, len(cf.primaryKey))
+	for _, k := range cf.primaryKey {
+		v, err := decodeKeyValue(mmap[k])
+		if err != nil {
+			return "", ChainError(err, "encoding of key", k, "failed")
+		}
+		values = append(values, v)
+	}
+	enc, err := json.Marshal(values)
+	return string(enc), err
+}
+
+// DecodeKey unmarshals a key encoded by EncodeKey into dest, one pointer per key column. Values of
+// timeuuid columns must be decoded into a gocql.UUID.
+//
+//        var name string
+//        var seq int64
+//        if err := ibis.DecodeKey(key, &name, &seq); err != nil {
+//            ...
+//        }
+func DecodeKey(key string, dest ...interface{}) error {
+	var values []json.RawMessage
+	if err := json.Unmarshal([]byte(key), &values); err != nil {
+		return NewError(ErrInvalidKey, err.Error())
+	}
+	if len(values) != len(dest) {
+		return NewError(ErrInvalidKey, fmt.Sprintf("key has %d values, not %d", len(values), len(dest)))
+	}
+	for i, v := range values {
+		if err := json.Unmarshal(v, dest[i]); err != nil {
+			return NewError(ErrInvalidKey, err.Error())
+		}
+	}
+	return nil
+}
+
+// decodeKeyValue unmarshals a marshaled key value into a value that encodes to JSON.
+func decodeKeyValue(mv *MarshaledValue) (interface{}, error) {
+	if mv == nil || mv.Bytes == nil {
+		return nil, nil
+	}
+	var dest interface{}
+	switch mv.TypeInfo.Type {
+	case gocql.TypeBoolean:
+		dest = new(bool)
+	case gocql.TypeBlob:
+		dest = new([]byte)
+	case gocql.TypeDouble:
+		dest = new(float64)
+	case gocql.TypeBigInt:
+		dest = new(int64)
+	case gocql.TypeVarchar, gocql.TypeAscii:
+		dest = new(string)
+	case gocql.TypeTimestamp:
+		dest = new(time.Time)
+	case gocql.TypeUUID, gocql.TypeTimeUUID:
+		dest = new(gocql.UUID)
+	default:
+		return nil, NewError(ErrInvalidKey, fmt.Sprintf("unsupported key type %+v", mv.TypeInfo))
+	}
+	if err := gocql.Unmarshal(mv.TypeInfo, mv.Bytes, dest); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
@@ -9,9 +9,16 @@ type Keyspace map[string]*CF
 type Schema struct {
 	Cluster
 	CFs           Keyspace
+	Types         map[string]*UDT // user-defined types by lowercased name
+	KeyspaceSpec  *KeyspaceSpec   // if set, the replication the keyspace should have
 	SchemaUpdates *SchemaDiff
 	ColumnTags
 
+	// If true, live indexes and materialized views that the schema doesn't declare are dropped by
+	// DiffLiveSchema and DiffSchemas. Otherwise they're left alone, as they may be maintained
+	// outside the schema.
+	DropUndeclaredIndexes bool
+
 	nextTypeID int
 	provisions []reflect.Value
 }
@@ -20,6 +27,7 @@ type Schema struct {
 func NewSchema() *Schema {
 	schema := &Schema{
 		CFs:        make(Keyspace),
+		Types:      make(map[string]*UDT),
 		nextTypeID: 1,
 	}
 	var plugin defaultPlugin
@@ -27,14 +35,33 @@ func NewSchema() *Schema {
 	return schema
 }
 
-// AddCF adds a column family definition to the schema.
+// AddCF adds a column family definition to the schema, along with the lookup column families it
+// declares (see CF.AddUnique and CF.AddLookup).
 func (s *Schema) AddCF(cf *CF) {
 	s.CFs[strings.ToLower(cf.name)] = cf
+	for _, udt := range cf.types {
+		if s.Types == nil {
+			s.Types = make(map[string]*UDT)
+		}
+		if _, ok := s.Types[strings.ToLower(udt.Name)]; !ok {
+			s.Types[strings.ToLower(udt.Name)] = udt
+		}
+	}
 	cf.setSchema(s)
 	if cf.typeID == 0 {
 		cf.typeID = s.nextTypeID
 		s.nextTypeID++
 	}
+	for _, column := range cf.uniques {
+		if _, ok := s.CFs[cf.uniqueLookupName(column)]; !ok {
+			s.AddCF(cf.newUniqueLookup(column))
+		}
+	}
+	for _, l := range cf.lookups {
+		if _, ok := s.CFs[strings.ToLower(l.Name)]; !ok {
+			s.AddCF(cf.newLookup(l))
+		}
+	}
 	var plugin SchemaPlugin
 	if cf.GetProvider(&plugin) {
 		plugin.RegisterColumnTags(&s.ColumnTags)
@@ -90,7 +117,15 @@ func (s *Schema) GetProvider(dest interface{}) bool {
 // Upon connecting, the live schema is automatically scanned and compared to this one. The
 // difference between the two will be available in the SchemaUpdates field, and the
 // RequiresUpdates method will be able to report on whether a difference exists.
+//
+// If the schema has a KeyspaceSpec and the keyspace doesn't exist yet, it is created first through a
+// connection to the system keyspace.
 func (s *Schema) DialCassandra(config CassandraConfig) error {
+	if s.KeyspaceSpec != nil {
+		if err := s.createKeyspace(config); err != nil {
+			return ChainError(err, "keyspace creation failed")
+		}
+	}
 	cluster, err := DialCassandra(config)
 	if err != nil {
 		return ChainError(err, "connection to cassandra failed")
@@ -103,6 +138,25 @@ func (s *Schema) DialCassandra(config CassandraConfig) error {
 	return nil
 }
 
+func (s *Schema) createKeyspace(config CassandraConfig) error {
+	spec := s.KeyspaceSpec.withName(config.Keyspace)
+	config.Keyspace = "system"
+	cluster, err := DialCassandra(config)
+	if err != nil {
+		return err
+	}
+	defer cluster.Close()
+	if _, err := GetLiveKeyspace(cluster, spec.Name); err == nil {
+		return nil
+	}
+	cql := spec.CreateStatement()
+	cql.Cluster(cluster)
+	if err := cql.Query().Exec(); err != nil {
+		return err
+	}
+	return WaitForSchemaAgreement(cluster, SchemaAgreementTimeout)
+}
+
 // RequiresUpdates returns true if this schema differs from the existing column families in the
 // connected cluster.
 func (s *Schema) RequiresUpdates() bool {
@@ -168,7 +222,22 @@ func ReflectSchema(model interface{}) (*Schema, error) {
 					return nil, ChainError(err, "failed to reflect schema")
 				}
 				cf.name = strings.ToLower(field.Name)
+				for _, udt := range cf.types {
+					if known, ok := schema.Types[udt.Name]; ok && !sameFields(known, udt) {
+						return nil, NewError(ErrConflictingType, udt.Name, "is used with different fields by",
+							cf.name)
+					}
+				}
 				schema.AddCF(cf)
+				if err := cf.validateCounters(); err != nil {
+					return nil, err
+				}
+				if err := cf.validateStatics(); err != nil {
+					return nil, err
+				}
+				if err := cf.validateSoftDelete(); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -1,7 +1,9 @@
 package ibis
 
 import "reflect"
+import "strings"
 import "testing"
+import "time"
 
 import . "github.com/smartystreets/goconvey/convey"
 
@@ -154,3 +156,119 @@ func TestAddCF(t *testing.T) {
 		So(bool(*p), ShouldBeTrue)
 	})
 }
+
+func TestSchemaDocument(t *testing.T) {
+	newSchema := func() *Schema {
+		schema := NewSchema()
+		point := newUDT("point", Column{Name: "X", Type: "double"}, Column{Name: "Y", Type: "double"})
+		schema.Types["point"] = point
+		schema.KeyspaceSpec = SimpleStrategy(3)
+		schema.KeyspaceSpec.Name = "geo"
+		schema.AddCF(NewCF("Places",
+			Column{Name: "Region", Type: "varchar"},
+			Column{Name: "Name", Type: "varchar"},
+			Column{Name: "Kind", Type: "varchar"},
+			point.column("Location", "")).
+			SetCompositeKey([]string{"Region"}, "Name").
+			SetClusteringOrder("Name DESC").
+			SetGCGrace(time.Hour).
+			AddIndex("Kind").
+			AddView("places_by_kind", []string{"Kind"}))
+		schema.AddCF(NewCF("counts", Column{Name: "ID", Type: "varchar"}).SetPrimaryKey("ID"))
+		return schema
+	}
+
+	Convey("Documents should round trip", t, func() {
+		schema := newSchema()
+		doc, err := schema.Document()
+		So(err, ShouldBeNil)
+		So(string(doc), ShouldContainSubstring, `"name": "Places"`)
+
+		loaded, err := LoadSchemaDocument(doc)
+		So(err, ShouldBeNil)
+		So(loaded.CFs["places"].CreateStatement().String(), ShouldEqual,
+			schema.CFs["places"].CreateStatement().String())
+		So(loaded.CFs["places"].Indexes(), ShouldResemble, schema.CFs["places"].Indexes())
+		So(loaded.CFs["places"].Views(), ShouldResemble, schema.CFs["places"].Views())
+		So(loaded.KeyspaceSpec, ShouldResemble, schema.KeyspaceSpec)
+		So(loaded.nextTypeID, ShouldEqual, 3)
+
+		redoc, err := loaded.Document()
+		So(err, ShouldBeNil)
+		So(string(redoc), ShouldEqual, string(doc))
+	})
+
+	Convey("Identical documents should have an empty diff", t, func() {
+		doc, err := newSchema().Document()
+		So(err, ShouldBeNil)
+		diff, err := DiffSchemaDocuments(doc, doc)
+		So(err, ShouldBeNil)
+		So(diff.Size(), ShouldEqual, 0)
+	})
+
+	Convey("Changes between documents should be diffed offline", t, func() {
+		base, err := newSchema().Document()
+		So(err, ShouldBeNil)
+		schema := newSchema()
+		schema.KeyspaceSpec.ReplicationFactor = 5
+		schema.CFs["places"].columns = append(schema.CFs["places"].columns,
+			Column{Name: "Rating", Type: "double"})
+		schema.AddCF(NewCF("tags", Column{Name: "Tag", Type: "varchar"}).SetPrimaryKey("Tag"))
+		head, err := schema.Document()
+		So(err, ShouldBeNil)
+
+		diff, err := DiffSchemaDocuments(base, head)
+		So(err, ShouldBeNil)
+		So(diff.String(), ShouldEqual, strings.Join([]string{
+			"ALTER KEYSPACE geo WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '5'}",
+			"CREATE TABLE tags (Tag varchar, PRIMARY KEY (Tag)) WITH comment='3'",
+			"ALTER TABLE places ADD Rating double",
+		}, "\n"))
+	})
+
+	Convey("Offline diffs should leave out keyspaces without a name", t, func() {
+		schema := newSchema()
+		schema.KeyspaceSpec.Name = ""
+		diff := DiffSchemas(NewSchema(), schema)
+		So(diff.String(), ShouldNotContainSubstring, "KEYSPACE")
+
+		schema.KeyspaceSpec.Name = "geo"
+		diff = DiffSchemas(NewSchema(), schema)
+		So(diff.String(), ShouldStartWith,
+			"CREATE KEYSPACE IF NOT EXISTS geo WITH replication = {'class': 'SimpleStrategy'")
+	})
+
+	Convey("Offline diffs should apply as migration scripts", t, func() {
+		cluster := FakeCassandra("test")
+		defer cluster.Close()
+		base := newSchema()
+		diff, err := DiffLiveSchema(cluster, base)
+		So(err, ShouldBeNil)
+		So(diff.Apply(cluster), ShouldBeNil)
+		baseDoc, err := base.Document()
+		So(err, ShouldBeNil)
+		head := newSchema()
+		head.CFs["places"].columns = append(head.CFs["places"].columns,
+			Column{Name: "Rating", Type: "double"})
+		headDoc, err := head.Document()
+		So(err, ShouldBeNil)
+
+		diff, err = DiffSchemaDocuments(baseDoc, headDoc)
+		So(err, ShouldBeNil)
+		So(diff.Fingerprint(), ShouldEqual, "")
+		So(ApplyScript(cluster, diff.Script()), ShouldBeNil)
+		diff, err = DiffLiveSchema(cluster, head)
+		So(err, ShouldBeNil)
+		So(diff.Size(), ShouldEqual, 0)
+	})
+
+	Convey("Invalid documents should be rejected", t, func() {
+		_, err := LoadSchemaDocument([]byte("{"))
+		So(err, ShouldNotBeNil)
+		So(err.(*Error).Key, ShouldEqual, ErrInvalidSchemaDocument)
+
+		_, err = LoadSchemaDocument([]byte(`{"tables": [{"name": "x"}]}`))
+		So(err, ShouldNotBeNil)
+		So(err.(*Error).Key, ShouldEqual, ErrInvalidSchemaDocument)
+	})
+}
@@ -0,0 +1,243 @@
+package ibis
+
+import "context"
+import "encoding/hex"
+import "reflect"
+
+// A Session is a unit of work over a schema, meant to last for a single request. Rows loaded
+// through a session are kept in an identity map, so loading the same row twice yields the same
+// value. Changes to the rows it holds aren't written until Flush, which commits all of them in a
+// single batch.
+//
+//        sess := schema.NewSession()
+//        var user *User
+//        if err := sess.Load(model.Users, &user, "alice"); err != nil {
+//            return err
+//        }
+//        user.Visits++
+//        sess.Add(model.Events, &Event{User: "alice", Kind: "visit"})
+//        return sess.Flush()
+//
+// A Session isn't safe for concurrent use.
+type Session struct {
+	schema *Schema
+	rows   map[*CF]map[string]*sessionRow
+	order  []*sessionRow
+}
+
+// sessionRow is a row held by a session, along with the values it was last loaded or flushed with.
+type sessionRow struct {
+	cf       *CF
+	row      interface{}
+	key      string       // the row's key in the identity map, or empty if it hasn't been flushed
+	original MarshaledMap // nil for rows that were added to the session
+}
+
+// NewSession returns an empty session over the schema.
+func (s *Schema) NewSession() *Session {
+	return &Session{schema: s, rows: make(map[*CF]map[string]*sessionRow)}
+}
+
+// Load loads the row with the given key from the column family. The dest argument must be a
+// pointer to a pointer to a row (such as a **User for a column family reflected from User), which
+// is set to the row held by the session. The row is only loaded from the column family the first
+// time it's requested; later loads of the same key set dest to the same pointer, with any changes
+// made to it since.
+func (sess *Session) Load(cf *CF, dest interface{}, key ...interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	ptr := reflect.ValueOf(dest)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Ptr {
+		return NewError(ErrInvalidRowType, "session loads require a pointer to a row pointer")
+	}
+	mkey, err := cf.MarshalKey(key...)
+	if err != nil {
+		return err
+	}
+	ckey := cf.cacheKey(mkey)
+	if sr, ok := sess.rows[cf][ckey]; ok {
+		row := reflect.ValueOf(sr.row)
+		if !row.Type().AssignableTo(ptr.Elem().Type()) {
+			return NewError(ErrInvalidRowType, "session holds a", row.Type().String())
+		}
+		ptr.Elem().Set(row)
+		return nil
+	}
+	mmap, err := cf.loadMarshaled(key...)
+	if err != nil {
+		return err
+	}
+	row := reflect.New(ptr.Elem().Type().Elem())
+	if err := cf.load(row.Interface(), mmap); err != nil {
+		return err
+	}
+	sess.track(&sessionRow{cf: cf, row: row.Interface(), key: ckey, original: mmap.clone()})
+	ptr.Elem().Set(row)
+	return nil
+}
+
+// Add registers a new row with the session, to be committed to the column family on the next
+// Flush. The row must be a pointer, which the session holds on to; once flushed, it's returned by
+// loads of its key.
+func (sess *Session) Add(cf *CF, row interface{}) {
+	sess.track(&sessionRow{cf: cf, row: row})
+}
+
+func (sess *Session) track(sr *sessionRow) {
+	if sr.key != "" {
+		if sess.rows[sr.cf] == nil {
+			sess.rows[sr.cf] = make(map[string]*sessionRow)
+		}
+		sess.rows[sr.cf][sr.key] = sr
+	}
+	sess.order = append(sess.order, sr)
+}
+
+// Flush commits every row added to the session, and every loaded row whose values have changed,
+// along with the statements of their precommit hooks, in a single batch. Statements are grouped by
+// partition within the batch, keeping the order in which rows were loaded or added otherwise. Rows
+// whose only changes are to columns that are always auto-populated (such as those tagged
+// `ibis:"updated_at"`) aren't committed. Rows of counter tables may be loaded, but fail the flush
+// if they're added or changed, as counters are only changed with Increment.
+//
+// Unique values are claimed before the batch is executed, as with Commit; if any claim fails,
+// nothing is written. Postcommit hooks are applied to each row written once the batch has
+// succeeded.
+func (sess *Session) Flush() error {
+	return sess.FlushContext(context.Background())
+}
+
+// FlushContext is Flush with a context, which is given to the precommit hooks.
+func (sess *Session) FlushContext(ctx context.Context) error {
+	type flushed struct {
+		sr        *sessionRow
+		mmap      MarshaledMap
+		partition string
+		stmts     []CQL
+		written   bool
+	}
+	pending := make([]*flushed, 0, len(sess.order))
+	claims := make([]uniqueClaim, 0)
+	fail := func(err error) error {
+		releaseUniques(claims)
+		return err
+	}
+	for _, sr := range sess.order {
+		cf := sr.cf
+		if !cf.IsBound() {
+			return fail(ErrTableNotBound.New())
+		}
+		mmap, err := cf.marshal(sr.row)
+		if err != nil {
+			return fail(ChainError(err, "marshal failed"))
+		}
+		if sr.original != nil {
+			for k, v := range mmap {
+				if o := sr.original[k]; v != nil && o != nil {
+					v.OriginalBytes = o.Bytes
+				}
+			}
+			if !sr.changed(mmap) {
+				// undo the auto-populated changes made while marshaling
+				if err := cf.unmarshal(sr.row, sr.original.clone()); err != nil {
+					return fail(err)
+				}
+				continue
+			}
+		}
+		if cf.IsCounterTable() {
+			return fail(errCounterCommit(cf))
+		}
+		c, err := cf.claimUniques(mmap)
+		if err != nil {
+			return fail(err)
+		}
+		claims = append(claims, c...)
+		stmts, cql, ok, err := cf.commitStatements(ctx, sr.row, mmap, false)
+		if err != nil {
+			return fail(err)
+		}
+		if ok {
+			stmts = append(stmts, cql)
+		}
+		pending = append(pending, &flushed{
+			sr:        sr,
+			mmap:      mmap,
+			partition: cf.partitionGroup(mmap),
+			stmts:     stmts,
+			written:   ok,
+		})
+	}
+
+	// Group the statements by partition, in order of each partition's first appearance.
+	partitions := make([]string, 0)
+	groups := make(map[string][]CQL)
+	for _, p := range pending {
+		if _, ok := groups[p.partition]; !ok {
+			partitions = append(partitions, p.partition)
+		}
+		groups[p.partition] = append(groups[p.partition], p.stmts...)
+	}
+	batch := make([]CQL, 0, len(pending))
+	for _, partition := range partitions {
+		batch = append(batch, groups[partition]...)
+	}
+	if len(batch) > 0 {
+		err := sess.schema.Cluster.Query(batch...).Exec()
+		for _, p := range pending {
+			p.sr.cf.invalidate(p.mmap)
+		}
+		if err != nil {
+			return fail(ChainError(err, "flush failed"))
+		}
+	}
+
+	var first error
+	for _, p := range pending {
+		sr := p.sr
+		if err := sr.cf.finishCommit(sr.row, p.mmap, false, p.written); err != nil && first == nil {
+			first = err
+		}
+		if sr.key != "" {
+			delete(sess.rows[sr.cf], sr.key)
+		}
+		sr.original = p.mmap.clone()
+		sr.key = sr.cf.cacheKey(p.mmap)
+		if sess.rows[sr.cf] == nil {
+			sess.rows[sr.cf] = make(map[string]*sessionRow)
+		}
+		sess.rows[sr.cf][sr.key] = sr
+	}
+	return first
+}
+
+// changed returns true if a marshaled row has changes besides those of columns that are always
+// auto-populated.
+func (sr *sessionRow) changed(mmap MarshaledMap) bool {
+	for _, k := range mmap.DirtyKeys() {
+		auto := false
+		for _, c := range sr.cf.autoColumns {
+			if c.always && c.column == k {
+				auto = true
+				break
+			}
+		}
+		if !auto {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionGroup identifies the partition a marshaled row belongs to.
+func (cf *CF) partitionGroup(mmap MarshaledMap) string {
+	group := cf.name
+	for _, k := range cf.PartitionKey() {
+		group += ":"
+		if v := mmap[k]; v != nil {
+			group += hex.EncodeToString(v.Bytes)
+		}
+	}
+	return group
+}
@@ -0,0 +1,177 @@
+package ibis
+
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// The files of a snapshot directory, besides the data file of each column family.
+const (
+	snapshotSchemaFile   = "schema.json"
+	snapshotManifestFile = "manifest.json"
+)
+
+// snapshotManifest lists the data files of a snapshot. It's written last, so that a snapshot
+// without one is known to be incomplete.
+type snapshotManifest struct {
+	Keyspace string          `json:"keyspace"`
+	TakenAt  time.Time       `json:"taken_at"`
+	Tables   []snapshotTable `json:"tables"`
+}
+
+type snapshotTable struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Rows int    `json:"rows"`
+}
+
+// SnapshotOptions configures Schema.Snapshot.
+type SnapshotOptions struct {
+	// The number of token ranges each column family is scanned in concurrently (see ExportOptions).
+	Ranges int
+	// If not nil, applied to each row before it's written, as to sanitize production data. Rows it
+	// returns nil for are left out of the snapshot.
+	Transform func(cf *CF, row MarshaledMap) (MarshaledMap, error)
+}
+
+// Snapshot writes a logical snapshot of every column family in the schema to a directory, which is
+// created if necessary: the schema document (see Document) in schema.json, the rows of each column
+// family in JSON Lines (see Export) in a file named for it, and a manifest of the files.
+//
+//        err := schema.Snapshot("snapshots/2015-06-01", ibis.SnapshotOptions{Ranges: 8})
+//
+// Column families are exported one after another, with no isolation from concurrent writes; rows
+// changed while the snapshot is taken may or may not be included in their new state. Include every
+// column family the application relies on (such as the lookup column families of AddUnique and
+// AddLookup) in the schema, so that they're restored along with the rows that refer to them.
+func (s *Schema) Snapshot(dir string, options SnapshotOptions) error {
+	if !s.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := s.WriteDocument(filepath.Join(dir, snapshotSchemaFile)); err != nil {
+		return ChainError(err, "snapshot schema failed")
+	}
+	var clock Clock = systemClock{}
+	s.GetProvider(&clock)
+	manifest := snapshotManifest{Keyspace: s.Cluster.GetKeyspace(), TakenAt: clock.Now().UTC()}
+	names := make([]string, 0, len(s.CFs))
+	for name := range s.CFs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cf := s.CFs[name]
+		table := snapshotTable{Name: cf.name, File: name + ".jsonl"}
+		n, err := cf.snapshot(filepath.Join(dir, table.File), options)
+		if err != nil {
+			return ChainError(err, "snapshot of", cf.name, "failed")
+		}
+		table.Rows = n
+		manifest.Tables = append(manifest.Tables, table)
+	}
+	encoded, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, snapshotManifestFile), append(encoded, '\n'), 0644)
+}
+
+// snapshot exports the column family to the named file.
+func (cf *CF) snapshot(filename string, options SnapshotOptions) (int, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	export := ExportOptions{Format: JSONLines, Ranges: options.Ranges}
+	if options.Transform != nil {
+		export.Transform = func(row MarshaledMap) (MarshaledMap, error) {
+			return options.Transform(cf, row)
+		}
+	}
+	n, err := cf.Export(f, export)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// RestoreOptions configures RestoreSnapshot.
+type RestoreOptions struct {
+	// The number of rows written in each batch (see ImportOptions).
+	BatchSize int
+	// The maximum number of rows to write per second, or unlimited if not positive.
+	Rate float64
+}
+
+// RestoreSnapshot restores a snapshot taken by Schema.Snapshot into the current keyspace of the
+// given cluster, which may be another keyspace or a FakeCassandra. Column families of the snapshot
+// are created, and the rows of each are imported (see Import). The keyspace itself isn't altered.
+// The restored schema is returned, bound to the cluster.
+//
+//        cluster := ibis.FakeCassandra("test")
+//        schema, err := ibis.RestoreSnapshot(cluster, "testdata/seed", ibis.RestoreOptions{})
+//
+// The keyspace must be empty, so that restoring neither alters nor overwrites what's already in
+// it; if it holds any column families or user-defined types, ErrKeyspaceNotEmpty is returned and
+// nothing is restored.
+func RestoreSnapshot(cluster Cluster, dir string, options RestoreOptions) (*Schema, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotManifestFile))
+	if err != nil {
+		return nil, NewError(ErrInvalidSnapshot, "no manifest in", dir)
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, NewError(ErrInvalidSnapshot, "invalid manifest:", err.Error())
+	}
+	schema, err := ReadSchemaDocument(filepath.Join(dir, snapshotSchemaFile))
+	if err != nil {
+		return nil, ChainError(err, "invalid snapshot schema")
+	}
+
+	live, err := GetLiveSchema(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if len(live.CFs) > 0 || len(live.Types) > 0 {
+		return nil, NewError(ErrKeyspaceNotEmpty, "can't restore into keyspace", cluster.GetKeyspace())
+	}
+
+	// replication is a property of the environment restored into
+	schema.KeyspaceSpec = nil
+	schema.Cluster = cluster
+	if schema.SchemaUpdates, err = DiffLiveSchema(cluster, schema); err != nil {
+		return nil, err
+	}
+	if err := schema.ApplySchemaUpdates(); err != nil {
+		return nil, ChainError(err, "restore schema failed")
+	}
+
+	for _, table := range manifest.Tables {
+		cf, ok := schema.CFs[strings.ToLower(table.Name)]
+		if !ok {
+			return nil, NewError(ErrInvalidSnapshot, "table", table.Name, "isn't in the schema")
+		}
+		f, err := os.Open(filepath.Join(dir, table.File))
+		if err != nil {
+			return nil, NewError(ErrInvalidSnapshot, "missing data file", table.File)
+		}
+		n, err := cf.Import(f, ImportOptions{Format: JSONLines, BatchSize: options.BatchSize,
+			Rate: options.Rate})
+		f.Close()
+		if err != nil {
+			return nil, ChainError(err, "restore of", table.Name, "failed")
+		}
+		if n != table.Rows {
+			return nil, NewError(ErrInvalidSnapshot, "data file", table.File, "has",
+				strconv.Itoa(n), "rows, expected", strconv.Itoa(table.Rows))
+		}
+	}
+	return schema, nil
+}
@@ -0,0 +1,201 @@
+package ibis
+
+import "time"
+
+import "github.com/gocql/gocql"
+
+// SetSoftDelete makes deletes from the column family soft: Delete sets the given timestamp column to
+// the time of deletion instead of removing the row. Reflected columns tagged `ibis:"deleted_at"` are
+// declared this way.
+//
+//        type User struct {
+//            Name      string    `ibis:"key"`
+//            DeletedAt time.Time `ibis:"deleted_at"`
+//        }
+//
+// Soft-deleted rows are treated as not found by LoadByKey, Exists, LoadByUnique, and LoadBy, and
+// are skipped by ScanRow. Use IncludeDeleted to see them, Restore to undelete one, and Purge to
+// remove them for good once they've been deleted long enough. A soft-deleted row keeps its lookup
+// entries and unique values until it's purged, so that it can be restored.
+//
+// SetSoftDelete returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) SetSoftDelete(column string) *CF {
+	cf.deletedAt = column
+	return cf
+}
+
+// SoftDeleteColumn returns the name of the column soft deletes are recorded in, or an empty string
+// if deletes from the column family are hard.
+func (cf *CF) SoftDeleteColumn() string {
+	return cf.deletedAt
+}
+
+// IncludeDeleted returns a copy of the column family whose loads and scans include soft-deleted
+// rows.
+//
+//        err := model.Users.IncludeDeleted().LoadByKey(&user, "alice")
+func (cf *CF) IncludeDeleted() *CF {
+	c := *cf
+	c.includeDeleted = true
+	return &c
+}
+
+// validateSoftDelete checks that the soft delete column is a timestamp outside the primary key.
+func (cf *CF) validateSoftDelete() error {
+	if cf.deletedAt == "" {
+		return nil
+	}
+	col, ok := cf.column(cf.deletedAt)
+	if !ok || col.Type != "timestamp" {
+		return NewError(ErrInvalidSoftDelete, "column", cf.deletedAt, "of", cf.name,
+			"is not a timestamp")
+	}
+	for _, k := range cf.primaryKey {
+		if k == cf.deletedAt {
+			return NewError(ErrInvalidSoftDelete, "column", k, "of", cf.name,
+				"is part of the primary key")
+		}
+	}
+	return nil
+}
+
+// filtersDeleted returns true if soft-deleted rows should be treated as not found.
+func (cf *CF) filtersDeleted() bool {
+	return cf.deletedAt != "" && !cf.includeDeleted
+}
+
+// isDeleted returns true if the marshaled row has been soft-deleted. Rows that have been restored
+// hold a zero timestamp.
+func (cf *CF) isDeleted(mmap MarshaledMap) bool {
+	if cf.deletedAt == "" {
+		return false
+	}
+	v := mmap[cf.deletedAt]
+	if v == nil || len(v.Bytes) == 0 {
+		return false
+	}
+	var ms int64
+	if err := gocql.Unmarshal(TIBigInt, v.Bytes, &ms); err != nil {
+		return false
+	}
+	return ms != 0
+}
+
+// deletedTime returns when a soft-deleted row was deleted.
+func (cf *CF) deletedTime(mmap MarshaledMap) (time.Time, error) {
+	var t time.Time
+	err := gocql.Unmarshal(TITimestamp, mmap[cf.deletedAt].Bytes, &t)
+	return t, err
+}
+
+// softDelete marks a row deleted along with the statements of the predelete hooks.
+func (cf *CF) softDelete(cqls []CQL, key ...interface{}) error {
+	upd := Update(cf).Set(cf.deletedAt, cf.now())
+	for i, k := range cf.primaryKey {
+		upd.Where(k+" = ?", key[i])
+	}
+	if err := cf.schema.Cluster.Query(append(cqls, upd.CQL())...).Exec(); err != nil {
+		return ChainError(err, "soft delete failed")
+	}
+	cf.invalidateKey(key...)
+	return nil
+}
+
+// Restore undeletes a soft-deleted row. If no soft-deleted row exists under the given key,
+// ErrNotFound is returned. Restore and Purge return ErrNoSoftDelete for column families without a
+// soft delete column.
+func (cf *CF) Restore(key ...interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	if cf.deletedAt == "" {
+		return NewError(ErrNoSoftDelete, cf.name)
+	}
+	if len(key) != len(cf.primaryKey) {
+		return ErrInvalidKey.New()
+	}
+	mmap, err := cf.IncludeDeleted().loadMarshaled(key...)
+	if err != nil {
+		return err
+	}
+	if !cf.isDeleted(mmap) {
+		return ErrNotFound.New()
+	}
+	// like a zero time.Time field, the restored row holds a zero timestamp
+	zero, err := gocql.Marshal(TIBigInt, int64(0))
+	if err != nil {
+		return err
+	}
+	upd := Update(cf).Set(cf.deletedAt, &MarshaledValue{Bytes: zero, TypeInfo: TITimestamp})
+	for i, k := range cf.primaryKey {
+		upd.Where(k+" = ?", key[i])
+	}
+	if err := upd.Query().Exec(); err != nil {
+		return ChainError(err, "restore failed")
+	}
+	cf.invalidateKey(key...)
+	return nil
+}
+
+// purgePageSize is the number of expired rows Purge collects before removing them.
+var purgePageSize = 100
+
+// Purge removes the rows that were soft-deleted more than the given retention period ago, along with
+// their lookup entries and unique values. Hooks aren't invoked, as they were when the rows were
+// deleted. Purge scans the entire column family, so it's meant to be run periodically as a
+// maintenance job. Expired rows are removed a page at a time as the scan proceeds. The number of
+// rows removed is returned.
+func (cf *CF) Purge(retention time.Duration) (int, error) {
+	if !cf.IsBound() {
+		return 0, ErrTableNotBound.New()
+	}
+	if cf.deletedAt == "" {
+		return 0, NewError(ErrNoSoftDelete, cf.name)
+	}
+	colnames := make([]string, len(cf.columns))
+	for i, col := range cf.columns {
+		colnames[i] = col.Name
+	}
+	qiter := Select(colnames...).From(cf).Query()
+	cutoff := cf.now().Add(-retention)
+	purged := 0
+	page := make([]MarshaledMap, 0, purgePageSize)
+	purge := func() error {
+		for _, mmap := range page {
+			if err := cf.hardDelete(nil, mmap); err != nil {
+				return err
+			}
+			purged++
+		}
+		page = page[:0]
+		return nil
+	}
+	for {
+		mmap := make(MarshaledMap)
+		if !qiter.Scan(mmap.PointersTo(colnames...)...) {
+			break
+		}
+		if !cf.isDeleted(mmap) {
+			continue
+		}
+		deleted, err := cf.deletedTime(mmap)
+		if err != nil {
+			qiter.Close()
+			return purged, ChainError(err, "invalid deletion time")
+		}
+		if !deleted.Before(cutoff) {
+			continue
+		}
+		if page = append(page, mmap); len(page) == purgePageSize {
+			if err := purge(); err != nil {
+				qiter.Close()
+				return purged, err
+			}
+		}
+	}
+	if err := qiter.Close(); err != nil {
+		return purged, ChainError(err, "purge scan failed")
+	}
+	return purged, purge()
+}
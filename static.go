@@ -0,0 +1,119 @@
+package ibis
+
+import "github.com/gocql/gocql"
+
+// StaticColumns returns the names of the static columns of the column family. A static column holds
+// a single value shared by every row of a partition, such as the title of a thread stored alongside
+// its messages. Fields of a reflected row are made static with the "static" tag:
+//
+//        type Message struct {
+//            Thread string        `ibis:"key"`
+//            ID     ibis.TimeUUID `ibis:"key"`
+//            Title  string        `ibis:"static"`
+//            Body   string
+//        }
+//
+// Committing a row whose clustering columns are all unset (e.g. unset TimeUUIDs, but not empty
+// strings) and whose regular columns are empty updates only the static columns of its partition:
+//
+//        err := model.Messages.Commit(&Message{Thread: "golang", Title: "Go"})
+//
+// A reflected row that also sets a regular column, such as Body, is given new TimeUUID keys and
+// committed as a new row (see AddDefault). Otherwise a row without clustering values can't change
+// its regular columns; its commit fails with ErrInvalidKey if it does.
+func (cf *CF) StaticColumns() []string {
+	names := make([]string, 0)
+	for _, col := range cf.columns {
+		if col.Static {
+			names = append(names, col.Name)
+		}
+	}
+	return names
+}
+
+// setStatic marks the named column as static.
+func (cf *CF) setStatic(name string) {
+	for i, col := range cf.columns {
+		if col.Name == name {
+			cf.columns[i].Static = true
+		}
+	}
+}
+
+// validateStatics checks that static columns are outside the primary key of a column family with
+// clustering columns.
+func (cf *CF) validateStatics() error {
+	statics := cf.StaticColumns()
+	if len(statics) == 0 {
+		return nil
+	}
+	if len(cf.clusteringColumns()) == 0 {
+		return NewError(ErrInvalidStaticColumn, "column", statics[0], "of", cf.name,
+			"requires clustering columns")
+	}
+	for _, k := range cf.primaryKey {
+		if col, ok := cf.column(k); ok && col.Static {
+			return NewError(ErrInvalidStaticColumn, "column", k, "of", cf.name,
+				"is part of the primary key")
+		}
+	}
+	return nil
+}
+
+// isStaticCommit returns true if the marshaled row gives its partition key but none of its
+// clustering columns, so that only its static columns may be written. A clustering column is given
+// unless its value is missing or null, or is an unset TimeUUID; an empty string is a value like any
+// other.
+func (cf *CF) isStaticCommit(mmap MarshaledMap) bool {
+	clustering := cf.clusteringColumns()
+	if len(clustering) == 0 || len(cf.StaticColumns()) == 0 {
+		return false
+	}
+	for _, k := range clustering {
+		if isPresent(mmap[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPresent returns true if the marshaled value is neither missing, null, nor an unset TimeUUID.
+func isPresent(v *MarshaledValue) bool {
+	if v == nil || v.Bytes == nil {
+		return false
+	}
+	return len(v.Bytes) > 0 || v.TypeInfo == nil || v.TypeInfo.Type != gocql.TypeTimeUUID
+}
+
+// checkStaticCommit returns an error if the marshaled row is a commit of static columns only that
+// changes any of its regular columns, as these can't be written without the clustering columns.
+func (cf *CF) checkStaticCommit(mmap MarshaledMap) error {
+	if !cf.isStaticCommit(mmap) {
+		return nil
+	}
+	for _, col := range cf.columns {
+		if v := mmap[col.Name]; v != nil && v.Dirty() && !col.Static && !cf.isKey(col.Name) {
+			return NewError(ErrInvalidKey, "column", col.Name, "of", cf.name,
+				"can't be committed without the clustering columns")
+		}
+	}
+	return nil
+}
+
+// generateStaticCommit returns an update of the dirty static columns of a row's partition.
+func (cf *CF) generateStaticCommit(mmap MarshaledMap) (cql CQL, ok bool) {
+	upd := Update(cf)
+	for _, k := range cf.StaticColumns() {
+		if v := mmap[k]; v != nil && v.Dirty() {
+			upd.Set(k, v)
+			ok = true
+		}
+	}
+	if ok {
+		for _, k := range cf.PartitionKey() {
+			upd.Where(k+" = ?", mmap[k])
+		}
+		cql = upd.CQL()
+	}
+	return
+}
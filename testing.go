@@ -4,6 +4,7 @@ import "flag"
 import "strconv"
 import "strings"
 import "testing"
+import "time"
 
 import . "github.com/smartystreets/goconvey/convey"
 
@@ -24,6 +25,21 @@ func (g *FakeSeqIDGenerator) NewSeqID() (SeqID, error) {
 	return SeqID(strconv.FormatUint(uint64(*g), 36)), nil
 }
 
+// FakeClock is a Clock for tests that stands still until it's advanced.
+type FakeClock struct {
+	time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.Time
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *FakeClock) Advance(d time.Duration) *FakeClock {
+	c.Time = c.Time.Add(d)
+	return c
+}
+
 func connect(config CassandraConfig) (Cluster, error) {
 	if config.Node[0] == "" {
 		return FakeCassandra(*flagKeyspace), nil
@@ -72,10 +88,9 @@ func initKeyspace(config CassandraConfig) error {
 		return ChainError(err, "drop keyspace failed")
 	}
 
-	b.Clear()
-	b.Append("CREATE KEYSPACE ").Append(*flagKeyspace)
-	b.Append(" WITH REPLICATION = {'class': 'SimpleStrategy', 'replication_factor': 1}")
-	cql = b.CQL()
+	spec := SimpleStrategy(1)
+	spec.Name = *flagKeyspace
+	cql = spec.CreateStatement()
 	cql.Cluster(c)
 	if err := cql.Query().Exec(); err != nil {
 		return ChainError(err, "create keyspace failed")
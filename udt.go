@@ -0,0 +1,345 @@
+package ibis
+
+import "encoding/binary"
+import "encoding/hex"
+import "errors"
+import "reflect"
+import "sort"
+import "strings"
+
+import "github.com/gocql/gocql"
+
+// A UDT describes a Cassandra user-defined type. UDTs are reflected from struct-typed fields tagged
+// `ibis:"udt"`; the struct's marshalable fields become the fields of the type.
+//
+//        type Address struct {
+//            Street string
+//            City   string
+//        }
+//        type User struct {
+//            Name string  `ibis:"key"`
+//            Home Address `ibis:"udt"`
+//        }
+//
+// This yields "CREATE TYPE address (Street varchar, City varchar)" in the schema, and a Home column
+// of type frozen<address>.
+type UDT struct {
+	Name     string
+	Fields   []Column
+	typeInfo *gocql.TypeInfo
+}
+
+func newUDT(name string, fields ...Column) *UDT {
+	return &UDT{
+		Name:     name,
+		Fields:   fields,
+		typeInfo: &gocql.TypeInfo{Type: gocql.TypeCustom, Custom: name},
+	}
+}
+
+// reflectUDT builds a UDT from a struct type. It and any nested UDTs not already in types are
+// appended to types, each following those it depends on.
+func reflectUDT(t reflect.Type, types []*UDT) (*UDT, []*UDT, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, nil, ErrInvalidRowType.New()
+	}
+	udt := newUDT(strings.ToLower(t.Name()))
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if hasDirective(field.Tag.Get("ibis"), "udt") {
+			nested, nestedTypes, err := reflectUDT(field.Type, types)
+			if err != nil {
+				return nil, nil, err
+			}
+			types = nestedTypes
+			udt.Fields = append(udt.Fields, nested.column(field.Name, field.Tag))
+		} else if col, ok := columnFromStructField(field); ok {
+			udt.Fields = append(udt.Fields, col)
+		}
+	}
+	for _, known := range types {
+		if known.Name == udt.Name {
+			if !sameFields(known, udt) {
+				return nil, nil, NewError(ErrConflictingType, udt.Name, "is reflected from", t.String(),
+					"with different fields")
+			}
+			return known, types, nil
+		}
+	}
+	return udt, append(types, udt), nil
+}
+
+// sameFields returns true if the two types have the same fields, of the same types, in the same
+// order.
+func sameFields(a, b *UDT) bool {
+	if len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for i, f := range a.Fields {
+		if f.Name != b.Fields[i].Name || f.Type != b.Fields[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+func hasDirective(tag, directive string) bool {
+	for _, d := range strings.Split(tag, ",") {
+		if strings.TrimSpace(d) == directive {
+			return true
+		}
+	}
+	return false
+}
+
+// column returns a column definition storing values of this type.
+func (udt *UDT) column(name string, tag reflect.StructTag) Column {
+	return Column{
+		Name:     name,
+		Type:     "frozen<" + udt.Name + ">",
+		typeInfo: udt.typeInfo,
+		tag:      tag,
+		udt:      udt,
+	}
+}
+
+// CreateStatement returns the CQL statement that would create this type.
+func (udt *UDT) CreateStatement() CQL {
+	fields := make([]string, len(udt.Fields))
+	for i, f := range udt.Fields {
+		fields[i] = f.Name + " " + f.Type
+	}
+	var b CQLBuilder
+	b.Append("CREATE TYPE " + udt.Name + " (" + strings.Join(fields, ", ") + ")")
+	return b.CQL()
+}
+
+// dependencies returns the names of the UDTs used by the fields of this one.
+func (udt *UDT) dependencies() []string {
+	deps := make([]string, 0)
+	for _, f := range udt.Fields {
+		if name, ok := udtNameFromType(f.Type); ok {
+			deps = append(deps, name)
+		}
+	}
+	return deps
+}
+
+// udtNameFromType extracts the type name from a column type of the form frozen<name>.
+func udtNameFromType(coltype string) (string, bool) {
+	if strings.HasPrefix(coltype, "frozen<") && strings.HasSuffix(coltype, ">") {
+		return coltype[len("frozen<") : len(coltype)-1], true
+	}
+	return "", false
+}
+
+// sortTypes orders the given types so that each follows those it depends on. Otherwise types are
+// sorted by name.
+func sortTypes(types []*UDT) []*UDT {
+	byName := make(map[string]*UDT)
+	names := make([]string, len(types))
+	for i, udt := range types {
+		byName[strings.ToLower(udt.Name)] = udt
+		names[i] = strings.ToLower(udt.Name)
+	}
+	sort.Strings(names)
+	sorted := make([]*UDT, 0, len(types))
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		udt, ok := byName[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, dep := range udt.dependencies() {
+			visit(strings.ToLower(dep))
+		}
+		sorted = append(sorted, udt)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return sorted
+}
+
+// A udtValue is a struct value of a user-defined type, handed to gocql as a Marshaler or
+// Unmarshaler. The version of gocql ibis builds against predates native support for user-defined
+// types, so this is how it's given their values to encode and decode.
+type udtValue struct {
+	udt   *UDT
+	value reflect.Value
+}
+
+func (v udtValue) MarshalCQL(info *gocql.TypeInfo) ([]byte, error) {
+	return v.udt.marshal(v.value)
+}
+
+func (v udtValue) UnmarshalCQL(info *gocql.TypeInfo, data []byte) error {
+	return v.udt.unmarshal(data, v.value)
+}
+
+// marshal encodes a struct value in the native protocol's format for UDT values: each field in order
+// as a 4-byte length followed by that many bytes, with a length of -1 for null.
+func (udt *UDT) marshal(value reflect.Value) ([]byte, error) {
+	if value.Kind() != reflect.Struct {
+		return nil, errors.New("can't marshal " + value.Type().String() + " into " + udt.Name)
+	}
+	var encoded []byte
+	for _, f := range udt.Fields {
+		length := make([]byte, 4)
+		fieldval := value.FieldByName(f.Name)
+		if !fieldval.IsValid() {
+			binary.BigEndian.PutUint32(length, 0xffffffff)
+			encoded = append(encoded, length...)
+			continue
+		}
+		marshaled, err := marshalField(f, fieldval)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(marshaled)))
+		encoded = append(encoded, length...)
+		encoded = append(encoded, marshaled...)
+	}
+	return encoded, nil
+}
+
+// unmarshal decodes a UDT value into a struct. Fields missing from the end of the value, as when the
+// type has had fields added since the value was written, are left zero.
+func (udt *UDT) unmarshal(data []byte, target reflect.Value) error {
+	if target.Kind() != reflect.Struct {
+		return errors.New("can't unmarshal " + udt.Name + " into " + target.Type().String())
+	}
+	target.Set(reflect.Zero(target.Type()))
+	for _, f := range udt.Fields {
+		if len(data) == 0 {
+			break
+		}
+		if len(data) < 4 {
+			return errors.New("truncated value of type " + udt.Name)
+		}
+		length := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if length < 0 {
+			continue
+		}
+		if int(length) > len(data) {
+			return errors.New("truncated value of type " + udt.Name)
+		}
+		fieldval := target.FieldByName(f.Name)
+		if fieldval.IsValid() {
+			if err := unmarshalField(f, data[:length], fieldval); err != nil {
+				return err
+			}
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+// UDTs returns the user-defined types used by the columns of this column family, each following
+// those it depends on.
+func (cf *CF) UDTs() []*UDT {
+	return cf.types
+}
+
+// udtFromValidator recognizes the validator Cassandra reports for a column of user-defined type,
+// e.g. org.apache.cassandra.db.marshal.UserType(keyspace,61646472657373,...), possibly wrapped in
+// FrozenType(...). The type name is hex-encoded.
+func udtFromValidator(validator string) (string, bool) {
+	const userType = "org.apache.cassandra.db.marshal.UserType("
+	i := strings.Index(validator, userType)
+	if i < 0 {
+		return "", false
+	}
+	params := strings.SplitN(validator[i+len(userType):], ",", 3)
+	if len(params) < 2 {
+		return "", false
+	}
+	name, err := hex.DecodeString(strings.TrimRight(params[1], ")"))
+	if err != nil {
+		return "", false
+	}
+	return "frozen<" + string(name) + ">", true
+}
+
+// getLiveTypes returns the user-defined types of the keyspace described by
+// system.schema_usertypes, which only exists in Cassandra 2.1 and later.
+func getLiveTypes(cluster Cluster, keyspace string) (map[string]*UDT, error) {
+	sel := Select("type_name", "field_names", "field_types").
+		From(NewCF("system.schema_usertypes")).Where("keyspace_name = ?", keyspace)
+	cql := sel.CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	types := make(map[string]*UDT)
+	for {
+		var type_name string
+		var field_names, field_types []string
+		if !qiter.Scan(&type_name, &field_names, &field_types) {
+			break
+		}
+		udt := newUDT(type_name)
+		for i, name := range field_names {
+			var validator string
+			if i < len(field_types) {
+				validator = field_types[i]
+			}
+			udt.Fields = append(udt.Fields, Column{Name: name, Type: typeFromValidator(validator)})
+		}
+		types[type_name] = udt
+	}
+	return types, qiter.Close()
+}
+
+type typeAlteration struct {
+	TypeName      string
+	NewFields     []Column
+	AlteredFields []Column
+}
+
+func (a typeAlteration) Size() int {
+	return len(a.NewFields) + len(a.AlteredFields)
+}
+
+func (a typeAlteration) AlterStatements() []CQL {
+	alts := make([]CQL, 0, a.Size())
+	for _, f := range a.NewFields {
+		var b CQLBuilder
+		b.Append("ALTER TYPE ").Append(a.TypeName).Append(" ADD ").Append(f.Name + " " + f.Type)
+		alts = append(alts, b.CQL())
+	}
+	for _, f := range a.AlteredFields {
+		var b CQLBuilder
+		b.Append("ALTER TYPE ").Append(a.TypeName).
+			Append(" ALTER ").Append(f.Name).Append(" TYPE ").Append(f.Type)
+		alts = append(alts, b.CQL())
+	}
+	return alts
+}
+
+// diffFields compares the fields of a model type to those of the live type.
+func diffFields(model, live *UDT) typeAlteration {
+	alteration := typeAlteration{
+		TypeName:      model.Name,
+		NewFields:     make([]Column, 0),
+		AlteredFields: make([]Column, 0),
+	}
+	old_fields := make(map[string]string)
+	for _, f := range live.Fields {
+		old_fields[strings.ToLower(f.Name)] = f.Type
+	}
+	for _, f := range model.Fields {
+		if old_type, ok := old_fields[strings.ToLower(f.Name)]; ok {
+			if old_type != f.Type {
+				alteration.AlteredFields = append(alteration.AlteredFields, f)
+			}
+		} else {
+			alteration.NewFields = append(alteration.NewFields, f)
+		}
+	}
+	return alteration
+}
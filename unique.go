@@ -0,0 +1,175 @@
+package ibis
+
+import "bytes"
+import "strings"
+
+// AddUnique declares that no two rows of the column family may share a value of the given column.
+// Reflected columns tagged `ibis:"unique"` are declared this way.
+//
+// Uniqueness is enforced through a lookup column family named <table>_<column>_unique, which is
+// added to the schema along with this one. It is keyed by the unique column, and records the primary
+// key of the row holding each value. Before Commit or CommitCAS writes a row, each changed unique
+// value is claimed in its lookup table with a lightweight transaction; if another row holds the
+// value, ErrNotUnique is returned and nothing is written. After the row is written, any value it
+// previously held is released, again with a lightweight transaction, so a value is only released by
+// the row holding it. Previous values are only known for rows with an AutoPatcher; see
+// AutoPatcher.
+//
+// Empty values aren't claimed. Statements built with MakeCommit or MakeCommitCAS don't claim or
+// release values.
+//
+// AddUnique returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddUnique(column string) *CF {
+	cf.uniques = append(cf.uniques, column)
+	return cf
+}
+
+// Uniques returns the names of the columns declared unique on this column family.
+func (cf *CF) Uniques() []string {
+	return cf.uniques
+}
+
+func (cf *CF) uniqueLookupName(column string) string {
+	return strings.ToLower(cf.name + "_" + column + "_unique")
+}
+
+// newUniqueLookup returns the definition of the lookup column family for a unique column.
+func (cf *CF) newUniqueLookup(column string) *CF {
+	columns := make([]Column, 0, len(cf.primaryKey)+1)
+	for _, name := range append([]string{column}, cf.primaryKey...) {
+		if col, ok := cf.column(name); ok {
+			columns = append(columns, Column{Name: col.Name, Type: col.Type, typeInfo: col.typeInfo})
+		}
+	}
+	return NewCF(cf.uniqueLookupName(column), columns...).SetPrimaryKey(column)
+}
+
+// uniqueLookup returns the lookup column family of a unique column, or nil if the column isn't
+// declared unique.
+func (cf *CF) uniqueLookup(column string) *CF {
+	for _, u := range cf.uniques {
+		if u == column && cf.schema != nil {
+			return cf.schema.CFs[cf.uniqueLookupName(column)]
+		}
+	}
+	return nil
+}
+
+// A uniqueClaim records a value claimed in a lookup column family by the row with the primary key
+// in owner.
+type uniqueClaim struct {
+	lookup *CF
+	column string
+	value  *MarshaledValue
+	owner  MarshaledMap
+}
+
+// release deletes the claim with a lightweight transaction, only if the owner still holds it. A
+// value released and then claimed by another row is left alone.
+func (c uniqueClaim) release() error {
+	del := DeleteFrom(c.lookup).Where(c.column+" = ?", c.value)
+	for _, col := range c.lookup.columns {
+		if col.Name != c.column {
+			del.If(col.Name+" = ?", c.owner[col.Name])
+		}
+	}
+	return del.Query().Exec()
+}
+
+// claimUniques claims the changed unique values of a row. If any value is held by another row, the
+// claims already made are released and ErrNotUnique is returned. Values the row already holds are
+// not included in the returned claims.
+func (cf *CF) claimUniques(mmap MarshaledMap) ([]uniqueClaim, error) {
+	claims := make([]uniqueClaim, 0, len(cf.uniques))
+	for _, column := range cf.uniques {
+		v := mmap[column]
+		if v == nil || len(v.Bytes) == 0 || !v.Dirty() {
+			continue
+		}
+		lookup := cf.uniqueLookup(column)
+		if lookup == nil {
+			continue
+		}
+		keys := append([]string{column}, cf.primaryKey...)
+		ins := InsertInto(lookup).Keys(keys...).Values(mmap.InterfacesFor(keys...)...).IfNotExists()
+		qiter := ins.Query()
+		existing := make(MarshaledMap)
+		if !qiter.ScanCAS(existing.PointersTo(lookup.casColumns()...)...) {
+			if err := qiter.Close(); err != nil {
+				releaseUniques(claims)
+				return nil, ChainError(err, "claim of unique", column, "failed")
+			}
+			if !sameKey(cf.primaryKey, existing, mmap) {
+				releaseUniques(claims)
+				return nil, NewError(ErrNotUnique, column, "of", cf.name)
+			}
+			continue
+		}
+		claims = append(claims, uniqueClaim{lookup, column, v, mmap})
+	}
+	return claims, nil
+}
+
+// releaseUniques releases the given claims, as when the commit they were made for fails.
+func releaseUniques(claims []uniqueClaim) {
+	for _, c := range claims {
+		c.release()
+	}
+}
+
+// releaseReplacedUniques releases the values a committed row held before it was changed.
+func (cf *CF) releaseReplacedUniques(mmap MarshaledMap) error {
+	for _, column := range cf.uniques {
+		v := mmap[column]
+		if v == nil || len(v.OriginalBytes) == 0 || !v.Dirty() {
+			continue
+		}
+		if lookup := cf.uniqueLookup(column); lookup != nil {
+			old := &MarshaledValue{Bytes: v.OriginalBytes, TypeInfo: v.TypeInfo}
+			if err := (uniqueClaim{lookup, column, old, mmap}).release(); err != nil {
+				return ChainError(err, "release of unique", column, "failed")
+			}
+		}
+	}
+	return nil
+}
+
+func sameKey(keys []string, a, b MarshaledMap) bool {
+	for _, k := range keys {
+		if a[k] == nil || b[k] == nil || !bytes.Equal(a[k].Bytes, b[k].Bytes) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadByUnique loads the row holding the given value of a unique column (see AddUnique) into dest.
+// If no row holds the value, ErrNotFound is returned.
+func (cf *CF) LoadByUnique(dest interface{}, column string, value interface{}) error {
+	if !cf.IsBound() {
+		return ErrTableNotBound.New()
+	}
+	lookup := cf.uniqueLookup(column)
+	if lookup == nil {
+		return NewError(ErrInvalidKey, column, "is not unique in", cf.name)
+	}
+	keys := append([]string{column}, cf.primaryKey...)
+	qiter := Select(keys...).From(lookup).Where(column+" = ?", value).Query()
+	claim := make(MarshaledMap)
+	if !qiter.Scan(claim.PointersTo(keys...)...) {
+		if err := qiter.Close(); err != nil {
+			return ChainError(err, "scan failed")
+		}
+		return ErrNotFound.New()
+	}
+	mmap, err := cf.loadMarshaled(claim.InterfacesFor(cf.primaryKey...)...)
+	if err != nil {
+		return err
+	}
+	// a claim may outlive its row's hold on the value, if the row was changed without releasing it
+	if mmap[column] == nil || !bytes.Equal(mmap[column].Bytes, claim[column].Bytes) {
+		return ErrNotFound.New()
+	}
+	return cf.load(dest, mmap)
+}
@@ -1,18 +1,54 @@
 package ibis
 
 import "encoding/json"
+import "fmt"
+import "sort"
 import "strconv"
 import "strings"
+import "time"
+
+import "github.com/gocql/gocql"
+
+// SchemaAgreementTimeout is how long SchemaDiff.Apply will wait for all nodes in the cluster to
+// report the same schema version after issuing DDL statements.
+var SchemaAgreementTimeout = 10 * time.Second
+
+// How often schema versions are polled while waiting for agreement.
+var schemaAgreementInterval = 200 * time.Millisecond
 
 // SchemaDiff enumerates the changes necessary to transform one schema into another.
 type SchemaDiff struct {
+	keyspace    *keyspaceChange   // creation or replication change of the keyspace itself
+	newTypes    []*UDT            // user-defined types missing from the former schema
+	typeChanges []typeAlteration  // user-defined types that have missing or altered fields
 	creations   []*CF             // tables that are completely missing from the former schema
 	alterations []tableAlteration // tables that have missing or altered columns
+	viewDrops   []viewChange      // views that are missing or defined differently in the latter
+	indexDrops  []indexChange     // indexes that are missing from the latter schema
+	newIndexes  []indexChange     // indexes that are missing from the former schema
+	newViews    []viewChange      // views that are missing or defined differently in the former
+
+	fingerprint string // of the former schema; see SchemaFingerprint
+}
+
+type indexChange struct {
+	Table string
+	Index Index
+}
+
+type viewChange struct {
+	Table string
+	View  MaterializedView
 }
 
-// Size returns the total number of creations and alterations in the SchemaDiff.
+// Size returns the total number of creations, alterations, and drops in the SchemaDiff.
 func (d *SchemaDiff) Size() int {
-	return len(d.creations) + len(d.alterations)
+	size := 0
+	if d.keyspace != nil {
+		size++
+	}
+	return size + len(d.newTypes) + len(d.typeChanges) + len(d.creations) + len(d.alterations) +
+		len(d.viewDrops) + len(d.indexDrops) + len(d.newIndexes) + len(d.newViews)
 }
 
 // String constructs a human-readable string describing the SchemaDiff in CQL.
@@ -21,45 +57,158 @@ func (d *SchemaDiff) String() string {
 		return "no diff"
 	}
 	changes := make([]string, 0, d.Size())
-	for _, t := range d.creations {
-		changes = append(changes, t.CreateStatement().String())
-	}
-	for _, a := range d.alterations {
-		for _, cql := range a.AlterStatements() {
+	for _, c := range d.Changes() {
+		if c.Unsupported != "" {
+			changes = append(changes, "-- unsupported: "+c.Unsupported)
+		}
+		for _, cql := range c.Statements {
 			changes = append(changes, cql.String())
 		}
 	}
 	return strings.Join(changes, "\n")
 }
 
-// Apply issues CQL statements to transform the former schema into the latter.
+// Apply issues CQL statements to transform the former schema into the latter. If any statements
+// are issued, Apply then waits up to SchemaAgreementTimeout for the nodes of the cluster to agree
+// on the new schema version (see WaitForSchemaAgreement).
+//
+// If the diff includes a change that can't be made by altering the schema, such as a change to the
+// clustering order of a table, ErrUnsupportedChange is returned and nothing is applied.
 func (d *SchemaDiff) Apply(cluster Cluster) error {
-	for _, t := range d.creations {
-		cql := t.CreateStatement()
-		cql.Cluster(cluster)
-		if err := cql.Query().Exec(); err != nil {
-			return ChainError(err, "column family creation failed")
+	changes := d.Changes()
+	for _, c := range changes {
+		if c.Unsupported != "" {
+			return NewError(ErrUnsupportedChange, c.Unsupported)
 		}
 	}
-	for _, a := range d.alterations {
-		for _, s := range a.AlterStatements() {
+	for _, c := range changes {
+		for _, s := range c.Statements {
 			s.Cluster(cluster)
 			if err := s.Query().Exec(); err != nil {
-				return ChainError(err, "column alteration failed")
+				return ChainError(err, c.Kind.failure())
 			}
 		}
 	}
+	if d.Size() > 0 {
+		return WaitForSchemaAgreement(cluster, SchemaAgreementTimeout)
+	}
 	return nil
 }
 
+// WaitForSchemaAgreement polls the schema_version reported by system.local and system.peers until
+// every node agrees, or until the timeout expires. In the latter case ErrSchemaDisagreement is
+// returned, with a message naming the nodes that have not caught up. Peers reporting no schema
+// version, as while they join the cluster, are ignored. If the local node reports none,
+// ErrSchemaDisagreement is returned at once.
+func WaitForSchemaAgreement(cluster Cluster, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		versions, err := getSchemaVersions(cluster)
+		if err != nil {
+			return ChainError(err, "schema version check failed")
+		}
+		lagging, err := disagreeingNodes(versions)
+		if err != nil {
+			return err
+		}
+		if len(lagging) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return NewError(ErrSchemaDisagreement, strings.Join(lagging, ", "))
+		}
+		time.Sleep(schemaAgreementInterval)
+	}
+}
+
+// The node name under which system.local's schema version is reported.
+const localNode = "local"
+
+func getSchemaVersions(cluster Cluster) (map[string]gocql.UUID, error) {
+	versions := make(map[string]gocql.UUID)
+
+	var b CQLBuilder
+	cql := b.Append("SELECT schema_version FROM system.local").CQL()
+	cql.Cluster(cluster)
+	qiter := cql.Query()
+	version := &MarshaledValue{}
+	if qiter.Scan(version) {
+		if u, ok := schemaVersion(version); ok {
+			versions[localNode] = u
+		}
+	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
+
+	b.Clear()
+	cql = b.Append("SELECT peer, schema_version FROM system.peers").CQL()
+	cql.Cluster(cluster)
+	qiter = cql.Query()
+	var peer string
+	// a fresh value is scanned for each peer, so that a null isn't mistaken for the previous version
+	version = &MarshaledValue{}
+	for qiter.Scan(&peer, version) {
+		if u, ok := schemaVersion(version); ok {
+			versions[peer] = u
+		}
+		version = &MarshaledValue{}
+	}
+	return versions, qiter.Close()
+}
+
+// schemaVersion decodes a scanned schema_version. False is returned if it was null.
+func schemaVersion(mv *MarshaledValue) (gocql.UUID, bool) {
+	if len(mv.Bytes) == 0 {
+		return gocql.UUID{}, false
+	}
+	u, err := gocql.UUIDFromBytes(mv.Bytes)
+	return u, err == nil
+}
+
+// disagreeingNodes returns descriptions of the nodes whose schema version differs from the one
+// reported by the local node, sorted by node name. If the local node reported no version,
+// ErrSchemaDisagreement is returned.
+func disagreeingNodes(versions map[string]gocql.UUID) ([]string, error) {
+	expected, ok := versions[localNode]
+	if !ok {
+		return nil, NewError(ErrSchemaDisagreement, "local node reported no schema version")
+	}
+	lagging := make([]string, 0)
+	for node, version := range versions {
+		if version != expected {
+			lagging = append(lagging, fmt.Sprintf("%s has %s, expected %s", node, version, expected))
+		}
+	}
+	sort.Strings(lagging)
+	return lagging, nil
+}
+
 type tableAlteration struct {
 	TableName      string
 	NewColumns     []Column
 	AlteredColumns []Column
+	AlteredOptions TableOptions
 }
 
 func (a tableAlteration) Size() int {
-	return len(a.NewColumns) + len(a.AlteredColumns)
+	size := len(a.NewColumns) + len(a.AlteredColumns)
+	if !a.AlteredOptions.empty() {
+		size++
+	}
+	if a.AlteredOptions.ClusteringOrder != nil {
+		size++
+	}
+	return size
+}
+
+// unsupported describes the part of the alteration that can't be made with ALTER TABLE, if any.
+func (a tableAlteration) unsupported() string {
+	if a.AlteredOptions.ClusteringOrder == nil {
+		return ""
+	}
+	return "clustering order of " + a.TableName + " can't be altered to " +
+		optionMapLiteral(a.AlteredOptions.ClusteringOrder) + "; the table must be recreated"
 }
 
 func (a tableAlteration) AlterStatements() []CQL {
@@ -67,7 +216,7 @@ func (a tableAlteration) AlterStatements() []CQL {
 	for _, col := range a.NewColumns {
 		var b CQLBuilder
 		b.Append("ALTER TABLE ").Append(a.TableName).
-			Append(" ADD ").Append(col.Name + " " + col.Type)
+			Append(" ADD ").Append(col.definition())
 		alts = append(alts, b.CQL())
 	}
 	for _, col := range a.AlteredColumns {
@@ -76,57 +225,107 @@ func (a tableAlteration) AlterStatements() []CQL {
 			Append(" ALTER ").Append(col.Name).Append(" TYPE ").Append(col.Type)
 		alts = append(alts, b.CQL())
 	}
+	if !a.AlteredOptions.empty() {
+		var b CQLBuilder
+		b.Append("ALTER TABLE ").Append(a.TableName).
+			Append(" WITH ").Append(strings.Join(a.AlteredOptions.clauses(nil), " AND "))
+		alts = append(alts, b.CQL())
+	}
 	return alts
 }
 
 // GetLiveSchema builds a schema by querying the column families that exist in the current keyspace
 // of the given cluster.
+//
+// Cassandra 3.0 and later describe the schema in the system_schema keyspace, and earlier versions
+// in the system keyspace; the cluster's release version determines which is queried. Materialized
+// views only exist in the former.
 func GetLiveSchema(c Cluster) (*Schema, error) {
-	var err error
+	version, err := getReleaseVersion(c)
+	if err != nil {
+		return nil, err
+	}
+	if version.systemSchema() {
+		return getSystemSchema(c, c.GetKeyspace())
+	}
 	tables, nextTypeID, err := getLiveColumnFamilies(c, c.GetKeyspace())
 	if err != nil {
 		return nil, err
 	}
+	types := make(map[string]*UDT)
+	if version.userTypes() {
+		if types, err = getLiveTypes(c, c.GetKeyspace()); err != nil {
+			return nil, err
+		}
+	}
 	schema := Schema{
 		CFs:        make(Keyspace),
+		Types:      types,
 		nextTypeID: nextTypeID,
 	}
 	for _, t := range tables {
 		schema.CFs[strings.ToLower(t.name)] = t
 	}
-	sel := Select("columnfamily_name", "column_name", "validator").
+	sel := Select("columnfamily_name", "column_name", "validator", `"type"`).
 		From(NewCF("system.schema_columns")).Where("keyspace_name = ?", c.GetKeyspace())
 	cql := sel.CQL()
 	cql.Cluster(c)
 	qiter := cql.Query()
-	var cf_name, col_name, validator string
-	for qiter.Scan(&cf_name, &col_name, &validator) {
-		col := Column{Name: col_name, Type: typeFromValidator(validator)}
+	var cf_name, col_name, validator, col_type string
+	for qiter.Scan(&cf_name, &col_name, &validator, &col_type) {
+		typ, reversed := unreverseValidator(validator)
+		col := Column{Name: col_name, Type: typeFromValidator(typ), Static: col_type == "static"}
 		t := schema.CFs[cf_name]
 		if t != nil {
 			t.columns = append(t.columns, col)
+			if reversed {
+				t.options.ClusteringOrder = setOption(t.options.ClusteringOrder, col_name, "DESC")
+			}
 		}
 	}
+	if err := qiter.Close(); err != nil {
+		return nil, err
+	}
 	for _, cf := range schema.CFs {
 		// reapply primary key to fix column ordering
-		cf.SetPrimaryKey(cf.primaryKey...)
+		cf.SetCompositeKey(cf.PartitionKey(), cf.clusteringColumns()...)
+	}
+
+	indexes, err := getLiveIndexes(c, c.GetKeyspace())
+	if err != nil {
+		return nil, err
 	}
-	return &schema, qiter.Close()
+	for cf_name, idxs := range indexes {
+		if t := schema.CFs[cf_name]; t != nil {
+			t.indexes = idxs
+		}
+	}
+	return &schema, nil
 }
 
 func getLiveColumnFamilies(cluster Cluster, keyspace string) ([]*CF, int, error) {
 	cf := &CF{name: "system.schema_columnfamilies"}
-	sel := Select("columnfamily_name", "key_aliases", "column_aliases", "comment").
+	sel := Select("columnfamily_name", "key_aliases", "column_aliases", "comment",
+		"compaction_strategy_class", "compaction_strategy_options", "compression_parameters",
+		"caching", "default_time_to_live", "gc_grace_seconds").
 		From(cf).Where("keyspace_name = ?", keyspace)
 	cql := sel.CQL()
 	cql.Cluster(cluster)
 	qiter := cql.Query()
 	tables := make([]*CF, 0, 32)
-	var cf_name, key_aliases, column_aliases, comment string
 	maxTypeID := 0
-	for qiter.Scan(&cf_name, &key_aliases, &column_aliases, &comment) {
+	for {
+		var cf_name, key_aliases, column_aliases, comment string
+		var compaction_class, compaction_options, compression, caching string
+		var default_ttl, gc_grace int
+		if !qiter.Scan(&cf_name, &key_aliases, &column_aliases, &comment, &compaction_class,
+			&compaction_options, &compression, &caching, &default_ttl, &gc_grace) {
+			break
+		}
 		t := CF{name: cf_name, columns: make([]Column, 0, 16)}
-		t.SetPrimaryKey(keyFromAliases(key_aliases, column_aliases)...)
+		t.SetCompositeKey(parseStringList(key_aliases), parseStringList(column_aliases)...)
+		t.options = liveTableOptions(compaction_class, compaction_options, compression, caching,
+			default_ttl, gc_grace)
 		t.typeID = typeIDFromComment(comment)
 		if t.typeID > maxTypeID {
 			maxTypeID = t.typeID
@@ -147,7 +346,9 @@ func typeIDFromComment(comment string) int {
 func typeFromValidator(validator string) string {
 	type_name, ok := column_validators[validator]
 	if !ok {
-		type_name = "blob"
+		if type_name, ok = udtFromValidator(validator); !ok {
+			type_name = "blob"
+		}
 	}
 	return type_name
 }
@@ -158,10 +359,6 @@ func parseStringList(encoded string) []string {
 	return result
 }
 
-func keyFromAliases(key_aliases, column_aliases string) []string {
-	return append(parseStringList(key_aliases), parseStringList(column_aliases)...)
-}
-
 // DiffLiveSchema compares the current schema in Cassandra to the given model. It returns a pointer
 // to a SchemaDiff describing the differences. If the two schemas are identical, then this
 // SchemaDiff will be empty.
@@ -170,22 +367,101 @@ func keyFromAliases(key_aliases, column_aliases string) []string {
 func DiffLiveSchema(c Cluster, model *Schema) (*SchemaDiff, error) {
 	var live *Schema
 	var err error
+	for _, cf := range model.CFs {
+		if err = cf.validateCounters(); err != nil {
+			return nil, err
+		}
+		if err = cf.validateStatics(); err != nil {
+			return nil, err
+		}
+		if err = cf.validateSoftDelete(); err != nil {
+			return nil, err
+		}
+	}
 	if live, err = GetLiveSchema(c); err != nil {
 		return nil, err
 	}
+	diff := diffSchemas(live, model)
+	diff.fingerprint = SchemaFingerprint(live)
+	if model.KeyspaceSpec != nil {
+		if diff.keyspace, err = diffKeyspace(c, model.KeyspaceSpec.withName(c.GetKeyspace())); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+// DiffSchemas compares two schemas without consulting a cluster, such as two loaded from schema
+// documents. It returns a pointer to a SchemaDiff describing the changes necessary to transform
+// from into to.
+//
+// Like DiffLiveSchema, this function modifies to, fixing its typeIDs to match those of from.
+//
+// A schema that wasn't read from a cluster needn't fingerprint the same as the live schema it
+// describes, so the diff has no fingerprint: its script and ApplyIfUnchanged don't check that the
+// live schema is unchanged.
+//
+// Without a cluster there's no current keyspace to fall back on, so the keyspace is only created or
+// altered if one of the specs names it.
+func DiffSchemas(from, to *Schema) *SchemaDiff {
+	diff := diffSchemas(from, to)
+	if to.KeyspaceSpec != nil && (to.KeyspaceSpec.Name != "" ||
+		(from.KeyspaceSpec != nil && from.KeyspaceSpec.Name != "")) {
+		var name string
+		if from.KeyspaceSpec != nil {
+			name = from.KeyspaceSpec.Name
+		}
+		spec := to.KeyspaceSpec.withName(name)
+		if from.KeyspaceSpec == nil {
+			diff.keyspace = &keyspaceChange{Spec: spec, Create: true}
+		} else if !spec.matches(from.KeyspaceSpec) {
+			diff.keyspace = &keyspaceChange{Spec: spec}
+		}
+	}
+	return diff
+}
+
+func diffSchemas(live, model *Schema) *SchemaDiff {
+	live_ids := make(map[int]bool)
 	for _, t := range live.CFs {
+		live_ids[t.typeID] = true
 		if t.typeID >= model.nextTypeID {
 			model.nextTypeID = t.typeID + 1
 		}
-		if model_t, ok := model.CFs[t.name]; ok {
+		if model_t, ok := model.CFs[strings.ToLower(t.name)]; ok {
 			model_t.typeID = t.typeID
 		}
 	}
-	var diff = &SchemaDiff{make([]*CF, 0), make([]tableAlteration, 0)}
-	for name, model_table := range model.CFs {
+	var diff = &SchemaDiff{creations: make([]*CF, 0), alterations: make([]tableAlteration, 0)}
+	model_types := make([]*UDT, 0, len(model.Types))
+	for _, udt := range model.Types {
+		model_types = append(model_types, udt)
+	}
+	for _, udt := range sortTypes(model_types) {
+		if live_udt, ok := live.Types[strings.ToLower(udt.Name)]; ok {
+			if alteration := diffFields(udt, live_udt); alteration.Size() > 0 {
+				diff.typeChanges = append(diff.typeChanges, alteration)
+			}
+		} else {
+			diff.newTypes = append(diff.newTypes, udt)
+		}
+	}
+	// tables are visited in order of name, so that the diff is stable
+	names := make([]string, 0, len(model.CFs))
+	for name := range model.CFs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		model_table := model.CFs[name]
 		live_table, ok := live.CFs[strings.ToLower(name)]
 		if ok {
-			alteration := tableAlteration{name, make([]Column, 0), make([]Column, 0)}
+			alteration := tableAlteration{
+				TableName:      name,
+				NewColumns:     make([]Column, 0),
+				AlteredColumns: make([]Column, 0),
+				AlteredOptions: model_table.options.drift(live_table.options),
+			}
 			old_cols := make(map[string]string)
 			for _, col := range live_table.columns {
 				old_cols[strings.ToLower(col.Name)] = col.Type
@@ -200,14 +476,76 @@ func DiffLiveSchema(c Cluster, model *Schema) (*SchemaDiff, error) {
 					alteration.NewColumns = append(alteration.NewColumns, col)
 				}
 			}
-			if len(alteration.NewColumns)+len(alteration.AlteredColumns) > 0 {
+			if alteration.Size() > 0 {
 				diff.alterations = append(diff.alterations, alteration)
 			}
+			diff.diffIndexes(name, model_table, live_table, model.DropUndeclaredIndexes)
 		} else {
-			model_table.typeID = model.nextTypeID
-			model.nextTypeID++
+			// a new table keeps its typeID unless it's already taken
+			if model_table.typeID == 0 || live_ids[model_table.typeID] {
+				model_table.typeID = model.nextTypeID
+			}
+			if model_table.typeID >= model.nextTypeID {
+				model.nextTypeID = model_table.typeID + 1
+			}
 			diff.creations = append(diff.creations, model_table)
+			diff.diffIndexes(name, model_table, NewCF(name), false)
+		}
+	}
+	return diff
+}
+
+// diffIndexes adds the index and view changes necessary to transform the live table into the model.
+// Indexes are matched by column, and views by name; a view whose primary key differs is dropped and
+// recreated. Live indexes and views the model doesn't declare are only dropped if drop is true.
+func (d *SchemaDiff) diffIndexes(name string, model_table, live_table *CF, drop bool) {
+	live_indexes := make(map[string]Index)
+	for _, idx := range live_table.Indexes() {
+		live_indexes[strings.ToLower(idx.Column)] = idx
+	}
+	for _, idx := range model_table.Indexes() {
+		col := strings.ToLower(idx.Column)
+		if _, ok := live_indexes[col]; ok {
+			delete(live_indexes, col)
+		} else {
+			d.newIndexes = append(d.newIndexes, indexChange{name, idx})
+		}
+	}
+	if drop {
+		// drops are made in order of column, so that the diff is stable
+		cols := make([]string, 0, len(live_indexes))
+		for col := range live_indexes {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			d.indexDrops = append(d.indexDrops, indexChange{name, live_indexes[col]})
+		}
+	}
+
+	live_views := make(map[string]MaterializedView)
+	for _, v := range live_table.views {
+		live_views[strings.ToLower(v.Name)] = v
+	}
+	for _, v := range model_table.Views() {
+		live_v, ok := live_views[strings.ToLower(v.Name)]
+		if ok {
+			delete(live_views, strings.ToLower(v.Name))
+			if v.sameKey(live_v) {
+				continue
+			}
+			d.viewDrops = append(d.viewDrops, viewChange{name, live_v})
+		}
+		d.newViews = append(d.newViews, viewChange{name, v})
+	}
+	if drop {
+		names := make([]string, 0, len(live_views))
+		for v := range live_views {
+			names = append(names, v)
+		}
+		sort.Strings(names)
+		for _, v := range names {
+			d.viewDrops = append(d.viewDrops, viewChange{name, live_views[v]})
 		}
 	}
-	return diff, nil
 }
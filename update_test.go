@@ -1,7 +1,10 @@
 package ibis
 
+import "errors"
 import "reflect"
+import "strings"
 import "testing"
+import "time"
 
 func TestGetLiveSchema(t *testing.T) {
 	tc := NewTestConn(t)
@@ -42,6 +45,10 @@ func TestGetLiveSchema(t *testing.T) {
 		},
 	}
 	expected.SetPrimaryKey("stringcol", "int64col", "boolcol")
+	expected.options = liveTableOptions(
+		"org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy", "{}",
+		`{"sstable_compression":"org.apache.cassandra.io.compress.LZ4Compressor"}`,
+		`{"keys":"ALL","rows_per_partition":"NONE"}`, 0, 864000)
 	schema, err = GetLiveSchema(tc)
 	if err != nil {
 		t.Fatal(err)
@@ -120,3 +127,559 @@ func TestDiffLiveSchema(t *testing.T) {
 		t.Error("expected empty diff")
 	}
 }
+
+func TestSchemaAgreement(t *testing.T) {
+	cluster := FakeCassandra("test").(*fakeCluster)
+	cluster.AddPeer("10.0.0.2", 2)
+	defer func(d time.Duration) { schemaAgreementInterval = d }(schemaAgreementInterval)
+	schemaAgreementInterval = time.Millisecond
+
+	model := &Schema{
+		CFs: Keyspace{
+			"T1": NewCF("T1", Column{Name: "A", Type: "varchar"}).SetPrimaryKey("A"),
+		},
+	}
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.Peers["10.0.0.2"].SchemaVersion != cluster.SchemaVersion {
+		t.Error("expected peer to catch up to local schema version")
+	}
+
+	cluster.AddPeer("10.0.0.3", 1000)
+	model.CFs["T2"] = NewCF("T2", Column{Name: "X", Type: "varchar"}).SetPrimaryKey("X")
+	if diff, err = DiffLiveSchema(cluster, model); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { SchemaAgreementTimeout = d }(SchemaAgreementTimeout)
+	SchemaAgreementTimeout = 10 * time.Millisecond
+	err = diff.Apply(cluster)
+	if e, ok := err.(*Error); !ok || e.Key != ErrSchemaDisagreement {
+		t.Fatalf("expected ErrSchemaDisagreement, received %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), string(ErrSchemaDisagreement)+": 10.0.0.3 has ") {
+		t.Errorf("expected error to name lagging node, received %q", err)
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	cluster := FakeCassandra("test").(*fakeCluster)
+	cluster.AddPeer("10.0.0.2", 0)
+	cluster.AddPeer("10.0.0.3", 0)
+	cluster.Peers["10.0.0.3"].Joining = true
+
+	versions, err := getSchemaVersions(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := versions["10.0.0.3"]; ok {
+		t.Error("expected peer with null schema version to be skipped")
+	}
+	if versions["10.0.0.2"] != cluster.SchemaVersion {
+		t.Errorf("expected peer to report %s, received %s", cluster.SchemaVersion, versions["10.0.0.2"])
+	}
+	if err = WaitForSchemaAgreement(cluster, time.Millisecond); err != nil {
+		t.Errorf("expected joining peer to be ignored, received %v", err)
+	}
+
+	delete(versions, localNode)
+	_, err = disagreeingNodes(versions)
+	if e, ok := err.(*Error); !ok || e.Key != ErrSchemaDisagreement {
+		t.Errorf("expected ErrSchemaDisagreement without a local version, received %v", err)
+	}
+}
+
+func TestDiffLiveSchemaOptions(t *testing.T) {
+	cluster := NewTestConn(t)
+	defer cluster.Close()
+
+	model := &Schema{
+		CFs: Keyspace{
+			"t1": NewCF("t1",
+				Column{Name: "a", Type: "varchar"},
+				Column{Name: "b", Type: "timeuuid"}).
+				SetPrimaryKey("a", "b").
+				SetClusteringOrder("b DESC").
+				SetCompaction("TimeWindowCompactionStrategy", nil).
+				SetDefaultTTL(time.Hour),
+		},
+		Cluster: cluster,
+	}
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if diff, err = DiffLiveSchema(cluster, model); err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, received: %s", diff)
+	}
+
+	model.CFs["t1"].SetDefaultTTL(2 * time.Hour).SetGCGrace(0)
+	if diff, err = DiffLiveSchema(cluster, model); err != nil {
+		t.Fatal(err)
+	}
+	expected := "ALTER TABLE t1 WITH default_time_to_live = 7200 AND gc_grace_seconds = 0"
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if diff, err = DiffLiveSchema(cluster, model); err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, received: %s", diff)
+	}
+
+	model.CFs["t1"].SetClusteringOrder("b ASC")
+	if diff, err = DiffLiveSchema(cluster, model); err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 1 {
+		t.Fatalf("expected clustering order drift, received: %s", diff)
+	}
+	if err = diff.Apply(cluster); err == nil || err.(*Error).Key != ErrUnsupportedChange {
+		t.Errorf("expected ErrUnsupportedChange, received %v", err)
+	}
+	script := diff.Script()
+	if !strings.Contains(script, "-- unsupported: clustering order of t1 can't be altered") {
+		t.Errorf("expected script to describe unsupported change, received:\n%s", script)
+	}
+	if err = ApplyScript(cluster, script); err == nil || err.(*Error).Key != ErrUnsupportedChange {
+		t.Errorf("expected ErrUnsupportedChange, received %v", err)
+	}
+}
+
+func TestLiveTableOptionsCaching(t *testing.T) {
+	options := liveTableOptions("SizeTieredCompactionStrategy", "{}", "{}", "KEYS_ONLY", 0, 0)
+	expected := map[string]string{"keys": "ALL", "rows_per_partition": "NONE"}
+	if !reflect.DeepEqual(options.Caching, expected) {
+		t.Errorf("expected %v, received %v", expected, options.Caching)
+	}
+	model := TableOptions{Caching: expected}
+	if d := model.drift(options); !d.empty() {
+		t.Errorf("expected no drift, received %v", d.clauses(nil))
+	}
+
+	options = liveTableOptions("SizeTieredCompactionStrategy", "{}", "{}", "unknown", 0, 0)
+	if options.Caching != nil {
+		t.Errorf("expected unrecognized caching to be left out, received %v", options.Caching)
+	}
+	if d := model.drift(options); !d.empty() {
+		t.Errorf("expected no drift, received %v", d.clauses(nil))
+	}
+}
+
+func TestDiffLiveSchemaIndexes(t *testing.T) {
+	cluster := NewTestConn(t)
+	defer cluster.Close()
+
+	model := &Schema{
+		CFs: Keyspace{
+			"posts": NewCF("posts",
+				Column{Name: "ID", Type: "varchar"},
+				Column{Name: "Author", Type: "varchar"},
+				Column{Name: "Topic", Type: "varchar"}).
+				SetPrimaryKey("ID").
+				AddIndex("Author").
+				AddView("posts_by_topic", []string{"Topic"}),
+		},
+		Cluster: cluster,
+	}
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		model.CFs["posts"].CreateStatement().String(),
+		"CREATE INDEX posts_author_idx ON posts (Author)",
+		"CREATE MATERIALIZED VIEW posts_by_topic AS SELECT * FROM posts" +
+			" WHERE Topic IS NOT NULL AND ID IS NOT NULL PRIMARY KEY (Topic, ID)",
+	}, "\n")
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := GetLiveSchema(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := live.CFs["posts"].Indexes()
+	if !reflect.DeepEqual(indexes, []Index{Index{Name: "posts_author_idx", Column: "author"}}) {
+		t.Errorf("unexpected live indexes: %+v", indexes)
+	}
+	views := live.CFs["posts"].Views()
+	expectedView := MaterializedView{
+		Name:         "posts_by_topic",
+		PartitionKey: []string{"topic"},
+		Clustering:   []string{"id"},
+	}
+	if !reflect.DeepEqual(views, []MaterializedView{expectedView}) {
+		t.Errorf("unexpected live views: %+v", views)
+	}
+
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, got: %s", diff)
+	}
+
+	// an index maintained outside the schema
+	var b CQLBuilder
+	cql := b.Append("CREATE INDEX posts_topic_idx ON posts (Topic)").CQL()
+	cql.Cluster(cluster)
+	if err = cql.Query().Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	model.CFs["posts"].indexes = nil
+	model.CFs["posts"].views = nil
+	model.CFs["posts"].AddView("posts_by_topic", []string{"Topic"}, "Author")
+	redefinedView := "CREATE MATERIALIZED VIEW posts_by_topic AS SELECT * FROM posts" +
+		" WHERE Topic IS NOT NULL AND Author IS NOT NULL AND ID IS NOT NULL" +
+		" PRIMARY KEY (Topic, Author, ID)"
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = strings.Join([]string{"DROP MATERIALIZED VIEW posts_by_topic", redefinedView}, "\n")
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+
+	model.DropUndeclaredIndexes = true
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = strings.Join([]string{
+		"DROP MATERIALIZED VIEW posts_by_topic",
+		"DROP INDEX posts_author_idx",
+		"DROP INDEX posts_topic_idx",
+		redefinedView,
+	}, "\n")
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, got: %s", diff)
+	}
+}
+
+func TestDiffLiveSchemaTypes(t *testing.T) {
+	cluster := NewTestConn(t)
+	defer cluster.Close()
+
+	point := newUDT("point", Column{Name: "X", Type: "double"})
+	shape := newUDT("shape", point.column("Origin", ""))
+	model := &Schema{
+		CFs: Keyspace{
+			"shapes": NewCF("shapes",
+				Column{Name: "ID", Type: "varchar"},
+				shape.column("Shape", "")).SetPrimaryKey("ID"),
+		},
+		Types:   map[string]*UDT{"shape": shape, "point": point},
+		Cluster: cluster,
+	}
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"CREATE TYPE point (X double)",
+		"CREATE TYPE shape (Origin frozen<point>)",
+		model.CFs["shapes"].CreateStatement().String(),
+	}, "\n")
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	point.Fields = append(point.Fields, Column{Name: "Y", Type: "double"})
+	shape.Fields[0].Type = "blob"
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = strings.Join([]string{
+		"ALTER TYPE point ADD Y double",
+		"ALTER TYPE shape ALTER Origin TYPE blob",
+	}, "\n")
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, got: %s", diff)
+	}
+}
+
+func TestEnsureKeyspace(t *testing.T) {
+	cluster := NewTestConn(t)
+	defer cluster.Close()
+
+	schema := NewSchema()
+	schema.Cluster = cluster
+	schema.KeyspaceSpec = SimpleStrategy(1)
+	schema.KeyspaceSpec.Name = "ensured"
+	if _, err := GetLiveKeyspace(cluster, "ensured"); err == nil {
+		t.Fatal("expected keyspace to be missing")
+	}
+	if err := schema.EnsureKeyspace(); err != nil {
+		t.Fatal(err)
+	}
+	live, err := GetLiveKeyspace(cluster, "ensured")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.String() != "ensured SimpleStrategy(1)" {
+		t.Errorf("expected SimpleStrategy(1), got %s", live)
+	}
+	if live.DurableWrites == nil || !*live.DurableWrites {
+		t.Errorf("expected durable writes by default")
+	}
+
+	schema.KeyspaceSpec = NetworkTopologyStrategy(map[string]int{"dc1": 3, "dc2": 2}).
+		SetDurableWrites(false)
+	schema.KeyspaceSpec.Name = "ensured"
+	diff, err := DiffLiveSchema(cluster, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "ALTER KEYSPACE ensured WITH replication = {'class': 'NetworkTopologyStrategy', " +
+		"'dc1': '3', 'dc2': '2'} AND durable_writes = false"
+	if diff.String() != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, diff)
+	}
+	if err := schema.EnsureKeyspace(); err != nil {
+		t.Fatal(err)
+	}
+	live, err = GetLiveKeyspace(cluster, "ensured")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.String() != "ensured NetworkTopologyStrategy(dc1:3, dc2:2)" {
+		t.Errorf("expected NetworkTopologyStrategy, got %s", live)
+	}
+	if live.DurableWrites == nil || *live.DurableWrites {
+		t.Errorf("expected durable writes to be disabled")
+	}
+	diff, err = DiffLiveSchema(cluster, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, got: %s", diff)
+	}
+}
+
+func TestSchemaDiffPlan(t *testing.T) {
+	cluster := NewTestConn(t)
+	defer cluster.Close()
+
+	model := NewSchema()
+	model.Cluster = cluster
+	model.AddCF(NewCF("users",
+		Column{Name: "Name", Type: "varchar"},
+		Column{Name: "Email", Type: "varchar"}).SetPrimaryKey("Name").AddIndex("Email"))
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := diff.Changes()
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+	if changes[0].Kind != CreateTable || changes[0].Name != "users" || len(changes[0].NewColumns) != 2 {
+		t.Errorf("unexpected first change: %+v", changes[0])
+	}
+	if changes[1].Kind != CreateIndex || changes[1].Name != "users_email_idx" ||
+		changes[1].Table != "users" {
+		t.Errorf("unexpected second change: %+v", changes[1])
+	}
+
+	script := diff.Script()
+	expected := strings.Join([]string{
+		"-- ibis schema migration: 2 changes",
+		"-- fingerprint: " + diff.Fingerprint(),
+		"",
+		"-- create table users",
+		"CREATE TABLE IF NOT EXISTS users (Name varchar, Email varchar, PRIMARY KEY (Name))" +
+			" WITH comment='1';",
+		"",
+		"-- create index users_email_idx on users",
+		"CREATE INDEX IF NOT EXISTS users_email_idx ON users (Email);",
+		"",
+	}, "\n")
+	if script != expected {
+		t.Errorf("\nexpected: %s\nreceived: %s", expected, script)
+	}
+	if err := ApplyScript(cluster, script); err != nil {
+		t.Fatal(err)
+	}
+	// a second run is harmless, but the schema no longer matches the script's fingerprint
+	err = ApplyScript(cluster, script)
+	if e, ok := err.(*Error); !ok || e.Key != ErrSchemaChanged {
+		t.Errorf("expected ErrSchemaChanged, got %v", err)
+	}
+	if err := ApplyScript(cluster, strings.Replace(script, "-- fingerprint", "--", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	model.CFs["users"].columns = append(model.CFs["users"].columns,
+		Column{Name: "Age", Type: "bigint"})
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = diff.Changes()
+	if len(changes) != 1 || changes[0].Kind != AlterTable || len(changes[0].NewColumns) != 1 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	var b CQLBuilder
+	cql := b.Append("ALTER TABLE users ADD Other varchar").CQL()
+	cql.Cluster(cluster)
+	if err := cql.Query().Exec(); err != nil {
+		t.Fatal(err)
+	}
+	err = diff.ApplyIfUnchanged(cluster)
+	if e, ok := err.(*Error); !ok || e.Key != ErrSchemaChanged {
+		t.Errorf("expected ErrSchemaChanged, got %v", err)
+	}
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff.ApplyIfUnchanged(cluster); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Size() != 0 {
+		t.Errorf("expected empty diff, got: %s", diff)
+	}
+}
+
+func TestLegacySchemaTables(t *testing.T) {
+	cluster := FakeCassandra("test").(*fakeCluster)
+	point := newUDT("point", Column{Name: "X", Type: "double"})
+	model := &Schema{
+		CFs: Keyspace{
+			"places": NewCF("places",
+				Column{Name: "Region", Type: "varchar"},
+				Column{Name: "Seen", Type: "timestamp"},
+				Column{Name: "Name", Type: "varchar", Static: true},
+				Column{Name: "Location", Type: "frozen<point>"}).
+				SetPrimaryKey("Region", "Seen").
+				SetClusteringOrder("Seen DESC").
+				SetCompaction("LeveledCompactionStrategy", nil).
+				SetCaching("ALL", "NONE").
+				SetDefaultTTL(time.Hour).
+				AddIndex("Name"),
+		},
+		Types:        map[string]*UDT{"point": point},
+		KeyspaceSpec: SimpleStrategy(3),
+		Cluster:      cluster,
+	}
+	diff, err := DiffLiveSchema(cluster, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = diff.Apply(cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	described := func(version string) (string, *KeyspaceSpec) {
+		cluster.ReleaseVersion = version
+		live, err := GetLiveSchema(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ks, err := GetLiveKeyspace(cluster, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff, err = DiffLiveSchema(cluster, model); err != nil {
+			t.Fatal(err)
+		}
+		if diff.Size() != 0 {
+			t.Errorf("expected empty diff from %s schema tables, got: %s", version, diff)
+		}
+		return SchemaFingerprint(live), ks
+	}
+	fingerprint, ks := described("3.0.0")
+	legacyFingerprint, legacyKS := described("2.1.0")
+	if fingerprint != legacyFingerprint {
+		t.Errorf("expected the same fingerprint from both schema tables")
+	}
+	if !reflect.DeepEqual(ks, legacyKS) {
+		t.Errorf("expected the same keyspace from both schema tables: %s, %s", ks, legacyKS)
+	}
+}
+
+// failingCluster fails queries of the given system table.
+type failingCluster struct {
+	Cluster
+	table string
+}
+
+func (c *failingCluster) Query(stmts ...CQL) Query {
+	if strings.Contains(stmts[0].String(), c.table) {
+		return &fakeQuery{err: errors.New("unavailable")}
+	}
+	return c.Cluster.Query(stmts...)
+}
+
+func TestGetLiveSchemaErrors(t *testing.T) {
+	for _, table := range []string{"system.local", "system_schema.views",
+		"system_schema.indexes", "system_schema.types"} {
+		cluster := &failingCluster{FakeCassandra("test"), table}
+		if _, err := GetLiveSchema(cluster); err == nil {
+			t.Errorf("expected failure to query %s to be returned", table)
+		}
+	}
+
+	legacy := FakeCassandra("test").(*fakeCluster)
+	legacy.ReleaseVersion = "2.1.0"
+	cluster := &failingCluster{legacy, "system.schema_usertypes"}
+	if _, err := GetLiveSchema(cluster); err == nil {
+		t.Errorf("expected failure to query system.schema_usertypes to be returned")
+	}
+	// types aren't queried from clusters that don't support them
+	legacy.ReleaseVersion = "2.0.0"
+	if _, err := GetLiveSchema(legacy); err != nil {
+		t.Error(err)
+	}
+}
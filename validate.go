@@ -0,0 +1,173 @@
+package ibis
+
+import "fmt"
+import "strings"
+import "time"
+
+// A Validator checks a row before it's committed. Rows may implement Validator to enforce rules
+// that constraints (see AddConstraint) can't express. If Validate returns Violations, they are
+// reported along with those of the constraints; any other error is reported as a single violation.
+//
+//        func (u *User) Validate() error {
+//            if u.Balance < 0 && !u.Overdraft {
+//                return ibis.Violations{{Field: "Balance", Message: "may not be negative"}}
+//            }
+//            return nil
+//        }
+type Validator interface {
+	Validate() error
+}
+
+// A Constraint restricts the values a column may hold. Its kind is one of:
+//
+//  * "required": the value may not be empty or zero
+//  * "min": a number may not be less than the bound, nor the length of a string or blob
+//  * "max": a number may not be greater than the bound, nor the length of a string or blob
+type Constraint struct {
+	Column string
+	Kind   string
+	Bound  float64
+}
+
+// AddConstraint restricts the values of a column. Reflected columns are constrained by the tags
+// `ibis:"required"`, `ibis:"min=n"`, and `ibis:"max=n"`. Constraints and Validator are checked when
+// a row is marshaled for a commit, before any CQL is issued; if any are violated, an error with the
+// key ErrValidationFailed is returned, caused by the Violations (see ViolationsOf).
+//
+//        type Account struct {
+//            ID      string `ibis:"key"`
+//            Name    string `ibis:"required,max=8"`
+//            Balance int64  `ibis:"min=0"`
+//        }
+//
+// AddConstraint returns a pointer to the column family it was called on so it can be chained during
+// configuration.
+func (cf *CF) AddConstraint(c Constraint) *CF {
+	cf.constraints = append(cf.constraints, c)
+	return cf
+}
+
+// Constraints returns the constraints on the column family's columns.
+func (cf *CF) Constraints() []Constraint {
+	return cf.constraints
+}
+
+// A Violation describes a field of a row that failed validation. The field is empty for a
+// violation of the row as a whole.
+type Violation struct {
+	Field   string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Field == "" {
+		return v.Message
+	}
+	return v.Field + " " + v.Message
+}
+
+// Violations lists the ways a row failed validation.
+type Violations []Violation
+
+func (vs Violations) Error() string {
+	msgs := make([]string, len(vs))
+	for i, v := range vs {
+		msgs[i] = v.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ViolationsOf returns the Violations that caused the given error, or nil if there are none.
+func ViolationsOf(err error) Violations {
+	for err != nil {
+		switch e := err.(type) {
+		case Violations:
+			return e
+		case *Error:
+			err = e.Cause
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// validate checks a marshaled row against the column family's constraints, and the row itself if
+// it's a Validator.
+func (cf *CF) validate(row interface{}, mmap MarshaledMap) error {
+	violations := make(Violations, 0)
+	for _, c := range cf.constraints {
+		if msg := c.check(mmap[c.Column]); msg != "" {
+			violations = append(violations, Violation{Field: c.Column, Message: msg})
+		}
+	}
+	if v, ok := row.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			if vs, ok := err.(Violations); ok {
+				violations = append(violations, vs...)
+			} else {
+				violations = append(violations, Violation{Message: err.Error()})
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	err := NewError(ErrValidationFailed, "row of", cf.name)
+	err.Cause = violations
+	return err
+}
+
+// check returns a description of how the value violates the constraint, or an empty string if it
+// doesn't.
+func (c Constraint) check(mv *MarshaledValue) string {
+	if mv == nil || len(mv.Bytes) == 0 {
+		if c.Kind == "required" {
+			return "is required"
+		}
+		return ""
+	}
+	x, err := unmarshal(mv)
+	if err != nil {
+		// constraints don't apply to values of other types
+		return ""
+	}
+	var n float64
+	var noun string
+	switch v := x.(type) {
+	case string:
+		n, noun = float64(len(v)), "length"
+	case []byte:
+		n, noun = float64(len(v)), "length"
+	case int64:
+		n, noun = float64(v), "value"
+	case float64:
+		n, noun = v, "value"
+	case bool:
+		if v {
+			n = 1
+		}
+	case time.Time:
+		// zero times are marshaled as the epoch
+		if v.Unix() != 0 {
+			n = 1
+		}
+	default:
+		n = 1
+	}
+	switch c.Kind {
+	case "required":
+		if n == 0 {
+			return "is required"
+		}
+	case "min":
+		if noun != "" && n < c.Bound {
+			return fmt.Sprintf("%s must be at least %v", noun, c.Bound)
+		}
+	case "max":
+		if noun != "" && n > c.Bound {
+			return fmt.Sprintf("%s must be at most %v", noun, c.Bound)
+		}
+	}
+	return ""
+}